@@ -3,13 +3,17 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/didip/tollbooth/v7"
 	"github.com/didip/tollbooth_chi"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/render"
+	"github.com/umputun/metrics/ingest"
 	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/monitor"
+	"github.com/umputun/metrics/storage"
 	"html/template"
 	"log"
 	"net/http"
@@ -21,26 +25,35 @@ import (
 
 // Service provides access to the db
 type Service struct {
-	Storage    Storage
-	Port       string
-	Auth       AuthMidlwr
-	templates  *template.Template
-	httpServer *http.Server
+	Storage         Storage
+	Port            string
+	Auth            AuthMidlwr
+	ShutdownTimeout time.Duration // time to drain in-flight requests on termination, closed right away if not set
+	MaxBodySize     int64         // limit of ingest request bodies after decompression, defaultMaxBodySize if not set
+	templates       *template.Template
+	httpServer      *http.Server
 }
 
 // Storage interface updates, deletes and gets metrics from the memory and db
 type Storage interface {
 	Update(ctx context.Context, m metric.Entry) error
+	UpdateMany(ctx context.Context, ms []metric.Entry) map[int]error
 	Delete(ctx context.Context, m metric.Entry) error
 	GetList(ctx context.Context) ([]string, error)
-	GetOneMetric(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error)
+	GetOneMetric(ctx context.Context, req metric.Lookup) ([]metric.Entry, error)
 	GetAll(ctx context.Context, from, to time.Time, interval time.Duration) ([]metric.Entry, error)
+	Latest(ctx context.Context) ([]metric.Entry, error)
 }
 
+// throttledRequests counts 429 responses of the rate limiters
+var throttledRequests = monitor.NewCounterVec("metrics_throttled_requests_total",
+	"Requests rejected with 429 by rate limiters, by route or * for the global limiter", "route")
+
 // JSON is a map alias, just for convenience
 type JSON map[string]interface{}
 
-// Run the listener and request's router, activates the rest server
+// Run the listener and request's router, activates the rest server.
+// Returns when the context is canceled and in-flight requests are drained
 func (s Service) Run(ctx context.Context) error {
 
 	s.templates = template.Must(template.ParseGlob("web/templates/*.tmpl"))
@@ -52,20 +65,37 @@ func (s Service) Run(ctx context.Context) error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	shutdownErr := make(chan error, 1)
 	go func() {
 		<-ctx.Done()
 		log.Printf("[DEBUG] termination requested")
-		err := s.httpServer.Close()
-		if err != nil {
-			log.Printf("[WARN] can't close server: %v", err)
-		}
-		log.Printf("[INFO] server closed")
+		shutdownErr <- s.shutdown()
 	}()
 
 	if err := s.httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		return fmt.Errorf("service failed to run, err:%v", err)
 	}
 
+	return <-shutdownErr
+}
+
+// shutdown stops accepting requests and waits up to ShutdownTimeout for in-flight ones, closing the rest
+func (s Service) shutdown() error {
+	if s.ShutdownTimeout <= 0 {
+		if err := s.httpServer.Close(); err != nil {
+			return fmt.Errorf("failed to close server: %w", err)
+		}
+		log.Printf("[INFO] server closed")
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		_ = s.httpServer.Close()
+		return fmt.Errorf("failed to drain requests: %w", err)
+	}
+	log.Printf("[INFO] server closed, requests drained")
 	return nil
 }
 
@@ -73,21 +103,32 @@ func (s Service) routes() chi.Router {
 	mux := chi.NewRouter()
 	mux.Use(middleware.Throttle(100), middleware.Timeout(60*time.Second))
 	mux.Use(PingMiddleware)
-	mux.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(10, nil)))
+	mux.Use(tollbooth_chi.LimitHandler(tollbooth.NewLimiter(10, nil).SetOnLimitReached(
+		func(w http.ResponseWriter, r *http.Request) { throttledRequests.With("*").Inc() })))
 
 	limiter := func(limit float64) func(http.Handler) http.Handler {
-		return tollbooth_chi.LimitHandler(tollbooth.NewLimiter(limit, nil))
+		lmt := tollbooth.NewLimiter(limit, nil).SetOnLimitReached(func(w http.ResponseWriter, r *http.Request) {
+			throttledRequests.With(r.Method + " " + r.URL.Path).Inc() // routes have no url params
+		})
+		return tollbooth_chi.LimitHandler(lmt)
 	}
 
+	otlp := ingest.NewOTLP()       // keeps cumulative points of OTLP series between requests
 	mux.Group(func(r chi.Router) { // protected routes
 		r.Use(s.Auth.Handler)
 		r.With(limiter(1000)).Post("/metric", s.postMetric)
+		r.With(limiter(100)).Post("/metric/batch", s.postMetricsBatch)
+		r.With(limiter(100)).Post("/write", s.postInfluxWrite)
+		r.With(limiter(100)).Post("/api/v1/write", s.postPromRemoteWrite)
+		r.With(limiter(100)).Post("/v1/metrics", s.postOTLPMetrics(otlp))
 		r.With(limiter(10)).Delete("/metric", s.deleteMetric)
 	})
 
 	mux.Get("/get-metrics-list", s.getMetricsList)
 	mux.Post("/get-metric", s.getMetric)
 	mux.Post("/get-metrics", s.getMetrics)
+	mux.Get("/metrics", s.getPromMetrics)
+	mux.Get("/debug/metrics", monitor.Handler().ServeHTTP)
 
 	fs := http.FileServer(http.Dir("./web/static"))
 	mux.Route("/web", func(r chi.Router) {
@@ -110,15 +151,31 @@ func (s Service) postMetric(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, JSON{"error": err.Error()})
 		return
 	}
+	if err := request.Validate(); err != nil {
+		log.Printf("[WARN] invalid metric %+v: %v", request, err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
 	if err := s.Storage.Update(ctx, request); err != nil {
 		log.Printf("[WARN] can't update request %v: %v", request, err)
-		render.Status(r, http.StatusInternalServerError)
+		status := http.StatusInternalServerError
+		if isRejected(err) {
+			status = http.StatusBadRequest
+		}
+		render.Status(r, status)
 		render.JSON(w, r, JSON{"error": err.Error()})
 		return
 	}
 	render.JSON(w, r, JSON{"status": "ok"})
 }
 
+// isRejected checks if the update error is caused by the sample itself, late or of another kind than its series,
+// so the sample should not be retried, unlike failures of the storage
+func isRejected(err error) bool {
+	return errors.Is(err, storage.ErrLateSample) || errors.Is(err, metric.ErrKindMismatch)
+}
+
 // DELETE /metric?name={metric}
 func (s Service) deleteMetric(w http.ResponseWriter, r *http.Request) {
 	entry := metric.Entry{Name: r.URL.Query().Get("name")}
@@ -164,8 +221,14 @@ func (s Service) getMetric(w http.ResponseWriter, r *http.Request) {
 		render.JSON(w, r, JSON{"error": err.Error()})
 		return
 	}
+	if err := request.Validate(); err != nil {
+		log.Printf("[WARN] invalid request %+v: %v", request, err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
 
-	result, err := s.Storage.GetOneMetric(ctx, request.Name, request.From, request.To, time.Duration(request.Interval))
+	result, err := s.Storage.GetOneMetric(ctx, request)
 	if err != nil {
 		log.Printf("[WARN] can't get metric data: %v", err)
 		render.Status(r, http.StatusInternalServerError)
@@ -235,7 +298,8 @@ func (s Service) webGetMetricsList(w http.ResponseWriter, r *http.Request) {
 // GET /metric-details?name={metric}
 func (s Service) webGetMetricsDetails(w http.ResponseWriter, r *http.Request) {
 	mname := r.URL.Query().Get("name")
-	metrs, _ := s.Storage.GetOneMetric(r.Context(), mname, time.Now().Add(-24*time.Hour), time.Now(), time.Minute*30)
+	metrs, _ := s.Storage.GetOneMetric(r.Context(), metric.Lookup{Name: mname, From: time.Now().Add(-24 * time.Hour),
+		To: time.Now(), Interval: metric.Duration(time.Minute * 30)})
 
 	sort.Slice(metrs, func(i, j int) bool {
 		return metrs[i].TimeStamp.Before(metrs[j].TimeStamp)
@@ -7,9 +7,13 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/storage"
 	"io"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
@@ -49,7 +53,7 @@ func TestService_postMetric(t *testing.T) {
 
 		require.Equal(t, 1, len(strg.UpdateCalls()))
 		assert.Equal(t, "test", strg.UpdateCalls()[0].M.Name)
-		assert.Equal(t, 123, strg.UpdateCalls()[0].M.Value)
+		assert.Equal(t, 123.0, strg.UpdateCalls()[0].M.Value)
 		assert.Equal(t, tm, strg.UpdateCalls()[0].M.TimeStamp)
 	}
 
@@ -63,6 +67,44 @@ func TestService_postMetric(t *testing.T) {
 		require.Equal(t, 1, len(strg.UpdateCalls()))
 	}
 
+	{ // gauge with float value
+		req, err := http.NewRequest("POST", ts.URL+"/metric",
+			strings.NewReader(`{"name": "cpu", "value":12.5, "kind": "gauge", "time_stamp": "2022-08-03T16:23:45Z"}`))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, 2, len(strg.UpdateCalls()))
+		assert.Equal(t, 12.5, strg.UpdateCalls()[1].M.Value)
+		assert.Equal(t, metric.KindGauge, strg.UpdateCalls()[1].M.Kind)
+	}
+
+	{ // unknown kind
+		req, err := http.NewRequest("POST", ts.URL+"/metric",
+			strings.NewReader(`{"name": "cpu", "value":12.5, "kind": "meter", "time_stamp": "2022-08-03T16:23:45Z"}`))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"error":"unknown kind \"meter\" of cpu"}`+"\n", string(data))
+		require.Equal(t, 2, len(strg.UpdateCalls()))
+	}
+
+	{ // histogram without buckets
+		req, err := http.NewRequest("POST", ts.URL+"/metric",
+			strings.NewReader(`{"name": "latency", "value":0.3, "kind": "histogram", "time_stamp": "2022-08-03T16:23:45Z"}`))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, 2, len(strg.UpdateCalls()))
+	}
+
 	{ // failed auth
 		tm := time.Date(2022, 8, 3, 16, 23, 45, 0, time.UTC)
 		req, err := http.NewRequest("POST", ts.URL+"/metric",
@@ -72,7 +114,7 @@ func TestService_postMetric(t *testing.T) {
 		resp, err := client.Do(req)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
-		require.Equal(t, 1, len(strg.UpdateCalls()))
+		require.Equal(t, 2, len(strg.UpdateCalls()))
 	}
 
 	{ // failed update
@@ -90,7 +132,41 @@ func TestService_postMetric(t *testing.T) {
 		data, err := io.ReadAll(resp.Body)
 		require.NoError(t, err)
 		assert.Equal(t, `{"error":"oh oh"}`+"\n", string(data))
-		require.Equal(t, 2, len(strg.UpdateCalls()))
+		require.Equal(t, 3, len(strg.UpdateCalls()))
+	}
+
+	{ // rejected late sample
+		strg.UpdateFunc = func(ctx context.Context, m metric.Entry) error {
+			return fmt.Errorf("%w: test", storage.ErrLateSample)
+		}
+		req, err := http.NewRequest("POST", ts.URL+"/metric",
+			strings.NewReader(`{"name": "test", "value":123, "time_stamp": "2022-08-03T16:23:45Z"}`))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"error":"sample is older than the lateness window: test"}`+"\n", string(data))
+		require.Equal(t, 4, len(strg.UpdateCalls()))
+	}
+
+	{ // rejected sample of another kind
+		strg.UpdateFunc = func(ctx context.Context, m metric.Entry) error {
+			return fmt.Errorf("%w: test", metric.ErrKindMismatch)
+		}
+		req, err := http.NewRequest("POST", ts.URL+"/metric",
+			strings.NewReader(`{"name": "test", "value":123, "time_stamp": "2022-08-03T16:23:45Z"}`))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, `{"error":"kind mismatch: test"}`+"\n", string(data))
+		require.Equal(t, 5, len(strg.UpdateCalls()))
 	}
 }
 
@@ -211,7 +287,7 @@ func TestService_getMetricsList(t *testing.T) {
 
 func TestService_getMetric(t *testing.T) {
 	strg := &StorageMock{
-		GetOneMetricFunc: func(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+		GetOneMetricFunc: func(ctx context.Context, req metric.Lookup) ([]metric.Entry, error) {
 			return []metric.Entry{
 				{
 					Name:      "file_1",
@@ -243,11 +319,60 @@ func TestService_getMetric(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, `[{"name":"file_1","time_stamp":"2022-10-11T02:21:23Z","value":1,"type":0,"type_str":""}]`+"\n", string(data))
 		require.Equal(t, 1, len(strg.GetOneMetricCalls()))
-		assert.Equal(t, time.Minute*30, strg.GetOneMetricCalls()[0].Interval)
-		assert.Equal(t, "test", strg.GetOneMetricCalls()[0].Name)
-		assert.Equal(t, time.Date(2022, time.August, 3, 16, 23, 45, 0, time.UTC), strg.GetOneMetricCalls()[0].From)
-		assert.Equal(t, time.Date(2022, time.August, 4, 17, 24, 45, 0, time.UTC), strg.GetOneMetricCalls()[0].To)
+		assert.Equal(t, metric.Duration(time.Minute*30), strg.GetOneMetricCalls()[0].Req.Interval)
+		assert.Equal(t, "test", strg.GetOneMetricCalls()[0].Req.Name)
+		assert.Equal(t, time.Date(2022, time.August, 3, 16, 23, 45, 0, time.UTC), strg.GetOneMetricCalls()[0].Req.From)
+		assert.Equal(t, time.Date(2022, time.August, 4, 17, 24, 45, 0, time.UTC), strg.GetOneMetricCalls()[0].Req.To)
+		assert.Equal(t, 0, len(strg.GetOneMetricCalls()[0].Req.Matchers))
+	}
+
+	{ // with label matchers
+		req, err := http.NewRequest("POST", ts.URL+"/get-metric",
+			strings.NewReader(`{"name": "test", "from": "2022-08-03T16:23:45Z", "to": "2022-08-04T17:24:45Z", "interval": "30m",
+				"matchers": [{"label": "host", "type": "=~", "value": "h[12]"}]}`))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, 2, len(strg.GetOneMetricCalls()))
+		matchers := strg.GetOneMetricCalls()[1].Req.Matchers
+		require.Equal(t, 1, len(matchers))
+		assert.Equal(t, "host", matchers[0].Label)
+		assert.True(t, matchers[0].Matches(map[string]string{"host": "h2"}))
+	}
+
+	{ // grouped by labels
+		req, err := http.NewRequest("POST", ts.URL+"/get-metric",
+			strings.NewReader(`{"name": "test", "interval": "30m", "stat": "avg", "group_by": ["region"], "quantiles": [0.5, 0.99]}`))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, 3, len(strg.GetOneMetricCalls()))
+		assert.Equal(t, []string{"region"}, strg.GetOneMetricCalls()[2].Req.GroupBy)
+		assert.Equal(t, metric.AggrSum, strg.GetOneMetricCalls()[2].Req.Aggregate)
+		assert.Equal(t, metric.StatAvg, strg.GetOneMetricCalls()[2].Req.Stat)
+		assert.Equal(t, []float64{0.5, 0.99}, strg.GetOneMetricCalls()[2].Req.Quantiles)
+	}
+
+	{ // invalid aggregation
+		req, err := http.NewRequest("POST", ts.URL+"/get-metric",
+			strings.NewReader(`{"name": "test", "interval": "30m", "stat": "max", "aggregate": "median"}`))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, 3, len(strg.GetOneMetricCalls()))
+	}
 
+	{ // invalid matcher
+		req, err := http.NewRequest("POST", ts.URL+"/get-metric",
+			strings.NewReader(`{"name": "test", "interval": "30m", "matchers": [{"label": "host", "type": "=~", "value": "h[12"}]}`))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		require.Equal(t, 3, len(strg.GetOneMetricCalls()))
 	}
 
 	{ // failed decode
@@ -256,11 +381,11 @@ func TestService_getMetric(t *testing.T) {
 		resp, err := client.Do(req)
 		require.NoError(t, err)
 		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
-		require.Equal(t, 1, len(strg.GetOneMetricCalls()))
+		require.Equal(t, 3, len(strg.GetOneMetricCalls()))
 	}
 
 	{ // failed to get metric data
-		strg.GetOneMetricFunc = func(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+		strg.GetOneMetricFunc = func(ctx context.Context, req metric.Lookup) ([]metric.Entry, error) {
 			return nil, errors.New("oh oh")
 		}
 		tmFrom := time.Date(2022, 8, 3, 16, 23, 45, 0, time.UTC)
@@ -276,7 +401,7 @@ func TestService_getMetric(t *testing.T) {
 		data, err := io.ReadAll(resp.Body)
 		require.NoError(t, err)
 		assert.Equal(t, `{"error":"oh oh"}`+"\n", string(data))
-		require.Equal(t, 2, len(strg.GetOneMetricCalls()))
+		require.Equal(t, 4, len(strg.GetOneMetricCalls()))
 	}
 }
 
@@ -350,6 +475,38 @@ func TestService_getMetrics(t *testing.T) {
 	}
 }
 
+func TestService_debugMetrics(t *testing.T) {
+	svc := &Service{Storage: &StorageMock{}}
+
+	ts := httptest.NewServer(svc.routes())
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Second}
+	before := throttledRequests.With("*").Value()
+	throttled := 0
+	for i := 0; i < 30; i++ { // over the global limit of 10 rps
+		resp, err := client.Get(ts.URL + "/debug/metrics")
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		if resp.StatusCode == http.StatusTooManyRequests {
+			throttled++
+		}
+	}
+	require.Greater(t, throttled, 0)
+	assert.Equal(t, uint64(throttled), throttledRequests.With("*").Value()-before)
+	time.Sleep(time.Second) // let the limiter refill
+
+	resp, err := client.Get(ts.URL + "/debug/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "# TYPE metrics_throttled_requests_total counter\n")
+	assert.Contains(t, string(data), `metrics_throttled_requests_total{route="*"} `)
+}
+
 func TestService_Run(t *testing.T) {
 	done := make(chan struct{})
 	go func() {
@@ -358,3 +515,78 @@ func TestService_Run(t *testing.T) {
 		require.NoError(t, e)
 	}()
 }
+
+func TestService_RunShutdown(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir("..")) // templates are loaded from web/templates
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+
+	release := make(chan struct{})
+	strg := &StorageMock{
+		GetListFunc: func(ctx context.Context) ([]string, error) {
+			<-release
+			return []string{"file1"}, nil
+		},
+	}
+
+	run := func(timeout time.Duration) (addr string, cancel context.CancelFunc, runErr chan error) {
+		port := 40000 + int(rand.Int31n(10000))
+		svc := Service{Storage: strg, Port: ":" + strconv.Itoa(port), ShutdownTimeout: timeout}
+		ctx, cancel := context.WithCancel(context.Background())
+		runErr = make(chan error, 1)
+		go func() { runErr <- svc.Run(ctx) }()
+		addr = "http://127.0.0.1:" + strconv.Itoa(port)
+		require.Eventually(t, func() bool {
+			resp, err := http.Get(addr + "/ping")
+			if err != nil {
+				return false
+			}
+			_ = resp.Body.Close()
+			return true
+		}, 5*time.Second, 50*time.Millisecond)
+		return addr, cancel, runErr
+	}
+
+	// inFlight sends a request blocked in storage, returns its status code when done
+	inFlight := func(addr string) chan int {
+		calls := len(strg.GetListCalls())
+		status := make(chan int, 1)
+		go func() {
+			resp, err := http.Get(addr + "/get-metrics-list")
+			if err != nil {
+				status <- 0
+				return
+			}
+			_ = resp.Body.Close()
+			status <- resp.StatusCode
+		}()
+		require.Eventually(t, func() bool { return len(strg.GetListCalls()) > calls }, time.Second, 10*time.Millisecond)
+		return status
+	}
+
+	{ // in-flight request drained
+		addr, cancel, runErr := run(5 * time.Second)
+		status := inFlight(addr)
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		select {
+		case err := <-runErr:
+			t.Fatalf("returned before the request is done: %v", err)
+		default:
+		}
+		close(release)
+		assert.Equal(t, http.StatusOK, <-status)
+		assert.NoError(t, <-runErr)
+	}
+
+	{ // drain timeout
+		release = make(chan struct{})
+		defer close(release)
+		addr, cancel, runErr := run(100 * time.Millisecond)
+		status := inFlight(addr)
+		cancel()
+		assert.EqualError(t, <-runErr, "failed to drain requests: context deadline exceeded")
+		assert.Equal(t, 0, <-status)
+	}
+}
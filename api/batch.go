@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/umputun/metrics/metric"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// defaultMaxBodySize limits the size of ingest request bodies, after decompression, if Service.MaxBodySize is not set.
+// The body should be read within the read timeout of the server, so the limit is kept small
+const defaultMaxBodySize = 1024 * 1024
+
+// errBodyTooLarge returned by reads of request body past the limit
+var errBodyTooLarge = errors.New("request body too large")
+
+// BatchError describes rejected entry of the batch
+type BatchError struct {
+	Index int    `json:"index"` // position in the array or among non-empty NDJSON lines, from 0
+	Error string `json:"error"`
+}
+
+// POST /metric/batch, body is a JSON array of entries or NDJSON stream (an entry per line),
+// optionally gzip-compressed with Content-Encoding: gzip
+func (s Service) postMetricsBatch(w http.ResponseWriter, r *http.Request) {
+	body, err := batchBody(r, s.maxBodySize())
+	if err != nil {
+		log.Printf("[WARN] can't decompress batch: %v", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	items, err := readBatch(body, s.maxBodySize())
+	if err != nil {
+		log.Printf("[WARN] can't read batch: %v", err)
+		render.Status(r, readErrorStatus(err))
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
+
+	var errs []BatchError
+	entries := make([]metric.Entry, 0, len(items))
+	indexes := make([]int, 0, len(items)) // batch index of each entry
+	for i, item := range items {
+		var e metric.Entry
+		if err := json.Unmarshal(item, &e); err != nil {
+			errs = append(errs, BatchError{Index: i, Error: err.Error()})
+			continue
+		}
+		if err := e.Validate(); err != nil {
+			errs = append(errs, BatchError{Index: i, Error: err.Error()})
+			continue
+		}
+		entries = append(entries, e)
+		indexes = append(indexes, i)
+	}
+
+	for i, err := range s.Storage.UpdateMany(r.Context(), entries) {
+		log.Printf("[WARN] can't update %v: %v", entries[i], err)
+		errs = append(errs, BatchError{Index: indexes[i], Error: err.Error()})
+	}
+
+	resp := JSON{"status": "ok", "accepted": len(items) - len(errs), "rejected": len(errs)}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+		resp["errors"] = errs
+	}
+	render.JSON(w, r, resp)
+}
+
+// maxBodySize returns the limit of ingest request bodies, defaultMaxBodySize if not set
+func (s Service) maxBodySize() int64 {
+	if s.MaxBodySize <= 0 {
+		return defaultMaxBodySize
+	}
+	return s.MaxBodySize
+}
+
+// batchBody returns request body limited to limit bytes, decompressed if Content-Encoding is gzip.
+// Reads past the limit, before or after decompression, fail with errBodyTooLarge
+func batchBody(r *http.Request, limit int64) (io.ReadCloser, error) {
+	body := struct {
+		io.Reader
+		io.Closer
+	}{newLimitedReader(r.Body, limit), r.Body}
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return body, nil
+	}
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{newLimitedReader(gz, limit), gz}, nil
+}
+
+// limitedReader reads up to n bytes and fails with errBodyTooLarge if there is more,
+// unlike io.LimitReader which silently stops at the limit
+type limitedReader struct {
+	r     io.Reader
+	n     int64 // bytes left
+	limit int64
+}
+
+func newLimitedReader(r io.Reader, limit int64) *limitedReader {
+	return &limitedReader{r: r, n: limit, limit: limit}
+}
+
+// Read reads from the underlying reader, up to the limit
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		var b [1]byte
+		if n, err := io.ReadFull(l.r, b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w, limit is %d bytes", errBodyTooLarge, l.limit)
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// readErrorStatus returns the status of the failed read of request body, 413 if it is too large
+func readErrorStatus(err error) int {
+	if errors.Is(err, errBodyTooLarge) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// readBatch splits the body into raw items, either elements of JSON array or NDJSON lines.
+// Malformed items are returned as is to be rejected one by one
+func readBatch(body io.Reader, limit int64) ([]json.RawMessage, error) {
+	br := bufio.NewReader(body)
+	first, err := peekNonSpace(br)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("empty batch")
+		}
+		return nil, err
+	}
+
+	var items []json.RawMessage
+	if first == '[' {
+		if err := json.NewDecoder(br).Decode(&items); err != nil {
+			return nil, fmt.Errorf("failed to decode array: %w", err)
+		}
+		return items, nil
+	}
+
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64*1024), int(limit))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, append(json.RawMessage{}, line...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read lines: %w", err)
+	}
+	if len(items) == 0 {
+		return nil, fmt.Errorf("empty batch")
+	}
+	return items, nil
+}
+
+// peekNonSpace skips leading whitespace and returns the next byte without consuming it
+func peekNonSpace(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = br.ReadByte()
+			continue
+		}
+		return b[0], nil
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestService_postMetricsBatch(t *testing.T) {
+	strg := &StorageMock{
+		UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+			for i, m := range ms {
+				if m.Name == "fail" {
+					return map[int]error{i: errors.New("oh oh")}
+				}
+			}
+			return nil
+		},
+	}
+
+	svc := &Service{Storage: strg, MaxBodySize: 1024, Auth: AuthMidlwr{
+		User:   "admin",
+		Passwd: "Lapatusik",
+	}}
+
+	ts := httptest.NewServer(svc.routes())
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Second}
+	post := func(body io.Reader, gzipped bool) (int, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/metric/batch", body)
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	{ // json array
+		code, resp := post(strings.NewReader(`[{"name": "file_1", "value": 1, "time_stamp": "2022-08-03T16:23:45Z"},
+			{"name": "cpu", "value": 42.5, "kind": "gauge", "time_stamp": "2022-08-03T16:23:45Z"}]`), false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, `{"accepted":2,"rejected":0,"status":"ok"}`+"\n", resp)
+		require.Equal(t, 1, len(strg.UpdateManyCalls()))
+		entries := strg.UpdateManyCalls()[0].Ms
+		require.Equal(t, 2, len(entries))
+		assert.Equal(t, "file_1", entries[0].Name)
+		assert.Equal(t, 42.5, entries[1].Value)
+		assert.Equal(t, time.Date(2022, 8, 3, 16, 23, 45, 0, time.UTC), entries[1].TimeStamp)
+	}
+
+	{ // json array with rejected entries
+		code, resp := post(strings.NewReader(`[{"name": "file_1", "value": 1}, {"name": "cpu", "kind": "meter"},
+			{"name": "file_2", "value": "bad"}, {"name": "fail", "value": 1}]`), false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, `{"accepted":1,"errors":[{"index":1,"error":"unknown kind \"meter\" of cpu"},`+
+			`{"index":2,"error":"json: cannot unmarshal string into Go struct field Entry.value of type float64"},`+
+			`{"index":3,"error":"oh oh"}],"rejected":3,"status":"ok"}`+"\n", resp)
+		require.Equal(t, 2, len(strg.UpdateManyCalls()))
+		assert.Equal(t, 2, len(strg.UpdateManyCalls()[1].Ms))
+	}
+
+	{ // gzipped ndjson
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(`{"name": "file_1", "value": 1}` + "\n\n" + `{"name": "file_2", "value": 2}` + "\n" +
+			`{"name": "file_3", "value` + "\n" + `{"name": "file_4", "value": 4}`))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		code, resp := post(&buf, true)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Contains(t, resp, `"accepted":3`)
+		assert.Contains(t, resp, `{"index":2,"error":"unexpected end of JSON input"}`)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+		entries := strg.UpdateManyCalls()[2].Ms
+		require.Equal(t, 3, len(entries))
+		assert.Equal(t, "file_4", entries[2].Name)
+	}
+
+	{ // empty batch
+		code, resp := post(strings.NewReader(" \n "), false)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `{"error":"empty batch"}`+"\n", resp)
+	}
+
+	{ // broken array
+		code, _ := post(strings.NewReader(`[{"name": "file_1", "value": 1}, {"name"`), false)
+		assert.Equal(t, http.StatusBadRequest, code)
+	}
+
+	{ // not gzipped
+		code, _ := post(strings.NewReader(`[{"name": "file_1", "value": 1}]`), true)
+		assert.Equal(t, http.StatusBadRequest, code)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // gzipped body too large after decompression
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(`[{"name": "file_1", "value": 1}` + strings.Repeat(" ", 1024) + "]"))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		code, resp := post(&buf, true)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+		assert.Contains(t, resp, "request body too large, limit is 1024 bytes")
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // body too large
+		code, _ := post(strings.NewReader(strings.Repeat(" ", 1025)), false)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, code)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // failed auth
+		req, err := http.NewRequest("POST", ts.URL+"/metric/batch", strings.NewReader(`[{"name": "file_1", "value": 1}]`))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+}
+
+func Test_limitedReader(t *testing.T) {
+	{ // up to the limit
+		data, err := io.ReadAll(newLimitedReader(strings.NewReader("12345"), 5))
+		require.NoError(t, err)
+		assert.Equal(t, "12345", string(data))
+	}
+	{ // past the limit
+		data, err := io.ReadAll(newLimitedReader(strings.NewReader("123456"), 5))
+		assert.ErrorIs(t, err, errBodyTooLarge)
+		assert.EqualError(t, err, "request body too large, limit is 5 bytes")
+		assert.Equal(t, "12345", string(data))
+	}
+	{ // error of the reader
+		_, err := io.ReadAll(newLimitedReader(iotest.ErrReader(errors.New("oh oh")), 5))
+		assert.EqualError(t, err, "oh oh")
+	}
+}
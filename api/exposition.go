@@ -0,0 +1,170 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/monitor"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// GET /metrics, the latest value of every series in Prometheus text exposition format.
+// Counters are exposed as gauges, as the stored value is a sum over the bucket and not a monotonic total
+func (s Service) getPromMetrics(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.Storage.Latest(r.Context())
+	if err != nil {
+		log.Printf("[WARN] can't get latest metrics: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeExposition(bw, entries)
+	if err := bw.Flush(); err != nil {
+		log.Printf("[WARN] can't write metrics: %v", err)
+	}
+}
+
+// writeExposition writes entries grouped into metric families by sanitized name, with HELP and TYPE lines.
+// The type of the family is set by its first series, series of a different type are skipped. Metrics with names
+// sanitized to the same one are not merged, the family is kept by the first name in order and others are skipped,
+// as well as series with colliding label names
+func writeExposition(w *bufio.Writer, entries []metric.Entry) {
+	type series struct {
+		name string
+		e    metric.Entry
+	}
+	all := make([]series, 0, len(entries))
+	for _, e := range entries {
+		all = append(all, series{name: promName(e.Name), e: e})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].name != all[j].name {
+			return all[i].name < all[j].name
+		}
+		return all[i].e.Name < all[j].e.Name
+	})
+
+	family, origin, histogram := "", "", false
+	var exposed map[string]bool // labels of the family series written already
+	for _, s := range all {
+		isHistogram := s.e.Kind == metric.KindHistogram && len(s.e.Buckets) > 0
+		if s.name != family {
+			family, origin, histogram = s.name, s.e.Name, isHistogram
+			exposed = map[string]bool{}
+			tp := "gauge"
+			if histogram {
+				tp = "histogram"
+			}
+			fmt.Fprintf(w, "# HELP %s %s\n", family, monitor.EscapeHelp("latest value of "+s.e.Name))
+			fmt.Fprintf(w, "# TYPE %s %s\n", family, tp)
+		}
+		if s.e.Name != origin {
+			log.Printf("[WARN] can't expose %s, its name collides with %s as %s", s.e.SeriesKey(), origin, family)
+			continue
+		}
+		if isHistogram != histogram {
+			log.Printf("[WARN] can't expose %s, mixed histogram and non-histogram series", s.e.SeriesKey())
+			continue
+		}
+		labels, err := promLabelSet(s.e.Labels, histogram)
+		if err != nil {
+			log.Printf("[WARN] can't expose %s, %v", s.e.SeriesKey(), err)
+			continue
+		}
+		rendered := promLabels(labels, "")
+		if exposed[rendered] {
+			log.Printf("[WARN] can't expose %s, its labels collide with another series as %s", s.e.SeriesKey(), rendered)
+			continue
+		}
+		exposed[rendered] = true
+
+		if !histogram {
+			fmt.Fprintf(w, "%s%s %s\n", family, rendered, monitor.FormatFloat(s.e.Value))
+			continue
+		}
+		counts := s.e.GetBucketCounts()
+		var cumulative int64
+		for i, c := range counts {
+			cumulative += c
+			le := math.Inf(1)
+			if i < len(s.e.Buckets) {
+				le = s.e.Buckets[i]
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", family, promLabels(labels, monitor.FormatFloat(le)), cumulative)
+		}
+		st := s.e.GetStats()
+		fmt.Fprintf(w, "%s_sum%s %s\n", family, rendered, monitor.FormatFloat(st.Sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", family, rendered, st.Count)
+	}
+}
+
+// promLabelSet returns labels with sanitized names, without le label of histograms, reserved for buckets.
+// Returns error if names of the labels are sanitized to the same one
+func promLabelSet(labels map[string]string, histogram bool) (map[string]string, error) {
+	res := make(map[string]string, len(labels))
+	names := make(map[string]string, len(labels)) // original name by sanitized one
+	for k, v := range labels {
+		name := promLabelName(k)
+		if histogram && name == "le" {
+			continue
+		}
+		if other, ok := names[name]; ok {
+			return nil, fmt.Errorf("labels %q and %q collide as %s", other, k, name)
+		}
+		names[name] = k
+		res[name] = v
+	}
+	return res, nil
+}
+
+// promLabels renders labels sorted by name, with le label appended if not empty. Names should be sanitized already
+func promLabels(labels map[string]string, le string) string {
+	if len(labels) == 0 && le == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys)+1)
+	for _, k := range keys {
+		parts = append(parts, k+`="`+monitor.EscapeLabelValue(labels[k])+`"`)
+	}
+	if le != "" {
+		parts = append(parts, `le="`+le+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// promName replaces chars not allowed in Prometheus metric name with underscore
+func promName(name string) string {
+	return sanitizeProm(name, true)
+}
+
+// promLabelName replaces chars not allowed in Prometheus label name with underscore
+func promLabelName(name string) string {
+	return sanitizeProm(name, false)
+}
+
+// sanitizeProm keeps letters, digits (not as the first char), underscore and, if colon set, colon
+func sanitizeProm(s string, colon bool) string {
+	if s == "" {
+		return "_"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		valid := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || (colon && c == ':') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestService_getPromMetrics(t *testing.T) {
+	tm := time.Date(2022, 10, 11, 2, 10, 0, 0, time.UTC)
+	strg := &StorageMock{
+		LatestFunc: func(ctx context.Context) ([]metric.Entry, error) {
+			return []metric.Entry{
+				{Name: "api.errors", Labels: map[string]string{"host": "h1", "path": `/a"b`}, Value: 3, TimeStamp: tm},
+				{Name: "api.errors", Labels: map[string]string{"host": "h2"}, Value: 1.5, TimeStamp: tm},
+				{Name: "temperature", Kind: metric.KindGauge, Value: -2, TimeStamp: tm},
+			}, nil
+		},
+	}
+
+	svc := &Service{Storage: strg}
+	ts := httptest.NewServer(svc.routes())
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Second}
+	get := func() (*http.Response, string) {
+		resp, err := client.Get(ts.URL + "/metrics")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(data)
+	}
+
+	{ // successful attempt
+		resp, body := get()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+		assert.Equal(t, `# HELP api_errors latest value of api.errors
+# TYPE api_errors gauge
+api_errors{host="h1",path="/a\"b"} 3
+api_errors{host="h2"} 1.5
+# HELP temperature latest value of temperature
+# TYPE temperature gauge
+temperature -2
+`, body)
+	}
+
+	{ // failed attempt
+		strg.LatestFunc = func(ctx context.Context) ([]metric.Entry, error) {
+			return nil, errors.New("oh oh")
+		}
+		resp, body := get()
+		assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+		assert.Equal(t, "oh oh\n", body)
+	}
+}
+
+func TestWriteExposition(t *testing.T) {
+	tbl := []struct {
+		name    string
+		entries []metric.Entry
+		res     string
+	}{
+		{
+			name:    "empty",
+			entries: nil,
+			res:     "",
+		},
+		{
+			name: "histogram",
+			entries: []metric.Entry{{Name: "latency", Kind: metric.KindHistogram, Labels: map[string]string{"le": "x", "job": "a"},
+				Buckets: []float64{0.1, 1}, BucketCounts: []int64{2, 0, 1}, Value: 5,
+				Stats: &metric.Stats{Count: 3, Sum: 5.15, Min: 0.05, Max: 5, Last: 5}}},
+			res: `# HELP latency latest value of latency
+# TYPE latency histogram
+latency_bucket{job="a",le="0.1"} 2
+latency_bucket{job="a",le="1"} 2
+latency_bucket{job="a",le="+Inf"} 3
+latency_sum{job="a"} 5.15
+latency_count{job="a"} 3
+`,
+		},
+		{
+			name:    "single sample histogram",
+			entries: []metric.Entry{{Name: "latency", Kind: metric.KindHistogram, Buckets: []float64{1}, Value: 0.5}},
+			res: `# HELP latency latest value of latency
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 1
+latency_sum 0.5
+latency_count 1
+`,
+		},
+		{
+			name: "colliding names skipped",
+			entries: []metric.Entry{
+				{Name: "a_b", Labels: map[string]string{"k": "v"}, Value: 2},
+				{Name: "a.b", Value: 1},
+				{Name: "9lives", Labels: map[string]string{"foo-bar": "line\nbreak"}, Value: math.Inf(1)},
+				{Name: "a_b", Kind: metric.KindHistogram, Buckets: []float64{1}, Value: 1},
+			},
+			res: `# HELP _lives latest value of 9lives
+# TYPE _lives gauge
+_lives{foo_bar="line\nbreak"} +Inf
+# HELP a_b latest value of a.b
+# TYPE a_b gauge
+a_b 1
+`,
+		},
+		{
+			name: "mixed types skipped",
+			entries: []metric.Entry{
+				{Name: "latency", Value: 1},
+				{Name: "latency", Kind: metric.KindHistogram, Labels: map[string]string{"k": "v"}, Buckets: []float64{1}, Value: 1},
+				{Name: "latency", Labels: map[string]string{"k": "v"}, Value: math.NaN()},
+			},
+			res: `# HELP latency latest value of latency
+# TYPE latency gauge
+latency 1
+latency{k="v"} NaN
+`,
+		},
+		{
+			name: "colliding labels skipped",
+			entries: []metric.Entry{
+				{Name: "cpu", Labels: map[string]string{"host.name": "h1", "host_name": "h2"}, Value: 1},
+				{Name: "cpu", Labels: map[string]string{"host.name": "h1"}, Value: -2},
+				{Name: "cpu", Labels: map[string]string{"host_name": "h1"}, Value: 3},
+				{Name: "cpu", Labels: map[string]string{"host_name": "h2"}, Value: 4},
+			},
+			res: `# HELP cpu latest value of cpu
+# TYPE cpu gauge
+cpu{host_name="h1"} -2
+cpu{host_name="h2"} 4
+`,
+		},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			writeExposition(w, tt.entries)
+			require.NoError(t, w.Flush())
+			assert.Equal(t, tt.res, buf.String())
+		})
+	}
+}
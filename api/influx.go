@@ -0,0 +1,82 @@
+package api
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/umputun/metrics/ingest"
+	"github.com/umputun/metrics/metric"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// POST /write?precision=ns, InfluxDB 1.x compatible write of line protocol body, optionally gzip-compressed.
+// Responds with 204 if all the lines are written. Malformed lines are skipped, the rest is written and
+// 400 with partial write error is returned, the same way InfluxDB does. Late samples and samples of series kept
+// as another kind are rejected the same way, while failures of the storage are returned with 500 to be retried
+func (s Service) postInfluxWrite(w http.ResponseWriter, r *http.Request) {
+	precision := r.URL.Query().Get("precision")
+	if !ingest.ValidInfluxPrecision(precision) {
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, JSON{"error": fmt.Sprintf("invalid precision %q", precision)})
+		return
+	}
+
+	body, err := batchBody(r, s.maxBodySize())
+	if err != nil {
+		log.Printf("[WARN] can't decompress influx write: %v", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
+	defer body.Close()
+
+	var errs []BatchError // index is the line number, from 1
+	var entries []metric.Entry
+	lines := []int{} // line number of each entry
+	now := time.Now()
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), int(s.maxBodySize()))
+	for n := 1; scanner.Scan(); n++ {
+		ms, err := ingest.ParseInflux(scanner.Text(), precision, now)
+		if err != nil {
+			errs = append(errs, BatchError{Index: n, Error: err.Error()})
+			continue
+		}
+		for range ms {
+			lines = append(lines, n)
+		}
+		entries = append(entries, ms...)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("[WARN] can't read influx write: %v", err)
+		render.Status(r, readErrorStatus(err))
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
+
+	status := http.StatusBadRequest
+	for i, err := range s.Storage.UpdateMany(r.Context(), entries) {
+		log.Printf("[WARN] can't update %v: %v", entries[i], err)
+		errs = append(errs, BatchError{Index: lines[i], Error: err.Error()})
+		if !isRejected(err) {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	if len(errs) > 0 {
+		log.Printf("[WARN] influx partial write, %d errors", len(errs))
+		render.Status(r, status)
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Index < errs[j].Index })
+		msgs := make([]string, len(errs))
+		for i, e := range errs {
+			msgs[i] = fmt.Sprintf("line %d: %s", e.Index, e.Error)
+		}
+		render.JSON(w, r, JSON{"error": "partial write: " + strings.Join(msgs, "; ")})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_postInfluxWrite(t *testing.T) {
+	strg := &StorageMock{
+		UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+			for i, m := range ms {
+				if m.Name == "fail" {
+					return map[int]error{i: errors.New("oh oh")}
+				}
+				if m.Name == "late" {
+					return map[int]error{i: fmt.Errorf("%w: blah", storage.ErrLateSample)}
+				}
+			}
+			return nil
+		},
+	}
+
+	svc := &Service{Storage: strg, Auth: AuthMidlwr{
+		User:   "admin",
+		Passwd: "Lapatusik",
+	}}
+
+	ts := httptest.NewServer(svc.routes())
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Second}
+	post := func(query string, body io.Reader, gzipped bool) (int, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/write"+query, body)
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	{ // lines with seconds precision
+		code, resp := post("?db=telegraf&precision=s", strings.NewReader("cpu,host=h1 usage_idle=97.5,usage_user=2i 1665454223\n"+
+			"mem used=1024i 1665454223\n"), false)
+		assert.Equal(t, http.StatusNoContent, code)
+		assert.Equal(t, "", resp)
+		require.Equal(t, 1, len(strg.UpdateManyCalls()))
+		entries := strg.UpdateManyCalls()[0].Ms
+		require.Equal(t, 3, len(entries))
+		assert.Equal(t, metric.Entry{Name: "cpu_usage_idle", Labels: map[string]string{"host": "h1"}, Kind: metric.KindGauge,
+			Value: 97.5, TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)}, entries[0])
+		assert.Equal(t, "cpu_usage_user", entries[1].Name)
+		assert.Equal(t, 1024.0, entries[2].Value)
+	}
+
+	{ // gzipped, malformed and failed lines, to be retried
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte("cpu usage_idle=97.5 1665454223100400200\nbad\n\nfail value=1\ncpu usage_idle=96\n"))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		code, resp := post("", &buf, true)
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.Equal(t, `{"error":"partial write: line 2: expected measurement, fields and timestamp, got 1 sections; `+
+			`line 4: oh oh"}`+"\n", resp)
+		require.Equal(t, 2, len(strg.UpdateManyCalls()))
+		entries := strg.UpdateManyCalls()[1].Ms
+		require.Equal(t, 3, len(entries))
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 10, 23, 100400200, time.UTC), entries[0].TimeStamp)
+		assert.Equal(t, 96.0, entries[2].Value)
+	}
+
+	{ // malformed and late lines
+		code, resp := post("", strings.NewReader("bad\nlate value=1\ncpu usage_idle=96\n"), false)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `{"error":"partial write: line 1: expected measurement, fields and timestamp, got 1 sections; `+
+			`line 2: sample is older than the lateness window: blah"}`+"\n", resp)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // bad precision
+		code, resp := post("?precision=d", strings.NewReader("cpu usage_idle=97.5 1665454223\n"), false)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `{"error":"invalid precision \"d\""}`+"\n", resp)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // failed auth
+		req, err := http.NewRequest("POST", ts.URL+"/write", strings.NewReader("cpu usage_idle=97.5\n"))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+}
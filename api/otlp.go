@@ -0,0 +1,96 @@
+package api
+
+import (
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/umputun/metrics/ingest"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// POST /v1/metrics, OTLP/HTTP metrics export request, protobuf (Content-Type: application/x-protobuf)
+// or JSON (application/json), optionally gzip-compressed. Responds with ExportMetricsServiceResponse of the same
+// encoding, with partial success if some data points are rejected, malformed, late or of series kept as another kind.
+// Responds with 503 if some data points failed to be written, so the exporter retries the request, with cumulative
+// series restored to make the same deltas
+func (s Service) postOTLPMetrics(otlp *ingest.OTLP) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if contentType != "application/x-protobuf" && contentType != "application/json" {
+			render.Status(r, http.StatusUnsupportedMediaType)
+			render.JSON(w, r, JSON{"error": "unsupported content type " + strconv.Quote(contentType)})
+			return
+		}
+
+		body, err := batchBody(r, s.maxBodySize())
+		if err != nil {
+			log.Printf("[WARN] can't decompress otlp export: %v", err)
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, JSON{"error": err.Error()})
+			return
+		}
+		defer body.Close()
+		data, err := io.ReadAll(body)
+		if err != nil {
+			log.Printf("[WARN] can't read otlp export: %v", err)
+			render.Status(r, readErrorStatus(err))
+			render.JSON(w, r, JSON{"error": err.Error()})
+			return
+		}
+
+		var res ingest.OTLPResult
+		if contentType == "application/json" {
+			res, err = otlp.DecodeJSON(data, time.Now())
+		} else {
+			res, err = otlp.DecodeProto(data, time.Now())
+		}
+		if err != nil {
+			log.Printf("[WARN] can't decode otlp export: %v", err)
+			render.Status(r, http.StatusBadRequest)
+			render.JSON(w, r, JSON{"error": err.Error()})
+			return
+		}
+
+		var failed []int // entries failed to be written, to be retried
+		var failReason string
+		for i, err := range s.Storage.UpdateMany(r.Context(), res.Entries) {
+			log.Printf("[WARN] can't update %v: %v", res.Entries[i], err)
+			if !isRejected(err) {
+				failed = append(failed, i)
+				failReason = err.Error()
+				continue
+			}
+			if res.Rejected == 0 {
+				res.RejectReason = err.Error()
+			}
+			res.Rejected++
+		}
+		if len(failed) > 0 {
+			otlp.Restore(res, failed)
+			render.Status(r, http.StatusServiceUnavailable)
+			render.JSON(w, r, JSON{"error": fmt.Sprintf("%d of %d data points failed to be written: %s",
+				len(failed), len(res.Entries), failReason)})
+			return
+		}
+		if res.Rejected > 0 {
+			log.Printf("[WARN] otlp export, %d data points rejected: %s", res.Rejected, res.RejectReason)
+		}
+
+		if contentType == "application/json" {
+			resp := JSON{}
+			if res.Rejected > 0 {
+				resp["partialSuccess"] = JSON{"rejectedDataPoints": strconv.Itoa(res.Rejected), "errorMessage": res.RejectReason}
+			}
+			render.JSON(w, r, resp)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		if _, err := w.Write(res.ProtoResponse()); err != nil {
+			log.Printf("[WARN] can't write otlp response: %v", err)
+		}
+	}
+}
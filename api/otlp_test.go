@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/ingest"
+	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestService_postOTLPMetrics(t *testing.T) {
+	strg := &StorageMock{
+		UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+			for i, m := range ms {
+				if m.Name == "fail" {
+					return map[int]error{i: errors.New("oh oh")}
+				}
+				if m.Name == "late" {
+					return map[int]error{i: fmt.Errorf("%w: blah", storage.ErrLateSample)}
+				}
+			}
+			return nil
+		},
+	}
+
+	svc := &Service{Storage: strg, Auth: AuthMidlwr{
+		User:   "admin",
+		Passwd: "Lapatusik",
+	}}
+
+	ts := httptest.NewServer(svc.routes())
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Second}
+	post := func(contentType string, body io.Reader, gzipped bool) (int, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/v1/metrics", body)
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		req.Header.Set("Content-Type", contentType)
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	{ // gzipped protobuf
+		data, err := os.ReadFile("../ingest/testdata/otlp_metrics.pb")
+		require.NoError(t, err)
+		buf := bytes.Buffer{}
+		gz := gzip.NewWriter(&buf)
+		_, err = gz.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		code, resp := post("application/x-protobuf", &buf, true)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, string(ingest.OTLPResult{Rejected: 1,
+			RejectReason: "exponential histogram http.client.duration not supported"}.ProtoResponse()), resp)
+		require.Equal(t, 1, len(strg.UpdateManyCalls()))
+		entries := strg.UpdateManyCalls()[0].Ms
+		require.Equal(t, 6, len(entries))
+		assert.Equal(t, "process.memory.usage", entries[0].Name)
+		assert.Equal(t, "checkout", entries[0].Labels["service.name"])
+		assert.Equal(t, []int64{2, 5, 2, 1}, entries[4].BucketCounts)
+	}
+
+	{ // json
+		data, err := os.ReadFile("../ingest/testdata/otlp_metrics.json")
+		require.NoError(t, err)
+		code, resp := post("application/json; charset=utf-8", bytes.NewReader(data), false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, `{"partialSuccess":{"errorMessage":"exponential histogram http.client.duration not supported",`+
+			`"rejectedDataPoints":"1"}}`+"\n", resp)
+		require.Equal(t, 2, len(strg.UpdateManyCalls()))
+		assert.Equal(t, strg.UpdateManyCalls()[0].Ms, strg.UpdateManyCalls()[1].Ms)
+	}
+
+	{ // all accepted
+		code, resp := post("application/json", strings.NewReader(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [
+			{"name": "a", "gauge": {"dataPoints": [{"asInt": "1"}]}}]}]}]}`), false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, "{}\n", resp)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // late point rejected
+		code, resp := post("application/json", strings.NewReader(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [
+			{"name": "late", "gauge": {"dataPoints": [{"asInt": "1"}]}}]}]}]}`), false)
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, `{"partialSuccess":{"errorMessage":"sample is older than the lateness window: blah",`+
+			`"rejectedDataPoints":"1"}}`+"\n", resp)
+		require.Equal(t, 4, len(strg.UpdateManyCalls()))
+	}
+
+	{ // failed point, to be retried with the same delta
+		sum := func(value int) io.Reader {
+			return strings.NewReader(fmt.Sprintf(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "fail",
+				"sum": {"dataPoints": [{"startTimeUnixNano": "%d", "timeUnixNano": "%d", "asInt": "%d"}],
+				"aggregationTemporality": 2, "isMonotonic": true}}]}]}]}`,
+				time.Now().UnixNano(), time.Now().Add(time.Duration(value)*time.Second).UnixNano(), value))
+		}
+		code, resp := post("application/json", sum(10), false)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		assert.Equal(t, `{"error":"1 of 1 data points failed to be written: oh oh"}`+"\n", resp)
+		require.Equal(t, 5, len(strg.UpdateManyCalls()))
+		assert.Equal(t, 10.0, strg.UpdateManyCalls()[4].Ms[0].Value)
+
+		code, _ = post("application/json", sum(10), false)
+		assert.Equal(t, http.StatusServiceUnavailable, code)
+		require.Equal(t, 6, len(strg.UpdateManyCalls()))
+		assert.Equal(t, 10.0, strg.UpdateManyCalls()[5].Ms[0].Value, "retried with the same delta")
+	}
+
+	{ // malformed
+		code, resp := post("application/x-protobuf", strings.NewReader("\x0a\x10\x01"), false)
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `{"error":"failed to decode protobuf: unexpected EOF"}`+"\n", resp)
+		require.Equal(t, 6, len(strg.UpdateManyCalls()))
+	}
+
+	{ // unsupported content type
+		code, resp := post("text/plain", strings.NewReader("a 1"), false)
+		assert.Equal(t, http.StatusUnsupportedMediaType, code)
+		assert.Equal(t, `{"error":"unsupported content type \"text/plain\""}`+"\n", resp)
+	}
+
+	{ // failed auth
+		req, err := http.NewRequest("POST", ts.URL+"/v1/metrics", strings.NewReader("{}"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, 6, len(strg.UpdateManyCalls()))
+	}
+}
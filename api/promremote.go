@@ -0,0 +1,53 @@
+package api
+
+import (
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/umputun/metrics/ingest"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// POST /api/v1/write, Prometheus remote-write request, snappy-compressed protobuf WriteRequest.
+// Responds with 204 if all the samples are written, 400 for malformed request, late samples and samples of series
+// kept as another kind, so Prometheus doesn't retry them, and 500 if some samples failed to be written, to be retried.
+// Samples are kept as gauges, so the retry keeps the last value, but samples written already before the failure
+// are merged again, adding to count, sum and quantiles of the minute
+func (s Service) postPromRemoteWrite(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(newLimitedReader(r.Body, s.maxBodySize()))
+	if err != nil {
+		log.Printf("[WARN] can't read remote write: %v", err)
+		render.Status(r, readErrorStatus(err))
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
+
+	entries, err := ingest.DecodeRemoteWrite(data, int(s.maxBodySize()))
+	if err != nil {
+		log.Printf("[WARN] can't decode remote write: %v", err)
+		render.Status(r, http.StatusBadRequest)
+		render.JSON(w, r, JSON{"error": err.Error()})
+		return
+	}
+
+	var errs []string
+	status := http.StatusBadRequest
+	for i, err := range s.Storage.UpdateMany(r.Context(), entries) {
+		log.Printf("[WARN] can't update %v: %v", entries[i], err)
+		errs = append(errs, fmt.Sprintf("%s: %v", entries[i].SeriesKey(), err))
+		if !isRejected(err) {
+			status = http.StatusInternalServerError
+		}
+	}
+	if len(errs) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	sort.Strings(errs)
+	render.Status(r, status)
+	render.JSON(w, r, JSON{"error": fmt.Sprintf("%d of %d samples rejected: %s", len(errs), len(entries), strings.Join(errs, "; "))})
+}
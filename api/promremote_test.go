@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/storage"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestService_postPromRemoteWrite(t *testing.T) {
+	strg := &StorageMock{
+		UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+			for i, m := range ms {
+				if m.Name == "fail" {
+					return map[int]error{i: errors.New("oh oh")}
+				}
+				if m.Name == "late" {
+					return map[int]error{i: fmt.Errorf("%w: blah", storage.ErrLateSample)}
+				}
+				if m.Name == "counter" {
+					return map[int]error{i: fmt.Errorf("%w: blah", metric.ErrKindMismatch)}
+				}
+			}
+			return nil
+		},
+	}
+
+	svc := &Service{Storage: strg, Auth: AuthMidlwr{
+		User:   "admin",
+		Passwd: "Lapatusik",
+	}}
+
+	ts := httptest.NewServer(svc.routes())
+	defer ts.Close()
+
+	client := http.Client{Timeout: time.Second}
+	post := func(body []byte) (int, string) {
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/write", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.SetBasicAuth("admin", "Lapatusik")
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(data)
+	}
+
+	// writeRequest encodes WriteRequest with a single series of a sample
+	writeRequest := func(name, job string, value float64, ts time.Time) []byte {
+		label := func(k, v string) []byte {
+			var l []byte
+			l = protowire.AppendTag(l, 1, protowire.BytesType)
+			l = protowire.AppendString(l, k)
+			l = protowire.AppendTag(l, 2, protowire.BytesType)
+			return protowire.AppendString(l, v)
+		}
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(ts.UnixMilli()))
+
+		var series []byte
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label("__name__", name))
+		series = protowire.AppendTag(series, 1, protowire.BytesType)
+		series = protowire.AppendBytes(series, label("job", job))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, sample)
+
+		var req []byte
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		return snappy.Encode(nil, protowire.AppendBytes(req, series))
+	}
+
+	{ // written
+		code, resp := post(writeRequest("up", "api", 1, time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)))
+		assert.Equal(t, http.StatusNoContent, code)
+		assert.Equal(t, "", resp)
+		require.Equal(t, 1, len(strg.UpdateManyCalls()))
+		assert.Equal(t, []metric.Entry{{Name: "up", Labels: map[string]string{"job": "api"}, Kind: metric.KindGauge, Value: 1,
+			TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)}}, strg.UpdateManyCalls()[0].Ms)
+	}
+
+	{ // failed sample, to be retried
+		code, resp := post(writeRequest("fail", "api", 1, time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)))
+		assert.Equal(t, http.StatusInternalServerError, code)
+		assert.Equal(t, `{"error":"1 of 1 samples rejected: fail{job=\"api\"}: oh oh"}`+"\n", resp)
+		require.Equal(t, 2, len(strg.UpdateManyCalls()))
+	}
+
+	{ // late sample
+		code, resp := post(writeRequest("late", "api", 1, time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `{"error":"1 of 1 samples rejected: late{job=\"api\"}: sample is older than the lateness window: blah"}`+"\n", resp)
+		require.Equal(t, 3, len(strg.UpdateManyCalls()))
+	}
+
+	{ // sample of a series kept as another kind
+		code, resp := post(writeRequest("counter", "api", 1, time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Equal(t, `{"error":"1 of 1 samples rejected: counter{job=\"api\"}: kind mismatch: blah"}`+"\n", resp)
+		require.Equal(t, 4, len(strg.UpdateManyCalls()))
+	}
+
+	{ // not snappy
+		code, resp := post([]byte("bad request"))
+		assert.Equal(t, http.StatusBadRequest, code)
+		assert.Contains(t, resp, "failed to decode")
+		require.Equal(t, 4, len(strg.UpdateManyCalls()))
+	}
+
+	{ // failed auth
+		req, err := http.NewRequest("POST", ts.URL+"/api/v1/write", bytes.NewReader(writeRequest("up", "api", 1, time.Now())))
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		require.Equal(t, 4, len(strg.UpdateManyCalls()))
+	}
+}
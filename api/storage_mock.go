@@ -29,12 +29,18 @@ var _ Storage = &StorageMock{}
 // 			GetListFunc: func(ctx context.Context) ([]string, error) {
 // 				panic("mock out the GetList method")
 // 			},
-// 			GetOneMetricFunc: func(ctx context.Context, name string, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+// 			GetOneMetricFunc: func(ctx context.Context, req metric.Lookup) ([]metric.Entry, error) {
 // 				panic("mock out the GetOneMetric method")
 // 			},
+// 			LatestFunc: func(ctx context.Context) ([]metric.Entry, error) {
+// 				panic("mock out the Latest method")
+// 			},
 // 			UpdateFunc: func(ctx context.Context, m metric.Entry) error {
 // 				panic("mock out the Update method")
 // 			},
+// 			UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+// 				panic("mock out the UpdateMany method")
+// 			},
 // 		}
 //
 // 		// use mockedStorage in code that requires Storage
@@ -52,11 +58,17 @@ type StorageMock struct {
 	GetListFunc func(ctx context.Context) ([]string, error)
 
 	// GetOneMetricFunc mocks the GetOneMetric method.
-	GetOneMetricFunc func(ctx context.Context, name string, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error)
+	GetOneMetricFunc func(ctx context.Context, req metric.Lookup) ([]metric.Entry, error)
+
+	// LatestFunc mocks the Latest method.
+	LatestFunc func(ctx context.Context) ([]metric.Entry, error)
 
 	// UpdateFunc mocks the Update method.
 	UpdateFunc func(ctx context.Context, m metric.Entry) error
 
+	// UpdateManyFunc mocks the UpdateMany method.
+	UpdateManyFunc func(ctx context.Context, ms []metric.Entry) map[int]error
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Delete holds details about calls to the Delete method.
@@ -86,14 +98,13 @@ type StorageMock struct {
 		GetOneMetric []struct {
 			// Ctx is the ctx argument value.
 			Ctx context.Context
-			// Name is the name argument value.
-			Name string
-			// From is the from argument value.
-			From time.Time
-			// To is the to argument value.
-			To time.Time
-			// Interval is the interval argument value.
-			Interval time.Duration
+			// Req is the req argument value.
+			Req metric.Lookup
+		}
+		// Latest holds details about calls to the Latest method.
+		Latest []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
 		}
 		// Update holds details about calls to the Update method.
 		Update []struct {
@@ -102,12 +113,21 @@ type StorageMock struct {
 			// M is the m argument value.
 			M metric.Entry
 		}
+		// UpdateMany holds details about calls to the UpdateMany method.
+		UpdateMany []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Ms is the ms argument value.
+			Ms []metric.Entry
+		}
 	}
 	lockDelete       sync.RWMutex
 	lockGetAll       sync.RWMutex
 	lockGetList      sync.RWMutex
 	lockGetOneMetric sync.RWMutex
+	lockLatest       sync.RWMutex
 	lockUpdate       sync.RWMutex
+	lockUpdateMany   sync.RWMutex
 }
 
 // Delete calls DeleteFunc.
@@ -220,45 +240,33 @@ func (mock *StorageMock) GetListCalls() []struct {
 }
 
 // GetOneMetric calls GetOneMetricFunc.
-func (mock *StorageMock) GetOneMetric(ctx context.Context, name string, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+func (mock *StorageMock) GetOneMetric(ctx context.Context, req metric.Lookup) ([]metric.Entry, error) {
 	if mock.GetOneMetricFunc == nil {
 		panic("StorageMock.GetOneMetricFunc: method is nil but Storage.GetOneMetric was just called")
 	}
 	callInfo := struct {
-		Ctx      context.Context
-		Name     string
-		From     time.Time
-		To       time.Time
-		Interval time.Duration
+		Ctx context.Context
+		Req metric.Lookup
 	}{
-		Ctx:      ctx,
-		Name:     name,
-		From:     from,
-		To:       to,
-		Interval: interval,
+		Ctx: ctx,
+		Req: req,
 	}
 	mock.lockGetOneMetric.Lock()
 	mock.calls.GetOneMetric = append(mock.calls.GetOneMetric, callInfo)
 	mock.lockGetOneMetric.Unlock()
-	return mock.GetOneMetricFunc(ctx, name, from, to, interval)
+	return mock.GetOneMetricFunc(ctx, req)
 }
 
 // GetOneMetricCalls gets all the calls that were made to GetOneMetric.
 // Check the length with:
 //     len(mockedStorage.GetOneMetricCalls())
 func (mock *StorageMock) GetOneMetricCalls() []struct {
-	Ctx      context.Context
-	Name     string
-	From     time.Time
-	To       time.Time
-	Interval time.Duration
+	Ctx context.Context
+	Req metric.Lookup
 } {
 	var calls []struct {
-		Ctx      context.Context
-		Name     string
-		From     time.Time
-		To       time.Time
-		Interval time.Duration
+		Ctx context.Context
+		Req metric.Lookup
 	}
 	mock.lockGetOneMetric.RLock()
 	calls = mock.calls.GetOneMetric
@@ -266,6 +274,37 @@ func (mock *StorageMock) GetOneMetricCalls() []struct {
 	return calls
 }
 
+// Latest calls LatestFunc.
+func (mock *StorageMock) Latest(ctx context.Context) ([]metric.Entry, error) {
+	if mock.LatestFunc == nil {
+		panic("StorageMock.LatestFunc: method is nil but Storage.Latest was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockLatest.Lock()
+	mock.calls.Latest = append(mock.calls.Latest, callInfo)
+	mock.lockLatest.Unlock()
+	return mock.LatestFunc(ctx)
+}
+
+// LatestCalls gets all the calls that were made to Latest.
+// Check the length with:
+//     len(mockedStorage.LatestCalls())
+func (mock *StorageMock) LatestCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockLatest.RLock()
+	calls = mock.calls.Latest
+	mock.lockLatest.RUnlock()
+	return calls
+}
+
 // Update calls UpdateFunc.
 func (mock *StorageMock) Update(ctx context.Context, m metric.Entry) error {
 	if mock.UpdateFunc == nil {
@@ -300,3 +339,38 @@ func (mock *StorageMock) UpdateCalls() []struct {
 	mock.lockUpdate.RUnlock()
 	return calls
 }
+
+// UpdateMany calls UpdateManyFunc.
+func (mock *StorageMock) UpdateMany(ctx context.Context, ms []metric.Entry) map[int]error {
+	if mock.UpdateManyFunc == nil {
+		panic("StorageMock.UpdateManyFunc: method is nil but Storage.UpdateMany was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Ms  []metric.Entry
+	}{
+		Ctx: ctx,
+		Ms:  ms,
+	}
+	mock.lockUpdateMany.Lock()
+	mock.calls.UpdateMany = append(mock.calls.UpdateMany, callInfo)
+	mock.lockUpdateMany.Unlock()
+	return mock.UpdateManyFunc(ctx, ms)
+}
+
+// UpdateManyCalls gets all the calls that were made to UpdateMany.
+// Check the length with:
+//     len(mockedStorage.UpdateManyCalls())
+func (mock *StorageMock) UpdateManyCalls() []struct {
+	Ctx context.Context
+	Ms  []metric.Entry
+} {
+	var calls []struct {
+		Ctx context.Context
+		Ms  []metric.Entry
+	}
+	mock.lockUpdateMany.RLock()
+	calls = mock.calls.UpdateMany
+	mock.lockUpdateMany.RUnlock()
+	return calls
+}
@@ -0,0 +1,81 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package ingest
+
+import (
+	"context"
+	"github.com/umputun/metrics/metric"
+	"sync"
+)
+
+// Ensure, that BatchUpdaterMock does implement BatchUpdater.
+// If this is not the case, regenerate this file with moq.
+var _ BatchUpdater = &BatchUpdaterMock{}
+
+// BatchUpdaterMock is a mock implementation of BatchUpdater.
+//
+// 	func TestSomethingThatUsesBatchUpdater(t *testing.T) {
+//
+// 		// make and configure a mocked BatchUpdater
+// 		mockedBatchUpdater := &BatchUpdaterMock{
+// 			UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+// 				panic("mock out the UpdateMany method")
+// 			},
+// 		}
+//
+// 		// use mockedBatchUpdater in code that requires BatchUpdater
+// 		// and then make assertions.
+//
+// 	}
+type BatchUpdaterMock struct {
+	// UpdateManyFunc mocks the UpdateMany method.
+	UpdateManyFunc func(ctx context.Context, ms []metric.Entry) map[int]error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// UpdateMany holds details about calls to the UpdateMany method.
+		UpdateMany []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Ms is the ms argument value.
+			Ms []metric.Entry
+		}
+	}
+	lockUpdateMany sync.RWMutex
+}
+
+// UpdateMany calls UpdateManyFunc.
+func (mock *BatchUpdaterMock) UpdateMany(ctx context.Context, ms []metric.Entry) map[int]error {
+	if mock.UpdateManyFunc == nil {
+		panic("BatchUpdaterMock.UpdateManyFunc: method is nil but BatchUpdater.UpdateMany was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		Ms  []metric.Entry
+	}{
+		Ctx: ctx,
+		Ms:  ms,
+	}
+	mock.lockUpdateMany.Lock()
+	mock.calls.UpdateMany = append(mock.calls.UpdateMany, callInfo)
+	mock.lockUpdateMany.Unlock()
+	return mock.UpdateManyFunc(ctx, ms)
+}
+
+// UpdateManyCalls gets all the calls that were made to UpdateMany.
+// Check the length with:
+//     len(mockedBatchUpdater.UpdateManyCalls())
+func (mock *BatchUpdaterMock) UpdateManyCalls() []struct {
+	Ctx context.Context
+	Ms  []metric.Entry
+} {
+	var calls []struct {
+		Ctx context.Context
+		Ms  []metric.Entry
+	}
+	mock.lockUpdateMany.RLock()
+	calls = mock.calls.UpdateMany
+	mock.lockUpdateMany.RUnlock()
+	return calls
+}
@@ -0,0 +1,162 @@
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:generate moq -out batchupdater_mock.go . BatchUpdater
+
+// BatchUpdater adds or updates many metric entries at once, implemented by storage.Service
+type BatchUpdater interface {
+	UpdateMany(ctx context.Context, ms []metric.Entry) map[int]error
+}
+
+// graphite limits
+const (
+	graphiteMaxBatch = 1000 // entries updated at once
+	graphiteMaxLine  = 4096
+)
+
+// Graphite receives metrics in Graphite plaintext protocol over TCP, i.e. "path value timestamp" lines,
+// many lines per connection. The dotted path is the metric name, tags of Graphite 1.1 (path;tag=value)
+// become labels. Values are stored as gauges, the way Graphite keeps the last value
+type Graphite struct {
+	Updater BatchUpdater
+	Addr    string // TCP listen address
+
+	lock sync.Mutex
+	ln   net.Listener
+}
+
+// Run starts listener and blocks until the context is canceled
+func (g *Graphite) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", g.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen tcp on %s: %w", g.Addr, err)
+	}
+	g.lock.Lock()
+	g.ln = ln
+	g.lock.Unlock()
+	log.Printf("[INFO] graphite listener on tcp %s", ln.Addr())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveTCP(ctx, ln, "graphite", func(conn net.Conn) { g.handleConn(ctx, conn) })
+	}()
+
+	<-ctx.Done()
+	_ = ln.Close()
+	<-done
+	return nil
+}
+
+// handleConn reads lines of the connection, updating them in batches. A batch is flushed when it is full
+// or all the received data is parsed, so the sender doesn't wait for the batch to be filled up
+func (g *Graphite) handleConn(ctx context.Context, conn net.Conn) {
+	br := bufio.NewReaderSize(conn, graphiteMaxLine)
+	batch := make([]metric.Entry, 0, graphiteMaxBatch)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		for i, err := range g.Updater.UpdateMany(ctx, batch) {
+			log.Printf("[WARN] can't update %s from graphite: %v", batch[i].Name, err)
+		}
+		batch = make([]metric.Entry, 0, graphiteMaxBatch) // not reused, the updater may keep it
+	}
+	defer flush()
+
+	for {
+		line, err := br.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			g.dropMalformed(fmt.Errorf("line longer than %d", graphiteMaxLine), line)
+			for errors.Is(err, bufio.ErrBufferFull) { // skip the rest of the line
+				_, err = br.ReadSlice('\n')
+			}
+			line = nil
+		}
+
+		if l := strings.TrimSpace(string(line)); l != "" {
+			if m, perr := ParseGraphite(l, time.Now()); perr == nil {
+				batch = append(batch, m)
+			} else {
+				g.dropMalformed(perr, line)
+			}
+		}
+
+		if len(batch) >= graphiteMaxBatch || br.Buffered() == 0 || err != nil {
+			flush()
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && ctx.Err() == nil {
+				log.Printf("[WARN] graphite read failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// dropMalformed counts and logs the malformed line, it is not updated
+func (g *Graphite) dropMalformed(err error, line []byte) {
+	malformedLines.With("graphite").Inc()
+	if len(line) > 100 {
+		line = line[:100]
+	}
+	log.Printf("[WARN] malformed graphite line %q: %v", line, err)
+}
+
+// ParseGraphite parses Graphite plaintext line, like path value timestamp or path;tag=value value timestamp.
+// Timestamp is unix time in seconds, the current time is used if it is missing or -1
+func ParseGraphite(line string, now time.Time) (metric.Entry, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields) > 3 {
+		return metric.Entry{}, fmt.Errorf("expected path, value and timestamp, got %d fields", len(fields))
+	}
+
+	res := metric.Entry{Kind: metric.KindGauge, TimeStamp: now}
+	path := strings.Split(fields[0], ";")
+	res.Name = path[0]
+	if res.Name == "" {
+		return metric.Entry{}, fmt.Errorf("empty path")
+	}
+	for _, tag := range path[1:] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" || v == "" {
+			return metric.Entry{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		if res.Labels == nil {
+			res.Labels = make(map[string]string)
+		}
+		res.Labels[k] = v
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return metric.Entry{}, fmt.Errorf("invalid value %q", fields[1])
+	}
+	res.Value = value
+
+	if len(fields) == 3 && fields[2] != "-1" {
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ts < 0 || math.IsNaN(ts) || math.IsInf(ts, 0) {
+			return metric.Entry{}, fmt.Errorf("invalid timestamp %q", fields[2])
+		}
+		sec, frac := math.Modf(ts)
+		res.TimeStamp = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	}
+	return res, nil
+}
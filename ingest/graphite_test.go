@@ -0,0 +1,120 @@
+package ingest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGraphite(t *testing.T) {
+	now := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+
+	tbl := []struct {
+		line string
+		res  metric.Entry
+		err  string
+	}{
+		{"servers.h1.cpu 42.5 1665454223", metric.Entry{Name: "servers.h1.cpu", Kind: metric.KindGauge, Value: 42.5,
+			TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)}, ""},
+		{"servers.h1.cpu  7\t1665454223.5", metric.Entry{Name: "servers.h1.cpu", Kind: metric.KindGauge, Value: 7,
+			TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 500000000, time.UTC)}, ""},
+		{"servers.h1.cpu 7 -1", metric.Entry{Name: "servers.h1.cpu", Kind: metric.KindGauge, Value: 7, TimeStamp: now}, ""},
+		{"servers.h1.cpu 7", metric.Entry{Name: "servers.h1.cpu", Kind: metric.KindGauge, Value: 7, TimeStamp: now}, ""},
+		{"disk.used;host=h1;dc=eu 12 1665454223", metric.Entry{Name: "disk.used", Kind: metric.KindGauge, Value: 12,
+			Labels: map[string]string{"host": "h1", "dc": "eu"}, TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)}, ""},
+		{"servers.h1.cpu", metric.Entry{}, "expected path, value and timestamp, got 1 fields"},
+		{"servers.h1.cpu 1 2 3", metric.Entry{}, "expected path, value and timestamp, got 4 fields"},
+		{";host=h1 1 1665454223", metric.Entry{}, "empty path"},
+		{"disk.used;host 1 1665454223", metric.Entry{}, `invalid tag "host"`},
+		{"servers.h1.cpu abc 1665454223", metric.Entry{}, `invalid value "abc"`},
+		{"servers.h1.cpu 1 yesterday", metric.Entry{}, `invalid timestamp "yesterday"`},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
+			res, err := ParseGraphite(tt.line, now)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestGraphite_Run(t *testing.T) {
+	updater := &BatchUpdaterMock{
+		UpdateManyFunc: func(ctx context.Context, ms []metric.Entry) map[int]error {
+			return nil
+		},
+	}
+	srv := &Graphite{Updater: updater, Addr: "127.0.0.1:0"}
+	malformed := malformedLines.With("graphite").Value()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.Run(ctx) }()
+
+	var addr string
+	require.Eventually(t, func() bool {
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		if srv.ln == nil {
+			return false
+		}
+		addr = srv.ln.Addr().String()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	lines := strings.Repeat("servers.h1.cpu 42.5 1665454223\n", 1500) + "broken line here now\n" +
+		"servers.h1.mem " + strings.Repeat("1", graphiteMaxLine) + " 1665454223\n" + "servers.h2.cpu 7 1665454223\n"
+	_, err = conn.Write([]byte(lines))
+	require.NoError(t, err)
+
+	count := func() (res int) {
+		for _, c := range updater.UpdateManyCalls() {
+			res += len(c.Ms)
+		}
+		return res
+	}
+	require.Eventually(t, func() bool { return count() == 1501 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, malformed+2, malformedLines.With("graphite").Value())
+	for _, c := range updater.UpdateManyCalls() {
+		assert.LessOrEqual(t, len(c.Ms), graphiteMaxBatch)
+	}
+
+	// the last batch is flushed without waiting for more lines
+	_, err = conn.Write([]byte("servers.h3.cpu 1 1665454223\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return count() == 1502 }, time.Second, 10*time.Millisecond)
+	calls := updater.UpdateManyCalls()
+	last := calls[len(calls)-1].Ms
+	assert.Equal(t, "servers.h3.cpu", last[len(last)-1].Name)
+
+	names := map[string]int{}
+	for _, c := range calls {
+		for _, m := range c.Ms {
+			names[m.Name]++
+		}
+	}
+	assert.Equal(t, map[string]int{"servers.h1.cpu": 1500, "servers.h2.cpu": 1, "servers.h3.cpu": 1}, names,
+		"malformed lines dropped")
+
+	cancel() // terminates with the open connection
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("not terminated")
+	}
+	require.NoError(t, conn.Close())
+}
@@ -0,0 +1,176 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseInflux parses InfluxDB line protocol line, like measurement,tag=value field=1.5,other=2i 1465839830100400200,
+// making an entry for each numeric field. The entry is named measurement_field, or just measurement for the field
+// named "value", tags become labels. Integer, unsigned, float and boolean (as 1 and 0) fields are stored as gauges,
+// string fields are skipped. Timestamp precision is one of n (ns), u (us), ms, s, m and h, the current time is used
+// if the timestamp is missing. Returns no entries and no error for empty and comment lines
+func ParseInflux(line, precision string, now time.Time) ([]metric.Entry, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	sections := splitEscaped(line, ' ', true)
+	if len(sections) < 2 || len(sections) > 3 {
+		return nil, fmt.Errorf("expected measurement, fields and timestamp, got %d sections", len(sections))
+	}
+
+	keys := splitEscaped(sections[0], ',', false)
+	measurement := unescapeInflux(keys[0])
+	if measurement == "" {
+		return nil, fmt.Errorf("empty measurement")
+	}
+	var labels map[string]string
+	for _, tag := range keys[1:] {
+		kv := splitEscaped(tag, '=', false)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	ts := now
+	if len(sections) == 3 {
+		var err error
+		if ts, err = parseInfluxTime(sections[2], precision); err != nil {
+			return nil, err
+		}
+	}
+
+	var res []metric.Entry
+	for _, field := range splitEscaped(sections[1], ',', true) {
+		kv := splitEscaped(field, '=', true)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("invalid field %q", field)
+		}
+		value, ok, err := parseInfluxValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid field %q: %w", field, err)
+		}
+		if !ok { // string field
+			continue
+		}
+
+		name := measurement
+		if key := unescapeInflux(kv[0]); key != "value" {
+			name += "_" + key
+		}
+		var entryLabels map[string]string
+		if labels != nil {
+			entryLabels = make(map[string]string, len(labels))
+			for k, v := range labels {
+				entryLabels[k] = v
+			}
+		}
+		res = append(res, metric.Entry{Name: name, Labels: entryLabels, Kind: metric.KindGauge, Value: value, TimeStamp: ts})
+	}
+	return res, nil
+}
+
+// parseInfluxValue parses field value, returns false for string value
+func parseInfluxValue(v string) (float64, bool, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		if len(v) < 2 || !strings.HasSuffix(v, `"`) {
+			return 0, false, fmt.Errorf("unterminated string")
+		}
+		return 0, false, nil
+	case v == "t" || v == "T" || v == "true" || v == "True" || v == "TRUE":
+		return 1, true, nil
+	case v == "f" || v == "F" || v == "false" || v == "False" || v == "FALSE":
+		return 0, true, nil
+	case strings.HasSuffix(v, "i"):
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(n), err == nil, err
+	case strings.HasSuffix(v, "u"):
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(n), err == nil, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return 0, false, fmt.Errorf("not a finite number")
+	}
+	return f, err == nil, err
+}
+
+// parseInfluxTime parses timestamp with the precision
+func parseInfluxTime(v, precision string) (time.Time, error) {
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", v)
+	}
+	switch precision {
+	case "", "n", "ns":
+		return time.Unix(0, n).UTC(), nil
+	case "u", "us", "µ":
+		return time.UnixMicro(n).UTC(), nil
+	case "ms":
+		return time.UnixMilli(n).UTC(), nil
+	case "s":
+		return time.Unix(n, 0).UTC(), nil
+	case "m":
+		return time.Unix(n*60, 0).UTC(), nil
+	case "h":
+		return time.Unix(n*3600, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("unknown precision %q", precision)
+}
+
+// ValidInfluxPrecision checks if the timestamp precision is supported
+func ValidInfluxPrecision(precision string) bool {
+	_, err := parseInfluxTime("0", precision)
+	return err == nil
+}
+
+// splitEscaped splits s by sep, skipping separators escaped with backslash and, if quotes set, inside double quotes.
+// Parts are returned still escaped
+func splitEscaped(s string, sep byte, quotes bool) []string {
+	var res []string
+	start, inQuotes := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++ // skip the escaped char
+		case quotes && s[i] == '"':
+			inQuotes = !inQuotes
+		case s[i] == sep && !inQuotes:
+			res = append(res, s[start:i])
+			start = i + 1
+			if sep == ' ' { // multiple spaces between sections
+				for start < len(s) && s[start] == ' ' {
+					start++
+				}
+				i = start - 1
+			}
+		}
+	}
+	return append(res, s[start:])
+}
+
+// unescapeInflux removes backslashes escaping special chars of names, tags and field keys
+func unescapeInflux(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`,= "\`, s[i+1]) >= 0 {
+			i++
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
@@ -0,0 +1,72 @@
+package ingest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseInflux(t *testing.T) {
+	now := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+	ts := time.Date(2022, 10, 11, 2, 10, 23, 100400200, time.UTC)
+
+	tbl := []struct {
+		line      string
+		precision string
+		res       []metric.Entry
+		err       string
+	}{
+		{"cpu,host=h1,cpu=cpu0 usage_idle=97.5,usage_user=2i 1665454223100400200", "", []metric.Entry{
+			{Name: "cpu_usage_idle", Labels: map[string]string{"host": "h1", "cpu": "cpu0"}, Kind: metric.KindGauge, Value: 97.5, TimeStamp: ts},
+			{Name: "cpu_usage_user", Labels: map[string]string{"host": "h1", "cpu": "cpu0"}, Kind: metric.KindGauge, Value: 2, TimeStamp: ts},
+		}, ""},
+		{"temperature value=21.5", "", []metric.Entry{{Name: "temperature", Kind: metric.KindGauge, Value: 21.5, TimeStamp: now}}, ""},
+		{"disk free=10u,ok=t,failed=F,path=\"/var, /tmp\" 1665454223", "s", []metric.Entry{
+			{Name: "disk_free", Kind: metric.KindGauge, Value: 10, TimeStamp: now},
+			{Name: "disk_ok", Kind: metric.KindGauge, Value: 1, TimeStamp: now},
+			{Name: "disk_failed", Kind: metric.KindGauge, Value: 0, TimeStamp: now},
+		}, ""},
+		{"mem used=1 1665454223100", "ms", []metric.Entry{{Name: "mem_used", Kind: metric.KindGauge, Value: 1,
+			TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 100000000, time.UTC)}}, ""},
+		{"mem used=1 1665454223100400", "u", []metric.Entry{{Name: "mem_used", Kind: metric.KindGauge, Value: 1,
+			TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 100400000, time.UTC)}}, ""},
+		{`my\ disk,mount\=point=/var\,lib used\ pct=5 1665454223`, "s", []metric.Entry{{Name: "my disk_used pct",
+			Labels: map[string]string{"mount=point": "/var,lib"}, Kind: metric.KindGauge, Value: 5, TimeStamp: now}}, ""},
+		{`log message="hello world"`, "", nil, ""},
+		{"# comment", "", nil, ""},
+		{"  ", "", nil, ""},
+		{"cpu", "", nil, "expected measurement, fields and timestamp, got 1 sections"},
+		{"cpu a=1 2 3", "", nil, "expected measurement, fields and timestamp, got 4 sections"},
+		{",host=h1 a=1", "", nil, "empty measurement"},
+		{"cpu,host a=1", "", nil, `invalid tag "host"`},
+		{"cpu a", "", nil, `invalid field "a"`},
+		{"cpu a=abc", "", nil, `invalid field "a=abc": strconv.ParseFloat: parsing "abc": invalid syntax`},
+		{"cpu a=1.5i", "", nil, `invalid field "a=1.5i": strconv.ParseInt: parsing "1.5": invalid syntax`},
+		{`cpu a="abc`, "", nil, `invalid field "a=\"abc": unterminated string`},
+		{"cpu a=1 yesterday", "", nil, `invalid timestamp "yesterday"`},
+		{"cpu a=1 1665454223", "d", nil, `unknown precision "d"`},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
+			res, err := ParseInflux(tt.line, tt.precision, now)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestValidInfluxPrecision(t *testing.T) {
+	for _, p := range []string{"", "n", "ns", "u", "us", "ms", "s", "m", "h"} {
+		assert.True(t, ValidInfluxPrecision(p), p)
+	}
+	assert.False(t, ValidInfluxPrecision("d"))
+	assert.False(t, ValidInfluxPrecision("rfc3339"))
+}
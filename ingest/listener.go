@@ -0,0 +1,42 @@
+package ingest
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+)
+
+// serveTCP accepts connections and calls handle for each one in a separate goroutine until the listener
+// is closed. Connections are closed on return of handle or on context cancellation, waits for all handlers
+func serveTCP(ctx context.Context, ln net.Listener, name string, handle func(conn net.Conn)) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[WARN] %s tcp accept failed: %v", name, err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close() //nolint
+
+			done := make(chan struct{})
+			defer close(done)
+			go func() { // unblock the reader on termination
+				select {
+				case <-ctx.Done():
+					_ = conn.Close()
+				case <-done:
+				}
+			}()
+
+			handle(conn)
+		}()
+	}
+}
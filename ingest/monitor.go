@@ -0,0 +1,11 @@
+package ingest
+
+import (
+	"github.com/umputun/metrics/monitor"
+)
+
+// metrics of the receivers, served by monitor.Handler
+var (
+	malformedLines = monitor.NewCounterVec("metrics_malformed_lines_total",
+		"Malformed lines of the receivers, logged and dropped", "protocol")
+)
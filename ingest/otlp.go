@@ -0,0 +1,611 @@
+package ingest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP aggregation temporality and data point flags
+const (
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+	otlpFlagNoRecordedValue   = 1
+)
+
+// cumulative points kept to make deltas of the next ones
+const (
+	otlpSeriesTTL      = time.Hour        // series not updated for this time are forgotten
+	otlpPurgeInterval  = 10 * time.Minute // how often forgotten series are removed
+	otlpScopeNameLabel = "otel.scope.name"
+	otlpScopeVerLabel  = "otel.scope.version"
+)
+
+// OTLP converts OpenTelemetry metrics export requests (OTLP/HTTP, protobuf or JSON) to entries.
+// Attributes of the resource, the scope and the data point become labels, the scope name and version as
+// otel.scope.name and otel.scope.version. Gauges are stored as gauges, delta sums as counters, cumulative
+// non-monotonic sums as gauges. Histograms are stored as histograms, summing up the bucket counts.
+// Cumulative monotonic sums and cumulative histograms are converted to deltas of the previous point
+// of the series. The first point of a series is only the base for the next one, unless the series
+// started after the converter, so nothing counted before is stored as a single minute increase
+type OTLP struct {
+	started time.Time
+
+	lock   sync.Mutex
+	prev   map[string]otlpCumulative // last cumulative point by series key
+	purged time.Time
+}
+
+// OTLPResult contains entries of the request and data points rejected
+type OTLPResult struct {
+	Entries      []metric.Entry
+	Rejected     int
+	RejectReason string // reason of the first rejection
+
+	base map[string]*otlpCumulative // cumulative series state before the request by series key, nil if new
+}
+
+// otlpCumulative is a cumulative point, or a delta made of two of them
+type otlpCumulative struct {
+	start, ts time.Time
+	value     float64 // sum value, or histogram sum
+	count     uint64
+	bounds    []float64
+	counts    []uint64
+	seen      time.Time
+}
+
+// NewOTLP makes OTLP converter
+func NewOTLP() *OTLP {
+	return &OTLP{started: time.Now(), purged: time.Now(), prev: make(map[string]otlpCumulative)}
+}
+
+// DecodeProto converts protobuf ExportMetricsServiceRequest
+func (o *OTLP) DecodeProto(data []byte, now time.Time) (OTLPResult, error) {
+	req, err := decodeOTLPRequest(data)
+	if err != nil {
+		return OTLPResult{}, fmt.Errorf("failed to decode protobuf: %w", err)
+	}
+	return o.convert(req, now), nil
+}
+
+// DecodeJSON converts JSON ExportMetricsServiceRequest
+func (o *OTLP) DecodeJSON(data []byte, now time.Time) (OTLPResult, error) {
+	var req otlpRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		return OTLPResult{}, fmt.Errorf("failed to decode json: %w", err)
+	}
+	return o.convert(req, now), nil
+}
+
+func (o *OTLP) convert(req otlpRequest, now time.Time) OTLPResult {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if now.Sub(o.purged) > otlpPurgeInterval {
+		for k, p := range o.prev {
+			if now.Sub(p.seen) > otlpSeriesTTL {
+				delete(o.prev, k)
+			}
+		}
+		o.purged = now
+	}
+
+	res := OTLPResult{}
+	reject := func(n int, format string, args ...interface{}) {
+		if res.Rejected == 0 {
+			res.RejectReason = fmt.Sprintf(format, args...)
+		}
+		res.Rejected += n
+	}
+
+	for _, rm := range req.ResourceMetrics {
+		for _, sm := range rm.ScopeMetrics {
+			base := otlpLabels(nil, rm.Resource.Attributes)
+			if sm.Scope.Name != "" {
+				base = otlpLabels(base, []otlpKeyValue{{Key: otlpScopeNameLabel, Value: otlpAnyValue{StringValue: &sm.Scope.Name}}})
+			}
+			if sm.Scope.Version != "" {
+				base = otlpLabels(base, []otlpKeyValue{{Key: otlpScopeVerLabel, Value: otlpAnyValue{StringValue: &sm.Scope.Version}}})
+			}
+			base = otlpLabels(base, sm.Scope.Attributes)
+
+			for _, m := range sm.Metrics {
+				if m.Name == "" {
+					reject(m.points(), "metric without name")
+					continue
+				}
+				switch {
+				case m.Gauge != nil:
+					o.numbers(&res, reject, m.Name, base, m.Gauge, metric.KindGauge, now)
+				case m.Sum != nil:
+					o.numbers(&res, reject, m.Name, base, m.Sum, "", now)
+				case m.Histogram != nil:
+					o.histograms(&res, reject, m.Name, base, m.Histogram, now)
+				case m.ExponentialHistogram != nil:
+					reject(len(m.ExponentialHistogram.DataPoints), "exponential histogram %s not supported", m.Name)
+				case m.Summary != nil:
+					reject(len(m.Summary.DataPoints), "summary %s not supported", m.Name)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// numbers converts points of gauge or sum, kind is empty for sum and defined by temporality
+func (o *OTLP) numbers(res *OTLPResult, reject func(int, string, ...interface{}), name string, base map[string]string,
+	nums *otlpNumbers, kind string, now time.Time) {
+	for _, p := range nums.DataPoints {
+		if p.Flags&otlpFlagNoRecordedValue != 0 {
+			continue
+		}
+		var value float64
+		switch {
+		case p.AsDouble != nil:
+			value = float64(*p.AsDouble)
+		case p.AsInt != nil:
+			value = float64(*p.AsInt)
+		default:
+			reject(1, "no value of %s", name)
+			continue
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			reject(1, "invalid value %v of %s", value, name)
+			continue
+		}
+
+		m := metric.Entry{Name: name, Labels: otlpLabels(copyLabels(base), p.Attributes), Kind: kind, Value: value,
+			TimeStamp: otlpTime(p.TimeUnixNano, now)}
+		if kind == "" {
+			switch {
+			case nums.AggregationTemporality == otlpTemporalityDelta:
+				m.Kind = metric.KindCounter
+			case nums.AggregationTemporality == otlpTemporalityCumulative && !nums.IsMonotonic:
+				m.Kind = metric.KindGauge
+			case nums.AggregationTemporality == otlpTemporalityCumulative:
+				m.Kind = metric.KindCounter
+				o.remember(res, m.SeriesKey())
+				d, ok := o.delta(m.SeriesKey(), otlpCumulative{start: otlpTime(p.StartTimeUnixNano, time.Time{}),
+					ts: m.TimeStamp, value: value, seen: now})
+				if !ok {
+					continue
+				}
+				m.Value = d.value
+			default:
+				reject(1, "unknown temporality %d of %s", nums.AggregationTemporality, name)
+				continue
+			}
+		}
+		res.Entries = append(res.Entries, m)
+	}
+}
+
+// histograms converts points of histogram
+func (o *OTLP) histograms(res *OTLPResult, reject func(int, string, ...interface{}), name string, base map[string]string,
+	hist *otlpHistogram, now time.Time) {
+	if hist.AggregationTemporality != otlpTemporalityDelta && hist.AggregationTemporality != otlpTemporalityCumulative {
+		reject(len(hist.DataPoints), "unknown temporality %d of %s", hist.AggregationTemporality, name)
+		return
+	}
+
+	for _, p := range hist.DataPoints {
+		if p.Flags&otlpFlagNoRecordedValue != 0 {
+			continue
+		}
+		bounds := make([]float64, len(p.ExplicitBounds))
+		for i, b := range p.ExplicitBounds {
+			bounds[i] = float64(b)
+		}
+		counts := make([]uint64, len(p.BucketCounts))
+		for i, c := range p.BucketCounts {
+			counts[i] = uint64(c)
+		}
+		if len(counts) != len(bounds)+1 {
+			reject(1, "%d bucket counts for %d bounds of %s", len(counts), len(bounds), name)
+			continue
+		}
+		var sum float64
+		if p.Sum != nil {
+			sum = float64(*p.Sum)
+		}
+		pmin, pmax := (*float64)(p.Min), (*float64)(p.Max)
+
+		labels := otlpLabels(copyLabels(base), p.Attributes)
+		ts := otlpTime(p.TimeUnixNano, now)
+		if hist.AggregationTemporality == otlpTemporalityCumulative {
+			key := metric.Entry{Name: name, Labels: labels}.SeriesKey()
+			o.remember(res, key)
+			d, ok := o.delta(key, otlpCumulative{start: otlpTime(p.StartTimeUnixNano, time.Time{}), ts: ts, value: sum,
+				count: uint64(p.Count), bounds: bounds, counts: counts, seen: now})
+			if !ok {
+				continue
+			}
+			if !d.start.Equal(otlpTime(p.StartTimeUnixNano, time.Time{})) { // min and max of the whole series, not the delta
+				pmin, pmax = nil, nil
+			}
+			sum, counts = d.value, d.counts
+		}
+
+		m, err := otlpHistogramEntry(name, labels, ts, bounds, counts, sum, pmin, pmax)
+		if err != nil {
+			reject(1, "%v", err)
+			continue
+		}
+		if m.Stats.Count == 0 {
+			continue // nothing observed
+		}
+		res.Entries = append(res.Entries, m)
+	}
+}
+
+// remember keeps the state of the cumulative series before the request, to be restored by Restore
+func (o *OTLP) remember(res *OTLPResult, key string) {
+	if _, ok := res.base[key]; ok {
+		return
+	}
+	if res.base == nil {
+		res.base = make(map[string]*otlpCumulative)
+	}
+	res.base[key] = nil
+	if p, ok := o.prev[key]; ok {
+		res.base[key] = &p
+	}
+}
+
+// Restore resets cumulative series of the entries failed to be written, by index in res.Entries,
+// to the state before the request, so the retried request makes the same deltas
+func (o *OTLP) Restore(res OTLPResult, failed []int) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	for _, i := range failed {
+		key := res.Entries[i].SeriesKey()
+		p, ok := res.base[key]
+		switch {
+		case !ok: // not cumulative
+		case p == nil:
+			delete(o.prev, key)
+		default:
+			o.prev[key] = *p
+		}
+	}
+}
+
+// delta returns the delta of cumulative point since the previous point of the series, false if there is nothing
+// to store: the point is the base of the series or it is not after the previous one.
+// Restarted series, with another start time or decreased values, are taken as is
+func (o *OTLP) delta(key string, p otlpCumulative) (otlpCumulative, bool) {
+	prev, ok := o.prev[key]
+	if ok && !p.ts.After(prev.ts) {
+		return otlpCumulative{}, false
+	}
+	o.prev[key] = p
+	if !ok {
+		return p, !p.start.IsZero() && !p.start.Before(o.started)
+	}
+	if !p.start.Equal(prev.start) || p.count < prev.count || !sameBounds(p.bounds, prev.bounds) ||
+		len(p.counts) != len(prev.counts) || (p.counts == nil && p.value < prev.value) {
+		return p, true
+	}
+
+	res := otlpCumulative{start: prev.ts, ts: p.ts, value: p.value - prev.value, count: p.count - prev.count}
+	if p.counts != nil {
+		res.counts = make([]uint64, len(p.counts))
+		for i := range p.counts {
+			if p.counts[i] < prev.counts[i] {
+				return p, true
+			}
+			res.counts[i] = p.counts[i] - prev.counts[i]
+		}
+	}
+	return res, true
+}
+
+// sameBounds checks if histogram bucket bounds are equal
+func sameBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// otlpHistogramEntry makes histogram entry of bucket counts. Stats and sketch count samples of each bucket
+// as the middle of the bucket, as samples themselves are unknown, the last one is taken as the average.
+// Histogram without bounds, with a single bucket, is stored as a counter of the sum
+func otlpHistogramEntry(name string, labels map[string]string, ts time.Time, bounds []float64, counts []uint64,
+	sum float64, pmin, pmax *float64) (metric.Entry, error) {
+	res := metric.Entry{Name: name, Labels: labels, TimeStamp: ts, Value: sum, Kind: metric.KindHistogram, Buckets: bounds}
+	if len(bounds) == 0 {
+		res.Kind, res.Buckets = metric.KindCounter, nil
+	}
+
+	st := metric.Stats{Sum: sum, Min: math.Inf(1), Max: math.Inf(-1)}
+	sketch := metric.NewSketch()
+	bucketCounts := make([]int64, len(counts))
+	for i, c := range counts {
+		if c > math.MaxInt64 {
+			return metric.Entry{}, fmt.Errorf("bucket count %d of %s too large", c, name)
+		}
+		bucketCounts[i] = int64(c)
+		if c == 0 {
+			continue
+		}
+		v := otlpBucketValue(bounds, i, pmin, pmax)
+		sketch.AddN(v, int64(c))
+		st.Count += int64(c)
+		st.Min, st.Max = math.Min(st.Min, v), math.Max(st.Max, v)
+	}
+	if pmin != nil && !math.IsNaN(*pmin) {
+		st.Min = *pmin
+	}
+	if pmax != nil && !math.IsNaN(*pmax) {
+		st.Max = *pmax
+	}
+	if st.Count > 0 {
+		st.Last = sum / float64(st.Count)
+	}
+	res.Stats, res.Sketch = &st, sketch
+	if res.Kind == metric.KindHistogram {
+		res.BucketCounts = bucketCounts
+	}
+
+	if math.IsNaN(sum) || math.IsInf(sum, 0) {
+		return metric.Entry{}, fmt.Errorf("invalid sum %v of %s", sum, name)
+	}
+	if err := res.Validate(); err != nil {
+		return metric.Entry{}, err
+	}
+	return res, nil
+}
+
+// otlpBucketValue returns the middle of the bucket, limited by min and max if known.
+// The first and the last buckets without min and max are represented by their only bound
+func otlpBucketValue(bounds []float64, i int, pmin, pmax *float64) float64 {
+	if len(bounds) == 0 {
+		if pmin != nil && pmax != nil {
+			return (*pmin + *pmax) / 2
+		}
+		return 0
+	}
+	var lower, upper float64
+	switch {
+	case i > 0:
+		lower = bounds[i-1]
+	case pmin != nil:
+		lower = *pmin
+	default:
+		lower = bounds[0]
+	}
+	switch {
+	case i < len(bounds):
+		upper = bounds[i]
+	case pmax != nil:
+		upper = *pmax
+	default:
+		upper = bounds[len(bounds)-1]
+	}
+	if pmin != nil && lower < *pmin {
+		lower = *pmin
+	}
+	if pmax != nil && upper > *pmax {
+		upper = *pmax
+	}
+	return (lower + upper) / 2
+}
+
+// otlpLabels adds attributes to the labels, returns nil if there are none
+func otlpLabels(labels map[string]string, attrs []otlpKeyValue) map[string]string {
+	for _, a := range attrs {
+		if a.Key == "" {
+			continue
+		}
+		if labels == nil {
+			labels = make(map[string]string, len(attrs))
+		}
+		labels[a.Key] = a.Value.String()
+	}
+	return labels
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+// otlpTime converts unix nanoseconds, def is used for zero value
+func otlpTime(nano otlpUint, def time.Time) time.Time {
+	if nano == 0 {
+		return def
+	}
+	return time.Unix(0, int64(nano)).UTC()
+}
+
+// OTLP messages, with JSON field names of OTLP/JSON. Protobuf is decoded to the same structs
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource struct {
+			Attributes []otlpKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name       string         `json:"name"`
+		Version    string         `json:"version"`
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpMetric struct {
+		Name                 string           `json:"name"`
+		Gauge                *otlpNumbers     `json:"gauge"`
+		Sum                  *otlpNumbers     `json:"sum"`
+		Histogram            *otlpHistogram   `json:"histogram"`
+		ExponentialHistogram *otlpUnsupported `json:"exponentialHistogram"`
+		Summary              *otlpUnsupported `json:"summary"`
+	}
+	otlpNumbers struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpNumberPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes"`
+		StartTimeUnixNano otlpUint       `json:"startTimeUnixNano"`
+		TimeUnixNano      otlpUint       `json:"timeUnixNano"`
+		AsDouble          *otlpFloat     `json:"asDouble"`
+		AsInt             *otlpInt       `json:"asInt"`
+		Flags             uint32         `json:"flags"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpKeyValue `json:"attributes"`
+		StartTimeUnixNano otlpUint       `json:"startTimeUnixNano"`
+		TimeUnixNano      otlpUint       `json:"timeUnixNano"`
+		Count             otlpUint       `json:"count"`
+		Sum               *otlpFloat     `json:"sum"`
+		BucketCounts      []otlpUint     `json:"bucketCounts"`
+		ExplicitBounds    []otlpFloat    `json:"explicitBounds"`
+		Min               *otlpFloat     `json:"min"`
+		Max               *otlpFloat     `json:"max"`
+		Flags             uint32         `json:"flags"`
+	}
+	otlpUnsupported struct {
+		DataPoints []json.RawMessage `json:"dataPoints"` // only counted
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string    `json:"stringValue"`
+		BoolValue   *bool      `json:"boolValue"`
+		IntValue    *otlpInt   `json:"intValue"`
+		DoubleValue *otlpFloat `json:"doubleValue"`
+		ArrayValue  *struct {
+			Values []otlpAnyValue `json:"values"`
+		} `json:"arrayValue"`
+		KvlistValue *struct {
+			Values []otlpKeyValue `json:"values"`
+		} `json:"kvlistValue"`
+		BytesValue []byte `json:"bytesValue"`
+	}
+)
+
+func (m otlpMetric) points() int {
+	switch {
+	case m.Gauge != nil:
+		return len(m.Gauge.DataPoints)
+	case m.Sum != nil:
+		return len(m.Sum.DataPoints)
+	case m.Histogram != nil:
+		return len(m.Histogram.DataPoints)
+	case m.ExponentialHistogram != nil:
+		return len(m.ExponentialHistogram.DataPoints)
+	case m.Summary != nil:
+		return len(m.Summary.DataPoints)
+	}
+	return 0
+}
+
+// String returns label value of the attribute, arrays and key-value lists are encoded as JSON
+func (v otlpAnyValue) String() string {
+	if s, ok := v.value().(string); ok {
+		return s
+	}
+	data, err := json.Marshal(v.value())
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+func (v otlpAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'f', -1, 64)
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	case v.ArrayValue != nil:
+		res := make([]interface{}, len(v.ArrayValue.Values))
+		for i, a := range v.ArrayValue.Values {
+			res[i] = a.value()
+		}
+		return res
+	case v.KvlistValue != nil:
+		res := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for _, kv := range v.KvlistValue.Values {
+			res[kv.Key] = kv.Value.value()
+		}
+		return res
+	}
+	return ""
+}
+
+// otlpUint is uint64 of OTLP/JSON, encoded as a string or a number
+type otlpUint uint64
+
+// UnmarshalJSON implements json.Unmarshaler
+func (u *otlpUint) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid uint64 %s", b)
+	}
+	*u = otlpUint(v)
+	return nil
+}
+
+// otlpInt is int64 of OTLP/JSON, encoded as a string or a number
+type otlpInt int64
+
+// UnmarshalJSON implements json.Unmarshaler
+func (n *otlpInt) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(b), `"`), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid int64 %s", b)
+	}
+	*n = otlpInt(v)
+	return nil
+}
+
+// otlpFloat is double of OTLP/JSON, a number or a string like "NaN" and "Infinity"
+type otlpFloat float64
+
+// UnmarshalJSON implements json.Unmarshaler
+func (f *otlpFloat) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseFloat(strings.Trim(string(b), `"`), 64)
+	if err != nil {
+		return fmt.Errorf("invalid double %s", b)
+	}
+	*f = otlpFloat(v)
+	return nil
+}
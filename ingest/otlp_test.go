@@ -0,0 +1,199 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestOTLP_DecodeRecorded(t *testing.T) {
+	ts := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+	resource := func(labels map[string]string) map[string]string {
+		res := map[string]string{"service.name": "checkout", "host.name": "h1", "process.pid": "4242",
+			"otel.scope.name": "io.opentelemetry.http", "otel.scope.version": "1.2.0"}
+		for k, v := range labels {
+			res[k] = v
+		}
+		return res
+	}
+	sum := 4.2 // the last sample is unknown, taken as the average
+	sketch := metric.NewSketch()
+	sketch.AddN(0.075, 2)
+	sketch.AddN(0.3, 5)
+	sketch.AddN(0.75, 2)
+	sketch.AddN(1.35, 1)
+
+	expected := []metric.Entry{
+		{Name: "process.memory.usage", Labels: resource(map[string]string{"state": "used"}), Kind: metric.KindGauge,
+			Value: 1048576, TimeStamp: ts},
+		{Name: "http.server.requests", Labels: resource(map[string]string{"http.method": "GET", "http.status_code": "200"}),
+			Kind: metric.KindCounter, Value: 7, TimeStamp: ts},
+		{Name: "http.server.requests", Labels: resource(map[string]string{"http.method": "POST", "http.status_code": "500"}),
+			Kind: metric.KindCounter, Value: 2, TimeStamp: ts},
+		// http.server.bytes is cumulative, started before the converter, so its first point is the base only
+		{Name: "queue.size", Labels: resource(nil), Kind: metric.KindGauge, Value: 3.5, TimeStamp: ts},
+		{Name: "http.server.duration", Labels: resource(map[string]string{"http.route": "/cart"}), Kind: metric.KindHistogram,
+			Value: 4.2, TimeStamp: ts, Buckets: []float64{0.1, 0.5, 1}, BucketCounts: []int64{2, 5, 2, 1},
+			Stats: &metric.Stats{Count: 10, Sum: 4.2, Min: 0.05, Max: 1.7, Last: sum / 10}, Sketch: sketch},
+		{Name: "runtime.goroutines", Labels: map[string]string{"service.name": "checkout", "host.name": "h1",
+			"process.pid": "4242", "otel.scope.name": "runtime", "runtime.go": "true"}, Kind: metric.KindGauge, Value: 12, TimeStamp: ts},
+	}
+
+	{ // protobuf
+		data, err := os.ReadFile("testdata/otlp_metrics.pb")
+		require.NoError(t, err)
+		res, err := NewOTLP().DecodeProto(data, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, expected, res.Entries)
+		assert.Equal(t, 1, res.Rejected)
+		assert.Equal(t, "exponential histogram http.client.duration not supported", res.RejectReason)
+	}
+
+	{ // json
+		data, err := os.ReadFile("testdata/otlp_metrics.json")
+		require.NoError(t, err)
+		res, err := NewOTLP().DecodeJSON(data, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, expected, res.Entries)
+		assert.Equal(t, 1, res.Rejected)
+		assert.Equal(t, "exponential histogram http.client.duration not supported", res.RejectReason)
+	}
+}
+
+func TestOTLP_CumulativeToDelta(t *testing.T) {
+	start := time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC)
+	otlp := NewOTLP()
+	otlp.started, otlp.purged = start, start
+
+	sum := func(startTS, ts time.Time, value float64) []byte {
+		return []byte(fmt.Sprintf(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "requests", "sum": {
+			"dataPoints": [{"startTimeUnixNano": "%d", "timeUnixNano": "%d", "asDouble": %v}],
+			"aggregationTemporality": 2, "isMonotonic": true}}]}]}]}`, startTS.UnixNano(), ts.UnixNano(), value))
+	}
+	hist := func(startTS, ts time.Time, count int, counts string) []byte {
+		return []byte(fmt.Sprintf(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "latency", "histogram": {
+			"dataPoints": [{"startTimeUnixNano": "%d", "timeUnixNano": "%d", "count": %d, "sum": %d, "min": 0.01, "max": 5,
+			"bucketCounts": [%s], "explicitBounds": [1, 2]}], "aggregationTemporality": 2}}]}]}]}`,
+			startTS.UnixNano(), ts.UnixNano(), count, count, counts))
+	}
+	decode := func(data []byte) []metric.Entry {
+		res, err := otlp.DecodeJSON(data, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 0, res.Rejected, res.RejectReason)
+		return res.Entries
+	}
+
+	tbl := []struct {
+		data  []byte
+		value float64
+		count int // number of entries expected
+	}{
+		{sum(start.Add(-time.Hour), start.Add(time.Minute), 100), 0, 0},    // started before the converter, the base
+		{sum(start.Add(-time.Hour), start.Add(2*time.Minute), 130), 30, 1}, // delta
+		{sum(start.Add(-time.Hour), start.Add(2*time.Minute), 140), 0, 0},  // not after the previous one
+		{sum(start.Add(-time.Hour), start.Add(3*time.Minute), 20), 20, 1},  // reset
+		{sum(start.Add(3*time.Minute), start.Add(4*time.Minute), 5), 5, 1}, // restarted
+		{sum(start.Add(3*time.Minute), start.Add(5*time.Minute), 5), 0, 1}, // nothing counted
+	}
+	for i, tt := range tbl {
+		res := decode(tt.data)
+		require.Equal(t, tt.count, len(res), "case %d", i)
+		if tt.count > 0 {
+			assert.Equal(t, metric.KindCounter, res[0].Kind, "case %d", i)
+			assert.Equal(t, tt.value, res[0].Value, "case %d", i)
+		}
+	}
+
+	{ // histogram started after the converter
+		res := decode(hist(start.Add(time.Minute), start.Add(2*time.Minute), 3, "1, 2, 0"))
+		require.Equal(t, 1, len(res))
+		assert.Equal(t, []int64{1, 2, 0}, res[0].BucketCounts)
+		assert.Equal(t, metric.Stats{Count: 3, Sum: 3, Min: 0.01, Max: 5, Last: 1}, *res[0].Stats)
+
+		res = decode(hist(start.Add(time.Minute), start.Add(3*time.Minute), 7, "2, 4, 1"))
+		require.Equal(t, 1, len(res))
+		assert.Equal(t, []int64{1, 2, 1}, res[0].BucketCounts)
+		assert.Equal(t, 4.0, res[0].Value)
+		// min and max of the series are not the ones of the delta, made of the buckets
+		assert.Equal(t, metric.Stats{Count: 4, Sum: 4, Min: 1, Max: 2, Last: 1}, *res[0].Stats)
+
+		res = decode(hist(start.Add(time.Minute), start.Add(4*time.Minute), 7, "2, 4, 1"))
+		assert.Empty(t, res, "nothing observed")
+	}
+
+	{ // forgotten series
+		_, err := otlp.DecodeJSON(sum(start, start, 1), start.Add(3*time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(otlp.prev))
+	}
+}
+
+func TestOTLP_Restore(t *testing.T) {
+	start := time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC)
+	otlp := NewOTLP()
+	otlp.started, otlp.purged = start, start
+
+	sum := func(name string, ts time.Time, value float64) []byte {
+		return []byte(fmt.Sprintf(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": %q, "sum": {
+			"dataPoints": [{"startTimeUnixNano": "%d", "timeUnixNano": "%d", "asDouble": %v}],
+			"aggregationTemporality": 2, "isMonotonic": true}}, {"name": "cpu", "gauge": {"dataPoints": [{"asInt": "1"}]}}
+			]}]}]}`, name, start.UnixNano(), ts.UnixNano(), value))
+	}
+	decode := func(data []byte) OTLPResult {
+		res, err := otlp.DecodeJSON(data, start.Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res.Entries))
+		return res
+	}
+
+	res := decode(sum("requests", start.Add(time.Minute), 10))
+	assert.Equal(t, 10.0, res.Entries[0].Value)
+	res = decode(sum("requests", start.Add(2*time.Minute), 25))
+	assert.Equal(t, 15.0, res.Entries[0].Value)
+	otlp.Restore(res, []int{0, 1}) // the gauge is not cumulative, nothing to restore
+	res = decode(sum("requests", start.Add(2*time.Minute), 25))
+	assert.Equal(t, 15.0, res.Entries[0].Value, "the same delta after restore")
+
+	res = decode(sum("new", start.Add(time.Minute), 5))
+	otlp.Restore(res, []int{0})
+	_, ok := otlp.prev["new"]
+	assert.False(t, ok, "new series forgotten")
+	res = decode(sum("new", start.Add(time.Minute), 5))
+	assert.Equal(t, 5.0, res.Entries[0].Value)
+}
+
+func TestOTLP_DecodeRejected(t *testing.T) {
+	otlp := NewOTLP()
+
+	tbl := []struct {
+		metric string
+		reason string
+	}{
+		{`{"name": "a", "sum": {"dataPoints": [{"asInt": "1"}]}}`, "unknown temporality 0 of a"},
+		{`{"name": "a", "gauge": {"dataPoints": [{"timeUnixNano": "1"}]}}`, "no value of a"},
+		{`{"name": "a", "gauge": {"dataPoints": [{"asDouble": "NaN"}]}}`, "invalid value NaN of a"},
+		{`{"gauge": {"dataPoints": [{"asInt": "1"}, {"asInt": "2"}]}}`, "metric without name"},
+		{`{"name": "a", "histogram": {"dataPoints": [{"count": 1, "bucketCounts": [1], "explicitBounds": [1]}],
+			"aggregationTemporality": 1}}`, "1 bucket counts for 1 bounds of a"},
+		{`{"name": "a", "histogram": {"dataPoints": [{"count": 2, "bucketCounts": [1, 1, 0], "explicitBounds": [2, 1]}],
+			"aggregationTemporality": 1}}`, "invalid histogram a: bucket bounds not increasing, 1 after 2"},
+		{`{"name": "a", "summary": {"dataPoints": [{"count": 1}]}}`, "summary a not supported"},
+	}
+	for i, tt := range tbl {
+		res, err := otlp.DecodeJSON([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [`+tt.metric+`]}]}]}`), time.Now())
+		require.NoError(t, err)
+		assert.Empty(t, res.Entries, "case %d", i)
+		assert.Equal(t, tt.reason, res.RejectReason, "case %d", i)
+	}
+
+	_, err := otlp.DecodeJSON([]byte(`{"resourceMetrics": [{"scopeMetrics": [{"metrics": [{"name": "a", "gauge":
+		{"dataPoints": [{"asInt": "one"}]}}]}]}]}`), time.Now())
+	assert.EqualError(t, err, `failed to decode json: invalid int64 "one"`)
+
+	_, err = otlp.DecodeProto([]byte{0x0a, 0x10, 0x01}, time.Now())
+	assert.EqualError(t, err, "failed to decode protobuf: unexpected EOF")
+}
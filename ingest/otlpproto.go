@@ -0,0 +1,394 @@
+package ingest
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// decodeOTLPRequest decodes protobuf ExportMetricsServiceRequest, see opentelemetry/proto/metrics/v1/metrics.proto.
+// Fields not used by the conversion are skipped
+func decodeOTLPRequest(buf []byte) (res otlpRequest, err error) {
+	err = consumeMessages(buf, 1, func(b []byte) error {
+		var rm otlpResourceMetrics
+		err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+			switch {
+			case num == 1 && typ == protowire.BytesType: // resource
+				return consumeMessage(b, func(m []byte) (err error) {
+					rm.Resource.Attributes, err = decodeOTLPAttributes(m, 1)
+					return err
+				})
+			case num == 2 && typ == protowire.BytesType: // scope_metrics
+				return consumeMessage(b, func(m []byte) error {
+					sm, err := decodeOTLPScopeMetrics(m)
+					rm.ScopeMetrics = append(rm.ScopeMetrics, sm)
+					return err
+				})
+			}
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		})
+		res.ResourceMetrics = append(res.ResourceMetrics, rm)
+		return err
+	})
+	return res, err
+}
+
+func decodeOTLPScopeMetrics(buf []byte) (res otlpScopeMetrics, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType: // scope
+			return consumeMessage(b, func(m []byte) error {
+				return consumeFields(m, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+					switch {
+					case num == 1 && typ == protowire.BytesType:
+						v, n := protowire.ConsumeString(b)
+						res.Scope.Name = v
+						return n, nil
+					case num == 2 && typ == protowire.BytesType:
+						v, n := protowire.ConsumeString(b)
+						res.Scope.Version = v
+						return n, nil
+					case num == 3 && typ == protowire.BytesType:
+						return consumeMessage(b, func(m []byte) error {
+							kv, err := decodeOTLPKeyValue(m)
+							res.Scope.Attributes = append(res.Scope.Attributes, kv)
+							return err
+						})
+					}
+					return protowire.ConsumeFieldValue(num, typ, b), nil
+				})
+			})
+		case num == 2 && typ == protowire.BytesType: // metrics
+			return consumeMessage(b, func(m []byte) error {
+				metric, err := decodeOTLPMetric(m)
+				res.Metrics = append(res.Metrics, metric)
+				return err
+			})
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+func decodeOTLPMetric(buf []byte) (res otlpMetric, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		switch num {
+		case 1: // name
+			v, n := protowire.ConsumeString(b)
+			res.Name = v
+			return n, nil
+		case 5: // gauge
+			return consumeMessage(b, func(m []byte) (err error) {
+				res.Gauge, err = decodeOTLPNumbers(m)
+				return err
+			})
+		case 7: // sum
+			return consumeMessage(b, func(m []byte) (err error) {
+				res.Sum, err = decodeOTLPNumbers(m)
+				return err
+			})
+		case 9: // histogram
+			return consumeMessage(b, func(m []byte) (err error) {
+				res.Histogram, err = decodeOTLPHistogram(m)
+				return err
+			})
+		case 10, 11: // exponential_histogram, summary, data points counted only
+			return consumeMessage(b, func(m []byte) error {
+				u := &otlpUnsupported{}
+				if num == 10 {
+					res.ExponentialHistogram = u
+				} else {
+					res.Summary = u
+				}
+				return consumeMessages(m, 1, func(p []byte) error {
+					u.DataPoints = append(u.DataPoints, nil)
+					return nil
+				})
+			})
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+// decodeOTLPNumbers decodes Gauge or Sum message
+func decodeOTLPNumbers(buf []byte) (*otlpNumbers, error) {
+	res := &otlpNumbers{}
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType: // data_points
+			return consumeMessage(b, func(m []byte) error {
+				p, err := decodeOTLPNumberPoint(m)
+				res.DataPoints = append(res.DataPoints, p)
+				return err
+			})
+		case num == 2 && typ == protowire.VarintType: // aggregation_temporality
+			v, n := protowire.ConsumeVarint(b)
+			res.AggregationTemporality = int(v)
+			return n, nil
+		case num == 3 && typ == protowire.VarintType: // is_monotonic
+			v, n := protowire.ConsumeVarint(b)
+			res.IsMonotonic = protowire.DecodeBool(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+func decodeOTLPNumberPoint(buf []byte) (res otlpNumberPoint, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 7 && typ == protowire.BytesType: // attributes
+			return consumeMessage(b, func(m []byte) error {
+				kv, err := decodeOTLPKeyValue(m)
+				res.Attributes = append(res.Attributes, kv)
+				return err
+			})
+		case num == 2 && typ == protowire.Fixed64Type: // start_time_unix_nano
+			v, n := protowire.ConsumeFixed64(b)
+			res.StartTimeUnixNano = otlpUint(v)
+			return n, nil
+		case num == 3 && typ == protowire.Fixed64Type: // time_unix_nano
+			v, n := protowire.ConsumeFixed64(b)
+			res.TimeUnixNano = otlpUint(v)
+			return n, nil
+		case num == 4 && typ == protowire.Fixed64Type: // as_double
+			v, n := protowire.ConsumeFixed64(b)
+			f := otlpFloat(math.Float64frombits(v))
+			res.AsDouble = &f
+			return n, nil
+		case num == 6 && typ == protowire.Fixed64Type: // as_int, sfixed64
+			v, n := protowire.ConsumeFixed64(b)
+			i := otlpInt(int64(v))
+			res.AsInt = &i
+			return n, nil
+		case num == 8 && typ == protowire.VarintType: // flags
+			v, n := protowire.ConsumeVarint(b)
+			res.Flags = uint32(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+func decodeOTLPHistogram(buf []byte) (*otlpHistogram, error) {
+	res := &otlpHistogram{}
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType: // data_points
+			return consumeMessage(b, func(m []byte) error {
+				p, err := decodeOTLPHistogramPoint(m)
+				res.DataPoints = append(res.DataPoints, p)
+				return err
+			})
+		case num == 2 && typ == protowire.VarintType: // aggregation_temporality
+			v, n := protowire.ConsumeVarint(b)
+			res.AggregationTemporality = int(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+func decodeOTLPHistogramPoint(buf []byte) (res otlpHistogramPoint, err error) {
+	double := func(b []byte) (*otlpFloat, int) {
+		v, n := protowire.ConsumeFixed64(b)
+		f := otlpFloat(math.Float64frombits(v))
+		return &f, n
+	}
+
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 9 && typ == protowire.BytesType: // attributes
+			return consumeMessage(b, func(m []byte) error {
+				kv, err := decodeOTLPKeyValue(m)
+				res.Attributes = append(res.Attributes, kv)
+				return err
+			})
+		case num == 2 && typ == protowire.Fixed64Type: // start_time_unix_nano
+			v, n := protowire.ConsumeFixed64(b)
+			res.StartTimeUnixNano = otlpUint(v)
+			return n, nil
+		case num == 3 && typ == protowire.Fixed64Type: // time_unix_nano
+			v, n := protowire.ConsumeFixed64(b)
+			res.TimeUnixNano = otlpUint(v)
+			return n, nil
+		case num == 4 && typ == protowire.Fixed64Type: // count
+			v, n := protowire.ConsumeFixed64(b)
+			res.Count = otlpUint(v)
+			return n, nil
+		case num == 5 && typ == protowire.Fixed64Type: // sum
+			var n int
+			res.Sum, n = double(b)
+			return n, nil
+		case num == 6: // bucket_counts, packed or not
+			return consumeFixed64s(b, num, typ, func(v uint64) { res.BucketCounts = append(res.BucketCounts, otlpUint(v)) })
+		case num == 7: // explicit_bounds, packed or not
+			return consumeFixed64s(b, num, typ, func(v uint64) {
+				res.ExplicitBounds = append(res.ExplicitBounds, otlpFloat(math.Float64frombits(v)))
+			})
+		case num == 10 && typ == protowire.VarintType: // flags
+			v, n := protowire.ConsumeVarint(b)
+			res.Flags = uint32(v)
+			return n, nil
+		case num == 11 && typ == protowire.Fixed64Type: // min
+			var n int
+			res.Min, n = double(b)
+			return n, nil
+		case num == 12 && typ == protowire.Fixed64Type: // max
+			var n int
+			res.Max, n = double(b)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+// decodeOTLPAttributes decodes repeated KeyValue field of the message
+func decodeOTLPAttributes(buf []byte, field protowire.Number) (res []otlpKeyValue, err error) {
+	err = consumeMessages(buf, field, func(b []byte) error {
+		kv, err := decodeOTLPKeyValue(b)
+		res = append(res, kv)
+		return err
+	})
+	return res, err
+}
+
+func decodeOTLPKeyValue(buf []byte) (res otlpKeyValue, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			res.Key = v
+			return n, nil
+		case num == 2 && typ == protowire.BytesType:
+			return consumeMessage(b, func(m []byte) (err error) {
+				res.Value, err = decodeOTLPAnyValue(m)
+				return err
+			})
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+func decodeOTLPAnyValue(buf []byte) (res otlpAnyValue, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			res.StringValue = &v
+			return n, nil
+		case num == 2 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			bv := protowire.DecodeBool(v)
+			res.BoolValue = &bv
+			return n, nil
+		case num == 3 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			iv := otlpInt(int64(v))
+			res.IntValue = &iv
+			return n, nil
+		case num == 4 && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			fv := otlpFloat(math.Float64frombits(v))
+			res.DoubleValue = &fv
+			return n, nil
+		case num == 5 && typ == protowire.BytesType: // array_value
+			return consumeMessage(b, func(m []byte) error {
+				res.ArrayValue = &struct {
+					Values []otlpAnyValue `json:"values"`
+				}{}
+				return consumeMessages(m, 1, func(v []byte) error {
+					av, err := decodeOTLPAnyValue(v)
+					res.ArrayValue.Values = append(res.ArrayValue.Values, av)
+					return err
+				})
+			})
+		case num == 6 && typ == protowire.BytesType: // kvlist_value
+			return consumeMessage(b, func(m []byte) error {
+				res.KvlistValue = &struct {
+					Values []otlpKeyValue `json:"values"`
+				}{}
+				var err error
+				res.KvlistValue.Values, err = decodeOTLPAttributes(m, 1)
+				return err
+			})
+		case num == 7 && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			res.BytesValue = append([]byte{}, v...)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return res, err
+}
+
+// consumeMessage consumes embedded message and passes it to fn, returns the length consumed
+func consumeMessage(b []byte, fn func(m []byte) error) (int, error) {
+	m, n := protowire.ConsumeBytes(b)
+	if n < 0 {
+		return n, nil
+	}
+	return n, fn(m)
+}
+
+// consumeMessages passes each embedded message of the field to fn, skipping other fields
+func consumeMessages(buf []byte, field protowire.Number, fn func(m []byte) error) error {
+	return consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != field || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		return consumeMessage(b, fn)
+	})
+}
+
+// consumeFixed64s consumes repeated fixed64 or double field, packed or a single value
+func consumeFixed64s(b []byte, num protowire.Number, typ protowire.Type, fn func(v uint64)) (int, error) {
+	switch typ {
+	case protowire.Fixed64Type:
+		v, n := protowire.ConsumeFixed64(b)
+		if n >= 0 {
+			fn(v)
+		}
+		return n, nil
+	case protowire.BytesType:
+		packed, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if len(packed)%8 != 0 {
+			return 0, fmt.Errorf("packed fixed64 of %d bytes", len(packed))
+		}
+		for len(packed) > 0 {
+			v, m := protowire.ConsumeFixed64(packed)
+			fn(v)
+			packed = packed[m:]
+		}
+		return n, nil
+	}
+	return protowire.ConsumeFieldValue(num, typ, b), nil
+}
+
+// ProtoResponse encodes ExportMetricsServiceResponse, with partial success if some data points are rejected
+func (r OTLPResult) ProtoResponse() []byte {
+	if r.Rejected == 0 {
+		return []byte{}
+	}
+	var ps []byte
+	ps = protowire.AppendTag(ps, 1, protowire.VarintType) // rejected_data_points
+	ps = protowire.AppendVarint(ps, uint64(r.Rejected))
+	ps = protowire.AppendTag(ps, 2, protowire.BytesType) // error_message
+	ps = protowire.AppendString(ps, r.RejectReason)
+
+	var res []byte
+	res = protowire.AppendTag(res, 1, protowire.BytesType) // partial_success
+	return protowire.AppendBytes(res, ps)
+}
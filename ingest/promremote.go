@@ -0,0 +1,179 @@
+package ingest
+
+import (
+	"fmt"
+	"github.com/golang/snappy"
+	"github.com/umputun/metrics/metric"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"time"
+)
+
+// fields of Prometheus remote-write protobuf messages, see prometheus/prompb/remote.proto and types.proto
+const (
+	pbWriteRequestTimeseries = 1
+	pbTimeSeriesLabels       = 1
+	pbTimeSeriesSamples      = 2
+	pbLabelName              = 1
+	pbLabelValue             = 2
+	pbSampleValue            = 1
+	pbSampleTimestamp        = 2
+)
+
+// DecodeRemoteWrite decodes Prometheus remote-write request, snappy-compressed protobuf WriteRequest, making an entry
+// for each sample. Label __name__ is the metric name, other labels become labels of the entry. Samples are stored
+// as gauges, as counters are sent with their cumulative values. Stale markers and other NaN samples are skipped,
+// as well as exemplars, native histograms and metadata. maxSize limits the size of uncompressed request
+func DecodeRemoteWrite(data []byte, maxSize int) ([]metric.Entry, error) {
+	size, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snappy: %w", err)
+	}
+	if size > maxSize {
+		return nil, fmt.Errorf("request of %d bytes, larger than %d", size, maxSize)
+	}
+	buf, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode snappy: %w", err)
+	}
+
+	var res []metric.Entry
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != pbWriteRequestTimeseries || typ != protowire.BytesType {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		ts, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		entries, err := decodeTimeSeries(ts)
+		if err != nil {
+			return 0, fmt.Errorf("invalid series #%d: %w", len(res), err)
+		}
+		res = append(res, entries...)
+		return n, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode write request: %w", err)
+	}
+	return res, nil
+}
+
+// decodeTimeSeries decodes TimeSeries message, making an entry of each sample
+func decodeTimeSeries(buf []byte) ([]metric.Entry, error) {
+	var name string
+	var labels map[string]string
+	var samples [][]byte
+
+	err := consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != pbTimeSeriesLabels && num != pbTimeSeriesSamples) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return n, nil
+		}
+		if num == pbTimeSeriesSamples {
+			samples = append(samples, v) // decoded after all the labels, which can follow samples
+			return n, nil
+		}
+		k, val, err := decodeLabel(v)
+		if err != nil {
+			return 0, err
+		}
+		if k == "__name__" {
+			name = val
+			return n, nil
+		}
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[k] = val
+		return n, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no __name__ label")
+	}
+
+	res := make([]metric.Entry, 0, len(samples))
+	for _, s := range samples {
+		value, ts, err := decodeSample(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample of %s: %w", name, err)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			continue
+		}
+		m := metric.Entry{Name: name, Kind: metric.KindGauge, Value: value, TimeStamp: time.UnixMilli(ts).UTC()}
+		if labels != nil {
+			m.Labels = make(map[string]string, len(labels))
+			for k, v := range labels {
+				m.Labels[k] = v
+			}
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// decodeLabel decodes Label message
+func decodeLabel(buf []byte) (name, value string, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if typ != protowire.BytesType || (num != pbLabelName && num != pbLabelValue) {
+			return protowire.ConsumeFieldValue(num, typ, b), nil
+		}
+		v, n := protowire.ConsumeString(b)
+		if num == pbLabelName {
+			name = v
+		} else {
+			value = v
+		}
+		return n, nil
+	})
+	if err == nil && name == "" {
+		err = fmt.Errorf("empty label name")
+	}
+	return name, value, err
+}
+
+// decodeSample decodes Sample message, returns value and timestamp in milliseconds
+func decodeSample(buf []byte) (value float64, ts int64, err error) {
+	err = consumeFields(buf, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == pbSampleValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			value = math.Float64frombits(v)
+			return n, nil
+		case num == pbSampleTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			ts = int64(v)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return value, ts, err
+}
+
+// consumeFields calls fn for each field of protobuf message, fn consumes the field value and returns its length,
+// negative one for malformed value
+func consumeFields(buf []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		n, err := fn(num, typ, buf)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
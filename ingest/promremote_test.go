@@ -0,0 +1,107 @@
+package ingest
+
+import (
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDecodeRemoteWrite(t *testing.T) {
+	ts := time.Date(2022, 10, 11, 2, 10, 23, 100000000, time.UTC)
+	req := promWriteRequest(
+		promSeries(map[string]string{"__name__": "http_requests_total", "job": "api", "code": "200"},
+			promSample{Value: 1027, TimeStamp: ts}, promSample{Value: 1030, TimeStamp: ts.Add(15 * time.Second)}),
+		promSeries(map[string]string{"__name__": "up"}, promSample{Value: 1, TimeStamp: ts},
+			promSample{Value: math.Float64frombits(0x7ff0000000000002), TimeStamp: ts.Add(15 * time.Second)}), // stale marker
+	)
+	req = protowire.AppendTag(req, 3, protowire.BytesType) // metadata, skipped
+	req = protowire.AppendBytes(req, []byte("meta"))
+
+	res, err := DecodeRemoteWrite(snappy.Encode(nil, req), 1024)
+	require.NoError(t, err)
+	assert.Equal(t, []metric.Entry{
+		{Name: "http_requests_total", Labels: map[string]string{"job": "api", "code": "200"}, Kind: metric.KindGauge,
+			Value: 1027, TimeStamp: ts},
+		{Name: "http_requests_total", Labels: map[string]string{"job": "api", "code": "200"}, Kind: metric.KindGauge,
+			Value: 1030, TimeStamp: ts.Add(15 * time.Second)},
+		{Name: "up", Kind: metric.KindGauge, Value: 1, TimeStamp: ts},
+	}, res)
+
+	{ // empty request
+		res, err := DecodeRemoteWrite(snappy.Encode(nil, nil), 1024)
+		require.NoError(t, err)
+		assert.Empty(t, res)
+	}
+
+	{ // too large
+		_, err := DecodeRemoteWrite(snappy.Encode(nil, req), 10)
+		assert.EqualError(t, err, "request of 156 bytes, larger than 10")
+	}
+
+	{ // not snappy
+		_, err := DecodeRemoteWrite([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1024)
+		assert.EqualError(t, err, "failed to decode snappy: snappy: corrupt input")
+	}
+
+	{ // no name
+		req := promWriteRequest(promSeries(map[string]string{"job": "api"}, promSample{Value: 1, TimeStamp: ts}))
+		_, err := DecodeRemoteWrite(snappy.Encode(nil, req), 1024)
+		assert.EqualError(t, err, "failed to decode write request: invalid series #0: no __name__ label")
+	}
+
+	{ // truncated
+		_, err := DecodeRemoteWrite(snappy.Encode(nil, req[:20]), 1024)
+		assert.EqualError(t, err, "failed to decode write request: unexpected EOF")
+	}
+}
+
+type promSample struct {
+	Value     float64
+	TimeStamp time.Time
+}
+
+// promWriteRequest encodes WriteRequest message with the series
+func promWriteRequest(series ...[]byte) []byte {
+	var res []byte
+	for _, s := range series {
+		res = protowire.AppendTag(res, pbWriteRequestTimeseries, protowire.BytesType)
+		res = protowire.AppendBytes(res, s)
+	}
+	return res
+}
+
+// promSeries encodes TimeSeries message, labels are sorted the way Prometheus sends them
+func promSeries(labels map[string]string, samples ...promSample) []byte {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var res []byte
+	for _, k := range keys {
+		var l []byte
+		l = protowire.AppendTag(l, pbLabelName, protowire.BytesType)
+		l = protowire.AppendString(l, k)
+		l = protowire.AppendTag(l, pbLabelValue, protowire.BytesType)
+		l = protowire.AppendString(l, labels[k])
+		res = protowire.AppendTag(res, pbTimeSeriesLabels, protowire.BytesType)
+		res = protowire.AppendBytes(res, l)
+	}
+	for _, s := range samples {
+		var b []byte
+		b = protowire.AppendTag(b, pbSampleValue, protowire.Fixed64Type)
+		b = protowire.AppendFixed64(b, math.Float64bits(s.Value))
+		b = protowire.AppendTag(b, pbSampleTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, uint64(s.TimeStamp.UnixMilli()))
+		res = protowire.AppendTag(res, pbTimeSeriesSamples, protowire.BytesType)
+		res = protowire.AppendBytes(res, b)
+	}
+	return res
+}
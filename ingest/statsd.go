@@ -0,0 +1,211 @@
+// Package ingest provides receivers of metrics in third-party formats, feeding them to the storage
+package ingest
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:generate moq -out updater_mock.go . Updater
+
+// Updater adds or updates metric entries, implemented by storage.Service
+type Updater interface {
+	Update(ctx context.Context, m metric.Entry) error
+}
+
+// StatsD receives metrics in StatsD line format over UDP and/or TCP, supporting counters (c), gauges (g),
+// timers (ms, as well as DogStatsD h and d), sample rates and DogStatsD tags as labels.
+// Malformed lines are dropped and counted by metrics_malformed_lines_total service metric
+type StatsD struct {
+	Updater Updater
+	UDPAddr string // UDP listen address, disabled if empty
+	TCPAddr string // TCP listen address, disabled if empty
+
+	lock    sync.Mutex
+	udpConn net.PacketConn
+	tcpLn   net.Listener
+}
+
+// Run starts listeners and blocks until the context is canceled
+func (s *StatsD) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	if s.UDPAddr != "" {
+		conn, err := net.ListenPacket("udp", s.UDPAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen udp on %s: %w", s.UDPAddr, err)
+		}
+		s.lock.Lock()
+		s.udpConn = conn
+		s.lock.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveUDP(ctx, conn)
+		}()
+		log.Printf("[INFO] statsd listener on udp %s", conn.LocalAddr())
+	}
+
+	if s.TCPAddr != "" {
+		ln, err := net.Listen("tcp", s.TCPAddr)
+		if err != nil {
+			s.closeAll()
+			wg.Wait()
+			return fmt.Errorf("failed to listen tcp on %s: %w", s.TCPAddr, err)
+		}
+		s.lock.Lock()
+		s.tcpLn = ln
+		s.lock.Unlock()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveTCP(ctx, ln, "statsd", func(conn net.Conn) {
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					s.handleLine(ctx, scanner.Text())
+				}
+			})
+		}()
+		log.Printf("[INFO] statsd listener on tcp %s", ln.Addr())
+	}
+
+	<-ctx.Done()
+	s.closeAll()
+	wg.Wait()
+	return nil
+}
+
+func (s *StatsD) serveUDP(ctx context.Context, conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("[WARN] statsd udp read failed: %v", err)
+			}
+			return
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.handleLine(ctx, line)
+		}
+	}
+}
+
+// handleLine parses a single line and updates the metric, malformed lines are counted and dropped
+func (s *StatsD) handleLine(ctx context.Context, line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	m, err := ParseStatsD(line, time.Now())
+	if err != nil {
+		malformedLines.With("statsd").Inc()
+		log.Printf("[WARN] malformed statsd line %q: %v", line, err)
+		return
+	}
+	if err := s.Updater.Update(ctx, m); err != nil {
+		log.Printf("[WARN] can't update %s from statsd: %v", m.Name, err)
+	}
+}
+
+func (s *StatsD) closeAll() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.udpConn != nil {
+		_ = s.udpConn.Close()
+	}
+	if s.tcpLn != nil {
+		_ = s.tcpLn.Close()
+	}
+}
+
+// ParseStatsD parses StatsD line, like name:value|type|@rate|#tag:value,tag.
+// Counters are scaled by the sample rate, timers become gauges keeping stats and quantiles of timings,
+// with the sample counted 1/rate times, rounded. Tags without value become labels with "true" value
+func ParseStatsD(line string, ts time.Time) (metric.Entry, error) {
+	nameEnd := strings.LastIndex(line, ":")
+	if i := strings.Index(line, "|"); i >= 0 {
+		nameEnd = strings.LastIndex(line[:i], ":")
+	}
+	if nameEnd <= 0 {
+		return metric.Entry{}, fmt.Errorf("no metric name")
+	}
+
+	parts := strings.Split(line[nameEnd+1:], "|")
+	if len(parts) < 2 {
+		return metric.Entry{}, fmt.Errorf("no metric type")
+	}
+
+	res := metric.Entry{Name: line[:nameEnd], TimeStamp: ts}
+	value, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return metric.Entry{}, fmt.Errorf("invalid value %q", parts[0])
+	}
+
+	rate := 1.0
+	for _, p := range parts[2:] {
+		switch {
+		case strings.HasPrefix(p, "@"):
+			if rate, err = strconv.ParseFloat(p[1:], 64); err != nil || rate <= 0 || rate > 1 {
+				return metric.Entry{}, fmt.Errorf("invalid sample rate %q", p)
+			}
+		case strings.HasPrefix(p, "#"):
+			res.Labels = parseTags(p[1:])
+		case strings.HasPrefix(p, "c:"), strings.HasPrefix(p, "T"): // DogStatsD container id and timestamp, ignored
+		default:
+			return metric.Entry{}, fmt.Errorf("unknown field %q", p)
+		}
+	}
+
+	switch parts[1] {
+	case "c":
+		res.Kind = metric.KindCounter
+		res.Value = value / rate
+	case "g":
+		if strings.HasPrefix(parts[0], "+") || strings.HasPrefix(parts[0], "-") {
+			return metric.Entry{}, fmt.Errorf("relative gauge %q not supported", parts[0])
+		}
+		res.Kind = metric.KindGauge
+		res.Value = value
+	case "ms", "h", "d":
+		res.Kind = metric.KindGauge
+		res.Value = value
+		if n := int64(math.Round(1 / rate)); n > 1 {
+			res.Stats = &metric.Stats{Count: n, Sum: value * float64(n), Min: value, Max: value, Last: value}
+			res.Sketch = &metric.Sketch{}
+			res.Sketch.AddN(value, n)
+		}
+	default:
+		return metric.Entry{}, fmt.Errorf("unsupported metric type %q", parts[1])
+	}
+	return res, nil
+}
+
+// parseTags makes labels of DogStatsD tags, like tag1:value1,tag2
+func parseTags(tags string) map[string]string {
+	res := make(map[string]string)
+	for _, t := range strings.Split(tags, ",") {
+		if t == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(t, ":")
+		if !ok {
+			v = "true"
+		}
+		res[k] = v
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
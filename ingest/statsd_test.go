@@ -0,0 +1,122 @@
+package ingest
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseStatsD(t *testing.T) {
+	ts := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+
+	tbl := []struct {
+		line string
+		res  metric.Entry
+		err  string
+	}{
+		{"requests:1|c", metric.Entry{Name: "requests", Kind: metric.KindCounter, Value: 1, TimeStamp: ts}, ""},
+		{"requests:2|c|@0.1", metric.Entry{Name: "requests", Kind: metric.KindCounter, Value: 20, TimeStamp: ts}, ""},
+		{"cpu:42.5|g", metric.Entry{Name: "cpu", Kind: metric.KindGauge, Value: 42.5, TimeStamp: ts}, ""},
+		{"db.query:320|ms", metric.Entry{Name: "db.query", Kind: metric.KindGauge, Value: 320, TimeStamp: ts}, ""},
+		{"db.query:320|ms|@0.3", metric.Entry{Name: "db.query", Kind: metric.KindGauge, Value: 320, TimeStamp: ts,
+			Stats:  &metric.Stats{Count: 3, Sum: 960, Min: 320, Max: 320, Last: 320},
+			Sketch: metric.NewSketch(320, 320, 320)}, ""},
+		{"db.query:320|d|@0.9", metric.Entry{Name: "db.query", Kind: metric.KindGauge, Value: 320, TimeStamp: ts}, ""},
+		{"api.latency:12|h|#host:h1,region:eu,canary", metric.Entry{Name: "api.latency", Kind: metric.KindGauge, Value: 12,
+			TimeStamp: ts, Labels: map[string]string{"host": "h1", "region": "eu", "canary": "true"}}, ""},
+		{"api.errors:1|c|#host:h1|c:abc123", metric.Entry{Name: "api.errors", Kind: metric.KindCounter, Value: 1,
+			TimeStamp: ts, Labels: map[string]string{"host": "h1"}}, ""},
+		{"requests", metric.Entry{}, "no metric name"},
+		{":1|c", metric.Entry{}, "no metric name"},
+		{"requests:1", metric.Entry{}, "no metric type"},
+		{"requests:abc|c", metric.Entry{}, `invalid value "abc"`},
+		{"requests:NaN|c", metric.Entry{}, `invalid value "NaN"`},
+		{"requests:1|c|@2", metric.Entry{}, `invalid sample rate "@2"`},
+		{"requests:1|c|x", metric.Entry{}, `unknown field "x"`},
+		{"users:15|s", metric.Entry{}, `unsupported metric type "s"`},
+		{"cpu:+5|g", metric.Entry{}, `relative gauge "+5" not supported`},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
+			res, err := ParseStatsD(tt.line, ts)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, res)
+		})
+	}
+}
+
+func TestStatsD_Run(t *testing.T) {
+	updater := &UpdaterMock{
+		UpdateFunc: func(ctx context.Context, m metric.Entry) error {
+			return nil
+		},
+	}
+	srv := &StatsD{Updater: updater, UDPAddr: "127.0.0.1:0", TCPAddr: "127.0.0.1:0"}
+	malformed := malformedLines.With("statsd").Value()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.Run(ctx) }()
+
+	var udpAddr, tcpAddr string
+	require.Eventually(t, func() bool {
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		if srv.udpConn == nil || srv.tcpLn == nil {
+			return false
+		}
+		udpAddr, tcpAddr = srv.udpConn.LocalAddr().String(), srv.tcpLn.Addr().String()
+		return true
+	}, time.Second, 10*time.Millisecond)
+
+	udp, err := net.Dial("udp", udpAddr)
+	require.NoError(t, err)
+	_, err = udp.Write([]byte("requests:1|c\ncpu:42.5|g|#host:h1\nbroken\n"))
+	require.NoError(t, err)
+	require.NoError(t, udp.Close())
+
+	tcp, err := net.Dial("tcp", tcpAddr)
+	require.NoError(t, err)
+	_, err = tcp.Write([]byte("db.query:320|ms\nusers:1|s\n"))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return len(updater.UpdateCalls()) == 3 && malformedLines.With("statsd").Value() == malformed+2
+	}, time.Second, 10*time.Millisecond)
+
+	names := map[string]int{}
+	for _, c := range updater.UpdateCalls() {
+		names[c.M.Name]++
+	}
+	assert.Equal(t, map[string]int{"requests": 1, "cpu": 1, "db.query": 1}, names, "malformed lines dropped")
+
+	cancel() // terminates with the open tcp connection
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("not terminated")
+	}
+	require.NoError(t, tcp.Close())
+}
+
+func TestStatsD_RunFailed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	srv := &StatsD{Updater: &UpdaterMock{}, UDPAddr: "127.0.0.1:0", TCPAddr: ln.Addr().String()}
+	err = srv.Run(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to listen tcp")
+}
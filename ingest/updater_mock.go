@@ -0,0 +1,81 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package ingest
+
+import (
+	"context"
+	"github.com/umputun/metrics/metric"
+	"sync"
+)
+
+// Ensure, that UpdaterMock does implement Updater.
+// If this is not the case, regenerate this file with moq.
+var _ Updater = &UpdaterMock{}
+
+// UpdaterMock is a mock implementation of Updater.
+//
+// 	func TestSomethingThatUsesUpdater(t *testing.T) {
+//
+// 		// make and configure a mocked Updater
+// 		mockedUpdater := &UpdaterMock{
+// 			UpdateFunc: func(ctx context.Context, m metric.Entry) error {
+// 				panic("mock out the Update method")
+// 			},
+// 		}
+//
+// 		// use mockedUpdater in code that requires Updater
+// 		// and then make assertions.
+//
+// 	}
+type UpdaterMock struct {
+	// UpdateFunc mocks the Update method.
+	UpdateFunc func(ctx context.Context, m metric.Entry) error
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// Update holds details about calls to the Update method.
+		Update []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// M is the m argument value.
+			M metric.Entry
+		}
+	}
+	lockUpdate sync.RWMutex
+}
+
+// Update calls UpdateFunc.
+func (mock *UpdaterMock) Update(ctx context.Context, m metric.Entry) error {
+	if mock.UpdateFunc == nil {
+		panic("UpdaterMock.UpdateFunc: method is nil but Updater.Update was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		M   metric.Entry
+	}{
+		Ctx: ctx,
+		M:   m,
+	}
+	mock.lockUpdate.Lock()
+	mock.calls.Update = append(mock.calls.Update, callInfo)
+	mock.lockUpdate.Unlock()
+	return mock.UpdateFunc(ctx, m)
+}
+
+// UpdateCalls gets all the calls that were made to Update.
+// Check the length with:
+//     len(mockedUpdater.UpdateCalls())
+func (mock *UpdaterMock) UpdateCalls() []struct {
+	Ctx context.Context
+	M   metric.Entry
+} {
+	var calls []struct {
+		Ctx context.Context
+		M   metric.Entry
+	}
+	mock.lockUpdate.RLock()
+	calls = mock.calls.Update
+	mock.lockUpdate.RUnlock()
+	return calls
+}
@@ -2,21 +2,27 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/umputun/go-flags"
 	"github.com/umputun/metrics/api"
+	"github.com/umputun/metrics/ingest"
 	"github.com/umputun/metrics/storage"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 var opts struct {
 	Port              string        `long:"port" env:"PORT" description:"port" default:":8080"`
+	Storage           string        `long:"storage" env:"STORAGE" description:"storage type" choice:"mongo" choice:"memory" choice:"bolt" default:"mongo"`
+	BoltFile          string        `long:"boltfile" env:"BOLT_FILE" description:"bolt file name" default:"metrics.db"`
 	MongoDbUri        string        `long:"mngdburi" env:"MNG_DB_URI" description:"MongoDB uri" default:"mongodb://localhost:27017"`
 	DbName            string        `long:"dbname" env:"DB_NAME" description:"MongoDB name" default:"metrics-service"`
 	CollName          string        `long:"collname" env:"COLL_NAME" description:"MongoDB collection name" default:"metrics"`
@@ -24,6 +30,21 @@ var opts struct {
 	CleanupDur        time.Duration `long:"cleanupdur" env:"CLEANUP_DUR" description:"cleanup duration" default:"1m"`
 	UserName          string        `long:"username" env:"USER_NAME" description:"user name" default:"admin"`
 	UserPasswd        string        `long:"userpasswd" env:"USER_PASSWD" description:"user password" default:"Lapatusik"`
+	StatsdUDP         string        `long:"statsdudp" env:"STATSD_UDP" description:"statsd udp listen address, disabled if empty"`
+	StatsdTCP         string        `long:"statsdtcp" env:"STATSD_TCP" description:"statsd tcp listen address, disabled if empty"`
+	GraphiteTCP       string        `long:"graphitetcp" env:"GRAPHITE_TCP" description:"graphite plaintext tcp listen address, disabled if empty"`
+	WalDir            string        `long:"waldir" env:"WAL_DIR" description:"write-ahead log directory of the current minute, disabled if empty"`
+	WalSync           bool          `long:"walsync" env:"WAL_SYNC" description:"fsync write-ahead log on every update"`
+	ShutdownTimeout   time.Duration `long:"shutdowntimeout" env:"SHUTDOWN_TIMEOUT" description:"graceful shutdown timeout" default:"10s"`
+	LateWindow        time.Duration `long:"latewindow" env:"LATE_WINDOW" description:"how far behind the newest minute of a series samples are staged" default:"0s"`
+	RejectLate        bool          `long:"rejectlate" env:"REJECT_LATE" description:"reject samples behind the lateness window instead of merging them into stored minutes"`
+	FlushQueue        int           `long:"flushqueue" env:"FLUSH_QUEUE" description:"capacity of the background write queue, updates wait when it is full" default:"10000"`
+	LatestAge         time.Duration `long:"latestage" env:"LATEST_AGE" description:"how far back /metrics looks for the latest value of a series" default:"24h"`
+	Tiers             []string      `long:"tier" env:"TIERS" env-delim:"," description:"roll-up tier interval:age, each one rolls up the interval of the previous one" default:"30m:1d"`
+	MaxAge            string        `long:"maxage" env:"MAX_AGE" description:"age of stored metrics to delete, i.e. 365d, kept forever if empty"`
+	RetentionFile     string        `long:"retention" env:"RETENTION_FILE" description:"retention config file with per-metric overrides, replaces tiers and max age"`
+	RollupWindow      time.Duration `long:"rollupwindow" env:"ROLLUP_WINDOW" description:"span of entries re-aggregated and committed at once" default:"1h"`
+	MaxBodySize       int64         `long:"maxbody" env:"MAX_BODY" description:"size limit of ingest request bodies after decompression, in bytes" default:"1048576"`
 }
 
 // main is the main application function
@@ -42,10 +63,10 @@ func main() {
 	log.Printf("stared metrics service")
 	ctx := context.Background()
 
-	// trap Ctrl+C and call cancel on the context
+	// trap Ctrl+C and SIGTERM of container stop and call cancel on the context
 	ctx, cancel := context.WithCancel(ctx)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT)
+	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 	defer func() {
 		signal.Stop(c)
 		cancel()
@@ -59,48 +80,205 @@ func main() {
 		}
 	}()
 
-	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI(opts.MongoDbUri))
-	if err != nil {
-		panic(err)
+	// the whole shutdown sequence is bounded by the timeout, started on termination request
+	stopCtx, stopCancel := stopContext(ctx, opts.ShutdownTimeout)
+	defer stopCancel()
+
+	var db storage.Accessor
+	var closeDB func(ctx context.Context) error
+	switch opts.Storage {
+	case "memory":
+		db = storage.NewMemAccessor(opts.IntForgivenessPrc)
+		closeDB = func(context.Context) error { return nil }
+	case "bolt":
+		boltDB, err := storage.NewBoltAccessor(opts.BoltFile, opts.IntForgivenessPrc)
+		if err != nil {
+			panic(err)
+		}
+		db = boltDB
+		closeDB = func(context.Context) error { return boltDB.Close() }
+	default:
+		dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI(opts.MongoDbUri))
+		if err != nil {
+			panic(err)
+		}
+		mongoDB := storage.NewAccessor(dbConn, opts.DbName, opts.CollName, opts.IntForgivenessPrc)
+		if err = mongoDB.CreateIndexes(ctx); err != nil {
+			log.Printf("[WARN] can't create indexes: %v", err)
+		}
+		db = mongoDB
+		closeDB = dbConn.Disconnect
 	}
 
-	db := storage.NewAccessor(dbConn, opts.DbName, opts.CollName, opts.IntForgivenessPrc)
 	svc := storage.New(db)
+	svc.LateWindow, svc.RejectLate, svc.QueueSize = opts.LateWindow, opts.RejectLate, opts.FlushQueue
+	svc.LatestAge = opts.LatestAge
+	var wal *storage.WAL
+	if opts.WalDir != "" {
+		var err error
+		if wal, err = storage.OpenWAL(opts.WalDir, opts.WalSync); err != nil {
+			panic(err)
+		}
+		if err = svc.UseWAL(wal); err != nil {
+			panic(err)
+		}
+	}
 	svc.ActivateCleanup(ctx, opts.CleanupDur) // async, exit right away
 
 	auth := api.AuthMidlwr{User: opts.UserName, Passwd: opts.UserPasswd}
 	apiService := api.Service{
-		Storage: svc,
-		Port:    opts.Port,
-		Auth:    auth,
+		Storage:         svc,
+		Port:            opts.Port,
+		Auth:            auth,
+		ShutdownTimeout: opts.ShutdownTimeout,
+		MaxBodySize:     opts.MaxBodySize,
+	}
+
+	var wg sync.WaitGroup // background loops, stopped by ctx
+	if opts.StatsdUDP != "" || opts.StatsdTCP != "" {
+		statsd := &ingest.StatsD{Updater: svc, UDPAddr: opts.StatsdUDP, TCPAddr: opts.StatsdTCP}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := statsd.Run(ctx); err != nil {
+				log.Printf("[WARN] statsd listener failed: %v", err)
+			}
+		}()
 	}
 
-	reagg := &storage.Reaggregator{
-		MongoClient: dbConn,
-		DbName:      opts.DbName,
-		CollName:    opts.CollName,
-		Buckets: []storage.ReaggrBucket{
-			{Interval: 30 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
-		},
+	if opts.GraphiteTCP != "" {
+		graphite := &ingest.Graphite{Updater: svc, Addr: opts.GraphiteTCP}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := graphite.Run(ctx); err != nil {
+				log.Printf("[WARN] graphite listener failed: %v", err)
+			}
+		}()
 	}
 
-	activateCleanup(ctx, reagg)
+	if store, ok := db.(storage.RollupStore); ok {
+		conf, err := retentionConfig(opts.Tiers, opts.MaxAge, opts.RetentionFile)
+		if err != nil {
+			panic(err)
+		}
+		reagg := &storage.Reaggregator{Store: store, Buckets: conf.Default.Buckets, MaxAge: conf.Default.MaxAge,
+			Overrides: conf.Overrides, Window: opts.RollupWindow}
+		if err = reagg.Validate(); err != nil {
+			panic(fmt.Errorf("invalid retention policy: %w", err))
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			activateCleanup(ctx, reagg, 24*time.Hour)
+		}()
+	}
 
+	failed := false
 	if err := apiService.Run(ctx); err != nil {
 		log.Printf("[ERROR] failed, %+v", err)
+		failed = true
+	}
+	cancel() // stops background loops if the server failed on its own
+
+	if err := shutdown(stopCtx, &wg, svc, wal, closeDB); err != nil {
+		log.Printf("[ERROR] shutdown failed, %v", err)
+		failed = true
+	}
+	if failed {
 		os.Exit(1)
 	}
+	log.Printf("[INFO] shutdown completed")
+}
+
+// shutdown waits for background loops, flushes staging to db and closes write-ahead log and db
+func shutdown(ctx context.Context, wg *sync.WaitGroup, svc *storage.Service, wal *storage.WAL,
+	closeDB func(ctx context.Context) error) error {
+
+	loopsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(loopsDone)
+	}()
+	select {
+	case <-loopsDone:
+	case <-ctx.Done():
+		return fmt.Errorf("background loops not stopped: %w", ctx.Err())
+	}
+
+	var errs []string
+	if err := svc.Shutdown(ctx); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if wal != nil {
+		if err := wal.Close(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if err := closeDB(ctx); err != nil {
+		errs = append(errs, fmt.Sprintf("failed to close db: %v", err))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// stopContext returns context canceled after the timeout since ctx is done
+func stopContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	stopCtx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stopCtx.Done():
+			return
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			cancel()
+		case <-stopCtx.Done():
+		}
+	}()
+	return stopCtx, cancel
 }
 
-func activateCleanup(ctx context.Context, reagg *storage.Reaggregator) {
-	go func(ctx context.Context) {
-		tk := time.NewTicker(time.Hour * 24)
-		defer tk.Stop()
-		for range tk.C {
-			err := reagg.Do(ctx)
-			if err != nil {
-				panic(err)
+// retentionConfig makes retention config of the tiers and max age, or loads it from the file if set
+func retentionConfig(tiers []string, maxAge, fileName string) (storage.RetentionConfig, error) {
+	if fileName != "" {
+		return storage.LoadRetention(fileName)
+	}
+
+	buckets, err := storage.ParseTiers(tiers)
+	if err != nil {
+		return storage.RetentionConfig{}, err
+	}
+	res := storage.RetentionConfig{Default: storage.RetentionPolicy{Buckets: buckets}}
+	if maxAge != "" {
+		if res.Default.MaxAge, err = storage.ParseDuration(maxAge); err != nil {
+			return storage.RetentionConfig{}, fmt.Errorf("invalid max age: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// activateCleanup runs re-aggregation every interval, until the context is canceled.
+// Failed runs are logged and retried by the next one, so a db failure doesn't stop the server
+func activateCleanup(ctx context.Context, reagg *storage.Reaggregator, interval time.Duration) {
+	tk := time.NewTicker(interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tk.C:
+		}
+		if err := reagg.Do(ctx); err != nil {
+			if ctx.Err() != nil {
+				return // interrupted by shutdown
 			}
+			log.Printf("[WARN] re-aggregation failed, retried in %v: %v", interval, err)
 		}
-	}(ctx)
+	}
 }
@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"github.com/umputun/metrics/storage"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"io"
@@ -13,6 +16,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
@@ -107,6 +111,85 @@ func Test_Main(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func Test_shutdown(t *testing.T) {
+	db := storage.NewMemAccessor(0.25)
+	svc := storage.New(db)
+	wal, err := storage.OpenWAL(t.TempDir(), false)
+	require.NoError(t, err)
+	require.NoError(t, svc.UseWAL(wal))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	svc.ActivateCleanup(ctx, time.Hour)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+	}()
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: time.Now(), Value: 1}))
+
+	{ // loops not stopped
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer stopCancel()
+		err = shutdown(stopCtx, &wg, svc, wal, func(context.Context) error { return nil })
+		assert.EqualError(t, err, "background loops not stopped: context deadline exceeded")
+	}
+
+	{ // staging flushed, db closed
+		cancel()
+		dbClosed := false
+		err = shutdown(context.Background(), &wg, svc, wal, func(context.Context) error {
+			dbClosed = true
+			return errors.New("blah")
+		})
+		assert.EqualError(t, err, "failed to close db: blah")
+		assert.True(t, dbClosed)
+		list, err := db.GetMetricsList(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"file_1"}, list)
+	}
+}
+
+func Test_stopContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopCtx, stopCancel := stopContext(ctx, 50*time.Millisecond)
+	defer stopCancel()
+
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, stopCtx.Err(), "timeout starts when ctx is done")
+
+	cancel()
+	st := time.Now()
+	<-stopCtx.Done()
+	assert.GreaterOrEqual(t, time.Since(st), 50*time.Millisecond)
+}
+
+func Test_activateCleanup(t *testing.T) {
+	store := &storage.RollupStoreMock{
+		ResumeRollupFunc: func(ctx context.Context) (int, int, error) {
+			return 0, 0, errors.New("db is down")
+		},
+	}
+	reagg := &storage.Reaggregator{Store: store, Buckets: []storage.ReaggrBucket{
+		{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: time.Minute},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		activateCleanup(ctx, reagg, 10*time.Millisecond)
+		close(done)
+	}()
+	assert.Eventually(t, func() bool { return len(store.ResumeRollupCalls()) >= 2 }, time.Second,
+		10*time.Millisecond, "failed run retried")
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup not stopped")
+	}
+}
+
 func waitForHTTPServerStart(port int) {
 	// wait for up to 10 seconds for server to start before returning it
 	client := http.Client{Timeout: time.Second}
@@ -118,3 +201,31 @@ func waitForHTTPServerStart(port int) {
 		}
 	}
 }
+
+func Test_retentionConfig(t *testing.T) {
+	day := 24 * time.Hour
+
+	conf, err := retentionConfig([]string{"5m:1d", "1h:7d"}, "90d", "")
+	require.NoError(t, err)
+	assert.Equal(t, storage.RetentionConfig{Default: storage.RetentionPolicy{Buckets: []storage.ReaggrBucket{
+		{Interval: 5 * time.Minute, Age: day, SrcType: time.Minute},
+		{Interval: time.Hour, Age: 7 * day, SrcType: 5 * time.Minute},
+	}, MaxAge: 90 * day}}, conf)
+
+	conf, err = retentionConfig(nil, "", "")
+	require.NoError(t, err)
+	assert.Equal(t, storage.RetentionConfig{}, conf)
+
+	_, err = retentionConfig([]string{"5m"}, "", "")
+	assert.EqualError(t, err, `invalid tier "5m", expected interval:age`)
+
+	_, err = retentionConfig(nil, "blah", "")
+	assert.EqualError(t, err, `invalid max age: time: invalid duration "blah"`)
+
+	conf, err = retentionConfig([]string{"5m:1d"}, "90d", "etc/retention.yml")
+	require.NoError(t, err)
+	assert.Equal(t, 365*day, conf.Default.MaxAge, "file replaces flags")
+	assert.NotEmpty(t, conf.Overrides)
+	reagg := storage.Reaggregator{Buckets: conf.Default.Buckets, MaxAge: conf.Default.MaxAge, Overrides: conf.Overrides}
+	assert.NoError(t, reagg.Validate())
+}
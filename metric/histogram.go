@@ -0,0 +1,73 @@
+package metric
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// validateBuckets checks histogram bucket bounds and counts, if set
+func validateBuckets(bounds []float64, counts []int64) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("no buckets")
+	}
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("invalid bucket bound %v", b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return fmt.Errorf("bucket bounds not increasing, %v after %v", b, bounds[i-1])
+		}
+	}
+	if counts != nil && len(counts) != len(bounds)+1 {
+		return fmt.Errorf("%d bucket counts for %d bounds, expected %d", len(counts), len(bounds), len(bounds)+1)
+	}
+	for _, c := range counts {
+		if c < 0 {
+			return fmt.Errorf("negative bucket count %d", c)
+		}
+	}
+	return nil
+}
+
+// bucketIndex returns the index of the bucket for the value, the first one with upper bound >= value,
+// len(bounds) for the +Inf bucket
+func bucketIndex(bounds []float64, v float64) int {
+	return sort.SearchFloat64s(bounds, v)
+}
+
+// mergeBuckets adds other bucket counts to the counts, both returned and counts are not changed.
+// Other counts with different bounds are moved to the bucket containing their upper bound
+func mergeBuckets(bounds []float64, counts []int64, otherBounds []float64, otherCounts []int64) []int64 {
+	res := make([]int64, len(bounds)+1)
+	copy(res, counts)
+
+	if sameBuckets(bounds, otherBounds) {
+		for i, c := range otherCounts {
+			res[i] += c
+		}
+		return res
+	}
+
+	for i, c := range otherCounts {
+		upper := math.Inf(1)
+		if i < len(otherBounds) {
+			upper = otherBounds[i]
+		}
+		res[bucketIndex(bounds, upper)] += c
+	}
+	return res
+}
+
+// sameBuckets checks if bucket bounds are equal
+func sameBuckets(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
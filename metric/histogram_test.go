@@ -0,0 +1,67 @@
+package metric
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_validateBuckets(t *testing.T) {
+	tbl := []struct {
+		bounds []float64
+		counts []int64
+		err    string
+	}{
+		{[]float64{0.1, 0.5, 1}, nil, ""},
+		{[]float64{0.1, 0.5, 1}, []int64{1, 0, 2, 5}, ""},
+		{nil, nil, "no buckets"},
+		{[]float64{0.5, 0.1}, nil, "bucket bounds not increasing, 0.1 after 0.5"},
+		{[]float64{0.5, 0.5}, nil, "bucket bounds not increasing, 0.5 after 0.5"},
+		{[]float64{0.5, 1}, []int64{1, 2}, "2 bucket counts for 2 bounds, expected 3"},
+		{[]float64{0.5, 1}, []int64{1, -2, 0}, "negative bucket count -2"},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
+			err := validateBuckets(tt.bounds, tt.counts)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func Test_mergeBuckets(t *testing.T) {
+	bounds := []float64{0.1, 0.5, 1}
+	counts := []int64{1, 2, 3, 4}
+
+	res := mergeBuckets(bounds, counts, bounds, []int64{1, 1, 1, 1})
+	assert.Equal(t, []int64{2, 3, 4, 5}, res)
+	assert.Equal(t, []int64{1, 2, 3, 4}, counts, "not changed")
+
+	res = mergeBuckets(bounds, nil, []float64{0.05, 0.5, 2}, []int64{1, 2, 3, 4})
+	assert.Equal(t, []int64{1, 2, 0, 7}, res, "other bounds re-bucketed by upper bound")
+}
+
+func TestEntry_MergeHistogram(t *testing.T) {
+	tm := time.Date(2022, 10, 11, 2, 10, 0, 0, time.UTC)
+	bounds := []float64{0.1, 0.5, 1}
+
+	e := Entry{Name: "latency", Kind: KindHistogram, TimeStamp: tm, Value: 0.05, Buckets: bounds}
+	require.NoError(t, e.Validate())
+	assert.Equal(t, []int64{1, 0, 0, 0}, e.GetBucketCounts())
+
+	e.Merge(Entry{Name: "latency", Kind: KindHistogram, TimeStamp: tm, Value: 0.5, Buckets: bounds})
+	e.Merge(Entry{Name: "latency", Kind: KindHistogram, TimeStamp: tm, Value: 3, Buckets: bounds})
+	e.Merge(Entry{Name: "latency", Kind: KindHistogram, TimeStamp: tm, Value: 1.2, Buckets: bounds,
+		BucketCounts: []int64{0, 1, 1, 0}}) // pre-aggregated
+	assert.Equal(t, []int64{1, 2, 1, 1}, e.BucketCounts)
+	assert.InDelta(t, 4.75, e.Value, 1e-9)
+
+	assert.EqualError(t, Entry{Name: "latency", Kind: KindHistogram}.Validate(), "invalid histogram latency: no buckets")
+	assert.Nil(t, Entry{Name: "bytes", Value: 1}.GetBucketCounts())
+}
@@ -2,27 +2,370 @@ package metric
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 )
 
 // Entry creates a metric to save/delete from the db
 type Entry struct {
-	Name      string    `bson:"name" json:"name"`
-	TimeStamp time.Time `bson:"time_stamp" json:"time_stamp"`
-	Value     int       `bson:"value" json:"value"`
+	Name      string            `bson:"name" json:"name"`
+	Labels    map[string]string `bson:"labels,omitempty" json:"labels,omitempty"`
+	TimeStamp time.Time         `bson:"time_stamp" json:"time_stamp"`
+	Value     float64           `bson:"value" json:"value"`
+	Kind      string            `bson:"kind,omitempty" json:"kind,omitempty"`             // counter if empty
+	GaugeMode string            `bson:"gauge_mode,omitempty" json:"gauge_mode,omitempty"` // gauge only, last if empty
+	Stats     *Stats            `bson:"stats,omitempty" json:"stats,omitempty"`           // nil for a single sample
+	Sketch    *Sketch           `bson:"sketch,omitempty" json:"sketch,omitempty"`         // nil for a single sample
 
-	MinSinceMidnight int           `bson:"-" json:"-"`
-	Type             time.Duration `bson:"type" json:"type"`
-	TypeStr          string        `bson:"type_str" json:"type_str"`
+	// histogram only, counts per bucket (not cumulative) with the last one for values above all the bounds
+	Buckets      []float64 `bson:"buckets,omitempty" json:"buckets,omitempty"` // upper bounds, increasing
+	BucketCounts []int64   `bson:"bucket_counts,omitempty" json:"bucket_counts,omitempty"`
+
+	Quantiles map[string]float64 `bson:"-" json:"quantiles,omitempty"` // requested quantiles by q, filled for lookups only
+
+	Type    time.Duration `bson:"type" json:"type"`
+	TypeStr string        `bson:"type_str" json:"type_str"`
+}
+
+// Metric kinds, defining how values of the same series are merged
+const (
+	KindCounter   = "counter"   // values summed up
+	KindGauge     = "gauge"     // latest value kept
+	KindHistogram = "histogram" // values summed up, samples counted in buckets
+)
+
+// Gauge modes, defining the value of merged gauge entries
+const (
+	GaugeLast = "last" // value of the latest entry
+	GaugeAvg  = "avg"  // average of all the values
+	GaugeMax  = "max"  // maximum of all the values
+)
+
+// ErrKindMismatch returned for entries of the same series which can't be merged, as their kinds differ
+var ErrKindMismatch = errors.New("kind mismatch")
+
+// Validate checks the entry
+func (e Entry) Validate() error {
+	switch e.GaugeMode {
+	case "", GaugeLast, GaugeAvg, GaugeMax:
+	default:
+		return fmt.Errorf("unknown gauge mode %q of %s", e.GaugeMode, e.Name)
+	}
+	if e.GaugeMode != "" && e.Kind != KindGauge {
+		return fmt.Errorf("gauge mode %q set for %s of kind %s", e.GaugeMode, e.Name, e.GetKind())
+	}
+
+	switch e.Kind {
+	case "", KindCounter, KindGauge:
+		return nil
+	case KindHistogram:
+		if err := validateBuckets(e.Buckets, e.BucketCounts); err != nil {
+			return fmt.Errorf("invalid histogram %s: %w", e.Name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown kind %q of %s", e.Kind, e.Name)
+}
+
+// Merge folds other entry of the same series into the entry according to the kind.
+// Counters are summed up, gauges keep the value of the latest entry by default, the one with
+// the same timestamp wins, so entries merged in time order end up with the last value.
+// Gauges with avg or max mode get the average or maximum of all the values merged.
+// Histograms are summed up and their buckets merged bucket-wise.
+// Stats and sketches of both are combined and the entry gets the timestamp of the latest one.
+// Returns ErrKindMismatch and keeps the entry as is if the merge kinds differ, see MergeKind
+func (e *Entry) Merge(other Entry) error {
+	if e.MergeKind() != other.MergeKind() {
+		return fmt.Errorf("%w: %s %s can't be merged into %s", ErrKindMismatch, other.MergeKind(), e.Name, e.MergeKind())
+	}
+
+	sketch := e.GetSketch()
+	sketch.Merge(other.GetSketch())
+	e.Sketch = sketch
+
+	st := e.GetStats()
+	isLatest := !other.TimeStamp.Before(e.TimeStamp)
+	st.Merge(other.GetStats(), isLatest)
+	if isLatest {
+		e.TimeStamp = other.TimeStamp
+	}
+	e.Stats = &st
+
+	if e.Kind == KindGauge {
+		switch e.GaugeMode {
+		case GaugeAvg:
+			e.Value = st.Sum / float64(st.Count)
+		case GaugeMax:
+			e.Value = st.Max
+		default:
+			if isLatest {
+				e.Value = other.Value
+			}
+		}
+		return nil
+	}
+	if e.Kind == KindHistogram {
+		e.MergeBuckets(other)
+	}
+	e.Value += other.Value
+	return nil
+}
+
+// GetKind returns the kind of the entry, counter if not set
+func (e Entry) GetKind() string {
+	if e.Kind == "" {
+		return KindCounter
+	}
+	return e.Kind
+}
+
+// MergeKind returns how values of the entry are merged, the kind with the gauge mode for gauges, i.e. gauge:avg.
+// Entries of different merge kinds are kept apart
+func (e Entry) MergeKind() string {
+	if e.Kind == KindGauge && e.GaugeMode != "" && e.GaugeMode != GaugeLast {
+		return e.Kind + ":" + e.GaugeMode
+	}
+	return e.GetKind()
+}
+
+// MergeBuckets adds histogram bucket counts of other entry bucket-wise. Counts of other entry with
+// different bounds are added to the bucket containing their upper bound
+func (e *Entry) MergeBuckets(other Entry) {
+	e.BucketCounts = mergeBuckets(e.Buckets, e.GetBucketCounts(), other.Buckets, other.GetBucketCounts())
+}
+
+// Stats of the samples merged into the entry
+type Stats struct {
+	Count int64   `bson:"count" json:"count"`
+	Sum   float64 `bson:"sum" json:"sum"`
+	Min   float64 `bson:"min" json:"min"`
+	Max   float64 `bson:"max" json:"max"`
+	Last  float64 `bson:"last" json:"last"`
+}
+
+// Merge adds samples of other stats, taking the last value of other if latest is set
+func (s *Stats) Merge(other Stats, latest bool) {
+	s.Count += other.Count
+	s.Sum += other.Sum
+	s.Min = math.Min(s.Min, other.Min)
+	s.Max = math.Max(s.Max, other.Max)
+	if latest {
+		s.Last = other.Last
+	}
+}
+
+// Stat types, selecting the value returned for each entry
+const (
+	StatValue = "value"
+	StatCount = "count"
+	StatSum   = "sum"
+	StatMin   = "min"
+	StatMax   = "max"
+	StatLast  = "last"
+	StatAvg   = "avg"
+)
+
+// GetStats returns stats of the entry, made of the value for a single sample entry
+func (e Entry) GetStats() Stats {
+	if e.Stats != nil {
+		return *e.Stats
+	}
+	return Stats{Count: 1, Sum: e.Value, Min: e.Value, Max: e.Value, Last: e.Value}
+}
+
+// GetBucketCounts returns histogram bucket counts, made of the value for a single sample entry
+func (e Entry) GetBucketCounts() []int64 {
+	if e.BucketCounts != nil || len(e.Buckets) == 0 {
+		return e.BucketCounts
+	}
+	res := make([]int64, len(e.Buckets)+1)
+	res[bucketIndex(e.Buckets, e.Value)]++
+	return res
+}
+
+// GetSketch returns a copy of the quantile sketch of the entry, made of the value for a single sample entry
+func (e Entry) GetSketch() *Sketch {
+	if e.Sketch != nil {
+		return e.Sketch.Copy()
+	}
+	return NewSketch(e.Value)
+}
+
+// StatValue returns the requested stat of the entry, the value itself if stat is empty
+func (e Entry) StatValue(stat string) float64 {
+	st := e.GetStats()
+	switch stat {
+	case StatCount:
+		return float64(st.Count)
+	case StatSum:
+		return st.Sum
+	case StatMin:
+		return st.Min
+	case StatMax:
+		return st.Max
+	case StatLast:
+		return st.Last
+	case StatAvg:
+		if st.Count == 0 {
+			return 0
+		}
+		return st.Sum / float64(st.Count)
+	}
+	return e.Value
+}
+
+// SeriesKey returns the key identifying the series of the entry, i.e. metric name with sorted labels,
+// like api_errors{host="h3",region="eu"}
+func (e Entry) SeriesKey() string {
+	if len(e.Labels) == 0 {
+		return e.Name
+	}
+
+	keys := make([]string, 0, len(e.Labels))
+	for k := range e.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteString(e.Name)
+	sb.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString(fmt.Sprintf("%s=%q", k, e.Labels[k]))
+	}
+	sb.WriteString("}")
+	return sb.String()
 }
 
 // Lookup criteria for metric/metrics in db
 type Lookup struct {
 	Name     string    `json:"name"`
+	Matchers []Matcher `json:"matchers"`
 	From     time.Time `json:"from"`
 	To       time.Time `json:"to"`
 	Interval Duration  `json:"interval"`
+
+	Stat      string    `json:"stat"`      // stat returned as the value of each entry, the value itself if empty
+	Quantiles []float64 `json:"quantiles"` // quantiles returned for each entry, like 0.5, 0.95 and 0.99
+	GroupBy   []string  `json:"group_by"`  // label keys to group series by, all series merged if empty
+	Aggregate string    `json:"aggregate"` // cross-series aggregation, series returned as is if empty
+}
+
+// Validate checks lookup criteria and prepares label matchers
+func (l *Lookup) Validate() error {
+	for i := range l.Matchers {
+		if err := l.Matchers[i].Validate(); err != nil {
+			return err
+		}
+	}
+
+	switch l.Stat {
+	case "", StatValue, StatCount, StatSum, StatMin, StatMax, StatLast, StatAvg:
+	default:
+		return fmt.Errorf("unknown stat %q", l.Stat)
+	}
+
+	for _, q := range l.Quantiles {
+		if q < 0 || q > 1 {
+			return fmt.Errorf("quantile %v out of [0, 1] range", q)
+		}
+	}
+
+	if len(l.GroupBy) > 0 && l.Aggregate == "" {
+		l.Aggregate = AggrSum
+	}
+	switch l.Aggregate {
+	case "", AggrSum, AggrAvg, AggrMin, AggrMax, AggrCount:
+	default:
+		return fmt.Errorf("unknown aggregation %q", l.Aggregate)
+	}
+	for _, k := range l.GroupBy {
+		if k == "" {
+			return fmt.Errorf("empty label in group_by")
+		}
+	}
+	return nil
+}
+
+// Cross-series aggregation types
+const (
+	AggrSum   = "sum"
+	AggrAvg   = "avg"
+	AggrMin   = "min"
+	AggrMax   = "max"
+	AggrCount = "count"
+)
+
+// Label matcher types
+const (
+	MatchEqual    = "="
+	MatchNotEqual = "!="
+	MatchRegexp   = "=~"
+)
+
+// Matcher filters series by the value of a label. Missing label matches as an empty value
+type Matcher struct {
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+
+	re *regexp.Regexp
+}
+
+// Validate checks the matcher and compiles regular expression, anchored to the whole value
+func (m *Matcher) Validate() error {
+	if m.Label == "" {
+		return fmt.Errorf("empty label in matcher %+v", *m)
+	}
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+		return nil
+	case MatchRegexp:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regexp in matcher for %s: %w", m.Label, err)
+		}
+		m.re = re
+		return nil
+	default:
+		return fmt.Errorf("unknown matcher type %q for %s", m.Type, m.Label)
+	}
+}
+
+// Matches checks if labels satisfy the matcher
+func (m Matcher) Matches(labels map[string]string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return labels[m.Label] == m.Value
+	case MatchNotEqual:
+		return labels[m.Label] != m.Value
+	case MatchRegexp:
+		if m.re == nil {
+			if err := m.Validate(); err != nil {
+				return false
+			}
+		}
+		return m.re.MatchString(labels[m.Label])
+	}
+	return false
+}
+
+// MatchLabels checks if labels satisfy all the matchers
+func MatchLabels(labels map[string]string, matchers []Matcher) bool {
+	for _, m := range matchers {
+		if !m.Matches(labels) {
+			return false
+		}
+	}
+	return true
 }
 
 // Duration custom type
@@ -42,3 +42,200 @@ func TestDuration_UnmarshalJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestEntry_SeriesKey(t *testing.T) {
+	tbl := []struct {
+		entry Entry
+		res   string
+	}{
+		{Entry{Name: "file_1"}, "file_1"},
+		{Entry{Name: "file_1", Labels: map[string]string{}}, "file_1"},
+		{Entry{Name: "api_errors", Labels: map[string]string{"region": "eu", "host": "h3"}}, `api_errors{host="h3",region="eu"}`},
+		{Entry{Name: "api_errors", Labels: map[string]string{"path": `/a"b`}}, `api_errors{path="/a\"b"}`},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
+			assert.Equal(t, tt.res, tt.entry.SeriesKey())
+		})
+	}
+}
+
+func TestMatcher(t *testing.T) {
+	labels := map[string]string{"host": "h3", "region": "eu"}
+
+	tbl := []struct {
+		matcher Matcher
+		res     bool
+		err     bool
+	}{
+		{Matcher{Label: "host", Type: MatchEqual, Value: "h3"}, true, false},
+		{Matcher{Label: "host", Type: MatchEqual, Value: "h1"}, false, false},
+		{Matcher{Label: "status", Type: MatchEqual, Value: ""}, true, false},
+		{Matcher{Label: "host", Type: MatchNotEqual, Value: "h1"}, true, false},
+		{Matcher{Label: "status", Type: MatchNotEqual, Value: "500"}, true, false},
+		{Matcher{Label: "host", Type: MatchRegexp, Value: "h[0-9]"}, true, false},
+		{Matcher{Label: "host", Type: MatchRegexp, Value: "h"}, false, false}, // anchored
+		{Matcher{Label: "region", Type: MatchRegexp, Value: "us|eu"}, true, false},
+		{Matcher{Label: "host", Type: MatchRegexp, Value: "h[0-9"}, false, true},
+		{Matcher{Label: "host", Type: "~~", Value: "h3"}, false, true},
+		{Matcher{Type: MatchEqual, Value: "h3"}, false, true},
+	}
+
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
+			err := tt.matcher.Validate()
+			if tt.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.res, tt.matcher.Matches(labels))
+		})
+	}
+}
+
+func TestLookup_Validate(t *testing.T) {
+	var l Lookup
+	err := json.Unmarshal([]byte(`{"name": "api_errors", "matchers": [{"label": "host", "type": "=~", "value": "h[12]"},
+		{"label": "region", "type": "!=", "value": "us"}], "interval": "5m"}`), &l)
+	require.NoError(t, err)
+	require.NoError(t, l.Validate())
+	assert.True(t, MatchLabels(map[string]string{"host": "h1", "region": "eu"}, l.Matchers))
+	assert.False(t, MatchLabels(map[string]string{"host": "h1", "region": "us"}, l.Matchers))
+	assert.False(t, MatchLabels(map[string]string{"host": "h3", "region": "eu"}, l.Matchers))
+	assert.True(t, MatchLabels(nil, nil))
+
+	l.Matchers = append(l.Matchers, Matcher{Label: "status", Type: "=~", Value: "("})
+	assert.Error(t, l.Validate())
+}
+
+func TestLookup_ValidateAggregate(t *testing.T) {
+	l := Lookup{Name: "api_errors", GroupBy: []string{"region"}}
+	require.NoError(t, l.Validate())
+	assert.Equal(t, AggrSum, l.Aggregate, "sum by default if grouped")
+
+	l = Lookup{Name: "api_errors", Aggregate: AggrAvg}
+	require.NoError(t, l.Validate())
+
+	l = Lookup{Name: "api_errors"}
+	require.NoError(t, l.Validate())
+	assert.Equal(t, "", l.Aggregate, "no aggregation if not requested")
+
+	l = Lookup{Name: "api_errors", Stat: StatMax, Aggregate: AggrMax}
+	require.NoError(t, l.Validate())
+
+	l = Lookup{Name: "api_errors", Quantiles: []float64{0.5, 0.99}}
+	require.NoError(t, l.Validate())
+
+	l = Lookup{Name: "api_errors", Quantiles: []float64{99}}
+	assert.EqualError(t, l.Validate(), "quantile 99 out of [0, 1] range")
+
+	l = Lookup{Name: "api_errors", Stat: "p99"}
+	assert.EqualError(t, l.Validate(), `unknown stat "p99"`)
+
+	l = Lookup{Name: "api_errors", Aggregate: "median"}
+	assert.EqualError(t, l.Validate(), `unknown aggregation "median"`)
+
+	l = Lookup{Name: "api_errors", GroupBy: []string{"region", ""}}
+	assert.Error(t, l.Validate())
+}
+
+func TestEntry_Merge(t *testing.T) {
+	tm := time.Date(2022, 10, 11, 2, 10, 0, 0, time.UTC)
+
+	counter := Entry{Name: "bytes", TimeStamp: tm, Value: 1.5}
+	counter.Merge(Entry{Name: "bytes", TimeStamp: tm.Add(-time.Second), Value: 2})
+	counter.Merge(Entry{Name: "bytes", TimeStamp: tm.Add(time.Second), Value: 3})
+	assert.Equal(t, 6.5, counter.Value)
+	assert.Equal(t, tm.Add(time.Second), counter.TimeStamp, "timestamp of the latest")
+	assert.Equal(t, &Stats{Count: 3, Sum: 6.5, Min: 1.5, Max: 3, Last: 3}, counter.Stats)
+
+	gauge := Entry{Name: "cpu", Kind: KindGauge, TimeStamp: tm, Value: 10}
+	gauge.Merge(Entry{Name: "cpu", Kind: KindGauge, TimeStamp: tm.Add(time.Second), Value: 70.5})
+	assert.Equal(t, 70.5, gauge.Value)
+	gauge.Merge(Entry{Name: "cpu", Kind: KindGauge, TimeStamp: tm, Value: 20}) // older
+	assert.Equal(t, 70.5, gauge.Value)
+	gauge.Merge(Entry{Name: "cpu", Kind: KindGauge, TimeStamp: tm.Add(time.Second), Value: 30})
+	assert.Equal(t, 30.0, gauge.Value, "same timestamp, merged later wins")
+	assert.Equal(t, tm.Add(time.Second), gauge.TimeStamp)
+	assert.Equal(t, &Stats{Count: 4, Sum: 130.5, Min: 10, Max: 70.5, Last: 30}, gauge.Stats)
+
+	merged := Entry{Name: "cpu", Kind: KindGauge, TimeStamp: tm, Value: 5}
+	merged.Merge(gauge) // stats of already merged entries combined
+	assert.Equal(t, &Stats{Count: 5, Sum: 135.5, Min: 5, Max: 70.5, Last: 30}, merged.Stats)
+
+	avg := Entry{Name: "queue", Kind: KindGauge, GaugeMode: GaugeAvg, TimeStamp: tm, Value: 10}
+	require.NoError(t, avg.Merge(Entry{Name: "queue", Kind: KindGauge, GaugeMode: GaugeAvg, TimeStamp: tm.Add(time.Second), Value: 30}))
+	assert.Equal(t, 20.0, avg.Value)
+	require.NoError(t, avg.Merge(Entry{Name: "queue", Kind: KindGauge, GaugeMode: GaugeAvg, TimeStamp: tm, Value: 5, // merged
+		Stats: &Stats{Count: 2, Sum: 10, Min: 5, Max: 5, Last: 5}}))
+	assert.Equal(t, 12.5, avg.Value, "weighted by count")
+
+	highest := Entry{Name: "temp", Kind: KindGauge, GaugeMode: GaugeMax, TimeStamp: tm, Value: 40}
+	require.NoError(t, highest.Merge(Entry{Name: "temp", Kind: KindGauge, GaugeMode: GaugeMax, TimeStamp: tm.Add(time.Second), Value: 35}))
+	assert.Equal(t, 40.0, highest.Value)
+
+	last := Entry{Name: "cpu", Kind: KindGauge, TimeStamp: tm, Value: 1}
+	require.NoError(t, last.Merge(Entry{Name: "cpu", Kind: KindGauge, GaugeMode: GaugeLast, TimeStamp: tm, Value: 2}),
+		"last is the default mode")
+	assert.Equal(t, 2.0, last.Value)
+}
+
+func TestEntry_MergeKindMismatch(t *testing.T) {
+	tm := time.Date(2022, 10, 11, 2, 10, 0, 0, time.UTC)
+	tbl := []struct {
+		e, other Entry
+	}{
+		{Entry{Name: "cpu", Value: 1}, Entry{Name: "cpu", Kind: KindGauge, Value: 2}},
+		{Entry{Name: "cpu", Kind: KindGauge, Value: 1}, Entry{Name: "cpu", Kind: KindGauge, GaugeMode: GaugeMax, Value: 2}},
+		{Entry{Name: "cpu", Kind: KindHistogram, Buckets: []float64{1}, Value: 1}, Entry{Name: "cpu", Value: 2}},
+	}
+	for i, tt := range tbl {
+		tt.e.TimeStamp, tt.other.TimeStamp = tm, tm
+		e := tt.e
+		err := e.Merge(tt.other)
+		assert.ErrorIs(t, err, ErrKindMismatch, "case %d", i)
+		assert.Equal(t, tt.e, e, "case %d, not changed", i)
+	}
+
+	counter := Entry{Name: "bytes", Value: 1}
+	require.NoError(t, counter.Merge(Entry{Name: "bytes", Kind: KindCounter, Value: 2}), "counter is the default kind")
+	assert.Equal(t, 3.0, counter.Value)
+}
+
+func TestStats_Merge(t *testing.T) {
+	st := Stats{Count: 2, Sum: 5, Min: 1, Max: 4, Last: 4}
+	st.Merge(Stats{Count: 1, Sum: -2, Min: -2, Max: -2, Last: -2}, false)
+	assert.Equal(t, Stats{Count: 3, Sum: 3, Min: -2, Max: 4, Last: 4}, st)
+	st.Merge(Stats{Count: 2, Sum: 11, Min: 5, Max: 6, Last: 5}, true)
+	assert.Equal(t, Stats{Count: 5, Sum: 14, Min: -2, Max: 6, Last: 5}, st)
+}
+
+func TestEntry_StatValue(t *testing.T) {
+	single := Entry{Name: "cpu", Value: 12.5}
+	assert.Equal(t, Stats{Count: 1, Sum: 12.5, Min: 12.5, Max: 12.5, Last: 12.5}, single.GetStats())
+	assert.Equal(t, 1.0, single.StatValue(StatCount))
+	assert.Equal(t, 12.5, single.StatValue(StatAvg))
+
+	e := Entry{Name: "cpu", Kind: KindGauge, Value: 30, Stats: &Stats{Count: 4, Sum: 130, Min: 10, Max: 70.5, Last: 30}}
+	tbl := []struct {
+		stat string
+		res  float64
+	}{
+		{"", 30}, {StatValue, 30}, {StatCount, 4}, {StatSum, 130}, {StatMin, 10}, {StatMax, 70.5}, {StatLast, 30}, {StatAvg, 32.5},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.res, e.StatValue(tt.stat), tt.stat)
+	}
+}
+
+func TestEntry_Validate(t *testing.T) {
+	assert.NoError(t, Entry{Name: "bytes"}.Validate())
+	assert.NoError(t, Entry{Name: "bytes", Kind: KindCounter}.Validate())
+	assert.NoError(t, Entry{Name: "cpu", Kind: KindGauge}.Validate())
+	assert.EqualError(t, Entry{Name: "cpu", Kind: "meter"}.Validate(), `unknown kind "meter" of cpu`)
+	assert.NoError(t, Entry{Name: "cpu", Kind: KindGauge, GaugeMode: GaugeAvg}.Validate())
+	assert.EqualError(t, Entry{Name: "cpu", Kind: KindGauge, GaugeMode: "median"}.Validate(), `unknown gauge mode "median" of cpu`)
+	assert.EqualError(t, Entry{Name: "bytes", GaugeMode: GaugeMax}.Validate(), `gauge mode "max" set for bytes of kind counter`)
+}
@@ -0,0 +1,151 @@
+package metric
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// sketch parameters, the same for all sketches so any two of them can be merged
+const (
+	sketchAccuracy = 0.01 // relative accuracy of quantiles
+	sketchMaxBins  = 2048 // lowest bins collapsed above this number
+	sketchMinValue = 1e-9 // values closer to zero are counted as zero
+)
+
+var sketchGamma = (1 + sketchAccuracy) / (1 - sketchAccuracy)
+
+// Sketch is a mergeable quantile sketch (DDSketch), values are counted in bins growing exponentially,
+// so every quantile is within relative accuracy of the real value. Merge of two sketches is exactly
+// the sketch of all their values
+type Sketch struct {
+	Pos  []SketchBin `bson:"pos,omitempty" json:"pos,omitempty"` // positive values, sorted by index
+	Neg  []SketchBin `bson:"neg,omitempty" json:"neg,omitempty"` // negative values by absolute value, sorted by index
+	Zero int64       `bson:"zero,omitempty" json:"zero,omitempty"`
+}
+
+// SketchBin counts values falling into the bin
+type SketchBin struct {
+	Index int32 `bson:"i" json:"i"`
+	Count int64 `bson:"c" json:"c"`
+}
+
+// NewSketch makes a sketch of the values
+func NewSketch(values ...float64) *Sketch {
+	res := &Sketch{}
+	for _, v := range values {
+		res.Add(v)
+	}
+	return res
+}
+
+// Add counts the value in the sketch
+func (s *Sketch) Add(v float64) {
+	s.AddN(v, 1)
+}
+
+// AddN counts the value n times, i.e. for values known by histogram buckets only
+func (s *Sketch) AddN(v float64, n int64) {
+	switch {
+	case math.IsNaN(v) || n <= 0:
+		return
+	case v > sketchMinValue:
+		s.Pos = addToBins(s.Pos, sketchIndex(v), n)
+	case v < -sketchMinValue:
+		s.Neg = addToBins(s.Neg, sketchIndex(-v), n)
+	default:
+		s.Zero += n
+	}
+}
+
+// Merge adds all values of other sketch
+func (s *Sketch) Merge(other *Sketch) {
+	if other == nil {
+		return
+	}
+	for _, b := range other.Pos {
+		s.Pos = addToBins(s.Pos, b.Index, b.Count)
+	}
+	for _, b := range other.Neg {
+		s.Neg = addToBins(s.Neg, b.Index, b.Count)
+	}
+	s.Zero += other.Zero
+}
+
+// Count returns the number of values in the sketch
+func (s *Sketch) Count() int64 {
+	res := s.Zero
+	for _, b := range s.Pos {
+		res += b.Count
+	}
+	for _, b := range s.Neg {
+		res += b.Count
+	}
+	return res
+}
+
+// Quantile returns the approximate value of q quantile, 0 <= q <= 1
+func (s *Sketch) Quantile(q float64) (float64, error) {
+	if q < 0 || q > 1 {
+		return 0, fmt.Errorf("quantile %v out of [0, 1] range", q)
+	}
+	count := s.Count()
+	if count == 0 {
+		return 0, fmt.Errorf("empty sketch")
+	}
+
+	rank := int64(q * float64(count-1))
+	var seen int64
+	for i := len(s.Neg) - 1; i >= 0; i-- { // the largest absolute value is the smallest one
+		if seen += s.Neg[i].Count; seen > rank {
+			return -sketchValue(s.Neg[i].Index), nil
+		}
+	}
+	if seen += s.Zero; seen > rank {
+		return 0, nil
+	}
+	for _, b := range s.Pos {
+		if seen += b.Count; seen > rank {
+			return sketchValue(b.Index), nil
+		}
+	}
+	return sketchValue(s.Pos[len(s.Pos)-1].Index), nil
+}
+
+// Copy returns a deep copy of the sketch
+func (s *Sketch) Copy() *Sketch {
+	return &Sketch{
+		Pos:  append([]SketchBin(nil), s.Pos...),
+		Neg:  append([]SketchBin(nil), s.Neg...),
+		Zero: s.Zero,
+	}
+}
+
+// addToBins adds count to the bin with the index, keeping bins sorted and limited
+func addToBins(bins []SketchBin, index int32, count int64) []SketchBin {
+	i := sort.Search(len(bins), func(i int) bool { return bins[i].Index >= index })
+	if i < len(bins) && bins[i].Index == index {
+		bins[i].Count += count
+		return bins
+	}
+
+	bins = append(bins, SketchBin{})
+	copy(bins[i+1:], bins[i:])
+	bins[i] = SketchBin{Index: index, Count: count}
+
+	if len(bins) > sketchMaxBins { // collapse the lowest bins, keeping precision for higher values
+		bins[1].Count += bins[0].Count
+		bins = bins[1:]
+	}
+	return bins
+}
+
+// sketchIndex returns the index of the bin for positive value
+func sketchIndex(v float64) int32 {
+	return int32(math.Ceil(math.Log(v) / math.Log(sketchGamma)))
+}
+
+// sketchValue returns the value represented by the bin, within relative accuracy of any value in the bin
+func sketchValue(index int32) float64 {
+	return 2 * math.Pow(sketchGamma, float64(index)) / (sketchGamma + 1)
+}
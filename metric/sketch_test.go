@@ -0,0 +1,104 @@
+package metric
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestSketch_Quantile(t *testing.T) {
+	s := NewSketch()
+	for i := 1; i <= 10000; i++ {
+		s.Add(float64(i))
+	}
+	assert.Equal(t, int64(10000), s.Count())
+
+	for _, q := range []float64{0, 0.5, 0.9, 0.95, 0.99, 1} {
+		v, err := s.Quantile(q)
+		require.NoError(t, err)
+		exp := 1 + q*9999
+		assert.InEpsilon(t, exp, v, sketchAccuracy, "q=%v", q)
+	}
+
+	_, err := s.Quantile(1.5)
+	assert.EqualError(t, err, "quantile 1.5 out of [0, 1] range")
+	_, err = NewSketch().Quantile(0.5)
+	assert.EqualError(t, err, "empty sketch")
+}
+
+func TestSketch_NegativeAndZero(t *testing.T) {
+	s := NewSketch(-100, -10, 0, 0, 10, 100, math.NaN())
+	assert.Equal(t, int64(6), s.Count())
+
+	tbl := []struct {
+		q   float64
+		res float64
+	}{{0, -100}, {0.2, -10}, {0.4, 0}, {0.6, 0}, {0.8, 10}, {1, 100}}
+	for _, tt := range tbl {
+		v, err := s.Quantile(tt.q)
+		require.NoError(t, err)
+		if tt.res == 0 {
+			assert.Equal(t, 0.0, v, "q=%v", tt.q)
+			continue
+		}
+		assert.InEpsilon(t, tt.res, v, sketchAccuracy, "q=%v", tt.q)
+	}
+}
+
+func TestSketch_AddN(t *testing.T) {
+	s := NewSketch()
+	s.AddN(10, 90)
+	s.AddN(-5, 5)
+	s.AddN(0, 4)
+	s.AddN(100, 1)
+	s.AddN(7, 0)
+	s.AddN(math.NaN(), 3)
+	assert.Equal(t, int64(100), s.Count())
+	assert.Equal(t, NewSketch(-5, -5, -5, -5, -5, 0, 0, 0, 0, 100).Neg, s.Neg)
+
+	v, err := s.Quantile(0.5)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 10, v, sketchAccuracy)
+	v, err = s.Quantile(1)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 100, v, sketchAccuracy)
+}
+
+func TestSketch_Merge(t *testing.T) {
+	all, s1, s2 := NewSketch(), NewSketch(), NewSketch()
+	for i := 1; i <= 1000; i++ {
+		all.Add(float64(i) * 0.37)
+		if i%3 == 0 {
+			s1.Add(float64(i) * 0.37)
+			continue
+		}
+		s2.Add(float64(i) * 0.37)
+	}
+
+	merged := s1.Copy()
+	merged.Merge(s2)
+	merged.Merge(nil)
+	assert.Equal(t, all, merged, "merge is exact")
+	assert.Equal(t, int64(333), s1.Count(), "merged into a copy")
+
+	data, err := json.Marshal(merged)
+	require.NoError(t, err)
+	var restored Sketch
+	require.NoError(t, json.Unmarshal(data, &restored))
+	assert.Equal(t, *all, restored)
+}
+
+func TestSketch_MaxBins(t *testing.T) {
+	s := NewSketch()
+	for i := 0; i < 3*sketchMaxBins; i++ {
+		s.Add(math.Pow(sketchGamma, float64(i)))
+	}
+	assert.Equal(t, sketchMaxBins, len(s.Pos))
+	assert.Equal(t, int64(3*sketchMaxBins), s.Count())
+
+	v, err := s.Quantile(1)
+	require.NoError(t, err)
+	assert.InEpsilon(t, math.Pow(sketchGamma, float64(3*sketchMaxBins-1)), v, sketchAccuracy)
+}
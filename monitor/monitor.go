@@ -0,0 +1,340 @@
+// Package monitor keeps metrics of the service itself, like ingest rate and storage latencies, and exposes them
+// in Prometheus text exposition format. Metrics are registered once, usually as package level variables,
+// the same way expvar does
+package monitor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DurationBuckets are histogram upper bounds in seconds, from 100µs in-memory updates to 10s db queries
+var DurationBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 10}
+
+// Registry keeps the registered metrics by name
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]collector
+}
+
+// collector is a registered metric, writing its samples
+type collector interface {
+	kind() string
+	help() string
+	write(w io.Writer, name string)
+}
+
+// Default registry, used by package level functions
+var Default = NewRegistry()
+
+// NewRegistry makes an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]collector)}
+}
+
+// register adds the metric, panics if the name is already taken, as it is a programming error
+func (r *Registry) register(name string, c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[name]; ok {
+		panic(fmt.Sprintf("metric %s registered twice", name))
+	}
+	r.metrics[name] = c
+}
+
+// Write writes all metrics sorted by name in Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	metrics := make(map[string]collector, len(r.metrics))
+	for k, v := range r.metrics {
+		metrics[k] = v
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		c := metrics[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, EscapeHelp(c.help()), name, c.kind())
+		c.write(bw, name)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := r.Write(w); err != nil {
+			log.Printf("[WARN] can't write service metrics: %v", err)
+		}
+	})
+}
+
+// NewCounter registers counter in the default registry
+func NewCounter(name, help string) *Counter { return Default.NewCounter(name, help) }
+
+// NewCounterVec registers counter with a label in the default registry
+func NewCounterVec(name, help, label string) *CounterVec {
+	return Default.NewCounterVec(name, help, label)
+}
+
+// NewGauge registers gauge in the default registry
+func NewGauge(name, help string) *Gauge { return Default.NewGauge(name, help) }
+
+// NewHistogram registers histogram in the default registry
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+// NewHistogramVec registers histogram with a label in the default registry
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	return Default.NewHistogramVec(name, help, label, buckets)
+}
+
+// Handler serves the default registry metrics
+func Handler() http.Handler { return Default.Handler() }
+
+// NewCounter registers counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(name, &single{tp: "counter", hlp: help, m: c})
+	return c
+}
+
+// NewCounterVec registers counter with a label
+func (r *Registry) NewCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{vec: vec{label: label, metrics: map[string]sampler{}}}
+	r.register(name, &multi{tp: "counter", hlp: help, v: &c.vec})
+	return c
+}
+
+// NewGauge registers gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(name, &single{tp: "gauge", hlp: help, m: g})
+	return g
+}
+
+// NewHistogram registers histogram with the upper bounds of buckets, increasing
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(name, &single{tp: "histogram", hlp: help, m: h})
+	return h
+}
+
+// NewHistogramVec registers histogram with a label
+func (r *Registry) NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	h := &HistogramVec{vec: vec{label: label, metrics: map[string]sampler{}}, buckets: buckets}
+	r.register(name, &multi{tp: "histogram", hlp: help, v: &h.vec})
+	return h
+}
+
+// Counter is a monotonic counter, safe for concurrent use
+type Counter struct {
+	v uint64
+}
+
+// Inc increments the counter
+func (c *Counter) Inc() { atomic.AddUint64(&c.v, 1) }
+
+// Add adds n to the counter
+func (c *Counter) Add(n uint64) { atomic.AddUint64(&c.v, n) }
+
+// Value returns the current value
+func (c *Counter) Value() uint64 { return atomic.LoadUint64(&c.v) }
+
+func (c *Counter) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, wrapLabels(labels), c.Value())
+}
+
+// Gauge is a value going up and down, safe for concurrent use
+type Gauge struct {
+	bits uint64
+}
+
+// Set sets the value
+func (g *Gauge) Set(v float64) { atomic.StoreUint64(&g.bits, math.Float64bits(v)) }
+
+// Value returns the current value
+func (g *Gauge) Value() float64 { return math.Float64frombits(atomic.LoadUint64(&g.bits)) }
+
+func (g *Gauge) write(w io.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %s\n", name, wrapLabels(labels), FormatFloat(g.Value()))
+}
+
+// Histogram counts observations in buckets, safe for concurrent use
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // per bucket, the last one is +Inf
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets)+1)}
+}
+
+// Observe adds the value
+func (h *Histogram) Observe(v float64) {
+	idx := sort.SearchFloat64s(h.buckets, v) // the first bucket with upper bound >= v
+	h.mu.Lock()
+	h.counts[idx]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// Since observes the time passed since start, in seconds
+func (h *Histogram) Since(start time.Time) { h.Observe(time.Since(start).Seconds()) }
+
+// Count returns the number of observations
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func (h *Histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	var cumulative uint64
+	for i, c := range counts {
+		cumulative += c
+		le := "+Inf"
+		if i < len(h.buckets) {
+			le = FormatFloat(h.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(labels, `le="`+le+`"`)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, wrapLabels(labels), FormatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(labels), count)
+}
+
+// CounterVec is a set of counters by label value
+type CounterVec struct {
+	vec
+}
+
+// With returns counter of the label value, making it on the first use
+func (c *CounterVec) With(value string) *Counter {
+	return c.get(value, func() sampler { return &Counter{} }).(*Counter)
+}
+
+// HistogramVec is a set of histograms by label value
+type HistogramVec struct {
+	vec
+	buckets []float64
+}
+
+// With returns histogram of the label value, making it on the first use
+func (h *HistogramVec) With(value string) *Histogram {
+	return h.get(value, func() sampler { return newHistogram(h.buckets) }).(*Histogram)
+}
+
+// sampler writes samples of a metric with the given labels
+type sampler interface {
+	write(w io.Writer, name, labels string)
+}
+
+// vec keeps metrics by label value
+type vec struct {
+	label   string
+	mu      sync.Mutex
+	metrics map[string]sampler
+}
+
+func (v *vec) get(value string, makeFn func() sampler) sampler {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	m, ok := v.metrics[value]
+	if !ok {
+		m = makeFn()
+		v.metrics[value] = m
+	}
+	return m
+}
+
+func (v *vec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.metrics))
+	for value := range v.metrics {
+		values = append(values, value)
+	}
+	metrics := make(map[string]sampler, len(v.metrics))
+	for k, m := range v.metrics {
+		metrics[k] = m
+	}
+	v.mu.Unlock()
+
+	sort.Strings(values)
+	for _, value := range values {
+		metrics[value].write(w, name, v.label+`="`+EscapeLabelValue(value)+`"`)
+	}
+}
+
+// single is a registered metric without labels
+type single struct {
+	tp, hlp string
+	m       sampler
+}
+
+func (s *single) kind() string                   { return s.tp }
+func (s *single) help() string                   { return s.hlp }
+func (s *single) write(w io.Writer, name string) { s.m.write(w, name, "") }
+
+// multi is a registered metric with a label
+type multi struct {
+	tp, hlp string
+	v       *vec
+}
+
+func (m *multi) kind() string                   { return m.tp }
+func (m *multi) help() string                   { return m.hlp }
+func (m *multi) write(w io.Writer, name string) { m.v.write(w, name) }
+
+func joinLabels(labels, other string) string {
+	if labels == "" {
+		return other
+	}
+	return labels + "," + other
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// FormatFloat formats value the way Prometheus does, with +Inf, -Inf and NaN
+func FormatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// EscapeHelp escapes backslash and line feed of HELP text
+func EscapeHelp(s string) string { return helpReplacer.Replace(s) }
+
+// EscapeLabelValue escapes backslash, line feed and double quote of label value
+func EscapeLabelValue(s string) string { return labelValueReplacer.Replace(s) }
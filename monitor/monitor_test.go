@@ -0,0 +1,151 @@
+package monitor
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry()
+	ingested := r.NewCounter("ingested_total", "samples ingested")
+	throttled := r.NewCounterVec("throttled_total", "throttled requests", "route")
+	staging := r.NewGauge("staging_series", "series in staging")
+	cleanup := r.NewHistogram("cleanup_seconds", "cleanup duration", []float64{0.1, 1})
+	query := r.NewHistogramVec("query_seconds", "query duration", "strategy", []float64{1})
+
+	var buf bytes.Buffer
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP cleanup_seconds cleanup duration
+# TYPE cleanup_seconds histogram
+cleanup_seconds_bucket{le="0.1"} 0
+cleanup_seconds_bucket{le="1"} 0
+cleanup_seconds_bucket{le="+Inf"} 0
+cleanup_seconds_sum 0
+cleanup_seconds_count 0
+# HELP ingested_total samples ingested
+# TYPE ingested_total counter
+ingested_total 0
+# HELP query_seconds query duration
+# TYPE query_seconds histogram
+# HELP staging_series series in staging
+# TYPE staging_series gauge
+staging_series 0
+# HELP throttled_total throttled requests
+# TYPE throttled_total counter
+`, buf.String())
+
+	ingested.Inc()
+	ingested.Add(2)
+	throttled.With("POST /metric").Inc()
+	throttled.With(`a"b`).Add(3)
+	staging.Set(1.5)
+	cleanup.Observe(0.05)
+	cleanup.Observe(0.1)
+	cleanup.Observe(5)
+	query.With("exact").Observe(0.5)
+	query.With("approximate").Observe(2)
+
+	buf.Reset()
+	require.NoError(t, r.Write(&buf))
+	assert.Equal(t, `# HELP cleanup_seconds cleanup duration
+# TYPE cleanup_seconds histogram
+cleanup_seconds_bucket{le="0.1"} 2
+cleanup_seconds_bucket{le="1"} 2
+cleanup_seconds_bucket{le="+Inf"} 3
+cleanup_seconds_sum 5.15
+cleanup_seconds_count 3
+# HELP ingested_total samples ingested
+# TYPE ingested_total counter
+ingested_total 3
+# HELP query_seconds query duration
+# TYPE query_seconds histogram
+query_seconds_bucket{strategy="approximate",le="1"} 0
+query_seconds_bucket{strategy="approximate",le="+Inf"} 1
+query_seconds_sum{strategy="approximate"} 2
+query_seconds_count{strategy="approximate"} 1
+query_seconds_bucket{strategy="exact",le="1"} 1
+query_seconds_bucket{strategy="exact",le="+Inf"} 1
+query_seconds_sum{strategy="exact"} 0.5
+query_seconds_count{strategy="exact"} 1
+# HELP staging_series series in staging
+# TYPE staging_series gauge
+staging_series 1.5
+# HELP throttled_total throttled requests
+# TYPE throttled_total counter
+throttled_total{route="POST /metric"} 1
+throttled_total{route="a\"b"} 3
+`, buf.String())
+
+	assert.Equal(t, uint64(3), ingested.Value())
+	assert.Equal(t, 1.5, staging.Value())
+	assert.Equal(t, uint64(3), cleanup.Count())
+	assert.Same(t, query.With("exact"), query.With("exact"))
+}
+
+func TestRegistry_RegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("ingested_total", "samples ingested")
+	assert.PanicsWithValue(t, "metric ingested_total registered twice", func() { r.NewGauge("ingested_total", "blah") })
+}
+
+func TestRegistry_Concurrent(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "requests", "route")
+	h := r.NewHistogram("latency_seconds", "latency", DurationBuckets)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				start := time.Now()
+				c.With("/metric").Inc()
+				h.Since(start)
+				require.NoError(t, r.Write(io.Discard))
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(1000), c.With("/metric").Value())
+	assert.Equal(t, uint64(1000), h.Count())
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("ingested_total", "samples ingested").Inc()
+
+	ts := httptest.NewServer(r.Handler())
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "# HELP ingested_total samples ingested\n# TYPE ingested_total counter\ningested_total 1\n", string(body))
+}
+
+func TestFormatFloat(t *testing.T) {
+	assert.Equal(t, "+Inf", FormatFloat(math.Inf(1)))
+	assert.Equal(t, "-Inf", FormatFloat(math.Inf(-1)))
+	assert.Equal(t, "NaN", FormatFloat(math.NaN()))
+	assert.Equal(t, "0.005", FormatFloat(0.005))
+	assert.Equal(t, "-2", FormatFloat(-2))
+	assert.Equal(t, "1e+21", FormatFloat(1e21))
+}
+
+func TestEscape(t *testing.T) {
+	assert.Equal(t, `a\\b\n"c"`, EscapeHelp("a\\b\n\"c\""))
+	assert.Equal(t, `a\\b\n\"c\"`, EscapeLabelValue("a\\b\n\"c\""))
+}
@@ -26,7 +26,10 @@ var _ Accessor = &AccessorMock{}
 // 			FindAllFunc: func(ctx context.Context, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
 // 				panic("mock out the FindAll method")
 // 			},
-// 			FindOneMetricFunc: func(ctx context.Context, name string, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+// 			FindLatestFunc: func(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+// 				panic("mock out the FindLatest method")
+// 			},
+// 			FindOneMetricFunc: func(ctx context.Context, name string, matchers []metric.Matcher, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
 // 				panic("mock out the FindOneMetric method")
 // 			},
 // 			GetMetricsListFunc: func(ctx context.Context) ([]string, error) {
@@ -35,6 +38,9 @@ var _ Accessor = &AccessorMock{}
 // 			WriteFunc: func(ctx context.Context, m metric.Entry) error {
 // 				panic("mock out the Write method")
 // 			},
+// 			WriteManyFunc: func(ctx context.Context, entries []metric.Entry) error {
+// 				panic("mock out the WriteMany method")
+// 			},
 // 		}
 //
 // 		// use mockedAccessor in code that requires Accessor
@@ -48,8 +54,11 @@ type AccessorMock struct {
 	// FindAllFunc mocks the FindAll method.
 	FindAllFunc func(ctx context.Context, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error)
 
+	// FindLatestFunc mocks the FindLatest method.
+	FindLatestFunc func(ctx context.Context, from time.Time) ([]metric.Entry, error)
+
 	// FindOneMetricFunc mocks the FindOneMetric method.
-	FindOneMetricFunc func(ctx context.Context, name string, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error)
+	FindOneMetricFunc func(ctx context.Context, name string, matchers []metric.Matcher, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error)
 
 	// GetMetricsListFunc mocks the GetMetricsList method.
 	GetMetricsListFunc func(ctx context.Context) ([]string, error)
@@ -57,6 +66,9 @@ type AccessorMock struct {
 	// WriteFunc mocks the Write method.
 	WriteFunc func(ctx context.Context, m metric.Entry) error
 
+	// WriteManyFunc mocks the WriteMany method.
+	WriteManyFunc func(ctx context.Context, entries []metric.Entry) error
+
 	// calls tracks calls to the methods.
 	calls struct {
 		// Delete holds details about calls to the Delete method.
@@ -77,12 +89,21 @@ type AccessorMock struct {
 			// Interval is the interval argument value.
 			Interval time.Duration
 		}
+		// FindLatest holds details about calls to the FindLatest method.
+		FindLatest []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// From is the from argument value.
+			From time.Time
+		}
 		// FindOneMetric holds details about calls to the FindOneMetric method.
 		FindOneMetric []struct {
 			// Ctx is the ctx argument value.
 			Ctx context.Context
 			// Name is the name argument value.
 			Name string
+			// Matchers is the matchers argument value.
+			Matchers []metric.Matcher
 			// From is the from argument value.
 			From time.Time
 			// To is the to argument value.
@@ -102,12 +123,21 @@ type AccessorMock struct {
 			// M is the m argument value.
 			M metric.Entry
 		}
+		// WriteMany holds details about calls to the WriteMany method.
+		WriteMany []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Entries is the entries argument value.
+			Entries []metric.Entry
+		}
 	}
 	lockDelete         sync.RWMutex
 	lockFindAll        sync.RWMutex
+	lockFindLatest     sync.RWMutex
 	lockFindOneMetric  sync.RWMutex
 	lockGetMetricsList sync.RWMutex
 	lockWrite          sync.RWMutex
+	lockWriteMany      sync.RWMutex
 }
 
 // Delete calls DeleteFunc.
@@ -130,7 +160,8 @@ func (mock *AccessorMock) Delete(ctx context.Context, m metric.Entry) error {
 
 // DeleteCalls gets all the calls that were made to Delete.
 // Check the length with:
-//     len(mockedAccessor.DeleteCalls())
+//
+// 	len(mockedAccessor.DeleteCalls())
 func (mock *AccessorMock) DeleteCalls() []struct {
 	Ctx context.Context
 	M   metric.Entry
@@ -169,7 +200,8 @@ func (mock *AccessorMock) FindAll(ctx context.Context, from time.Time, to time.T
 
 // FindAllCalls gets all the calls that were made to FindAll.
 // Check the length with:
-//     len(mockedAccessor.FindAllCalls())
+//
+// 	len(mockedAccessor.FindAllCalls())
 func (mock *AccessorMock) FindAllCalls() []struct {
 	Ctx      context.Context
 	From     time.Time
@@ -188,20 +220,58 @@ func (mock *AccessorMock) FindAllCalls() []struct {
 	return calls
 }
 
+// FindLatest calls FindLatestFunc.
+func (mock *AccessorMock) FindLatest(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+	if mock.FindLatestFunc == nil {
+		panic("AccessorMock.FindLatestFunc: method is nil but Accessor.FindLatest was just called")
+	}
+	callInfo := struct {
+		Ctx  context.Context
+		From time.Time
+	}{
+		Ctx:  ctx,
+		From: from,
+	}
+	mock.lockFindLatest.Lock()
+	mock.calls.FindLatest = append(mock.calls.FindLatest, callInfo)
+	mock.lockFindLatest.Unlock()
+	return mock.FindLatestFunc(ctx, from)
+}
+
+// FindLatestCalls gets all the calls that were made to FindLatest.
+// Check the length with:
+//
+// 	len(mockedAccessor.FindLatestCalls())
+func (mock *AccessorMock) FindLatestCalls() []struct {
+	Ctx  context.Context
+	From time.Time
+} {
+	var calls []struct {
+		Ctx  context.Context
+		From time.Time
+	}
+	mock.lockFindLatest.RLock()
+	calls = mock.calls.FindLatest
+	mock.lockFindLatest.RUnlock()
+	return calls
+}
+
 // FindOneMetric calls FindOneMetricFunc.
-func (mock *AccessorMock) FindOneMetric(ctx context.Context, name string, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+func (mock *AccessorMock) FindOneMetric(ctx context.Context, name string, matchers []metric.Matcher, from time.Time, to time.Time, interval time.Duration) ([]metric.Entry, error) {
 	if mock.FindOneMetricFunc == nil {
 		panic("AccessorMock.FindOneMetricFunc: method is nil but Accessor.FindOneMetric was just called")
 	}
 	callInfo := struct {
 		Ctx      context.Context
 		Name     string
+		Matchers []metric.Matcher
 		From     time.Time
 		To       time.Time
 		Interval time.Duration
 	}{
 		Ctx:      ctx,
 		Name:     name,
+		Matchers: matchers,
 		From:     from,
 		To:       to,
 		Interval: interval,
@@ -209,15 +279,17 @@ func (mock *AccessorMock) FindOneMetric(ctx context.Context, name string, from t
 	mock.lockFindOneMetric.Lock()
 	mock.calls.FindOneMetric = append(mock.calls.FindOneMetric, callInfo)
 	mock.lockFindOneMetric.Unlock()
-	return mock.FindOneMetricFunc(ctx, name, from, to, interval)
+	return mock.FindOneMetricFunc(ctx, name, matchers, from, to, interval)
 }
 
 // FindOneMetricCalls gets all the calls that were made to FindOneMetric.
 // Check the length with:
-//     len(mockedAccessor.FindOneMetricCalls())
+//
+// 	len(mockedAccessor.FindOneMetricCalls())
 func (mock *AccessorMock) FindOneMetricCalls() []struct {
 	Ctx      context.Context
 	Name     string
+	Matchers []metric.Matcher
 	From     time.Time
 	To       time.Time
 	Interval time.Duration
@@ -225,6 +297,7 @@ func (mock *AccessorMock) FindOneMetricCalls() []struct {
 	var calls []struct {
 		Ctx      context.Context
 		Name     string
+		Matchers []metric.Matcher
 		From     time.Time
 		To       time.Time
 		Interval time.Duration
@@ -253,7 +326,8 @@ func (mock *AccessorMock) GetMetricsList(ctx context.Context) ([]string, error)
 
 // GetMetricsListCalls gets all the calls that were made to GetMetricsList.
 // Check the length with:
-//     len(mockedAccessor.GetMetricsListCalls())
+//
+// 	len(mockedAccessor.GetMetricsListCalls())
 func (mock *AccessorMock) GetMetricsListCalls() []struct {
 	Ctx context.Context
 } {
@@ -286,7 +360,8 @@ func (mock *AccessorMock) Write(ctx context.Context, m metric.Entry) error {
 
 // WriteCalls gets all the calls that were made to Write.
 // Check the length with:
-//     len(mockedAccessor.WriteCalls())
+//
+// 	len(mockedAccessor.WriteCalls())
 func (mock *AccessorMock) WriteCalls() []struct {
 	Ctx context.Context
 	M   metric.Entry
@@ -300,3 +375,39 @@ func (mock *AccessorMock) WriteCalls() []struct {
 	mock.lockWrite.RUnlock()
 	return calls
 }
+
+// WriteMany calls WriteManyFunc.
+func (mock *AccessorMock) WriteMany(ctx context.Context, entries []metric.Entry) error {
+	if mock.WriteManyFunc == nil {
+		panic("AccessorMock.WriteManyFunc: method is nil but Accessor.WriteMany was just called")
+	}
+	callInfo := struct {
+		Ctx     context.Context
+		Entries []metric.Entry
+	}{
+		Ctx:     ctx,
+		Entries: entries,
+	}
+	mock.lockWriteMany.Lock()
+	mock.calls.WriteMany = append(mock.calls.WriteMany, callInfo)
+	mock.lockWriteMany.Unlock()
+	return mock.WriteManyFunc(ctx, entries)
+}
+
+// WriteManyCalls gets all the calls that were made to WriteMany.
+// Check the length with:
+//
+// 	len(mockedAccessor.WriteManyCalls())
+func (mock *AccessorMock) WriteManyCalls() []struct {
+	Ctx     context.Context
+	Entries []metric.Entry
+} {
+	var calls []struct {
+		Ctx     context.Context
+		Entries []metric.Entry
+	}
+	mock.lockWriteMany.RLock()
+	calls = mock.calls.WriteMany
+	mock.lockWriteMany.RUnlock()
+	return calls
+}
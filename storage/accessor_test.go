@@ -0,0 +1,551 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"sort"
+	"testing"
+	"time"
+)
+
+// accessorFactory makes an empty accessor for a single check, along with the function
+// inserting pre-aggregated entries as is, the way re-aggregation does
+type accessorFactory func(t *testing.T) (acc Accessor, insert func(entries ...metric.Entry))
+
+// typedRollupStore is RollupStore with lookups by type, implemented by all accessors
+type typedRollupStore interface {
+	RollupStore
+	FindByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) ([]metric.Entry, error)
+}
+
+// testAccessorBehaviour runs the same behavioural checks against any Accessor implementation
+func testAccessorBehaviour(t *testing.T, newAccessor accessorFactory) {
+	from, to := time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC), time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC)
+	oneMinEntries := []metric.Entry{
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 9},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 12, 23, 0, time.UTC), Value: 11},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 17, 23, 0, time.UTC), Value: 11},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 20, 23, 0, time.UTC), Value: 11},
+		{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 20, 23, 0, time.UTC), Value: 11},
+		{Name: "file_3", TimeStamp: time.Date(2022, 11, 11, 2, 26, 23, 0, time.UTC), Value: 1},
+	}
+	aggregated := func(name string, tp time.Duration, values ...float64) []metric.Entry {
+		var res []metric.Entry
+		for i, v := range values {
+			res = append(res, metric.Entry{Name: name, TimeStamp: from.Add(time.Duration(i+1) * tp), Value: v,
+				Type: tp, TypeStr: tp.String()})
+		}
+		return res
+	}
+	total := func(entries []metric.Entry) (res float64) {
+		for _, e := range entries {
+			res += e.Value
+		}
+		return res
+	}
+	writeMany := func(t *testing.T, acc Accessor, entries ...metric.Entry) {
+		for _, e := range entries {
+			require.NoError(t, acc.Write(context.Background(), e))
+		}
+	}
+
+	t.Run("write", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		writeMany(t, acc,
+			metric.Entry{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 55, 0, time.UTC), Value: 5},
+			metric.Entry{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 9})
+
+		res, err := acc.FindAll(context.Background(), from, to, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res))
+		assert.Equal(t, 14.0, total(res))
+		for _, r := range res {
+			assert.Equal(t, time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC), r.TimeStamp.UTC())
+			assert.Equal(t, time.Minute, r.Type)
+			assert.Equal(t, "1m", r.TypeStr)
+		}
+	})
+
+	t.Run("write merges minute", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		tm := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+		labels := func(kv ...string) map[string]string {
+			res := map[string]string{}
+			for i := 0; i < len(kv); i += 2 {
+				res[kv[i]] = kv[i+1]
+			}
+			return res
+		}
+		insert(metric.Entry{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC), Value: 100,
+			Type: 5 * time.Minute, TypeStr: "5m0s"}) // other type, not merged
+		writeMany(t, acc,
+			metric.Entry{Name: "file_1", TimeStamp: tm, Value: 5},
+			metric.Entry{Name: "file_1", Labels: labels("host", "h1"), TimeStamp: tm, Value: 1},
+			metric.Entry{Name: "file_1", Labels: labels("host", "h1", "region", "eu"), TimeStamp: tm, Value: 2},
+			metric.Entry{Name: "file_1", TimeStamp: tm.Add(-10 * time.Second), Value: 4},
+			metric.Entry{Name: "file_1", Labels: labels("region", "eu", "host", "h1"), TimeStamp: tm, Value: 3},
+			metric.Entry{Name: "cpu", Kind: metric.KindGauge, TimeStamp: tm, Value: 10},
+			metric.Entry{Name: "cpu", Kind: metric.KindGauge, TimeStamp: tm.Add(-time.Second), Value: 20},
+		)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(res))
+		values := map[string]metric.Entry{}
+		for _, r := range res {
+			values[r.SeriesKey()] = r
+		}
+		assert.Equal(t, 9.0, values["file_1"].Value)
+		assert.Equal(t, &metric.Stats{Count: 2, Sum: 9, Min: 4, Max: 5, Last: 4}, values["file_1"].Stats)
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC), values["file_1"].TimeStamp.UTC())
+		assert.Equal(t, 1.0, values[`file_1{host="h1"}`].Value)
+		assert.Equal(t, 5.0, values[`file_1{host="h1",region="eu"}`].Value)
+
+		res, err = acc.FindOneMetric(context.Background(), "cpu", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(res))
+		assert.Equal(t, 20.0, res[0].Value, "the last written value")
+		assert.Equal(t, int64(2), res[0].GetStats().Count)
+	})
+
+	t.Run("write many", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		tm := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+		require.NoError(t, acc.WriteMany(context.Background(), nil))
+		writeMany(t, acc, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 5}) // stored bucket
+		require.NoError(t, acc.WriteMany(context.Background(), []metric.Entry{
+			{Name: "file_1", Labels: map[string]string{"host": "h1"}, TimeStamp: tm, Value: 1},
+			{Name: "file_1", TimeStamp: tm.Add(-10 * time.Second), Value: 4},
+			{Name: "file_1", Labels: map[string]string{"host": "h1"}, TimeStamp: tm.Add(time.Second), Value: 2},
+			{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 8},
+			{Name: "cpu", Kind: metric.KindGauge, TimeStamp: tm, Value: 10},
+			{Name: "cpu", Kind: metric.KindGauge, TimeStamp: tm.Add(-time.Second), Value: 20},
+		}))
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(res))
+		sort.Slice(res, func(i, j int) bool {
+			if !res[i].TimeStamp.Equal(res[j].TimeStamp) {
+				return res[i].TimeStamp.Before(res[j].TimeStamp)
+			}
+			return res[i].SeriesKey() < res[j].SeriesKey()
+		})
+		assert.Equal(t, "file_1", res[0].SeriesKey())
+		assert.Equal(t, 9.0, res[0].Value, "merged into the stored bucket")
+		assert.Equal(t, &metric.Stats{Count: 2, Sum: 9, Min: 4, Max: 5, Last: 4}, res[0].Stats)
+		assert.Equal(t, `file_1{host="h1"}`, res[1].SeriesKey())
+		assert.Equal(t, 3.0, res[1].Value, "merged within the batch")
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC), res[1].TimeStamp.UTC())
+		assert.Equal(t, 8.0, res[2].Value)
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 12, 0, 0, time.UTC), res[2].TimeStamp.UTC())
+
+		res, err = acc.FindOneMetric(context.Background(), "cpu", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(res))
+		assert.Equal(t, 20.0, res[0].Value, "the last written value")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		writeMany(t, acc, oneMinEntries...)
+
+		require.NoError(t, acc.Delete(context.Background(), metric.Entry{Name: "file_1"}))
+		list, err := acc.GetMetricsList(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"file_2", "file_3"}, list)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	})
+
+	t.Run("metrics list", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		list, err := acc.GetMetricsList(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(list))
+
+		writeMany(t, acc, oneMinEntries...)
+		list, err = acc.GetMetricsList(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"file_1", "file_2", "file_3"}, list)
+	})
+
+	t.Run("everything is matching", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		writeMany(t, acc, oneMinEntries...)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 5, len(res))
+		assert.Equal(t, 47.0, total(res))
+
+		res, err = acc.FindOneMetric(context.Background(), "file_1", nil, from.AddDate(0, 1, 0), to.AddDate(0, 1, 0), time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	})
+
+	t.Run("aggregate smaller interval", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		writeMany(t, acc, oneMinEntries...)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 3, len(res))
+		assert.Equal(t, 47.0, total(res))
+		for _, r := range res {
+			assert.Equal(t, 5*time.Minute, r.Type)
+			assert.Equal(t, "5m0s", r.TypeStr)
+		}
+	})
+
+	t.Run("aggregate largest dividing interval", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		insert(aggregated("file_1", 3*time.Minute, 14, 22, 11)...)
+		writeMany(t, acc, metric.Entry{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 20, 23, 0, time.UTC), Value: 11})
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, 15*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 1, len(res))
+		assert.Equal(t, 47.0, total(res))
+	})
+
+	t.Run("no interval with zero remainder", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		insert(aggregated("file_1", 3*time.Minute, 14, 22, 11)...)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	})
+
+	t.Run("approximate interval", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		insert(aggregated("file_1", 5*time.Minute, 25, 11, 11)...)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, 6*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 3, len(res))
+		assert.Equal(t, 47.0, total(res))
+	})
+
+	t.Run("cannot approximate", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		insert(aggregated("file_1", 5*time.Minute, 25, 11, 11)...)
+
+		res, err := acc.FindOneMetric(context.Background(), "file_1", nil, from, to, 2*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	})
+
+	t.Run("label matchers", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		writeMany(t, acc,
+			metric.Entry{Name: "api_errors", Labels: map[string]string{"host": "h1", "region": "eu"},
+				TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 1},
+			metric.Entry{Name: "api_errors", Labels: map[string]string{"host": "h2", "region": "eu"},
+				TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 2},
+			metric.Entry{Name: "api_errors", Labels: map[string]string{"host": "h3", "region": "us"},
+				TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 4},
+			metric.Entry{Name: "api_errors", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 8},
+		)
+
+		tbl := []struct {
+			matchers []metric.Matcher
+			interval time.Duration
+			count    int
+			total    float64
+		}{
+			{nil, time.Minute, 4, 15},
+			{[]metric.Matcher{{Label: "host", Type: metric.MatchEqual, Value: "h1"}}, time.Minute, 1, 1},
+			{[]metric.Matcher{{Label: "region", Type: metric.MatchNotEqual, Value: "eu"}}, time.Minute, 2, 12},
+			{[]metric.Matcher{{Label: "host", Type: metric.MatchRegexp, Value: "h[12]"}}, time.Minute, 2, 3},
+			{[]metric.Matcher{{Label: "region", Type: metric.MatchEqual, Value: ""}}, time.Minute, 1, 8},
+			{[]metric.Matcher{{Label: "host", Type: metric.MatchRegexp, Value: "h1|"}}, time.Minute, 2, 9},
+			{[]metric.Matcher{{Label: "region", Type: metric.MatchEqual, Value: "eu"},
+				{Label: "host", Type: metric.MatchNotEqual, Value: "h2"}}, time.Minute, 1, 1},
+			{[]metric.Matcher{{Label: "region", Type: metric.MatchEqual, Value: "eu"}}, 5 * time.Minute, 2, 3}, // series kept apart
+		}
+
+		for i, tt := range tbl {
+			for j := range tt.matchers {
+				require.NoError(t, tt.matchers[j].Validate())
+			}
+			res, err := acc.FindOneMetric(context.Background(), "api_errors", tt.matchers, from, to, tt.interval)
+			require.NoError(t, err)
+			assert.Equal(t, tt.count, len(res), "case #%d", i)
+			assert.Equal(t, tt.total, total(res), "case #%d", i)
+		}
+	})
+
+	t.Run("gauge", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		writeMany(t, acc,
+			metric.Entry{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 12, 23, 0, time.UTC), Value: 30.5},
+			metric.Entry{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 10},
+			metric.Entry{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 70.5},
+			metric.Entry{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 16, 23, 0, time.UTC), Value: 1.25},
+		)
+
+		res, err := acc.FindOneMetric(context.Background(), "cpu", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res))
+		sort.Slice(res, func(i, j int) bool { return res[i].TimeStamp.Before(res[j].TimeStamp) })
+		assert.Equal(t, 30.5, res[0].Value)
+		assert.Equal(t, 1.25, res[1].Value)
+		assert.Equal(t, metric.KindGauge, res[0].Kind)
+	})
+
+	t.Run("gauge modes and kinds", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		tm := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+		writeMany(t, acc,
+			metric.Entry{Name: "queue", Kind: metric.KindGauge, GaugeMode: metric.GaugeAvg, TimeStamp: tm, Value: 10},
+			metric.Entry{Name: "queue", Kind: metric.KindGauge, GaugeMode: metric.GaugeAvg, TimeStamp: tm.Add(time.Minute), Value: 20},
+			metric.Entry{Name: "queue", Kind: metric.KindGauge, GaugeMode: metric.GaugeAvg, TimeStamp: tm.Add(time.Minute), Value: 60},
+			metric.Entry{Name: "queue", TimeStamp: tm.Add(time.Minute), Value: 1}, // another kind
+			metric.Entry{Name: "queue", TimeStamp: tm.Add(time.Minute), Value: 2},
+		)
+
+		res, err := acc.FindOneMetric(context.Background(), "queue", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(res), "buckets of different kinds kept apart")
+		sort.Slice(res, func(i, j int) bool {
+			return res[i].TimeStamp.Before(res[j].TimeStamp) ||
+				res[i].TimeStamp.Equal(res[j].TimeStamp) && res[i].Kind < res[j].Kind
+		})
+		assert.Equal(t, 10.0, res[0].Value)
+		assert.Equal(t, 3.0, res[1].Value)
+		assert.Equal(t, "", res[1].Kind)
+		assert.Equal(t, 40.0, res[2].Value)
+
+		res, err = acc.FindOneMetric(context.Background(), "queue", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res))
+		sort.Slice(res, func(i, j int) bool { return res[i].Kind < res[j].Kind })
+		assert.Equal(t, 3.0, res[0].Value)
+		assert.InDelta(t, 30.0, res[1].Value, 1e-9, "average of all the samples")
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		insert(
+			metric.Entry{Name: "latency", TimeStamp: from.Add(5 * time.Minute), Value: 30, Type: 5 * time.Minute, TypeStr: "5m0s",
+				Stats: &metric.Stats{Count: 3, Sum: 30, Min: 2, Max: 20, Last: 8}},
+			metric.Entry{Name: "latency", TimeStamp: from.Add(10 * time.Minute), Value: 12, Type: 5 * time.Minute, TypeStr: "5m0s",
+				Stats: &metric.Stats{Count: 2, Sum: 12, Min: 1, Max: 11, Last: 11}},
+			metric.Entry{Name: "latency", TimeStamp: from.Add(15 * time.Minute), Value: 40, Type: 5 * time.Minute, TypeStr: "5m0s"},
+		)
+
+		res, err := acc.FindOneMetric(context.Background(), "latency", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(res))
+		sort.Slice(res, func(i, j int) bool { return res[i].TimeStamp.Before(res[j].TimeStamp) })
+		assert.Equal(t, &metric.Stats{Count: 3, Sum: 30, Min: 2, Max: 20, Last: 8}, res[0].Stats)
+		assert.Nil(t, res[2].Stats)
+
+		res, err = acc.FindOneMetric(context.Background(), "latency", nil, from, to, 15*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(res))
+		assert.Equal(t, 82.0, res[0].Value)
+		assert.Equal(t, &metric.Stats{Count: 6, Sum: 82, Min: 1, Max: 40, Last: 40}, res[0].Stats)
+	})
+
+	t.Run("quantiles", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		sketch := func(from, to int) *metric.Sketch {
+			res := metric.NewSketch()
+			for i := from; i <= to; i++ {
+				res.Add(float64(i))
+			}
+			return res
+		}
+		insert(
+			metric.Entry{Name: "latency", TimeStamp: from.Add(5 * time.Minute), Value: 5050, Type: 5 * time.Minute, TypeStr: "5m0s",
+				Sketch: sketch(1, 100)},
+			metric.Entry{Name: "latency", TimeStamp: from.Add(10 * time.Minute), Value: 15050, Type: 5 * time.Minute, TypeStr: "5m0s",
+				Sketch: sketch(101, 200)},
+			metric.Entry{Name: "latency", TimeStamp: from.Add(15 * time.Minute), Value: 1000, Type: 5 * time.Minute, TypeStr: "5m0s"},
+		)
+
+		res, err := acc.FindOneMetric(context.Background(), "latency", nil, from, to, 15*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(res))
+		require.NotNil(t, res[0].Sketch)
+		assert.Equal(t, int64(201), res[0].Sketch.Count())
+		p50, err := res[0].Sketch.Quantile(0.5)
+		require.NoError(t, err)
+		assert.InEpsilon(t, 101, p50, 0.01)
+		p100, err := res[0].Sketch.Quantile(1)
+		require.NoError(t, err)
+		assert.InEpsilon(t, 1000, p100, 0.01)
+	})
+
+	t.Run("histogram", func(t *testing.T) {
+		acc, _ := newAccessor(t)
+		bounds := []float64{0.1, 0.5, 1}
+		hist := func(tm time.Time, v float64) metric.Entry {
+			return metric.Entry{Name: "latency", Kind: metric.KindHistogram, TimeStamp: tm, Value: v, Buckets: bounds,
+				BucketCounts: metric.Entry{Value: v, Buckets: bounds}.GetBucketCounts()}
+		}
+		writeMany(t, acc,
+			hist(time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), 0.05),
+			hist(time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), 0.3),
+			hist(time.Date(2022, 10, 11, 2, 12, 23, 0, time.UTC), 0.4),
+			hist(time.Date(2022, 10, 11, 2, 13, 23, 0, time.UTC), 7),
+		)
+
+		res, err := acc.FindOneMetric(context.Background(), "latency", nil, from, to, 15*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 1, len(res))
+		assert.Equal(t, metric.KindHistogram, res[0].Kind)
+		assert.Equal(t, bounds, res[0].Buckets)
+		assert.Equal(t, []int64{1, 2, 0, 1}, res[0].BucketCounts)
+		assert.InDelta(t, 7.75, res[0].Value, 1e-9)
+	})
+
+	t.Run("find latest", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		res, err := acc.FindLatest(context.Background(), time.Time{})
+		require.NoError(t, err)
+		assert.Empty(t, res)
+
+		writeMany(t, acc, oneMinEntries...)
+		writeMany(t, acc,
+			metric.Entry{Name: "api_errors", Labels: map[string]string{"host": "h1", "region": "eu"}, Value: 1,
+				TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)},
+			metric.Entry{Name: "api_errors", Labels: map[string]string{"region": "eu", "host": "h1"}, Value: 2,
+				TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC)},
+			metric.Entry{Name: "api_errors", Labels: map[string]string{"host": "h2"}, Value: 3,
+				TimeStamp: time.Date(2022, 10, 11, 2, 9, 23, 0, time.UTC)})
+		insert(aggregated("file_2", 30*time.Minute, 7)...) // 02:30, after the 1m entry
+
+		res, err = acc.FindLatest(context.Background(), time.Time{})
+		require.NoError(t, err)
+		require.Equal(t, 5, len(res))
+		keys := make([]string, len(res))
+		for i, r := range res {
+			keys[i] = r.SeriesKey()
+		}
+		assert.Equal(t, []string{`api_errors{host="h1",region="eu"}`, `api_errors{host="h2"}`, "file_1", "file_2", "file_3"}, keys)
+		assert.Equal(t, 2.0, res[0].Value)
+		assert.Equal(t, 3.0, res[1].Value)
+		assert.Equal(t, 11.0, res[2].Value)
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 21, 0, 0, time.UTC), res[2].TimeStamp.UTC())
+		assert.Equal(t, 7.0, res[3].Value)
+		assert.Equal(t, 30*time.Minute, res[3].Type)
+		assert.Equal(t, 1.0, res[4].Value)
+
+		// series without entries after the time are not reported
+		res, err = acc.FindLatest(context.Background(), time.Date(2022, 10, 11, 2, 25, 0, 0, time.UTC))
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res))
+		assert.Equal(t, "file_2", res[0].Name)
+		assert.Equal(t, 7.0, res[0].Value)
+		assert.Equal(t, "file_3", res[1].Name)
+	})
+
+	t.Run("find all", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		writeMany(t, acc, oneMinEntries...)
+		insert(aggregated("file_4", 4*time.Minute, 1, 2)...)
+
+		res, err := acc.FindAll(context.Background(), from, to, 5*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 6, len(res)) // 3 aggregated file_1, 1 aggregated file_2, 2 approximated file_4
+		assert.Equal(t, 61.0, total(res))
+
+		res, err = acc.FindAll(context.Background(), from, to, 2*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 5, len(res)) // file_4 can't be approximated
+		assert.Equal(t, 58.0, total(res))
+
+		res, err = acc.FindAll(context.Background(), from.AddDate(1, 0, 0), to.AddDate(1, 0, 0), 5*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	})
+
+	t.Run("rollup by names", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		store, ok := acc.(typedRollupStore)
+		require.True(t, ok)
+		ctx := context.Background()
+		writeMany(t, acc, oneMinEntries...)
+		insert(aggregated("file_1", 30*time.Minute, 7)...)
+
+		res, err := store.FindByType(ctx, time.Minute, time.Time{}, to, []string{"file_2", "file_3"})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(res), "file_3 is newer")
+		assert.Equal(t, "file_2", res[0].Name)
+
+		res, err = store.FindByType(ctx, time.Minute, time.Time{}, to, []string{})
+		require.NoError(t, err)
+		assert.Empty(t, res, "empty names match nothing")
+
+		res, err = store.FindByType(ctx, time.Minute, time.Date(2022, 10, 11, 2, 12, 0, 0, time.UTC), to, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 4, len(res), "window excludes its start")
+
+		oldest, err := store.OldestByType(ctx, time.Minute, time.Time{}, to, []string{"file_2", "file_3"})
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 21, 0, 0, time.UTC), oldest.UTC())
+		oldest, err = store.OldestByType(ctx, time.Minute, time.Date(2022, 10, 11, 2, 12, 0, 0, time.UTC), to, nil)
+		require.NoError(t, err)
+		assert.Equal(t, time.Date(2022, 10, 11, 2, 13, 0, 0, time.UTC), oldest.UTC())
+		oldest, err = store.OldestByType(ctx, 5*time.Minute, time.Time{}, to, nil)
+		require.NoError(t, err)
+		assert.True(t, oldest.IsZero(), "no entries of the type")
+
+		require.NoError(t, store.DeleteOlder(ctx, to, []string{"file_1", "file_3"}))
+		res, err = acc.FindAll(ctx, from, to.AddDate(1, 0, 0), time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 2, len(res), "30m file_1 deleted, newer file_3 kept")
+		sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+		assert.Equal(t, "file_2", res[0].Name)
+		assert.Equal(t, "file_3", res[1].Name)
+
+		require.NoError(t, store.DeleteOlder(ctx, to.AddDate(1, 0, 0), nil))
+		list, err := acc.GetMetricsList(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, list)
+	})
+
+	t.Run("rollup", func(t *testing.T) {
+		acc, insert := newAccessor(t)
+		store, ok := acc.(typedRollupStore)
+		require.True(t, ok)
+		ctx := context.Background()
+		writeMany(t, acc, oneMinEntries...)
+		stored := metric.Entry{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 15, 0, 0, time.UTC), Value: 50,
+			Type: 5 * time.Minute, TypeStr: "5m0s"}
+		insert(stored, stored) // the same bucket twice, as left by the old re-aggregation
+
+		w := RollupWindow{From: from, To: time.Date(2022, 10, 11, 2, 15, 0, 0, time.UTC), SrcType: time.Minute,
+			Interval: 5 * time.Minute, Names: []string{"file_1", "file_2"}}
+		for i := 0; i < 2; i++ { // repeated rollup finds no sources and changes nothing
+			aggregates, deleted, err := store.Rollup(ctx, w)
+			require.NoError(t, err)
+			assert.Equal(t, 1-i, aggregates)
+			assert.Equal(t, 3-3*i, deleted)
+
+			res, err := store.FindByType(ctx, 5*time.Minute, time.Time{}, to, nil)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(res), "duplicate merged")
+			assert.Equal(t, 125.0, res[0].Value)
+			assert.Equal(t, time.Date(2022, 10, 11, 2, 15, 0, 0, time.UTC), res[0].TimeStamp.UTC())
+			res, err = store.FindByType(ctx, time.Minute, time.Time{}, to, nil)
+			require.NoError(t, err)
+			require.Equal(t, 3, len(res), "sources deleted")
+			sortByTime(res)
+			assert.Equal(t, time.Date(2022, 10, 11, 2, 18, 0, 0, time.UTC), res[0].TimeStamp.UTC(), "newer kept")
+		}
+
+		aggregates, deleted, err := store.ResumeRollup(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, aggregates+deleted, "nothing to resume")
+	})
+}
@@ -0,0 +1,486 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+const boltMetricsBucket = "metrics"
+
+// errSkipMetric stops the scan of the current metric in scanEntries
+var errSkipMetric = errors.New("skip metric")
+
+// BoltAccessor keeps metrics in a single bolt file, an embedded alternative to DBAccessor.
+// Each metric has its own nested bucket with entries keyed by timestamp and sequence number,
+// so entries are ordered by time. Sequence number keeps entries of different series and types apart,
+// Write merges into the stored 1m bucket of the series.
+type BoltAccessor struct {
+	db                     *bolt.DB
+	intervalForgivenessPrc float64
+}
+
+// NewBoltAccessor opens (or creates) bolt file and returns access to it
+func NewBoltAccessor(fileName string, intervalForgivenessPrc float64) (*BoltAccessor, error) {
+	db, err := bolt.Open(fileName, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt file %s: %w", fileName, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, e := tx.CreateBucketIfNotExists([]byte(boltMetricsBucket))
+		return e
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create top-level bucket in %s: %w", fileName, err)
+	}
+
+	return &BoltAccessor{db: db, intervalForgivenessPrc: intervalForgivenessPrc}, nil
+}
+
+// Close closes bolt file
+func (b *BoltAccessor) Close() error {
+	return b.db.Close()
+}
+
+// Write merges entry into the stored 1m bucket of the series, inserting the bucket if missing
+func (b *BoltAccessor) Write(ctx context.Context, m metric.Entry) error {
+	var merged bool
+	err := b.db.Update(func(tx *bolt.Tx) (err error) {
+		merged, err = mergeEntry(tx, m)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %+v: %w", m, err)
+	}
+	if merged {
+		log.Printf("merged metric: %v", m.Name)
+		return nil
+	}
+	log.Printf("inserted metric: %v", m.Name)
+	return nil
+}
+
+// WriteMany merges entries into the stored 1m buckets of their series in a single transaction,
+// all of them fail together
+func (b *BoltAccessor) WriteMany(ctx context.Context, entries []metric.Entry) error {
+	merged := 0
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			ok, err := mergeEntry(tx, e)
+			if err != nil {
+				return err
+			}
+			if ok {
+				merged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write %d metrics: %w", len(entries), err)
+	}
+	log.Printf("written %d metrics, %d merged", len(entries), merged)
+	return nil
+}
+
+// Delete removes all entries of the metric from bolt
+func (b *BoltAccessor) Delete(ctx context.Context, m metric.Entry) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket([]byte(boltMetricsBucket)).DeleteBucket([]byte(m.Name))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %v: %w", m.Name, err)
+	}
+	log.Printf("deleted metric %v", m.Name)
+	return nil
+}
+
+// GetMetricsList gets a list of available metrics in bolt
+func (b *BoltAccessor) GetMetricsList(ctx context.Context) ([]string, error) {
+	var metricsList []string
+	err := b.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(boltMetricsBucket))
+		return root.ForEach(func(name, v []byte) error {
+			if v != nil { // not a nested bucket
+				return nil
+			}
+			if k, _ := root.Bucket(name).Cursor().First(); k != nil { // skip metrics without entries
+				metricsList = append(metricsList, string(name))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read all metrics: %w", err)
+	}
+	sort.Strings(metricsList)
+	return metricsList, nil
+}
+
+// FindOneMetric gets the values for the required metric series, timeframe and interval from bolt
+func (b *BoltAccessor) FindOneMetric(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration) ([]metric.Entry, error) {
+	entries, err := b.load(name, from, to)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %v metric: %w", name, err)
+	}
+	return findMetric(ctx, entries, matchers, from, to, interval, b.intervalForgivenessPrc)
+}
+
+// FindAll gets all entries for the specified timeframe and interval from bolt
+func (b *BoltAccessor) FindAll(ctx context.Context, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+	metricsList, err := b.GetMetricsList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []metric.Entry
+	for _, name := range metricsList {
+		res, err := b.FindOneMetric(ctx, name, nil, from, to, interval)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+
+	if len(results) == 0 {
+		return []metric.Entry{}, nil
+	}
+	return results, nil
+}
+
+// FindLatest gets the latest entry of every series with timestamp after from. Entries are keyed by timestamp,
+// so only the entries of the time range are read
+func (b *BoltAccessor) FindLatest(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+	var entries []metric.Entry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return scanEntries(tx, nil, from, time.Unix(0, math.MaxInt64), func(_ *bolt.Bucket, _ []byte, e metric.Entry) error {
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find latest entries: %w", err)
+	}
+	return latestBySeries(entries), nil
+}
+
+// FindByType gets all entries of the given type with timestamp in (from, to],
+// of the given metrics or of all of them if names is nil
+func (b *BoltAccessor) FindByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) ([]metric.Entry, error) {
+	var results []metric.Entry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return scanEntries(tx, names, from, to, func(_ *bolt.Bucket, _ []byte, e metric.Entry) error {
+			if e.Type == tp {
+				results = append(results, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find entries of type %v: %w", tp, err)
+	}
+	return results, nil
+}
+
+// OldestByType gets the timestamp of the oldest entry of the given type with timestamp in (from, to],
+// of the given metrics or of all of them if names is nil. Returns zero time if there are none
+func (b *BoltAccessor) OldestByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) (time.Time, error) {
+	var oldest time.Time
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return scanEntries(tx, names, from, to, func(_ *bolt.Bucket, _ []byte, e metric.Entry) error {
+			if e.Type != tp {
+				return nil
+			}
+			if oldest.IsZero() || e.TimeStamp.Before(oldest) {
+				oldest = e.TimeStamp
+			}
+			return errSkipMetric // entries are ordered by time, the rest of the metric is newer
+		})
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to find the oldest entry of type %v: %w", tp, err)
+	}
+	return oldest, nil
+}
+
+// InsertMany inserts entries as is, without rounding the timestamp and setting the type
+func (b *BoltAccessor) InsertMany(ctx context.Context, entries []metric.Entry) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			bkt, err := tx.Bucket([]byte(boltMetricsBucket)).CreateBucketIfNotExists([]byte(e.Name))
+			if err != nil {
+				return fmt.Errorf("failed to create bucket for %s: %w", e.Name, err)
+			}
+			if err = insertEntry(bkt, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Rollup re-aggregates the window in a single transaction, so the sources can't change between the lookup
+// and the delete
+func (b *BoltAccessor) Rollup(ctx context.Context, w RollupWindow) (aggregates, deleted int, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		// collect keys first, deleting under the cursor makes it skip the next key
+		var locations []entryLocation
+		var sources []metric.Entry
+		err := scanEntries(tx, w.Names, w.From, w.To, func(bkt *bolt.Bucket, k []byte, e metric.Entry) error {
+			if e.Type == w.SrcType {
+				locations = append(locations, entryLocation{bkt: bkt, key: append([]byte{}, k...)})
+				sources = append(sources, e)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		res, err := rollupEntries(ctx, sources, w.Interval)
+		if err != nil {
+			return err
+		}
+
+		for _, l := range locations {
+			if err = l.bkt.Delete(l.key); err != nil {
+				return err
+			}
+		}
+		for _, e := range res {
+			stored, err := takeBucket(tx, e)
+			if err != nil {
+				return err
+			}
+			bkt, err := tx.Bucket([]byte(boltMetricsBucket)).CreateBucketIfNotExists([]byte(e.Name))
+			if err != nil {
+				return fmt.Errorf("failed to create bucket for %s: %w", e.Name, err)
+			}
+			if err = insertEntry(bkt, mergeAggregate(stored, e)); err != nil {
+				return err
+			}
+		}
+		aggregates, deleted = len(res), len(locations)
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to re-aggregate window (%v, %v]: %w", w.From, w.To, err)
+	}
+	return aggregates, deleted, nil
+}
+
+// ResumeRollup does nothing, Rollup is never left half done
+func (b *BoltAccessor) ResumeRollup(ctx context.Context) (aggregates, deleted int, err error) {
+	return 0, 0, nil
+}
+
+// DeleteOlder removes entries of any type with timestamp up to (and including) the given time,
+// of the given metrics or of all of them if names is nil
+func (b *BoltAccessor) DeleteOlder(ctx context.Context, to time.Time, names []string) error {
+	if err := b.deleteWhere(names, to, func(metric.Entry) bool { return true }); err != nil {
+		return fmt.Errorf("failed to delete entries older than %v: %w", to, err)
+	}
+	return nil
+}
+
+// entryLocation is the key of the entry in the bucket of its metric
+type entryLocation struct {
+	bkt *bolt.Bucket
+	key []byte
+}
+
+// deleteWhere removes entries of the metrics with timestamp up to (and including) the given time,
+// matching the condition
+func (b *BoltAccessor) deleteWhere(names []string, to time.Time, cond func(e metric.Entry) bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		// collect keys first, deleting under the cursor makes it skip the next key
+		var locations []entryLocation
+		err := scanEntries(tx, names, time.Time{}, to, func(bkt *bolt.Bucket, k []byte, e metric.Entry) error {
+			if cond(e) {
+				locations = append(locations, entryLocation{bkt: bkt, key: append([]byte{}, k...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, l := range locations {
+			if err := l.bkt.Delete(l.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// load gets all entries of the metric within the timeframe
+func (b *BoltAccessor) load(name string, from, to time.Time) ([]metric.Entry, error) {
+	var results []metric.Entry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(boltMetricsBucket)).Bucket([]byte(name))
+		if bkt == nil {
+			return nil
+		}
+		c := bkt.Cursor()
+		maxKey := boltKey(to, 1<<64-1)
+		for k, v := c.Seek(boltKey(from, 0)); k != nil && bytes.Compare(k, maxKey) <= 0; k, v = c.Next() {
+			var e metric.Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("failed to unmarshal %s: %w", string(v), err)
+			}
+			results = append(results, e)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// scanEntries calls fn for every entry of the given metrics, or of all of them if names is nil,
+// with timestamp in (from, to], zero from for all entries up to the given time. The rest of the metric
+// is skipped if fn returns errSkipMetric
+func scanEntries(tx *bolt.Tx, names []string, from, to time.Time, fn func(bkt *bolt.Bucket, k []byte, e metric.Entry) error) error {
+	root := tx.Bucket([]byte(boltMetricsBucket))
+	maxKey := boltKey(to, 1<<64-1)
+
+	scan := func(bkt *bolt.Bucket) error {
+		c := bkt.Cursor()
+		k, v := c.First()
+		if !from.IsZero() {
+			k, v = c.Seek(boltKey(from.Add(time.Nanosecond), 0))
+		}
+		for ; k != nil && bytes.Compare(k, maxKey) <= 0; k, v = c.Next() {
+			var e metric.Entry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("failed to unmarshal %s: %w", string(v), err)
+			}
+			err := fn(bkt, k, e)
+			if err == errSkipMetric {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if names != nil {
+		for _, name := range names {
+			if bkt := root.Bucket([]byte(name)); bkt != nil {
+				if err := scan(bkt); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return root.ForEach(func(name, v []byte) error {
+		if v != nil { // not a nested bucket
+			return nil
+		}
+		return scan(root.Bucket(name))
+	})
+}
+
+// mergeEntry merges entry into the stored 1m bucket of the series, inserting the bucket if missing.
+// Returns true if merged
+func mergeEntry(tx *bolt.Tx, m metric.Entry) (bool, error) {
+	m.TimeStamp = minuteBucket(m.TimeStamp)
+	m.Type = 1 * time.Minute
+	m.TypeStr = "1m"
+	bkt, err := tx.Bucket([]byte(boltMetricsBucket)).CreateBucketIfNotExists([]byte(m.Name))
+	if err != nil {
+		return false, fmt.Errorf("failed to create bucket for %s: %w", m.Name, err)
+	}
+
+	key, prefix := bucketKey(m), boltKey(m.TimeStamp, 0)[:8]
+	c := bkt.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var stored metric.Entry
+		if err = json.Unmarshal(v, &stored); err != nil {
+			return false, fmt.Errorf("failed to unmarshal %s: %w", string(v), err)
+		}
+		if bucketKey(stored) != key {
+			continue
+		}
+		_ = stored.Merge(m) // of the same bucket key, so of the same kind
+		stored.TimeStamp = m.TimeStamp
+		return true, putEntry(bkt, append([]byte{}, k...), stored)
+	}
+	return false, insertEntry(bkt, m)
+}
+
+// takeBucket removes stored entries of the bucket of the entry, by series, type and timestamp.
+// Returns the removed entries
+func takeBucket(tx *bolt.Tx, m metric.Entry) ([]metric.Entry, error) {
+	bkt := tx.Bucket([]byte(boltMetricsBucket)).Bucket([]byte(m.Name))
+	if bkt == nil {
+		return nil, nil
+	}
+
+	// collect keys first, deleting under the cursor makes it skip the next key
+	var keys [][]byte
+	var res []metric.Entry
+	key, prefix := bucketKey(m), boltKey(m.TimeStamp, 0)[:8]
+	c := bkt.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var stored metric.Entry
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s: %w", string(v), err)
+		}
+		if bucketKey(stored) == key {
+			keys = append(keys, append([]byte{}, k...))
+			res = append(res, stored)
+		}
+	}
+	for _, k := range keys {
+		if err := bkt.Delete(k); err != nil {
+			return nil, fmt.Errorf("failed to delete %s: %w", key, err)
+		}
+	}
+	return res, nil
+}
+
+// insertEntry puts entry under a new key of its timestamp
+func insertEntry(bkt *bolt.Bucket, e metric.Entry) error {
+	seq, err := bkt.NextSequence()
+	if err != nil {
+		return fmt.Errorf("failed to get sequence for %s: %w", e.Name, err)
+	}
+	return putEntry(bkt, boltKey(e.TimeStamp, seq), e)
+}
+
+// putEntry puts entry under the key, replacing the stored one
+func putEntry(bkt *bolt.Bucket, key []byte, e metric.Entry) error {
+	val, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %+v: %w", e, err)
+	}
+	if err = bkt.Put(key, val); err != nil {
+		return fmt.Errorf("failed to put %+v: %w", e, err)
+	}
+	return nil
+}
+
+// boltKey makes a key sorted by timestamp, sequence number allows multiple entries with the same timestamp
+func boltKey(ts time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key[:8], uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestBoltAccessor_Behaviour(t *testing.T) {
+	testAccessorBehaviour(t, func(t *testing.T) (Accessor, func(entries ...metric.Entry)) {
+		acc, err := NewBoltAccessor(filepath.Join(t.TempDir(), "metrics.db"), 0.25)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			require.NoError(t, acc.Close())
+		})
+		insert := func(entries ...metric.Entry) {
+			require.NoError(t, acc.InsertMany(context.Background(), entries))
+		}
+		return acc, insert
+	})
+}
+
+func TestBoltAccessor_Persistence(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	fileName := filepath.Join(t.TempDir(), "metrics.db")
+
+	acc, err := NewBoltAccessor(fileName, 0.25)
+	require.NoError(t, err)
+	err = acc.Write(ctx, metric.Entry{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5})
+	require.NoError(t, err)
+	require.NoError(t, acc.Close())
+
+	acc, err = NewBoltAccessor(fileName, 0.25)
+	require.NoError(t, err)
+	defer acc.Close()
+
+	res, err := acc.FindOneMetric(ctx, "file_1", nil, time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
+		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC), time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, 5.0, res[0].Value)
+	assert.Equal(t, time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC), res[0].TimeStamp)
+}
+
+func TestBoltAccessor_ByType(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	acc, err := NewBoltAccessor(filepath.Join(t.TempDir(), "metrics.db"), 0.25)
+	require.NoError(t, err)
+	defer acc.Close()
+
+	for _, e := range []metric.Entry{
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 9},
+		{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 1},
+		{Name: "file_2", TimeStamp: time.Date(2022, 10, 12, 2, 11, 23, 0, time.UTC), Value: 2},
+	} {
+		require.NoError(t, acc.Write(ctx, e))
+	}
+	err = acc.InsertMany(ctx, []metric.Entry{{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 15, 0, 0, time.UTC),
+		Value: 7, Type: 5 * time.Minute, TypeStr: "5m0s"}})
+	require.NoError(t, err)
+
+	cutoff := time.Date(2022, 10, 11, 23, 0, 0, 0, time.UTC)
+	res, err := acc.FindByType(ctx, time.Minute, time.Time{}, cutoff, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, len(res))
+
+	aggregates, deleted, err := acc.Rollup(ctx, RollupWindow{To: cutoff, SrcType: time.Minute, Interval: 5 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, 2, aggregates)
+	assert.Equal(t, 3, deleted)
+	res, err = acc.FindByType(ctx, time.Minute, time.Time{}, cutoff, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+
+	res, err = acc.FindByType(ctx, time.Minute, time.Time{}, cutoff.AddDate(0, 0, 1), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(res), "newer entry kept")
+
+	res, err = acc.FindByType(ctx, 5*time.Minute, time.Time{}, cutoff, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(res))
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	assert.Equal(t, 21.0, res[0].Value, "merged into the stored aggregate")
+	assert.Equal(t, 1.0, res[1].Value)
+}
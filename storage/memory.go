@@ -0,0 +1,370 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemAccessor keeps metrics in memory, it is a drop-in replacement for DBAccessor
+// for local runs and tests which can't rely on MongoDB
+type MemAccessor struct {
+	intervalForgivenessPrc float64
+
+	mu   sync.RWMutex
+	data map[string][]metric.Entry // entries per metric name
+}
+
+// NewMemAccessor returns in-memory accessor
+func NewMemAccessor(intervalForgivenessPrc float64) *MemAccessor {
+	return &MemAccessor{intervalForgivenessPrc: intervalForgivenessPrc, data: make(map[string][]metric.Entry)}
+}
+
+// Write merges entry into the stored 1m bucket of the series, adding the bucket if missing
+func (m *MemAccessor) Write(ctx context.Context, e metric.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.merge(e)
+	return nil
+}
+
+// WriteMany merges entries into the stored 1m buckets of their series, under a single lock
+func (m *MemAccessor) WriteMany(ctx context.Context, entries []metric.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		m.merge(e)
+	}
+	return nil
+}
+
+// merge merges entry into the stored 1m bucket of the series, lock should be held by the caller
+func (m *MemAccessor) merge(e metric.Entry) {
+	e.TimeStamp = minuteBucket(e.TimeStamp)
+	e.Type = 1 * time.Minute
+	e.TypeStr = "1m"
+
+	entries, key := m.data[e.Name], bucketKey(e)
+	for i, v := range entries {
+		if bucketKey(v) != key {
+			continue
+		}
+		// copy on write, entries may be read by lookups without the lock
+		updated := append([]metric.Entry{}, entries...)
+		_ = updated[i].Merge(e) // of the same bucket key, so of the same kind
+		updated[i].TimeStamp = e.TimeStamp
+		m.data[e.Name] = updated
+		return
+	}
+	m.data[e.Name] = append(entries, e)
+}
+
+// Delete removes all entries of the metric from memory
+func (m *MemAccessor) Delete(ctx context.Context, e metric.Entry) error {
+	m.mu.Lock()
+	delete(m.data, e.Name)
+	m.mu.Unlock()
+	return nil
+}
+
+// GetMetricsList gets a list of available metrics
+func (m *MemAccessor) GetMetricsList(ctx context.Context) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var metricsList []string
+	for name, entries := range m.data {
+		if len(entries) > 0 {
+			metricsList = append(metricsList, name)
+		}
+	}
+	sort.Strings(metricsList)
+	return metricsList, nil
+}
+
+// FindOneMetric gets the values for the required metric series, timeframe and interval
+func (m *MemAccessor) FindOneMetric(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration) ([]metric.Entry, error) {
+	m.mu.RLock()
+	entries := m.data[name]
+	m.mu.RUnlock()
+
+	return findMetric(ctx, entries, matchers, from, to, interval, m.intervalForgivenessPrc)
+}
+
+// FindAll gets all entries for the specified timeframe and interval
+func (m *MemAccessor) FindAll(ctx context.Context, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+	metricsList, err := m.GetMetricsList(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []metric.Entry
+	for _, name := range metricsList {
+		res, err := m.FindOneMetric(ctx, name, nil, from, to, interval)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+
+	if len(results) == 0 {
+		return []metric.Entry{}, nil
+	}
+	return results, nil
+}
+
+// FindLatest gets the latest entry of every series with timestamp after from
+func (m *MemAccessor) FindLatest(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+	var entries []metric.Entry
+	m.scan(nil, from, time.Unix(0, math.MaxInt64), func(e metric.Entry) {
+		entries = append(entries, e)
+	})
+	return latestBySeries(entries), nil
+}
+
+// FindByType gets all entries of the given type with timestamp in (from, to],
+// of the given metrics or of all of them if names is nil
+func (m *MemAccessor) FindByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) ([]metric.Entry, error) {
+	var results []metric.Entry
+	m.scan(names, from, to, func(e metric.Entry) {
+		if e.Type == tp {
+			results = append(results, e)
+		}
+	})
+	return results, nil
+}
+
+// OldestByType gets the timestamp of the oldest entry of the given type with timestamp in (from, to],
+// of the given metrics or of all of them if names is nil. Returns zero time if there are none
+func (m *MemAccessor) OldestByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) (time.Time, error) {
+	var oldest time.Time
+	m.scan(names, from, to, func(e metric.Entry) {
+		if e.Type == tp && (oldest.IsZero() || e.TimeStamp.Before(oldest)) {
+			oldest = e.TimeStamp
+		}
+	})
+	return oldest, nil
+}
+
+// scan calls fn for every entry of the metrics with timestamp in (from, to]
+func (m *MemAccessor) scan(names []string, from, to time.Time, fn func(e metric.Entry)) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	matched := matchNames(names)
+	for name, entries := range m.data {
+		if !matched(name) {
+			continue
+		}
+		for _, e := range entries {
+			if e.TimeStamp.After(from) && !e.TimeStamp.After(to) {
+				fn(e)
+			}
+		}
+	}
+}
+
+// InsertMany inserts entries as is, without rounding the timestamp and setting the type
+func (m *MemAccessor) InsertMany(ctx context.Context, entries []metric.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		m.data[e.Name] = append(m.data[e.Name], e)
+	}
+	return nil
+}
+
+// Rollup re-aggregates the window under a single lock, so the sources can't change between the lookup and the delete
+func (m *MemAccessor) Rollup(ctx context.Context, w RollupWindow) (aggregates, deleted int, err error) {
+	isSource := func(e metric.Entry) bool {
+		return e.Type == w.SrcType && e.TimeStamp.After(w.From) && !e.TimeStamp.After(w.To)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	matched := matchNames(w.Names)
+	var sources []metric.Entry
+	for name, entries := range m.data {
+		if !matched(name) {
+			continue
+		}
+		for _, e := range entries {
+			if isSource(e) {
+				sources = append(sources, e)
+			}
+		}
+	}
+	res, err := rollupEntries(ctx, sources, w.Interval)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// stored aggregates of the same buckets are replaced by the merged ones
+	stored := make(map[string][]metric.Entry, len(res))
+	for _, e := range res {
+		stored[bucketKey(e)] = nil
+	}
+	m.deleteLocked(w.Names, func(e metric.Entry) bool {
+		if isSource(e) {
+			deleted++
+			return true
+		}
+		vs, ok := stored[bucketKey(e)]
+		if ok {
+			stored[bucketKey(e)] = append(vs, e)
+		}
+		return ok
+	})
+	for _, e := range res {
+		m.data[e.Name] = append(m.data[e.Name], mergeAggregate(stored[bucketKey(e)], e))
+	}
+	return len(res), deleted, nil
+}
+
+// ResumeRollup does nothing, Rollup is never left half done
+func (m *MemAccessor) ResumeRollup(ctx context.Context) (aggregates, deleted int, err error) {
+	return 0, 0, nil
+}
+
+// DeleteOlder removes entries of any type with timestamp up to (and including) the given time,
+// of the given metrics or of all of them if names is nil
+func (m *MemAccessor) DeleteOlder(ctx context.Context, to time.Time, names []string) error {
+	m.deleteWhere(names, func(e metric.Entry) bool { return !e.TimeStamp.After(to) })
+	return nil
+}
+
+// deleteWhere removes entries of the metrics matching the condition
+func (m *MemAccessor) deleteWhere(names []string, cond func(e metric.Entry) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleteLocked(names, cond)
+}
+
+// deleteLocked removes entries of the metrics matching the condition, lock should be held by the caller
+func (m *MemAccessor) deleteLocked(names []string, cond func(e metric.Entry) bool) {
+	matched := matchNames(names)
+	for name, entries := range m.data {
+		if !matched(name) {
+			continue
+		}
+		// copy on write, entries may be read by lookups without the lock
+		kept := make([]metric.Entry, 0, len(entries))
+		for _, e := range entries {
+			if !cond(e) {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(m.data, name)
+			continue
+		}
+		m.data[name] = kept
+	}
+}
+
+// findMetric applies the same lookup strategy as DBAccessor.FindOneMetric to the entries of a single metric
+// matching the label matchers: exact interval match first, then aggregation of a smaller interval and finally
+// approximation of the interval within forgiveness percent
+func findMetric(ctx context.Context, entries []metric.Entry, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration, intervalForgivenessPrc float64) ([]metric.Entry, error) {
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	var inRange []metric.Entry
+	for _, e := range entries {
+		if e.TimeStamp.Before(from) || e.TimeStamp.After(to) || !metric.MatchLabels(e.Labels, matchers) {
+			continue
+		}
+		inRange = append(inRange, e)
+	}
+
+	start := time.Now()
+	res := filterByType(inRange, interval, interval)
+	queryDuration.With("exact").Since(start)
+	if len(res) > 0 {
+		return res, nil
+	}
+
+	start = time.Now()
+	res, err := aggregateEntries(ctx, inRange, interval)
+	queryDuration.With("aggregate").Since(start)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) > 0 {
+		return res, nil
+	}
+
+	// to find interval within 25% of requested
+	lowerInterval := time.Second * time.Duration(interval.Seconds()*(1-intervalForgivenessPrc))
+	upperInterval := time.Second * time.Duration(interval.Seconds()*(1+intervalForgivenessPrc))
+	start = time.Now()
+	res = filterByType(inRange, lowerInterval, upperInterval)
+	queryDuration.With("approximate").Since(start)
+	if len(res) > 0 {
+		return res, nil
+	}
+
+	// cannot even approximate
+	return []metric.Entry{}, nil
+}
+
+// filterByType returns entries with type in [lower, upper] range
+func filterByType(entries []metric.Entry, lower, upper time.Duration) []metric.Entry {
+	var results []metric.Entry
+	for _, e := range entries {
+		if e.Type >= lower && e.Type <= upper {
+			results = append(results, e)
+		}
+	}
+	return results
+}
+
+// aggregateEntries aggregates entries of the largest smaller interval which results in 0 remainder
+func aggregateEntries(ctx context.Context, entries []metric.Entry, interval time.Duration) ([]metric.Entry, error) {
+	var intervalList []time.Duration
+	seen := map[time.Duration]bool{}
+	for _, e := range entries {
+		if e.Type < interval && !seen[e.Type] {
+			seen[e.Type] = true
+			intervalList = append(intervalList, e.Type)
+		}
+	}
+
+	// sort the available intervals (descending)
+	sort.Slice(intervalList, func(i, j int) bool { return intervalList[i] > intervalList[j] })
+
+	var sInterval time.Duration
+	for _, l := range intervalList {
+		if l > 0 && interval%l == 0 {
+			sInterval = l
+			break
+		}
+	}
+
+	if sInterval == 0 {
+		return []metric.Entry{}, nil
+	}
+
+	srcEntries := filterByType(entries, sInterval, sInterval)
+	sortByTime(srcEntries)
+
+	var results []metric.Entry
+	var err error
+	for _, e := range srcEntries {
+		if results, err = aggrProcess(ctx, results, e, interval); err != nil {
+			return nil, fmt.Errorf("failed to reaggregate: %w", err)
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"testing"
+	"time"
+)
+
+func TestMemAccessor_Behaviour(t *testing.T) {
+	testAccessorBehaviour(t, func(t *testing.T) (Accessor, func(entries ...metric.Entry)) {
+		acc := NewMemAccessor(0.25)
+		insert := func(entries ...metric.Entry) {
+			require.NoError(t, acc.InsertMany(context.Background(), entries))
+		}
+		return acc, insert
+	})
+}
+
+func TestMemAccessor_WriteDelete(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	acc := NewMemAccessor(0.25)
+
+	err := acc.Write(ctx, metric.Entry{Name: "file_1", TimeStamp: time.Date(2022, 7, 29, 12, 10, 55, 0, time.UTC), Value: 5})
+	require.NoError(t, err)
+	err = acc.Write(ctx, metric.Entry{Name: "file_2", TimeStamp: time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC), Value: 9})
+	require.NoError(t, err)
+
+	require.Equal(t, 1, len(acc.data["file_1"]))
+	assert.Equal(t, time.Date(2022, 7, 29, 12, 11, 0, 0, time.UTC), acc.data["file_1"][0].TimeStamp)
+	assert.Equal(t, time.Minute, acc.data["file_1"][0].Type)
+	assert.Equal(t, "1m", acc.data["file_1"][0].TypeStr)
+
+	metricsList, err := acc.GetMetricsList(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file_1", "file_2"}, metricsList)
+
+	err = acc.Delete(ctx, metric.Entry{Name: "file_1"})
+	require.NoError(t, err)
+	metricsList, err = acc.GetMetricsList(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file_2"}, metricsList)
+}
+
+func TestMemAccessor_FindOneMetric(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	acc := NewMemAccessor(0.25)
+	for _, e := range []metric.Entry{
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 9},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 12, 23, 0, time.UTC), Value: 11},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 17, 23, 0, time.UTC), Value: 11},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 20, 23, 0, time.UTC), Value: 11},
+	} {
+		require.NoError(t, acc.Write(ctx, e))
+	}
+	// pre-aggregated entries, 4m is within forgiveness of 5m
+	acc.data["file_2"] = []metric.Entry{
+		{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 12, 0, 0, time.UTC), Value: 3, Type: 4 * time.Minute},
+		{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 16, 0, 0, time.UTC), Value: 4, Type: 4 * time.Minute},
+	}
+
+	from, to := time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC), time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC)
+
+	{ // everything is matching
+		res, err := acc.FindOneMetric(ctx, "file_1", nil, from, to, time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 5, len(res))
+	}
+
+	{ // aggregate smaller interval
+		res, err := acc.FindOneMetric(ctx, "file_1", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		require.Equal(t, 3, len(res))
+		total := 0.0
+		for _, r := range res {
+			assert.Equal(t, 5*time.Minute, r.Type)
+			assert.Equal(t, "5m0s", r.TypeStr)
+			total += r.Value
+		}
+		assert.Equal(t, 47.0, total)
+	}
+
+	{ // approximate interval
+		res, err := acc.FindOneMetric(ctx, "file_2", nil, from, to, 5*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 2, len(res))
+	}
+
+	{ // cannot approximate
+		res, err := acc.FindOneMetric(ctx, "file_2", nil, from, to, 3*time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	}
+
+	{ // no data in the requested timeframe
+		res, err := acc.FindOneMetric(ctx, "file_1", nil, from.Add(24*time.Hour), to.Add(24*time.Hour), time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(res))
+	}
+}
+
+func TestMemAccessor_FindAll(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	acc := NewMemAccessor(0.25)
+	for _, e := range []metric.Entry{
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 17, 23, 0, time.UTC), Value: 11},
+		{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 20, 23, 0, time.UTC), Value: 11},
+		{Name: "file_3", TimeStamp: time.Date(2022, 11, 11, 2, 26, 23, 0, time.UTC), Value: 1},
+	} {
+		require.NoError(t, acc.Write(ctx, e))
+	}
+
+	res, err := acc.FindAll(ctx, time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC), time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
+		15*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(res))
+	for _, r := range res {
+		assert.NotEqual(t, "file_3", r.Name)
+	}
+
+	res, err = acc.FindAll(ctx, time.Date(2023, 10, 11, 2, 0, 0, 0, time.UTC), time.Date(2023, 10, 11, 3, 0, 0, 0, time.UTC),
+		15*time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(res))
+}
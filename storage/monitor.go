@@ -0,0 +1,28 @@
+package storage
+
+import (
+	"github.com/umputun/metrics/monitor"
+)
+
+// metrics of the storage itself, served by monitor.Handler
+var (
+	ingestedSamples = monitor.NewCounter("metrics_ingested_samples_total", "Samples accepted to staging")
+	lateSamples     = monitor.NewCounterVec("metrics_late_samples_total",
+		"Samples behind the lateness window, merged into the stored minutes or rejected", "action")
+	updateDuration = monitor.NewHistogramVec("metrics_update_duration_seconds",
+		"Duration of staging updates, writes to the storage are done in the background", "method", monitor.DurationBuckets)
+	stagingSeries   = monitor.NewGauge("metrics_staging_series", "Series in staging, not persisted yet")
+	cleanupDuration = monitor.NewHistogram("metrics_cleanup_duration_seconds",
+		"Duration of staging flushes to the storage", monitor.DurationBuckets)
+	cleanupFailures  = monitor.NewCounter("metrics_cleanup_failures_total", "Failed staging flushes to the storage")
+	flushQueueLength = monitor.NewGauge("metrics_flush_queue_length", "Pending writes in the background flush queue")
+	flushFailures    = monitor.NewCounter("metrics_flush_failures_total", "Failed background writes, retried on cleanup")
+	queryDuration    = monitor.NewHistogramVec("metrics_query_duration_seconds",
+		"Duration of metric lookups by strategy, exact, aggregate or approximate", "strategy", monitor.DurationBuckets)
+	reaggrDuration = monitor.NewHistogram("metrics_reaggregation_duration_seconds",
+		"Duration of re-aggregation runs", monitor.DurationBuckets)
+	reaggrDocuments = monitor.NewCounterVec("metrics_reaggregation_documents_total",
+		"Documents moved by re-aggregation, inserted aggregates and deleted sources", "op")
+	reaggrFailures = monitor.NewCounter("metrics_reaggregation_failures_total",
+		"Failed re-aggregation runs, retried by the next run")
+)
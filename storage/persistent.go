@@ -2,12 +2,17 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/umputun/metrics/metric"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
 	"sort"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -15,35 +20,317 @@ import (
 
 // DBAccessor initiates MongoDB
 type DBAccessor struct {
+	Retries    int           // retries of bulk writes failed with transient errors
+	RetryDelay time.Duration // delay before the first retry, doubled by every next one
+
 	db                     *mongo.Client
 	dbName, collName       string
 	intervalForgivenessPrc float64
+
+	latestMu sync.Mutex
+	latest   map[string]metric.Entry // latest bucket of every series, loaded by FindLatest and kept by writes
 }
 
+// transientCodes are server error codes of failures worth a retry, i.e. elections, shutdowns and timeouts
+var transientCodes = []int{6, 7, 89, 91, 189, 262, 9001, 10107, 11600, 11602, 13435, 13436}
+
 // NewAccessor returns access to db
 func NewAccessor(db *mongo.Client, dbName, collName string, intervalForgivenessPrc float64) *DBAccessor {
-	return &DBAccessor{db: db, dbName: dbName, collName: collName, intervalForgivenessPrc: intervalForgivenessPrc}
+	return &DBAccessor{db: db, dbName: dbName, collName: collName, intervalForgivenessPrc: intervalForgivenessPrc,
+		Retries: 3, RetryDelay: 100 * time.Millisecond}
 }
 
-// Write inserts entries to db
-func (d *DBAccessor) Write(ctx context.Context, m metric.Entry) error {
-	m.TimeStamp = roundUpTime(m.TimeStamp, 1*time.Minute)
+// CreateIndexes makes indexes used by the lookups, by metric name with type and timestamp, by labels
+// and by timestamp for the latest entries, and the unique index of bucket keys, which keeps concurrent writes from inserting the same bucket twice
+func (d *DBAccessor) CreateIndexes(ctx context.Context) error {
 	collection := d.db.Database(d.dbName).Collection(d.collName)
-	m.Type = 1 * time.Minute
-	m.TypeStr = "1m"
-	if _, err := collection.InsertOne(ctx, m); err != nil {
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "type", Value: 1}, {Key: "time_stamp", Value: 1}}},
+		{Keys: bson.D{{Key: "labels.$**", Value: 1}}},
+		{Keys: bson.D{{Key: "time_stamp", Value: -1}, {Key: "type", Value: 1}}},
+		{Keys: bson.D{{Key: "key", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true)},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create indexes: %w", err)
+	}
+	return nil
+}
+
+// Write merges entry into the stored 1m bucket of the series, inserting the bucket if missing.
+// Buckets are merged in place of $inc, as gauges, sketches and histograms can't be added up by db
+func (d *DBAccessor) Write(ctx context.Context, m metric.Entry) error {
+	if err := d.WriteMany(ctx, []metric.Entry{m}); err != nil {
 		return fmt.Errorf("failed to write %+v: %w", m, err)
 	}
-	log.Printf("inserted metric: %v", m.Name)
 	return nil
 }
 
+// WriteMany merges entries into the stored 1m buckets of their series, in a single lookup of the stored buckets
+// and an unordered bulk of writes. Entries of the same bucket are merged before the write. Every write is guarded
+// by the version of the bucket read, so buckets changed by a concurrent write since the lookup are read again
+// and merged once more, up to Retries times. Written buckets are marked by the op of the call, and the ones
+// found already marked are not merged again, so writes repeated by a retry are applied once.
+// Returns *WriteError with the failed entries if some of them failed
+func (d *DBAccessor) WriteMany(ctx context.Context, entries []metric.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	buckets, owners := mergeBuckets(entries)
+	op := primitive.NewObjectID()
+
+	failed := make(map[int]error)
+	written := make(map[int]metric.Entry) // buckets as written by the last write of each
+	pending := make([]int, len(buckets))  // indexes of the buckets to write
+	for i := range pending {
+		pending[i] = i
+	}
+	conflicts := 0
+	for attempt := 0; len(pending) > 0; attempt++ {
+		batch := make([]metric.Entry, len(pending))
+		for i, j := range pending {
+			batch[i] = buckets[j]
+		}
+		stored, err := d.findBuckets(ctx, batch)
+		if err != nil && attempt == 0 {
+			return fmt.Errorf("failed to find stored buckets of %d entries: %w", len(entries), err)
+		}
+		if err != nil {
+			for _, j := range pending {
+				failed[j] = fmt.Errorf("failed to find stored bucket: %w", err)
+			}
+			break
+		}
+
+		var models []mongo.WriteModel
+		var idx []int // indexes of the buckets of the models
+		for i, b := range batch {
+			if m, e, ok := bucketModel(b, op, stored[bucketKey(b)]); ok {
+				models = append(models, m)
+				idx = append(idx, pending[i])
+				written[pending[i]] = e
+			}
+		}
+		if len(models) == 0 {
+			break
+		}
+		var retry []int
+		for i, err := range d.bulkWrite(ctx, models) {
+			if mongo.IsDuplicateKeyError(err) && attempt < d.Retries {
+				retry = append(retry, idx[i])
+				continue
+			}
+			failed[idx[i]] = err
+		}
+		conflicts += len(retry)
+		pending = retry
+	}
+	d.dropApplied(ctx, buckets, op, failed)
+	for i := range failed {
+		delete(written, i)
+	}
+	d.keepLatest(written)
+
+	log.Printf("written %d metrics in %d buckets, %d conflicts, %d failed", len(entries), len(buckets),
+		conflicts, len(failed))
+	if len(failed) == 0 {
+		return nil
+	}
+	werr := &WriteError{Failed: make(map[int]error), Total: len(entries)}
+	for i, err := range failed {
+		for _, j := range owners[i] {
+			werr.Failed[j] = err
+		}
+	}
+	return werr
+}
+
+// dropApplied removes the buckets found written by the op from the failed ones, as the outcome of a write failed
+// with a network error or a timeout is unknown
+func (d *DBAccessor) dropApplied(ctx context.Context, buckets []metric.Entry, op primitive.ObjectID,
+	failed map[int]error) {
+	if len(failed) == 0 {
+		return
+	}
+	batch := make([]metric.Entry, 0, len(failed))
+	for i := range failed {
+		batch = append(batch, buckets[i])
+	}
+	stored, err := d.findBuckets(ctx, batch)
+	if err != nil {
+		log.Printf("[WARN] can't check %d failed writes: %v", len(failed), err)
+		return
+	}
+	for i := range failed {
+		if vs := stored[bucketKey(buckets[i])]; len(vs) > 0 && vs[0].Op == op {
+			delete(failed, i)
+		}
+	}
+}
+
+// storedBucket is a stored entry with its id, unique bucket key, version increased by every write and the op
+// of the last write. Buckets stored before versioning have neither key nor version
+type storedBucket struct {
+	ID           primitive.ObjectID `bson:"_id"`
+	Key          string             `bson:"key,omitempty"`
+	Version      int64              `bson:"version"`
+	Op           primitive.ObjectID `bson:"op,omitempty"`
+	metric.Entry `bson:",inline"`
+}
+
+// bucketModel makes the write of the bucket merged into the stored one, or the insert of a new bucket, marked
+// by the op, and returns the bucket written. Returns false if the stored bucket is already written by the op.
+// The write fails with a duplicate key error if the bucket was inserted or changed since the lookup,
+// including by the same write applied twice
+func bucketModel(b metric.Entry, op primitive.ObjectID, stored []storedBucket) (mongo.WriteModel, metric.Entry, bool) {
+	if len(stored) == 0 {
+		return mongo.NewInsertOneModel().SetDocument(storedBucket{ID: primitive.NewObjectID(), Key: bucketKey(b),
+			Version: 1, Op: op, Entry: b}), b, true
+	}
+	v := stored[0]
+	if v.Op == op {
+		return nil, metric.Entry{}, false
+	}
+	filter := bson.M{"key": v.Key, "version": v.Version}
+	if v.Key == "" {
+		filter = bson.M{"_id": v.ID, "version": bson.M{"$exists": false}}
+	}
+	_ = v.Merge(b) // of the same bucket key, so of the same kind
+	v.TimeStamp = b.TimeStamp
+	v.Key, v.Version, v.Op = bucketKey(b), v.Version+1, op
+	// upsert of the stale version fails on the duplicate key, instead of matching nothing
+	return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(v).SetUpsert(true), v.Entry, true
+}
+
+// findBuckets gets the stored buckets of the entries, by bucketKey, except the sources claimed by re-aggregation.
+// There may be more than one of the same bucket, left by the old re-aggregation which inserted aggregates without a lookup
+func (d *DBAccessor) findBuckets(ctx context.Context, entries []metric.Entry) (map[string][]storedBucket, error) {
+	var names []string
+	var types []time.Duration
+	var stamps []time.Time
+	seen := make(map[interface{}]bool)
+	for _, e := range entries {
+		if !seen[e.Name] {
+			seen[e.Name] = true
+			names = append(names, e.Name)
+		}
+		if !seen[e.Type] {
+			seen[e.Type] = true
+			types = append(types, e.Type)
+		}
+		if !seen[e.TimeStamp] {
+			seen[e.TimeStamp] = true
+			stamps = append(stamps, e.TimeStamp)
+		}
+	}
+
+	// labels map is stored in random order, so the exact series is matched by the key
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	cursor, err := collection.Find(ctx, bson.M{"type": bson.M{"$in": types}, "name": bson.M{"$in": names},
+		"time_stamp": bson.M{"$in": stamps}, "rollup": bson.M{"$exists": false}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	res := make(map[string][]storedBucket)
+	for cursor.Next(ctx) {
+		var stored storedBucket
+		if err = cursor.Decode(&stored); err != nil {
+			return nil, fmt.Errorf("failed to decode stored bucket: %w", err)
+		}
+		key := bucketKey(stored.Entry)
+		res[key] = append(res[key], stored)
+	}
+	return res, cursor.Err()
+}
+
+// bulkWrite runs the models as an unordered bulk write. Models failed with transient errors are retried
+// with backoff, up to Retries times. Returns errors of the models failed in the end, by index.
+// If the outcome of the batch is unknown all of its models are retried, so they should be safe to apply twice,
+// like the replace of a document by id or the version guarded writes of WriteMany
+func (d *DBAccessor) bulkWrite(ctx context.Context, models []mongo.WriteModel) map[int]error {
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	failed := make(map[int]error)
+	idx := make([]int, len(models)) // indexes of the models in the current attempt
+	for i := range idx {
+		idx[i] = i
+	}
+
+	delay := d.RetryDelay
+	for attempt := 0; ; attempt++ {
+		batch := make([]mongo.WriteModel, len(idx))
+		for i, j := range idx {
+			batch[i] = models[j]
+		}
+		_, err := collection.BulkWrite(ctx, batch, options.BulkWrite().SetOrdered(false))
+		if err == nil {
+			return failed
+		}
+
+		var retry []int
+		var bwe mongo.BulkWriteException
+		if errors.As(err, &bwe) && len(bwe.WriteErrors) > 0 {
+			for _, we := range bwe.WriteErrors {
+				j := idx[we.Index]
+				failed[j] = we
+				if isTransient(we) {
+					retry = append(retry, j)
+				}
+			}
+		} else {
+			// the whole batch failed, or the outcome is unknown
+			for _, j := range idx {
+				failed[j] = err
+			}
+			if isTransient(err) {
+				retry = idx
+			}
+		}
+
+		if len(retry) == 0 || attempt >= d.Retries {
+			return failed
+		}
+		log.Printf("[WARN] %d of %d writes failed, retry %d in %v: %v", len(retry), len(idx), attempt+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return failed
+		case <-time.After(delay):
+		}
+		delay *= 2
+		for _, j := range retry {
+			delete(failed, j)
+		}
+		idx = retry
+	}
+}
+
+// isTransient checks if the write error is worth a retry
+func isTransient(err error) bool {
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableWriteError") || se.HasErrorLabel("TransientTransactionError") {
+		return true
+	}
+	for _, code := range transientCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
+
 // Delete removes entries from db
 func (d *DBAccessor) Delete(ctx context.Context, m metric.Entry) error {
 	collection := d.db.Database(d.dbName).Collection(d.collName)
 	if _, err := collection.DeleteMany(ctx, bson.D{{Key: "name", Value: m.Name}}); err != nil {
 		return fmt.Errorf("failed to delete %v: %w", m.Name, err)
 	}
+	d.dropLatest(func(e metric.Entry) bool { return e.Name == m.Name })
 	fmt.Printf("deleted metric %v\n", m.Name)
 	return nil
 }
@@ -64,10 +351,13 @@ func (d *DBAccessor) GetMetricsList(ctx context.Context) ([]string, error) {
 	return metricsList, nil
 }
 
-// FindOneMetric gets the values for the required metric, timeframe and interval from db
-func (d *DBAccessor) FindOneMetric(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+// FindOneMetric gets the values for the required metric series, timeframe and interval from db
+func (d *DBAccessor) FindOneMetric(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration) ([]metric.Entry, error) {
 
-	res, err := d.everythingIsMatching(ctx, name, from, to, interval)
+	start := time.Now()
+	res, err := d.everythingIsMatching(ctx, name, matchers, from, to, interval)
+	queryDuration.With("exact").Since(start)
 	if err != nil {
 		return nil, err
 	}
@@ -75,7 +365,9 @@ func (d *DBAccessor) FindOneMetric(ctx context.Context, name string, from, to ti
 		return res, nil
 	}
 
-	res, err = d.aggregateSmallerInterval(ctx, name, from, to, interval)
+	start = time.Now()
+	res, err = d.aggregateSmallerInterval(ctx, name, matchers, from, to, interval)
+	queryDuration.With("aggregate").Since(start)
 	if err != nil {
 		return nil, err
 	}
@@ -83,7 +375,9 @@ func (d *DBAccessor) FindOneMetric(ctx context.Context, name string, from, to ti
 		return res, nil
 	}
 
-	res, err = d.approximateInterval(ctx, name, from, to, interval)
+	start = time.Now()
+	res, err = d.approximateInterval(ctx, name, matchers, from, to, interval)
+	queryDuration.With("approximate").Since(start)
 	if err != nil {
 		return nil, err
 	}
@@ -126,50 +420,366 @@ func (d *DBAccessor) FindAll(ctx context.Context, from, to time.Time, interval t
 			return nil, ctx.Err()
 		default:
 		}
-		res, err := d.everythingIsMatching(ctx, name, from, to, interval)
+		res, err := d.FindOneMetric(ctx, name, nil, from, to, interval)
 		if err != nil {
 			return nil, err
 		}
-		if len(res) > 0 {
-			results = append(results, res...)
-			continue
-		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// FindLatest gets the latest entry of every series with timestamp after from. The latest buckets are looked up
+// in db once, by the timestamp index, and kept up to date by the writes of the accessor, so scrapes don't read db.
+// Writes to the collection made by other processes are not seen
+func (d *DBAccessor) FindLatest(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+	d.latestMu.Lock()
+	defer d.latestMu.Unlock()
 
-		res, err = d.aggregateSmallerInterval(ctx, name, from, to, interval)
+	if d.latest == nil {
+		latest, err := d.loadLatest(ctx, from)
 		if err != nil {
 			return nil, err
 		}
-		if len(res) > 0 {
-			results = append(results, res...)
+		d.latest = latest
+	}
+
+	results := make([]metric.Entry, 0, len(d.latest))
+	for key, e := range d.latest {
+		if !e.TimeStamp.After(from) {
+			delete(d.latest, key) // series not updated since from
 			continue
 		}
+		results = append(results, e)
+	}
+	return latestBySeries(results), nil
+}
 
-		res, err = d.approximateInterval(ctx, name, from, to, interval)
-		if err != nil {
-			return nil, err
+// loadLatest gets the latest bucket of every series with timestamp after from from db, by series key.
+// Documents are streamed newest first and only the first one of each series is kept
+func (d *DBAccessor) loadLatest(ctx context.Context, from time.Time) (map[string]metric.Entry, error) {
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	cursor, err := collection.Find(ctx, bson.M{"time_stamp": bson.M{"$gt": from}},
+		options.Find().SetSort(bson.D{{Key: "time_stamp", Value: -1}, {Key: "type", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find latest entries: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	latest := make(map[string]metric.Entry)
+	for cursor.Next(ctx) {
+		var e metric.Entry
+		if err = cursor.Decode(&e); err != nil {
+			return nil, fmt.Errorf("failed to decode latest entry: %w", err)
 		}
-		if len(res) > 0 {
-			results = append(results, res...)
-			continue
+		if _, ok := latest[e.SeriesKey()]; !ok {
+			latest[e.SeriesKey()] = e
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get a list of latest entries: %w", err)
+	}
+	return latest, nil
+}
+
+// keepLatest updates the latest buckets with the written ones, if loaded
+func (d *DBAccessor) keepLatest(written map[int]metric.Entry) {
+	d.latestMu.Lock()
+	defer d.latestMu.Unlock()
+	if d.latest == nil {
+		return
+	}
+	for _, e := range written {
+		key := e.SeriesKey()
+		v, ok := d.latest[key]
+		if !ok || e.TimeStamp.After(v.TimeStamp) || (e.TimeStamp.Equal(v.TimeStamp) && e.Type <= v.Type) {
+			d.latest[key] = e
+		}
+	}
+}
+
+// dropLatest removes the latest buckets matching the condition, as deleted from db
+func (d *DBAccessor) dropLatest(cond func(e metric.Entry) bool) {
+	d.latestMu.Lock()
+	defer d.latestMu.Unlock()
+	for key, e := range d.latest {
+		if cond(e) {
+			delete(d.latest, key)
 		}
 	}
+}
+
+// resetLatest drops the latest buckets, to be looked up in db again by the next FindLatest
+func (d *DBAccessor) resetLatest() {
+	d.latestMu.Lock()
+	d.latest = nil
+	d.latestMu.Unlock()
+}
+
+// FindByType gets all entries of the given type with timestamp in (from, to],
+// of the given metrics or of all of them if names is nil
+func (d *DBAccessor) FindByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) ([]metric.Entry, error) {
+	var results []metric.Entry
+
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	cursor, err := collection.Find(ctx, namesFilter(bson.M{"type": tp, "time_stamp": timeRange(from, to)}, names),
+		options.Find().SetSort(bson.D{{Key: "time_stamp", Value: 1}}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find entries of type %v: %w", tp, err)
+	}
+	defer cursor.Close(ctx)
+
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, fmt.Errorf("failed to get a list of all returned documents of type %v: %w", tp, err)
+	}
 	return results, nil
 }
 
-// everythingIsMatching finds all documents that are matching the metric, interval and timeframe
-func (d *DBAccessor) everythingIsMatching(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+// OldestByType gets the timestamp of the oldest entry of the given type with timestamp in (from, to],
+// of the given metrics or of all of them if names is nil. Returns zero time if there are none
+func (d *DBAccessor) OldestByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) (time.Time, error) {
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	var oldest metric.Entry
+	err := collection.FindOne(ctx, namesFilter(bson.M{"type": tp, "time_stamp": timeRange(from, to)}, names),
+		options.FindOne().SetSort(bson.D{{Key: "time_stamp", Value: 1}})).Decode(&oldest)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to find the oldest entry of type %v: %w", tp, err)
+	}
+	return oldest.TimeStamp, nil
+}
+
+// InsertMany inserts entries as is, without rounding the timestamp and setting the type, in an unordered bulk
+// of upserts retried the same way as WriteMany. Returns *WriteError with the failed entries if some of them failed
+func (d *DBAccessor) InsertMany(ctx context.Context, entries []metric.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	models := make([]mongo.WriteModel, len(entries))
+	for i, e := range entries {
+		models[i] = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": primitive.NewObjectID()}).
+			SetReplacement(e).SetUpsert(true)
+	}
+	defer d.resetLatest() // inserted entries may be newer than the latest buckets
+	if failed := d.bulkWrite(ctx, models); len(failed) > 0 {
+		return &WriteError{Failed: failed, Total: len(entries)}
+	}
+	return nil
+}
+
+// rollupCheckpoint is the window being re-aggregated, kept until done. Its sources are claimed by the op,
+// which marks the aggregates written as well
+type rollupCheckpoint struct {
+	ID      string             `bson:"_id"`
+	Op      primitive.ObjectID `bson:"op"`
+	Claimed bool               `bson:"claimed"` // sources are claimed, and can't be claimed again as some may be deleted
+	Window  RollupWindow       `bson:"window"`
+}
+
+// rollupCheckpointID is the id of the checkpoint, there is at most one window re-aggregated at a time
+const rollupCheckpointID = "checkpoint"
+
+// Rollup re-aggregates the window in steps safe to repeat, saved as the checkpoint first, so an interrupted
+// re-aggregation is completed by ResumeRollup. Sources of the window are claimed by the op of the checkpoint,
+// and writes of the same buckets coming later go to new buckets. Aggregates and the delete of the claimed sources
+// are written in a single ordered bulk, the sources are deleted only once all aggregates are written
+func (d *DBAccessor) Rollup(ctx context.Context, w RollupWindow) (aggregates, deleted int, err error) {
+	cp := rollupCheckpoint{ID: rollupCheckpointID, Op: primitive.NewObjectID(), Window: w}
+	if err = d.saveCheckpoint(ctx, &cp); err != nil {
+		return 0, 0, err
+	}
+	return d.rollup(ctx, cp)
+}
+
+// ResumeRollup completes the re-aggregation of the window left by the interrupted Rollup, if any
+func (d *DBAccessor) ResumeRollup(ctx context.Context) (aggregates, deleted int, err error) {
+	var cp rollupCheckpoint
+	err = d.checkpoints().FindOne(ctx, bson.M{"_id": rollupCheckpointID}).Decode(&cp)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to load checkpoint: %w", err)
+	}
+	log.Printf("[INFO] resume re-aggregation of window (%v, %v]", cp.Window.From, cp.Window.To)
+	return d.rollup(ctx, cp)
+}
+
+// rollup claims the sources of the checkpoint window unless claimed already, aggregates and commits them,
+// and clears the checkpoint
+func (d *DBAccessor) rollup(ctx context.Context, cp rollupCheckpoint) (aggregates, deleted int, err error) {
+	w := cp.Window
+	if !cp.Claimed {
+		if err = d.claim(ctx, &cp); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+
+	var sources []metric.Entry
+	cursor, err := collection.Find(ctx, bson.M{"rollup": cp.Op})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to find claimed entries of type %v: %w", w.SrcType, err)
+	}
+	if err = cursor.All(ctx, &sources); err != nil {
+		return 0, 0, fmt.Errorf("failed to get a list of claimed entries of type %v: %w", w.SrcType, err)
+	}
+	res, err := rollupEntries(ctx, sources, w.Interval)
+	if err != nil {
+		return 0, 0, err
+	}
+	deleted, err = d.commitRollup(ctx, cp.Op, res)
+	d.resetLatest() // latest buckets may be re-aggregated, even if the commit failed in part
+	if err != nil {
+		return 0, 0, err
+	}
+	if err = d.saveCheckpoint(ctx, nil); err != nil {
+		return 0, 0, err
+	}
+	log.Printf("committed %d aggregates of window (%v, %v], %d entries deleted", len(res), w.From, w.To, deleted)
+	return len(res), deleted, nil
+}
+
+// claim marks the sources of the checkpoint window by its op and saves the checkpoint as claimed. Claimed sources
+// lose the key, so writes of their buckets don't find them, and the version guard of the ones read before fails
+func (d *DBAccessor) claim(ctx context.Context, cp *rollupCheckpoint) error {
+	w := cp.Window
+	filter := namesFilter(bson.M{"type": w.SrcType, "time_stamp": timeRange(w.From, w.To),
+		"rollup": bson.M{"$exists": false}}, w.Names)
+	update := bson.M{"$set": bson.M{"rollup": cp.Op}, "$unset": bson.M{"key": ""}, "$inc": bson.M{"version": 1}}
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	if _, err := collection.UpdateMany(ctx, filter, update); err != nil {
+		return fmt.Errorf("failed to claim entries of type %v: %w", w.SrcType, err)
+	}
+	cp.Claimed = true
+	return d.saveCheckpoint(ctx, cp)
+}
+
+// commitRollup merges the aggregates into the stored buckets and deletes the sources claimed by the op,
+// in an ordered bulk. Buckets changed since the lookup or failed with transient errors are read and written again,
+// up to Retries times, the ones written by the op already are not merged again. Returns the number of deleted sources
+func (d *DBAccessor) commitRollup(ctx context.Context, op primitive.ObjectID, aggregates []metric.Entry) (int, error) {
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	delay := d.RetryDelay
+	for attempt := 0; ; attempt++ {
+		stored := map[string][]storedBucket{}
+		var err error
+		if len(aggregates) > 0 {
+			if stored, err = d.findBuckets(ctx, aggregates); err != nil {
+				return 0, fmt.Errorf("failed to find stored buckets of %d aggregates: %w", len(aggregates), err)
+			}
+		}
+		var models []mongo.WriteModel
+		duplicates := 0
+		for _, e := range aggregates {
+			vs := stored[bucketKey(e)]
+			if len(vs) > 1 {
+				duplicates += len(vs) - 1
+			}
+			models = append(models, rollupModels(e, op, vs)...)
+		}
+		models = append(models, mongo.NewDeleteManyModel().SetFilter(bson.M{"rollup": op}))
+
+		res, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+		if err == nil {
+			return int(res.DeletedCount) - duplicates, nil
+		}
+		if attempt >= d.Retries || !(isTransient(err) || mongo.IsDuplicateKeyError(err)) {
+			return 0, fmt.Errorf("failed to commit %d aggregates: %w", len(aggregates), err)
+		}
+		log.Printf("[WARN] commit of %d aggregates failed, retry %d in %v: %v", len(aggregates), attempt+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// rollupModels makes the write of the aggregate merged into the stored bucket, followed by deletes of
+// the duplicates of the bucket merged into it, left by the old re-aggregation. The bucket written by the op
+// already is not merged again, only the duplicates left are deleted
+func rollupModels(e metric.Entry, op primitive.ObjectID, stored []storedBucket) []mongo.WriteModel {
+	var models []mongo.WriteModel
+	kept := -1 // the bucket written by the op
+	for i, v := range stored {
+		if v.Op == op {
+			kept = i
+			break
+		}
+	}
+	if kept < 0 {
+		var bucket []storedBucket
+		if len(stored) > 0 {
+			kept = 0
+			v := stored[0]
+			for _, dup := range stored[1:] {
+				_ = v.Merge(dup.Entry) // of the same bucket key, so of the same kind
+			}
+			bucket = []storedBucket{v}
+		}
+		m, _, _ := bucketModel(e, op, bucket)
+		models = append(models, m)
+	}
+	for i, v := range stored {
+		if i != kept {
+			models = append(models, mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": v.ID}))
+		}
+	}
+	return models
+}
+
+// saveCheckpoint keeps the window being re-aggregated, nil clears it
+func (d *DBAccessor) saveCheckpoint(ctx context.Context, cp *rollupCheckpoint) error {
+	var err error
+	if cp == nil {
+		_, err = d.checkpoints().DeleteOne(ctx, bson.M{"_id": rollupCheckpointID})
+	} else {
+		_, err = d.checkpoints().ReplaceOne(ctx, bson.M{"_id": rollupCheckpointID}, cp, options.Replace().SetUpsert(true))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save checkpoint: %w", err)
+	}
+	return nil
+}
+
+// checkpoints returns the collection of re-aggregation checkpoints, next to the metrics one
+func (d *DBAccessor) checkpoints() *mongo.Collection {
+	return d.db.Database(d.dbName).Collection(d.collName + "_rollup")
+}
+
+// DeleteOlder removes entries of any type with timestamp up to (and including) the given time,
+// of the given metrics or of all of them if names is nil
+func (d *DBAccessor) DeleteOlder(ctx context.Context, to time.Time, names []string) error {
+	collection := d.db.Database(d.dbName).Collection(d.collName)
+	res, err := collection.DeleteMany(ctx, namesFilter(bson.M{"time_stamp": bson.M{"$lte": to}}, names))
+	if err != nil {
+		return fmt.Errorf("failed to delete entries older than %v: %w", to, err)
+	}
+	matched := matchNames(names)
+	d.dropLatest(func(e metric.Entry) bool { return matched(e.Name) && !e.TimeStamp.After(to) })
+	log.Printf("deleted %d entries older than %v", res.DeletedCount, to)
+	return nil
+}
+
+// everythingIsMatching finds all documents that are matching the metric series, interval and timeframe
+func (d *DBAccessor) everythingIsMatching(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration) ([]metric.Entry, error) {
 	var results []metric.Entry
 
 	collection := d.db.Database(d.dbName).Collection(d.collName)
 
-	cursor, err := collection.Find(ctx, bson.M{
-		"name": name,
-		"type": interval,
-		"time_stamp": bson.M{
-			"$gte": from,
-			"$lte": to,
-		},
-	})
+	filter := seriesFilter(name, matchers)
+	filter["type"] = interval
+	filter["time_stamp"] = bson.M{
+		"$gte": from,
+		"$lte": to,
+	}
+	cursor, err := collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -186,15 +796,19 @@ func (d *DBAccessor) everythingIsMatching(ctx context.Context, name string, from
 	return results, nil
 }
 
-// aggregateSmallerInterval aggregates all documents that are matching the metric, timeframe from a smaller interval
-func (d *DBAccessor) aggregateSmallerInterval(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+// aggregateSmallerInterval aggregates all documents that are matching the metric series, timeframe from a smaller interval
+func (d *DBAccessor) aggregateSmallerInterval(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration) ([]metric.Entry, error) {
 
 	var results []metric.Entry
 
 	collection := d.db.Database(d.dbName).Collection(d.collName)
 
 	var intervalList []time.Duration
-	list, err := collection.Distinct(ctx, "type", bson.D{{"name", name}, {"type", bson.D{{"$lt", interval}}}, {"time_stamp", bson.D{{"$gte", from}, {"$lte", to}}}}) //nolint
+	filter := seriesFilter(name, matchers)
+	filter["type"] = bson.M{"$lt": interval}
+	filter["time_stamp"] = bson.M{"$gte": from, "$lte": to}
+	list, err := collection.Distinct(ctx, "type", filter)
 
 	if len(list) == 0 {
 		return []metric.Entry{}, nil
@@ -226,14 +840,13 @@ func (d *DBAccessor) aggregateSmallerInterval(ctx context.Context, name string,
 		return []metric.Entry{}, nil
 	}
 
-	cursor, err := collection.Find(ctx, bson.M{
-		"name": name,
-		"type": sInterval,
-		"time_stamp": bson.M{
-			"$gte": from,
-			"$lte": to,
-		},
-	})
+	filter = seriesFilter(name, matchers)
+	filter["type"] = sInterval
+	filter["time_stamp"] = bson.M{
+		"$gte": from,
+		"$lte": to,
+	}
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "time_stamp", Value: 1}})) // gauges keep the last value
 	if err != nil {
 		return nil, err
 	}
@@ -255,7 +868,8 @@ func (d *DBAccessor) aggregateSmallerInterval(ctx context.Context, name string,
 }
 
 // approximateInterval can approximate the requested interval
-func (d *DBAccessor) approximateInterval(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+func (d *DBAccessor) approximateInterval(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time,
+	interval time.Duration) ([]metric.Entry, error) {
 	var results []metric.Entry
 
 	collection := d.db.Database(d.dbName).Collection(d.collName)
@@ -264,17 +878,16 @@ func (d *DBAccessor) approximateInterval(ctx context.Context, name string, from,
 	lowerInterval := time.Second * time.Duration(interval.Seconds()*(1-d.intervalForgivenessPrc))
 	upperInterval := time.Second * time.Duration(interval.Seconds()*(1+d.intervalForgivenessPrc))
 
-	cursor, err := collection.Find(ctx, bson.M{
-		"name": name,
-		"type": bson.M{
-			"$gte": lowerInterval,
-			"$lte": upperInterval,
-		},
-		"time_stamp": bson.M{
-			"$gte": from,
-			"$lte": to,
-		},
-	})
+	filter := seriesFilter(name, matchers)
+	filter["type"] = bson.M{
+		"$gte": lowerInterval,
+		"$lte": upperInterval,
+	}
+	filter["time_stamp"] = bson.M{
+		"$gte": from,
+		"$lte": to,
+	}
+	cursor, err := collection.Find(ctx, filter)
 	if err != nil {
 		return nil, err
 	}
@@ -291,6 +904,92 @@ func (d *DBAccessor) approximateInterval(ctx context.Context, name string, from,
 	return results, nil
 }
 
+// timeRange makes a filter of timestamps in (from, to], zero from for all timestamps up to the given time
+func timeRange(from, to time.Time) bson.M {
+	if from.IsZero() {
+		return bson.M{"$lte": to}
+	}
+	return bson.M{"$gt": from, "$lte": to}
+}
+
+// namesFilter adds the names of metrics to the filter, nil names match all metrics
+func namesFilter(filter bson.M, names []string) bson.M {
+	if names != nil {
+		filter["name"] = bson.M{"$in": names}
+	}
+	return filter
+}
+
+// seriesFilter makes a filter for the documents of the metric series matching label matchers.
+// Missing label matches as an empty value, the same way metric.Matcher does
+func seriesFilter(name string, matchers []metric.Matcher) bson.M {
+	filter := bson.M{"name": name}
+
+	var conds bson.A
+	for _, m := range matchers {
+		field := "labels." + m.Label
+		switch m.Type {
+		case metric.MatchEqual:
+			if m.Value == "" {
+				conds = append(conds, bson.M{field: bson.M{"$in": bson.A{nil, ""}}})
+				continue
+			}
+			conds = append(conds, bson.M{field: m.Value})
+		case metric.MatchNotEqual:
+			if m.Value == "" {
+				conds = append(conds, bson.M{field: bson.M{"$nin": bson.A{nil, ""}}})
+				continue
+			}
+			conds = append(conds, bson.M{field: bson.M{"$ne": m.Value}})
+		case metric.MatchRegexp:
+			re := primitive.Regex{Pattern: "^(?:" + m.Value + ")$"}
+			if m.Matches(nil) { // matches an empty value, so documents without the label match as well
+				conds = append(conds, bson.M{"$or": bson.A{bson.M{field: bson.M{"$exists": false}}, bson.M{field: re}}})
+				continue
+			}
+			conds = append(conds, bson.M{field: re})
+		}
+	}
+
+	if len(conds) > 0 {
+		filter["$and"] = conds
+	}
+	return filter
+}
+
+// mergeBuckets moves entries to their 1m buckets and merges entries of the same bucket, in order.
+// Returns the buckets and indexes of the entries merged into each of them
+func mergeBuckets(entries []metric.Entry) (buckets []metric.Entry, owners [][]int) {
+	pos := make(map[string]int)
+	for i, e := range entries {
+		e.TimeStamp = minuteBucket(e.TimeStamp)
+		e.Type = 1 * time.Minute
+		e.TypeStr = "1m"
+		if k, ok := pos[bucketKey(e)]; ok {
+			_ = buckets[k].Merge(e) // of the same bucket key, so of the same kind
+			buckets[k].TimeStamp = e.TimeStamp
+			owners[k] = append(owners[k], i)
+			continue
+		}
+		pos[bucketKey(e)] = len(buckets)
+		buckets = append(buckets, e)
+		owners = append(owners, []int{i})
+	}
+	return buckets, owners
+}
+
+// bucketKey returns the key of the stored bucket, by series, merge kind, type and timestamp.
+// Entries of the series of different kinds make separate buckets, as they can't be merged
+func bucketKey(e metric.Entry) string {
+	return e.SeriesKey() + "@" + e.MergeKind() + "@" + e.Type.String() + "@" + strconv.FormatInt(e.TimeStamp.UnixNano(), 10)
+}
+
+// minuteBucket returns the time of the 1m bucket of the timestamp, the end of its UTC minute.
+// Buckets are half-open, i.e. samples of 10:05:00 up to 10:05:59.999 make the bucket of 10:06
+func minuteBucket(ts time.Time) time.Time {
+	return ts.UTC().Truncate(time.Minute).Add(time.Minute)
+}
+
 func roundUpTime(t time.Time, roundOn time.Duration) time.Time {
 	var tr time.Time
 	tr = t.Round(roundOn)
@@ -2,10 +2,13 @@ package storage
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/umputun/metrics/metric"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
@@ -14,6 +17,75 @@ import (
 	"time"
 )
 
+func TestDBAccessor_Behaviour(t *testing.T) {
+	testAccessorBehaviour(t, func(t *testing.T) (Accessor, func(entries ...metric.Entry)) {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		t.Cleanup(cancel)
+		dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+		require.NoError(t, err)
+
+		coll := dbConn.Database("test").Collection("metrics")
+		t.Cleanup(func() {
+			require.NoError(t, coll.Drop(ctx))
+			require.NoError(t, dbConn.Database("test").Collection("metrics_rollup").Drop(ctx))
+		})
+
+		acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+		insert := func(entries ...metric.Entry) {
+			require.NoError(t, acc.InsertMany(ctx, entries))
+		}
+		return acc, insert
+	})
+}
+
+func TestDBAccessor_CreateIndexes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+
+	defer func() {
+		err := dbConn.Database("test").Collection("metrics").Drop(ctx)
+		require.NoError(t, err)
+	}()
+
+	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+	require.NoError(t, acc.CreateIndexes(ctx))
+
+	cursor, err := dbConn.Database("test").Collection("metrics").Indexes().List(ctx)
+	require.NoError(t, err)
+	var indexes []bson.M
+	require.NoError(t, cursor.All(ctx, &indexes))
+	assert.Equal(t, 5, len(indexes)) // _id, name+type+time_stamp, labels, time_stamp+type and key
+}
+
+func TestDBAccessor_FindOneMetric_IntValues(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+
+	coll := dbConn.Database("test").Collection("metrics")
+	defer func() {
+		require.NoError(t, coll.Drop(ctx))
+	}()
+
+	// documents written before values became floats
+	tm := time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC)
+	_, err = coll.InsertMany(ctx, []interface{}{
+		bson.M{"name": "file_1", "time_stamp": tm, "value": int64(5), "type": time.Minute, "type_str": "1m"},
+		bson.M{"name": "file_1", "time_stamp": tm.Add(time.Minute), "value": int32(9), "type": time.Minute, "type_str": "1m"},
+	})
+	require.NoError(t, err)
+
+	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+	res, err := acc.FindOneMetric(ctx, "file_1", nil, tm.Add(-time.Hour), tm.Add(time.Hour), 2*time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, 14.0, res[0].Value)
+	assert.Equal(t, "", res[0].Kind)
+}
+
 func TestDBAccessor_Write(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -45,11 +117,214 @@ func TestDBAccessor_Write(t *testing.T) {
 	if err = cursor.All(ctx, &results); err != nil {
 		log.Fatal(err)
 	}
-	i := 0
+	i := 0.0
 	for _, result := range results {
 		i += result.Value
 	}
-	assert.Equal(t, 14, i)
+	assert.Equal(t, 14.0, i)
+}
+
+func TestDBAccessor_WriteManyVersions(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+	coll := dbConn.Database("test").Collection("metrics")
+	defer func() {
+		require.NoError(t, coll.Drop(ctx))
+	}()
+
+	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+	require.NoError(t, acc.CreateIndexes(ctx))
+
+	// bucket stored before versioning is merged and gets the key
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	_, err = coll.InsertOne(ctx, metric.Entry{Name: "file_1", TimeStamp: minuteBucket(tm), Type: time.Minute,
+		TypeStr: "1m", Value: 1})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, acc.WriteMany(ctx, []metric.Entry{
+			{Name: "file_1", TimeStamp: tm, Value: 1},
+			{Name: "file_2", TimeStamp: tm, Value: 2},
+		}))
+	}
+
+	read := func() []storedBucket {
+		cursor, err := coll.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+		require.NoError(t, err)
+		var res []storedBucket
+		require.NoError(t, cursor.All(ctx, &res))
+		return res
+	}
+	res := read()
+	require.Equal(t, 2, len(res), "one bucket per series")
+	assert.Equal(t, 4.0, res[0].Value)
+	assert.Equal(t, bucketKey(res[0].Entry), res[0].Key)
+	assert.Equal(t, int64(3), res[0].Version)
+	assert.Equal(t, 6.0, res[1].Value)
+	assert.Equal(t, int64(3), res[1].Version)
+
+	op := primitive.NewObjectID()
+	model := func(b storedBucket, stored ...storedBucket) mongo.WriteModel {
+		m, _, ok := bucketModel(b.Entry, op, stored)
+		require.True(t, ok)
+		return m
+	}
+	{ // write of a stale version conflicts
+		stale := res[0]
+		stale.Version--
+		_, err = coll.BulkWrite(ctx, []mongo.WriteModel{model(stale, stale)})
+		assert.True(t, mongo.IsDuplicateKeyError(err), "%v", err)
+	}
+	{ // insert of a stored bucket conflicts
+		_, err = coll.BulkWrite(ctx, []mongo.WriteModel{model(res[1])})
+		assert.True(t, mongo.IsDuplicateKeyError(err), "%v", err)
+	}
+	{ // write of the current version merges, once
+		m := model(res[1], res[1])
+		_, err = coll.BulkWrite(ctx, []mongo.WriteModel{m})
+		require.NoError(t, err)
+		_, err = coll.BulkWrite(ctx, []mongo.WriteModel{m})
+		assert.True(t, mongo.IsDuplicateKeyError(err), "%v", err)
+	}
+	res = read()
+	assert.Equal(t, 4.0, res[0].Value)
+	assert.Equal(t, 12.0, res[1].Value)
+	assert.Equal(t, int64(4), res[1].Version)
+	assert.Equal(t, op, res[1].Op)
+
+	// bucket written by the op is not written again
+	_, _, ok := bucketModel(res[1].Entry, op, res[1:])
+	assert.False(t, ok)
+	_, _, ok = bucketModel(res[1].Entry, primitive.NewObjectID(), res[1:])
+	assert.True(t, ok)
+}
+
+func TestDBAccessor_FindLatest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+	coll := dbConn.Database("test").Collection("metrics")
+	defer func() {
+		require.NoError(t, coll.Drop(ctx))
+	}()
+
+	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+	require.NoError(t, acc.CreateIndexes(ctx))
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	require.NoError(t, acc.WriteMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: tm, Value: 1},
+		{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 2},
+		{Name: "file_2", TimeStamp: tm, Value: 3},
+		{Name: "file_3", TimeStamp: tm.Add(-time.Hour), Value: 4},
+	}))
+	latest := func(from time.Time) map[string]float64 {
+		res, err := acc.FindLatest(ctx, from)
+		require.NoError(t, err)
+		values := make(map[string]float64)
+		for _, e := range res {
+			values[e.SeriesKey()] = e.Value
+		}
+		return values
+	}
+
+	// loaded from db, within the time range
+	assert.Equal(t, map[string]float64{"file_1": 2, "file_2": 3}, latest(tm.Add(-time.Minute)))
+
+	// kept by writes, merged into the stored buckets
+	require.NoError(t, acc.WriteMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 5},
+		{Name: "file_2", TimeStamp: tm.Add(-time.Minute), Value: 6},
+		{Name: "file_4", TimeStamp: tm, Value: 7},
+	}))
+	_, err = coll.InsertOne(ctx, metric.Entry{Name: "file_5", TimeStamp: tm, Type: time.Minute, Value: 8})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"file_1": 7, "file_2": 3, "file_4": 7}, latest(tm.Add(-time.Minute)),
+		"writes of others not seen")
+
+	// deleted with the entries
+	require.NoError(t, acc.Delete(ctx, metric.Entry{Name: "file_4"}))
+	require.NoError(t, acc.DeleteOlder(ctx, tm.Add(time.Minute), []string{"file_2"}))
+	assert.Equal(t, map[string]float64{"file_1": 7}, latest(tm.Add(-time.Minute)))
+
+	// looked up again after re-aggregation
+	_, _, err = acc.Rollup(ctx, RollupWindow{From: tm.Add(-2 * time.Hour), To: tm.Add(-time.Hour), SrcType: time.Minute,
+		Interval: 30 * time.Minute})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"file_1": 7, "file_5": 8}, latest(tm.Add(-time.Minute)))
+}
+
+func TestDBAccessor_ResumeRollup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+	coll := dbConn.Database("test").Collection("metrics")
+	defer func() {
+		require.NoError(t, coll.Drop(ctx))
+		require.NoError(t, dbConn.Database("test").Collection("metrics_rollup").Drop(ctx))
+	}()
+
+	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+	require.NoError(t, acc.CreateIndexes(ctx))
+	require.NoError(t, acc.WriteMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 9},
+		{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 5, 12, 23, 0, time.UTC), Value: 11},
+	}))
+	find := func(tp time.Duration) []metric.Entry {
+		res, err := acc.FindByType(ctx, tp, time.Time{}, time.Date(2022, 10, 12, 0, 0, 0, 0, time.UTC), nil)
+		require.NoError(t, err)
+		return res
+	}
+
+	// the run is interrupted once the sources are claimed
+	cp := rollupCheckpoint{ID: rollupCheckpointID, Op: primitive.NewObjectID(), Window: RollupWindow{
+		From: time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC), To: time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
+		SrcType: time.Minute, Interval: 30 * time.Minute}}
+	require.NoError(t, acc.claim(ctx, &cp))
+
+	// the sample of a claimed bucket, written after the claim, goes to a new bucket
+	require.NoError(t, acc.Write(ctx, metric.Entry{Name: "file_1", Value: 1,
+		TimeStamp: time.Date(2022, 10, 11, 2, 10, 50, 0, time.UTC)}))
+	assert.Equal(t, 4, len(find(time.Minute)))
+
+	aggregates, deleted, err := acc.ResumeRollup(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 1, aggregates)
+	assert.Equal(t, 2, deleted, "only claimed sources deleted")
+	res := find(30 * time.Minute)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, 14.0, res[0].Value)
+	res = find(time.Minute)
+	sortByTime(res)
+	require.Equal(t, 2, len(res))
+	assert.Equal(t, 1.0, res[0].Value, "new bucket kept")
+
+	{ // completed window is not resumed, and its commit repeated changes nothing
+		aggregates, deleted, err = acc.ResumeRollup(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, aggregates+deleted)
+		deleted, err = acc.commitRollup(ctx, cp.Op, []metric.Entry{{Name: "file_1", Value: 14, Type: 30 * time.Minute,
+			TimeStamp: time.Date(2022, 10, 11, 2, 30, 0, 0, time.UTC)}})
+		require.NoError(t, err)
+		assert.Equal(t, 0, deleted)
+		assert.Equal(t, 14.0, find(30 * time.Minute)[0].Value)
+	}
+
+	// the next run merges the late bucket into the aggregate
+	aggregates, deleted, err = acc.Rollup(ctx, cp.Window)
+	require.NoError(t, err)
+	assert.Equal(t, 1, aggregates)
+	assert.Equal(t, 1, deleted)
+	res = find(30 * time.Minute)
+	require.Equal(t, 1, len(res))
+	assert.Equal(t, 15.0, res[0].Value)
+	assert.Equal(t, int64(3), res[0].Stats.Count)
+	assert.Equal(t, 1, len(find(time.Minute)), "newer entry kept")
+	assert.ErrorIs(t, dbConn.Database("test").Collection("metrics_rollup").FindOne(ctx, bson.M{}).Err(),
+		mongo.ErrNoDocuments, "checkpoint cleared")
 }
 
 func TestDBAccessor_Delete(t *testing.T) {
@@ -155,7 +430,7 @@ func TestDBAccessor_everythingIsMatching_Success(t *testing.T) {
 		})
 
 	metricsList, err := acc.everythingIsMatching(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		1*time.Minute)
@@ -178,7 +453,7 @@ func TestDBAccessor_everythingIsMatching_None(t *testing.T) {
 	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
 
 	metricsList, err := acc.everythingIsMatching(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 11, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 11, 11, 3, 0, 0, 0, time.UTC),
 		1*time.Minute)
@@ -227,7 +502,7 @@ func TestDBAccessor_aggregateSmallerInterval_Success(t *testing.T) {
 		})
 
 	res, err := acc.aggregateSmallerInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		5*time.Minute)
@@ -262,7 +537,7 @@ func TestDBAccessor_aggregateSmallerInterval_NoData(t *testing.T) {
 		})
 
 	res, err := acc.aggregateSmallerInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 11, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 11, 11, 3, 0, 0, 0, time.UTC),
 		5*time.Minute)
@@ -297,9 +572,7 @@ func TestDBAccessor_aggregateSmallerInterval_NoZeroRemainder(t *testing.T) {
 		})
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 3 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -308,7 +581,7 @@ func TestDBAccessor_aggregateSmallerInterval_NoZeroRemainder(t *testing.T) {
 	require.NoError(t, err)
 
 	res, err := acc.aggregateSmallerInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		5*time.Minute)
@@ -358,9 +631,7 @@ func TestDBAccessor_aggregateSmallerInterval_IntervalCheck(t *testing.T) {
 		})
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 3 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -376,14 +647,14 @@ func TestDBAccessor_aggregateSmallerInterval_IntervalCheck(t *testing.T) {
 	require.NoError(t, err)
 
 	res, err := acc.aggregateSmallerInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		15*time.Minute)
 
 	require.NoError(t, err)
 	assert.Equal(t, 2, len(res))
-	assert.Equal(t, 47, res[0].Value+res[1].Value)
+	assert.Equal(t, 47.0, res[0].Value+res[1].Value)
 }
 
 func TestDBAccessor_ApproximateInterval_Success(t *testing.T) {
@@ -428,9 +699,7 @@ func TestDBAccessor_ApproximateInterval_Success(t *testing.T) {
 	)
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -439,7 +708,7 @@ func TestDBAccessor_ApproximateInterval_Success(t *testing.T) {
 	require.NoError(t, err)
 
 	res, err := acc.approximateInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		6*time.Minute)
@@ -463,7 +732,7 @@ func TestDBAccessor_ApproximateInterval_NoForgiveness(t *testing.T) {
 	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
 
 	res, err := acc.approximateInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		10*time.Minute)
@@ -486,7 +755,7 @@ func TestDBAccessor_ApproximateInterval_NoData(t *testing.T) {
 	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
 
 	res, err := acc.approximateInterval(ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 11, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 11, 11, 3, 0, 0, 0, time.UTC),
 		6*time.Minute)
@@ -567,9 +836,7 @@ func TestDBAccessor_FindOneMetric_EverythingIsMatching(t *testing.T) {
 	)
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -593,7 +860,7 @@ func TestDBAccessor_FindOneMetric_EverythingIsMatching(t *testing.T) {
 
 	res, err := acc.FindOneMetric(
 		ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		5*time.Minute)
@@ -641,14 +908,14 @@ func TestDBAccessor_FindOneMetric_AggrSmallerInterval(t *testing.T) {
 
 	res, err := acc.FindOneMetric(
 		ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		10*time.Minute)
 	require.NoError(t, err)
 
 	assert.Equal(t, 2, len(res))
-	assert.Equal(t, 47, res[0].Value+res[1].Value)
+	assert.Equal(t, 47.0, res[0].Value+res[1].Value)
 }
 
 // successful test when approximating interval
@@ -690,7 +957,7 @@ func TestDBAccessor_FindOneMetric_ApproximateInterval(t *testing.T) {
 
 	res, err := acc.FindOneMetric(
 		ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		2*time.Minute)
@@ -737,9 +1004,7 @@ func TestDBAccessor_FindOneMetric_CannotApprox(t *testing.T) {
 	)
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -749,7 +1014,7 @@ func TestDBAccessor_FindOneMetric_CannotApprox(t *testing.T) {
 
 	res, err := acc.FindOneMetric(
 		ctx,
-		"file_1",
+		"file_1", nil,
 		time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
 		time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
 		2*time.Minute)
@@ -869,9 +1134,7 @@ func TestDBAccessor_FindAll_IntervApprox(t *testing.T) {
 	)
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -936,9 +1199,7 @@ func TestDBAccessor_FindAll_CannotApprox(t *testing.T) {
 	)
 
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -955,3 +1216,74 @@ func TestDBAccessor_FindAll_CannotApprox(t *testing.T) {
 
 	assert.Equal(t, 0, len(res))
 }
+
+func TestDBAccessor_InsertManyPartialFailure(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	dbConn, err := mongo.Connect(ctx, options.Client().ApplyURI("mongodb://localhost:27017"))
+	require.NoError(t, err)
+	coll := dbConn.Database("test").Collection("metrics")
+	defer func() {
+		require.NoError(t, coll.Drop(ctx))
+	}()
+
+	// unique index makes the second entry of the same name fail, duplicates are not retried
+	_, err = coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true)})
+	require.NoError(t, err)
+
+	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
+	acc.RetryDelay = time.Millisecond
+	tm := time.Date(2022, 7, 29, 12, 10, 0, 0, time.UTC)
+	err = acc.InsertMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: tm, Value: 1, Type: 5 * time.Minute},
+		{Name: "file_1", TimeStamp: tm.Add(5 * time.Minute), Value: 2, Type: 5 * time.Minute},
+		{Name: "file_2", TimeStamp: tm, Value: 3, Type: 5 * time.Minute},
+	})
+	require.Error(t, err)
+	var werr *WriteError
+	require.True(t, errors.As(err, &werr))
+	assert.Equal(t, 3, werr.Total)
+	require.Equal(t, 1, len(werr.Failed))
+	for _, e := range werr.Failed {
+		assert.True(t, mongo.IsDuplicateKeyError(e))
+	}
+	assert.Contains(t, err.Error(), "1 of 3 entries failed")
+}
+
+func Test_isTransient(t *testing.T) {
+	tbl := []struct {
+		err error
+		res bool
+	}{
+		{errors.New("blah"), false},
+		{context.DeadlineExceeded, true},
+		{mongo.WriteError{Code: 11000, Message: "duplicate key"}, false},
+		{mongo.WriteError{Code: 11600, Message: "interrupted at shutdown"}, true},
+		{mongo.CommandError{Code: 1, Labels: []string{"RetryableWriteError"}}, true},
+		{mongo.CommandError{Code: 2, Labels: []string{"NetworkError"}}, true},
+		{fmt.Errorf("wrapped: %w", mongo.CommandError{Code: 91}), true},
+	}
+	for i, tt := range tbl {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			assert.Equal(t, tt.res, isTransient(tt.err))
+		})
+	}
+}
+
+func Test_mergeBuckets(t *testing.T) {
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	buckets, owners := mergeBuckets([]metric.Entry{
+		{Name: "file_1", TimeStamp: tm, Value: 1},
+		{Name: "file_1", Labels: map[string]string{"host": "h1"}, TimeStamp: tm, Value: 2},
+		{Name: "file_1", TimeStamp: tm.Add(40 * time.Second), Value: 4},
+		{Name: "file_1", TimeStamp: tm.Add(-10 * time.Second), Value: 8},
+	})
+	require.Equal(t, 3, len(buckets))
+	assert.Equal(t, [][]int{{0, 3}, {1}, {2}}, owners)
+	assert.Equal(t, 9.0, buckets[0].Value)
+	assert.Equal(t, time.Date(2022, 7, 29, 12, 11, 0, 0, time.UTC), buckets[0].TimeStamp)
+	assert.Equal(t, time.Minute, buckets[0].Type)
+	assert.Equal(t, `file_1{host="h1"}`, buckets[1].SeriesKey())
+	assert.Equal(t, time.Date(2022, 7, 29, 12, 12, 0, 0, time.UTC), buckets[2].TimeStamp)
+}
@@ -4,11 +4,12 @@ import (
 	"context"
 	"fmt"
 	"github.com/umputun/metrics/metric"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"sort"
 	"time"
 )
 
+//go:generate moq -out rollupstore_mock.go . RollupStore
+
 // ReaggrBucket contains buckets that need to be re-aggregated in db based on the age and interval
 type ReaggrBucket struct {
 	Interval time.Duration // 30m, 8h, 24h, 7d what interval we want to, to know what the type of the interval is after aggr
@@ -16,74 +17,225 @@ type ReaggrBucket struct {
 	SrcType  time.Duration // to know what type of the interval we are looking for to aggr in db
 }
 
-// Reaggregator allows to connect to a specific MongoDB and collection to re-aggregate data based on the buckets
+// RollupStore provides access to the stored entries for re-aggregation, implemented by every storage backend.
+// Lookups and deletes are limited to the given metrics, nil names match all of them.
+// Rollup aggregates the sources of the window, merges the aggregates into the stored ones of the same buckets
+// and deletes exactly the aggregated sources, returning the number of aggregates and deleted sources.
+// A store which can't do it at once keeps the window until done, and completes it by ResumeRollup
+type RollupStore interface {
+	GetMetricsList(ctx context.Context) ([]string, error)
+	OldestByType(ctx context.Context, tp time.Duration, from, to time.Time, names []string) (time.Time, error)
+	Rollup(ctx context.Context, w RollupWindow) (aggregates, deleted int, err error)
+	ResumeRollup(ctx context.Context) (aggregates, deleted int, err error)
+	DeleteOlder(ctx context.Context, to time.Time, names []string) error
+}
+
+// RollupWindow is the re-aggregation of source entries of SrcType with timestamp in (From, To] into aggregates
+// of Interval, of the given metrics or of all of them if Names is nil
+type RollupWindow struct {
+	From     time.Time     `bson:"from"`
+	To       time.Time     `bson:"to"`
+	SrcType  time.Duration `bson:"src_type"`
+	Interval time.Duration `bson:"interval"`
+	Names    []string      `bson:"names"`
+}
+
+// defaultRollupWindow is the span of source entries committed at once if Reaggregator.Window is not set
+const defaultRollupWindow = time.Hour
+
+// Reaggregator re-aggregates data in the store based on the buckets, and deletes data older than MaxAge.
+// Metrics matching one of Overrides follow its policy instead
 type Reaggregator struct {
-	MongoClient      *mongo.Client
-	DbName, CollName string
-	Buckets          []ReaggrBucket
+	Store     RollupStore
+	Buckets   []ReaggrBucket      // tiers of the default policy, ordered by age
+	MaxAge    time.Duration       // age of the final deletion in the default policy, entries are kept forever if 0
+	Overrides []RetentionOverride // policies of individual metrics, the first matching one is used
+	Window    time.Duration       // span of source entries committed at once, rounded up to the tier interval, 1h if 0
 }
 
-// Do initiates the re-aggregation process in db
+// Validate checks the default policy and the overrides
+func (a *Reaggregator) Validate() error {
+	if err := (RetentionPolicy{Buckets: a.Buckets, MaxAge: a.MaxAge}).Validate(); err != nil {
+		return fmt.Errorf("default policy: %w", err)
+	}
+	for _, o := range a.Overrides {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("policy of %q: %w", o.Pattern, err)
+		}
+	}
+	return nil
+}
+
+// Do initiates the re-aggregation process in db. Failures, except of canceled runs, are counted
 func (a *Reaggregator) Do(ctx context.Context) error {
+	defer reaggrDuration.Since(time.Now())
 
-	for _, bk := range a.Buckets {
-		if err := a.process(ctx, bk); err != nil {
-			return fmt.Errorf("failed to aggregate db: %w", err)
+	if err := a.do(ctx); err != nil {
+		if ctx.Err() == nil {
+			reaggrFailures.Inc()
 		}
+		return err
 	}
 	return nil
 }
 
-func (a *Reaggregator) process(ctx context.Context, bk ReaggrBucket) error {
-	coll := a.MongoClient.Database(a.DbName).Collection(a.CollName)
-	now := time.Now()
-	cursor, err := coll.Find(ctx, bson.M{
-		"type": bk.SrcType,
-		"time_stamp": bson.M{
-			"$lte": time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(-1 * bk.Age)},
-	})
+// do resumes the interrupted re-aggregation, re-aggregates metrics of every policy and deletes the expired ones
+func (a *Reaggregator) do(ctx context.Context) error {
+	if err := a.Validate(); err != nil {
+		return fmt.Errorf("invalid retention policy: %w", err)
+	}
+
+	if err := a.resume(ctx); err != nil {
+		return fmt.Errorf("failed to resume re-aggregation: %w", err)
+	}
 
+	groups, err := a.groups(ctx)
 	if err != nil {
-		return fmt.Errorf("error reading from the db: %w", err)
+		return fmt.Errorf("failed to match metrics to retention policies: %w", err)
 	}
-	defer cursor.Close(ctx)
+	for _, g := range groups {
+		for _, bk := range g.policy.Buckets {
+			if err := a.process(ctx, bk, g.names); err != nil {
+				return fmt.Errorf("failed to aggregate db: %w", err)
+			}
+		}
+		if g.policy.MaxAge > 0 {
+			if err := a.Store.DeleteOlder(ctx, cutoff(time.Now(), g.policy.MaxAge), g.names); err != nil {
+				return fmt.Errorf("failed to delete expired metrics: %w", err)
+			}
+		}
+	}
+	return nil
+}
 
-	var results []metric.Entry
+// policyGroup is a retention policy with metrics following it, nil names for all metrics
+type policyGroup struct {
+	policy RetentionPolicy
+	names  []string
+}
 
-	for cursor.Next(ctx) {
+// groups returns the policies with metrics following them. Without overrides all metrics follow the default policy,
+// otherwise the stored metrics are listed and matched to the overrides
+func (a *Reaggregator) groups(ctx context.Context) ([]policyGroup, error) {
+	def := RetentionPolicy{Buckets: a.Buckets, MaxAge: a.MaxAge}
+	if len(a.Overrides) == 0 {
+		return []policyGroup{{policy: def}}, nil
+	}
 
-		var result metric.Entry
-		if err := cursor.Decode(&result); err != nil {
-			return fmt.Errorf("failed to decode from db: %w", err)
+	names, err := a.Store.GetMetricsList(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byPolicy := make([][]string, len(a.Overrides)+1) // the default policy is the last one
+	for _, name := range names {
+		i := len(a.Overrides)
+		for j, o := range a.Overrides {
+			if o.Match(name) {
+				i = j
+				break
+			}
 		}
-		results, err = aggrProcess(ctx, results, result, bk.Interval)
-		if err != nil {
-			return fmt.Errorf("failed to aggregate db: %w", err)
+		byPolicy[i] = append(byPolicy[i], name)
+	}
+
+	var res []policyGroup
+	for i, names := range byPolicy {
+		if len(names) == 0 {
+			continue // nil names would match all metrics
+		}
+		policy := def
+		if i < len(a.Overrides) {
+			policy = a.Overrides[i].RetentionPolicy
 		}
+		res = append(res, policyGroup{policy: policy, names: names})
 	}
+	return res, nil
+}
 
-	if len(results) == 0 {
-		return nil
+// resume completes the window left by the interrupted run, if any
+func (a *Reaggregator) resume(ctx context.Context) error {
+	aggregates, deleted, err := a.Store.ResumeRollup(ctx)
+	if err != nil {
+		return err
 	}
+	reaggrDocuments.With("inserted").Add(uint64(aggregates))
+	reaggrDocuments.With("deleted").Add(uint64(deleted))
+	return nil
+}
 
-	// insert the aggregated metrics to db
-	for _, v := range results {
-		if _, err := coll.InsertOne(ctx, v); err != nil {
-			return fmt.Errorf("failed to write %+v: %w", v, err)
+// process re-aggregates entries of the tier source type older than the tier age, window by window from the oldest one.
+// Windows are aligned to the tier interval, so buckets are not split between them
+func (a *Reaggregator) process(ctx context.Context, bk ReaggrBucket, names []string) error {
+	to := cutoff(time.Now(), bk.Age)
+	span := a.window(bk)
+
+	var from time.Time
+	for {
+		oldest, err := a.Store.OldestByType(ctx, bk.SrcType, from, to, names)
+		if err != nil {
+			return fmt.Errorf("error reading from the db: %w", err)
+		}
+		if oldest.IsZero() {
+			return nil
 		}
+
+		// the window of the oldest entry, entries on the boundary belong to the previous window as buckets do
+		start := roundUpTime(oldest, span).Add(-span)
+		end := start.Add(span)
+		if end.After(to) {
+			end = to
+		}
+		aggregates, deleted, err := a.Store.Rollup(ctx, RollupWindow{From: start, To: end, SrcType: bk.SrcType,
+			Interval: bk.Interval, Names: names})
+		if err != nil {
+			return fmt.Errorf("failed to write aggregated metrics: %w", err)
+		}
+		reaggrDocuments.With("inserted").Add(uint64(aggregates))
+		reaggrDocuments.With("deleted").Add(uint64(deleted))
+		from = end
 	}
+}
 
-	// delete the un-aggregated metrics from db
-	_, err = coll.DeleteMany(ctx, bson.M{
-		"type": bk.SrcType,
-		"time_stamp": bson.M{
-			"$lte": time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(-1 * bk.Age)},
-	})
-	if err != nil {
-		return fmt.Errorf("failed to delete matching docs in db: %w", err)
+// window returns the span of source entries committed at once, a multiple of the tier interval
+func (a *Reaggregator) window(bk ReaggrBucket) time.Duration {
+	span := a.Window
+	if span <= 0 {
+		span = defaultRollupWindow
+	}
+	if rem := span % bk.Interval; rem != 0 {
+		span += bk.Interval - rem
 	}
+	return span
+}
 
-	return nil
+// rollupEntries aggregates the sources into the buckets of the interval, ordered by bucket key.
+// Sources are aggregated in time order, as gauges keep the last value
+func rollupEntries(ctx context.Context, sources []metric.Entry, interval time.Duration) ([]metric.Entry, error) {
+	sortByTime(sources)
+	var results []metric.Entry
+	var err error
+	for _, e := range sources {
+		if results, err = aggrProcess(ctx, results, e, interval); err != nil {
+			return nil, fmt.Errorf("failed to aggregate: %w", err)
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return bucketKey(results[i]) < bucketKey(results[j]) })
+	return results, nil
+}
+
+// mergeAggregate merges the aggregate into the stored entries of its bucket, more than one if left
+// by the old re-aggregation which inserted aggregates without a lookup
+func mergeAggregate(stored []metric.Entry, aggr metric.Entry) metric.Entry {
+	if len(stored) == 0 {
+		return aggr
+	}
+	v := stored[0]
+	for _, e := range stored[1:] {
+		_ = v.Merge(e) // of the same bucket key, so of the same kind
+	}
+	_ = v.Merge(aggr)
+	v.TimeStamp, v.Type, v.TypeStr = aggr.TimeStamp, aggr.Type, aggr.TypeStr
+	return v
 }
 
 func aggrProcess(ctx context.Context, results []metric.Entry, result metric.Entry, interval time.Duration) ([]metric.Entry, error) {
@@ -96,13 +248,14 @@ func aggrProcess(ctx context.Context, results []metric.Entry, result metric.Entr
 
 	dict := make(map[string]metric.Entry)
 	result.TimeStamp = roundUpTime(result.TimeStamp, interval)
+	// entries of different kinds are aggregated apart, as they can't be merged
 	for _, v := range results {
-		dictKey := v.Name + "+" + v.TimeStamp.String()
+		dictKey := v.SeriesKey() + "+" + v.MergeKind() + "+" + v.TimeStamp.String()
 		dict[dictKey] = v
 	}
 	var finalResults []metric.Entry
 
-	dictKey := result.Name + "+" + result.TimeStamp.String()
+	dictKey := result.SeriesKey() + "+" + result.MergeKind() + "+" + result.TimeStamp.String()
 	v, ok := dict[dictKey]
 	if !ok {
 		// metric not found
@@ -116,7 +269,9 @@ func aggrProcess(ctx context.Context, results []metric.Entry, result metric.Entr
 	}
 
 	// metric found
-	v.Value += result.Value
+	if err := v.Merge(result); err != nil {
+		return nil, err
+	}
 	v.Type = interval
 	v.TypeStr = interval.String()
 	dict[dictKey] = v
@@ -125,3 +280,14 @@ func aggrProcess(ctx context.Context, results []metric.Entry, result metric.Entr
 	}
 	return finalResults, nil
 }
+
+// cutoff returns the start of the UTC day of now, moved back by age. Entries up to it are older than the age
+func cutoff(now time.Time, age time.Duration) time.Time {
+	now = now.UTC()
+	return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC).Add(-1 * age)
+}
+
+// sortByTime sorts entries by timestamp, keeping the order of entries with the same timestamp
+func sortByTime(entries []metric.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].TimeStamp.Before(entries[j].TimeStamp) })
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/umputun/metrics/metric"
@@ -9,6 +10,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -23,6 +25,7 @@ func TestReaggregator_Do(t *testing.T) {
 	defer func() {
 		err := dbConn.Database("test").Collection("metrics").Drop(ctx)
 		require.NoError(t, err)
+		require.NoError(t, dbConn.Database("test").Collection("metrics_rollup").Drop(ctx))
 	}()
 
 	acc := NewAccessor(dbConn, "test", "metrics", 0.25)
@@ -64,9 +67,7 @@ func TestReaggregator_Do(t *testing.T) {
 
 	// successful test
 	reagg := &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 3 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
 		},
@@ -87,9 +88,7 @@ func TestReaggregator_Do(t *testing.T) {
 
 	// failed test due to no data old enough
 	reagg = &Reaggregator{
-		MongoClient: dbConn,
-		DbName:      "test",
-		CollName:    "metrics",
+		Store: acc,
 		Buckets: []ReaggrBucket{
 			{Interval: 30 * time.Minute, Age: 12000 * time.Hour, SrcType: 3 * time.Minute},
 		},
@@ -99,3 +98,269 @@ func TestReaggregator_Do(t *testing.T) {
 
 	assert.Equal(t, nil, err)
 }
+
+func TestReaggregator_DoWithStores(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	boltAcc, err := NewBoltAccessor(filepath.Join(t.TempDir(), "metrics.db"), 0.25)
+	require.NoError(t, err)
+	defer boltAcc.Close()
+
+	stores := map[string]interface {
+		Accessor
+		typedRollupStore
+	}{"memory": NewMemAccessor(0.25), "bolt": boltAcc}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, e := range []metric.Entry{
+				{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 5},
+				{Name: "file_2", TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 9},
+				{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 12, 23, 0, time.UTC), Value: 11},
+				{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 13, 23, 0, time.UTC), Value: 11},
+				{Name: "file_1", TimeStamp: time.Date(2022, 10, 11, 2, 20, 23, 0, time.UTC), Value: 11},
+			} {
+				require.NoError(t, store.Write(ctx, e))
+			}
+
+			reagg := &Reaggregator{
+				Store: store,
+				Buckets: []ReaggrBucket{
+					{Interval: 3 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
+				},
+			}
+			require.NoError(t, reagg.Do(ctx))
+
+			res, err := store.FindByType(ctx, time.Minute, time.Time{}, time.Now(), nil)
+			require.NoError(t, err)
+			assert.Equal(t, 0, len(res))
+
+			res, err = store.FindByType(ctx, 3*time.Minute, time.Time{}, time.Now(), nil)
+			require.NoError(t, err)
+			assert.Equal(t, 3, len(res))
+
+			res, err = store.FindOneMetric(ctx, "file_1", nil, time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
+				time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC), 3*time.Minute)
+			require.NoError(t, err)
+			require.Equal(t, 2, len(res))
+			assert.Equal(t, 33.0, res[0].Value+res[1].Value)
+		})
+	}
+
+	for name, store := range map[string]interface {
+		Accessor
+		typedRollupStore
+		InsertMany(ctx context.Context, entries []metric.Entry) error
+	}{"memory gauge": NewMemAccessor(0.25), "bolt gauge": boltAcc} {
+		t.Run(name, func(t *testing.T) {
+			for _, e := range []metric.Entry{
+				{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 11, 23, 0, time.UTC), Value: 70.5},
+				{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC), Value: 10},
+				{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 10, 11, 2, 12, 23, 0, time.UTC), Value: 30.5},
+			} {
+				require.NoError(t, store.Write(ctx, e))
+			}
+
+			reagg := &Reaggregator{Store: store, Buckets: []ReaggrBucket{
+				{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute},
+			}}
+			require.NoError(t, reagg.Do(ctx))
+
+			res, err := store.FindByType(ctx, 5*time.Minute, time.Time{}, time.Now(), nil)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(res))
+			assert.Equal(t, 30.5, res[0].Value, "the last value kept")
+			assert.Equal(t, metric.KindGauge, res[0].Kind)
+			assert.Equal(t, &metric.Stats{Count: 3, Sum: 111, Min: 10, Max: 70.5, Last: 30.5}, res[0].Stats)
+			assert.Equal(t, metric.NewSketch(10, 30.5, 70.5), res[0].Sketch)
+
+			// the next roll-up keeps stats exact
+			require.NoError(t, store.InsertMany(ctx, []metric.Entry{{Name: "cpu", Kind: metric.KindGauge,
+				TimeStamp: time.Date(2022, 10, 11, 2, 20, 0, 0, time.UTC), Value: 5, Type: 5 * time.Minute, TypeStr: "5m0s",
+				Stats: &metric.Stats{Count: 5, Sum: 100, Min: 5, Max: 90, Last: 5}}}))
+			reagg = &Reaggregator{Store: store, Buckets: []ReaggrBucket{
+				{Interval: 30 * time.Minute, Age: 24 * time.Hour, SrcType: 5 * time.Minute},
+			}}
+			require.NoError(t, reagg.Do(ctx))
+			res, err = store.FindByType(ctx, 30*time.Minute, time.Time{}, time.Now(), nil)
+			require.NoError(t, err)
+			require.Equal(t, 1, len(res))
+			assert.Equal(t, 5.0, res[0].Value)
+			assert.Equal(t, &metric.Stats{Count: 8, Sum: 211, Min: 5, Max: 90, Last: 5}, res[0].Stats)
+		})
+	}
+}
+
+func TestReaggregator_DoWithMock(t *testing.T) {
+	oldest := time.Date(2022, 10, 11, 2, 11, 0, 0, time.UTC)
+	store := &RollupStoreMock{
+		OldestByTypeFunc: func(ctx context.Context, tp time.Duration, from, to time.Time, names []string) (time.Time, error) {
+			if tp != time.Minute || !oldest.After(from) {
+				return time.Time{}, nil
+			}
+			return oldest, nil
+		},
+		RollupFunc: func(ctx context.Context, w RollupWindow) (int, int, error) {
+			return 2, 3, nil
+		},
+		ResumeRollupFunc: func(ctx context.Context) (int, int, error) {
+			return 0, 0, nil
+		},
+	}
+
+	reagg := &Reaggregator{
+		Store:   store,
+		Buckets: []ReaggrBucket{{Interval: 30 * time.Minute, Age: 24 * time.Hour, SrcType: 1 * time.Minute}},
+	}
+
+	{ // successful attempt
+		inserted, deleted := reaggrDocuments.With("inserted").Value(), reaggrDocuments.With("deleted").Value()
+		require.NoError(t, reagg.Do(context.Background()))
+		assert.Equal(t, uint64(2), reaggrDocuments.With("inserted").Value()-inserted)
+		assert.Equal(t, uint64(3), reaggrDocuments.With("deleted").Value()-deleted)
+
+		assert.Equal(t, 1, len(store.ResumeRollupCalls()))
+		require.Equal(t, 1, len(store.RollupCalls()))
+		assert.Equal(t, RollupWindow{From: time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
+			To: time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC), SrcType: time.Minute, Interval: 30 * time.Minute},
+			store.RollupCalls()[0].W, "window of the oldest entry")
+		require.Equal(t, 2, len(store.OldestByTypeCalls()))
+		assert.Equal(t, store.RollupCalls()[0].W.To, store.OldestByTypeCalls()[1].From, "next window after the committed one")
+	}
+
+	{ // failed rollup
+		store.RollupFunc = func(ctx context.Context, w RollupWindow) (int, int, error) {
+			return 0, 0, errors.New("oh oh")
+		}
+		err := reagg.Do(context.Background())
+		assert.EqualError(t, err, "failed to aggregate db: failed to write aggregated metrics: oh oh")
+	}
+
+	{ // the interrupted window is completed first
+		store.ResumeRollupFunc = func(ctx context.Context) (int, int, error) {
+			return 1, 2, nil
+		}
+		oldest = time.Time{}
+		inserted, deleted := reaggrDocuments.With("inserted").Value(), reaggrDocuments.With("deleted").Value()
+		require.NoError(t, reagg.Do(context.Background()))
+		assert.Equal(t, uint64(1), reaggrDocuments.With("inserted").Value()-inserted)
+		assert.Equal(t, uint64(2), reaggrDocuments.With("deleted").Value()-deleted)
+		assert.Equal(t, 2, len(store.RollupCalls()), "nothing else to re-aggregate")
+	}
+
+	{ // failed resume
+		store.ResumeRollupFunc = func(ctx context.Context) (int, int, error) {
+			return 0, 0, errors.New("oh oh")
+		}
+		failures := reaggrFailures.Value()
+		err := reagg.Do(context.Background())
+		assert.EqualError(t, err, "failed to resume re-aggregation: oh oh")
+		assert.Equal(t, 4, len(store.ResumeRollupCalls()))
+		assert.Equal(t, uint64(1), reaggrFailures.Value()-failures)
+	}
+
+	{ // canceled run is not a failure
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		failures := reaggrFailures.Value()
+		assert.Error(t, reagg.Do(ctx))
+		assert.Equal(t, uint64(0), reaggrFailures.Value()-failures)
+	}
+}
+
+func Test_Reaggregator_window(t *testing.T) {
+	tbl := []struct {
+		window, interval, res time.Duration
+	}{
+		{0, 5 * time.Minute, time.Hour},
+		{0, 7 * time.Minute, 63 * time.Minute},
+		{0, 24 * time.Hour, 24 * time.Hour},
+		{6 * time.Hour, time.Hour, 6 * time.Hour},
+		{time.Minute, 5 * time.Minute, 5 * time.Minute},
+	}
+
+	for i, tt := range tbl {
+		reagg := Reaggregator{Window: tt.window}
+		assert.Equal(t, tt.res, reagg.window(ReaggrBucket{Interval: tt.interval}), "case %d", i)
+	}
+}
+
+func TestReaggregator_DoPolicies(t *testing.T) {
+	store := &RollupStoreMock{
+		GetMetricsListFunc: func(ctx context.Context) ([]string, error) {
+			return []string{"billing", "cpu", "debug_cpu", "debug_mem"}, nil
+		},
+		OldestByTypeFunc: func(ctx context.Context, tp time.Duration, from, to time.Time, names []string) (time.Time, error) {
+			return time.Time{}, nil
+		},
+		ResumeRollupFunc: func(ctx context.Context) (int, int, error) {
+			return 0, 0, nil
+		},
+		DeleteOlderFunc: func(ctx context.Context, to time.Time, names []string) error {
+			return nil
+		},
+	}
+	day := 24 * time.Hour
+	reagg := &Reaggregator{
+		Store:   store,
+		Buckets: []ReaggrBucket{{Interval: 5 * time.Minute, Age: day, SrcType: time.Minute}},
+		MaxAge:  30 * day,
+		Overrides: []RetentionOverride{
+			{Pattern: "debug_*", RetentionPolicy: RetentionPolicy{MaxAge: 7 * day}},
+			{Pattern: "billing", RetentionPolicy: RetentionPolicy{Buckets: []ReaggrBucket{
+				{Interval: time.Hour, Age: 7 * day, SrcType: time.Minute},
+			}}},
+			{Pattern: "unused", RetentionPolicy: RetentionPolicy{MaxAge: day}},
+		},
+	}
+
+	{ // metrics follow the first matching policy
+		require.NoError(t, reagg.Do(context.Background()))
+		findCalls := store.OldestByTypeCalls()
+		require.Equal(t, 2, len(findCalls))
+		assert.Equal(t, []string{"billing"}, findCalls[0].Names)
+		assert.Equal(t, time.Minute, findCalls[0].Tp)
+		assert.Equal(t, cutoff(time.Now(), 7*day), findCalls[0].To)
+		assert.Equal(t, []string{"cpu"}, findCalls[1].Names)
+		assert.Equal(t, cutoff(time.Now(), day), findCalls[1].To)
+
+		deleteCalls := store.DeleteOlderCalls()
+		require.Equal(t, 2, len(deleteCalls), "billing is kept forever")
+		assert.Equal(t, []string{"debug_cpu", "debug_mem"}, deleteCalls[0].Names)
+		assert.Equal(t, cutoff(time.Now(), 7*day), deleteCalls[0].To)
+		assert.Equal(t, []string{"cpu"}, deleteCalls[1].Names)
+		assert.Equal(t, cutoff(time.Now(), 30*day), deleteCalls[1].To)
+	}
+
+	{ // without overrides the default policy applies to all metrics
+		reagg := &Reaggregator{Store: store, MaxAge: 30 * day}
+		require.NoError(t, reagg.Do(context.Background()))
+		require.Equal(t, 3, len(store.DeleteOlderCalls()))
+		assert.Nil(t, store.DeleteOlderCalls()[2].Names)
+		assert.Equal(t, 1, len(store.GetMetricsListCalls()))
+	}
+
+	{ // failed deletion
+		store.DeleteOlderFunc = func(ctx context.Context, to time.Time, names []string) error {
+			return errors.New("oh oh")
+		}
+		err := reagg.Do(context.Background())
+		assert.EqualError(t, err, "failed to delete expired metrics: oh oh")
+	}
+
+	{ // failed metrics list
+		store.GetMetricsListFunc = func(ctx context.Context) ([]string, error) { return nil, errors.New("oh oh") }
+		err := reagg.Do(context.Background())
+		assert.EqualError(t, err, "failed to match metrics to retention policies: oh oh")
+	}
+
+	{ // invalid policy, nothing touched
+		calls := len(store.GetMetricsListCalls())
+		reagg.Overrides[1].Buckets[0].Interval = 90 * time.Second
+		err := reagg.Do(context.Background())
+		assert.EqualError(t, err, `invalid retention policy: policy of "billing": tier 1: interval 1m30s is not a `+
+			`multiple of the source type 1m0s`)
+		assert.Equal(t, calls, len(store.GetMetricsListCalls()))
+	}
+}
@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RetentionPolicy is how stored entries of a metric are rolled up and when they are deleted
+type RetentionPolicy struct {
+	Buckets []ReaggrBucket // tiers ordered by age, each one rolls up the interval of the previous one
+	MaxAge  time.Duration  // entries older than this are deleted, kept forever if 0
+}
+
+// RetentionOverride is the retention policy of metrics matching the pattern
+type RetentionOverride struct {
+	Pattern string // metric name or a pattern of names, i.e. debug_*, in path.Match syntax
+	RetentionPolicy
+}
+
+// RetentionConfig is the default retention policy and the overrides, the first matching override is used
+type RetentionConfig struct {
+	Default   RetentionPolicy
+	Overrides []RetentionOverride
+}
+
+// Validate checks the interval of every tier is a multiple of its source type, tiers are chained
+// and ordered by age, and the final deletion is after the last tier
+func (p RetentionPolicy) Validate() error {
+	for i, bk := range p.Buckets {
+		if bk.SrcType <= 0 || bk.Interval <= bk.SrcType {
+			return fmt.Errorf("tier %d: interval %v should be longer than the source type %v", i+1, bk.Interval, bk.SrcType)
+		}
+		if bk.Interval%bk.SrcType != 0 {
+			return fmt.Errorf("tier %d: interval %v is not a multiple of the source type %v", i+1, bk.Interval, bk.SrcType)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := p.Buckets[i-1]
+		if bk.SrcType != prev.Interval {
+			return fmt.Errorf("tier %d: source type %v is not the interval %v of the previous tier", i+1, bk.SrcType,
+				prev.Interval)
+		}
+		if bk.Age <= prev.Age {
+			return fmt.Errorf("tier %d: age %v is not after the age %v of the previous tier", i+1, bk.Age, prev.Age)
+		}
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("negative max age %v", p.MaxAge)
+	}
+	if n := len(p.Buckets); p.MaxAge > 0 && n > 0 && p.MaxAge <= p.Buckets[n-1].Age {
+		return fmt.Errorf("max age %v is not after the age %v of the last tier", p.MaxAge, p.Buckets[n-1].Age)
+	}
+	return nil
+}
+
+// Validate checks the pattern and the policy
+func (o RetentionOverride) Validate() error {
+	if o.Pattern == "" {
+		return errors.New("empty pattern")
+	}
+	if _, err := path.Match(o.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern: %w", err)
+	}
+	return o.RetentionPolicy.Validate()
+}
+
+// Match checks if the metric follows the override
+func (o RetentionOverride) Match(name string) bool {
+	ok, err := path.Match(o.Pattern, name)
+	return err == nil && ok
+}
+
+// ParseTiers makes tiers of interval:age specs, i.e. 5m:1d, each one rolling up the interval of the previous one,
+// the first one rolls up 1m entries
+func ParseTiers(specs []string) ([]ReaggrBucket, error) {
+	var res []ReaggrBucket
+	src := time.Minute
+	for _, spec := range specs {
+		elems := strings.Split(spec, ":")
+		if len(elems) != 2 {
+			return nil, fmt.Errorf("invalid tier %q, expected interval:age", spec)
+		}
+		interval, err := ParseDuration(elems[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval of tier %q: %w", spec, err)
+		}
+		age, err := ParseDuration(elems[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid age of tier %q: %w", spec, err)
+		}
+		res = append(res, ReaggrBucket{Interval: interval, Age: age, SrcType: src})
+		src = interval
+	}
+	return res, nil
+}
+
+// ParseDuration parses duration the same way as time.ParseDuration, with days allowed, i.e. 90d or 1d12h
+func ParseDuration(s string) (time.Duration, error) {
+	days := time.Duration(0)
+	if i := strings.Index(s, "d"); i >= 0 {
+		n, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid days in %q", s)
+		}
+		days, s = time.Duration(n)*24*time.Hour, s[i+1:]
+		if s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return days + d, nil
+}
+
+// LoadRetention reads retention config from the yaml file, i.e.
+//
+//	default:
+//	  tiers:
+//	    - {to: 5m, after: 1d}
+//	    - {to: 1h, after: 7d}
+//	  max_age: 365d
+//	overrides:
+//	  - pattern: debug_*
+//	    max_age: 7d
+//
+// Source type of a tier is the interval of the previous one if not set, 1m for the first one
+func LoadRetention(fileName string) (RetentionConfig, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return RetentionConfig{}, fmt.Errorf("failed to read retention config: %w", err)
+	}
+
+	type tier struct {
+		From  yamlDuration `yaml:"from"`
+		To    yamlDuration `yaml:"to"`
+		After yamlDuration `yaml:"after"`
+	}
+	type policy struct {
+		Pattern string       `yaml:"pattern"`
+		Tiers   []tier       `yaml:"tiers"`
+		MaxAge  yamlDuration `yaml:"max_age"`
+	}
+	var file struct {
+		Default   policy   `yaml:"default"`
+		Overrides []policy `yaml:"overrides"`
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err = dec.Decode(&file); err != nil {
+		return RetentionConfig{}, fmt.Errorf("failed to parse retention config %s: %w", fileName, err)
+	}
+
+	toPolicy := func(p policy) RetentionPolicy {
+		res := RetentionPolicy{MaxAge: time.Duration(p.MaxAge)}
+		src := time.Minute
+		for _, t := range p.Tiers {
+			if t.From != 0 {
+				src = time.Duration(t.From)
+			}
+			res.Buckets = append(res.Buckets, ReaggrBucket{Interval: time.Duration(t.To), Age: time.Duration(t.After),
+				SrcType: src})
+			src = time.Duration(t.To)
+		}
+		return res
+	}
+
+	res := RetentionConfig{Default: toPolicy(file.Default)}
+	for _, o := range file.Overrides {
+		res.Overrides = append(res.Overrides, RetentionOverride{Pattern: o.Pattern, RetentionPolicy: toPolicy(o)})
+	}
+	return res, nil
+}
+
+// yamlDuration is a duration in yaml, in ParseDuration format
+type yamlDuration time.Duration
+
+// UnmarshalYAML parses the duration
+func (d *yamlDuration) UnmarshalYAML(value *yaml.Node) error {
+	v, err := ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q at line %d: %w", value.Value, value.Line, err)
+	}
+	*d = yamlDuration(v)
+	return nil
+}
+
+// matchNames returns the check of the metric name to be one of names, all names match if names is nil
+func matchNames(names []string) func(name string) bool {
+	if names == nil {
+		return func(string) bool { return true }
+	}
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return func(name string) bool { return set[name] }
+}
@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy_Validate(t *testing.T) {
+	day := 24 * time.Hour
+	tbl := []struct {
+		policy RetentionPolicy
+		err    string
+	}{
+		{RetentionPolicy{}, ""},
+		{RetentionPolicy{MaxAge: 30 * day}, ""},
+		{RetentionPolicy{Buckets: []ReaggrBucket{
+			{Interval: 5 * time.Minute, Age: day, SrcType: time.Minute},
+			{Interval: time.Hour, Age: 7 * day, SrcType: 5 * time.Minute},
+			{Interval: day, Age: 90 * day, SrcType: time.Hour},
+		}, MaxAge: 365 * day}, ""},
+		{RetentionPolicy{Buckets: []ReaggrBucket{{Interval: 90 * time.Second, Age: day, SrcType: time.Minute}}},
+			"tier 1: interval 1m30s is not a multiple of the source type 1m0s"},
+		{RetentionPolicy{Buckets: []ReaggrBucket{{Interval: time.Minute, Age: day, SrcType: time.Minute}}},
+			"tier 1: interval 1m0s should be longer than the source type 1m0s"},
+		{RetentionPolicy{Buckets: []ReaggrBucket{{Interval: 5 * time.Minute, Age: day}}},
+			"tier 1: interval 5m0s should be longer than the source type 0s"},
+		{RetentionPolicy{Buckets: []ReaggrBucket{
+			{Interval: 5 * time.Minute, Age: day, SrcType: time.Minute},
+			{Interval: time.Hour, Age: 7 * day, SrcType: time.Minute},
+		}}, "tier 2: source type 1m0s is not the interval 5m0s of the previous tier"},
+		{RetentionPolicy{Buckets: []ReaggrBucket{
+			{Interval: 5 * time.Minute, Age: 7 * day, SrcType: time.Minute},
+			{Interval: time.Hour, Age: day, SrcType: 5 * time.Minute},
+		}}, "tier 2: age 24h0m0s is not after the age 168h0m0s of the previous tier"},
+		{RetentionPolicy{Buckets: []ReaggrBucket{{Interval: 5 * time.Minute, Age: 7 * day, SrcType: time.Minute}},
+			MaxAge: day}, "max age 24h0m0s is not after the age 168h0m0s of the last tier"},
+		{RetentionPolicy{MaxAge: -time.Hour}, "negative max age -1h0m0s"},
+	}
+
+	for i, tt := range tbl {
+		err := tt.policy.Validate()
+		if tt.err == "" {
+			assert.NoError(t, err, "case %d", i)
+			continue
+		}
+		assert.EqualError(t, err, tt.err, "case %d", i)
+	}
+}
+
+func TestRetentionOverride(t *testing.T) {
+	o := RetentionOverride{Pattern: "debug_*", RetentionPolicy: RetentionPolicy{MaxAge: time.Hour}}
+	require.NoError(t, o.Validate())
+	assert.True(t, o.Match("debug_cpu"))
+	assert.False(t, o.Match("cpu"))
+
+	assert.EqualError(t, RetentionOverride{}.Validate(), "empty pattern")
+	assert.EqualError(t, RetentionOverride{Pattern: "debug_["}.Validate(), "invalid pattern: syntax error in pattern")
+	o.MaxAge = -time.Hour
+	assert.EqualError(t, o.Validate(), "negative max age -1h0m0s")
+}
+
+func TestParseTiers(t *testing.T) {
+	res, err := ParseTiers([]string{"5m:1d", "1h:7d", "1d:90d"})
+	require.NoError(t, err)
+	assert.Equal(t, []ReaggrBucket{
+		{Interval: 5 * time.Minute, Age: 24 * time.Hour, SrcType: time.Minute},
+		{Interval: time.Hour, Age: 7 * 24 * time.Hour, SrcType: 5 * time.Minute},
+		{Interval: 24 * time.Hour, Age: 90 * 24 * time.Hour, SrcType: time.Hour},
+	}, res)
+
+	res, err = ParseTiers(nil)
+	require.NoError(t, err)
+	assert.Empty(t, res)
+
+	_, err = ParseTiers([]string{"5m"})
+	assert.EqualError(t, err, `invalid tier "5m", expected interval:age`)
+	_, err = ParseTiers([]string{"5x:1d"})
+	assert.EqualError(t, err, `invalid interval of tier "5x:1d": time: unknown unit "x" in duration "5x"`)
+	_, err = ParseTiers([]string{"5m:blah"})
+	assert.EqualError(t, err, `invalid age of tier "5m:blah": time: invalid duration "blah"`)
+}
+
+func TestParseDuration(t *testing.T) {
+	tbl := []struct {
+		in  string
+		res time.Duration
+		err bool
+	}{
+		{"5m", 5 * time.Minute, false},
+		{"90d", 90 * 24 * time.Hour, false},
+		{"1d12h", 36 * time.Hour, false},
+		{"0", 0, false},
+		{"xd", 0, true},
+		{"1d12", 0, true},
+		{"", 0, true},
+	}
+
+	for i, tt := range tbl {
+		res, err := ParseDuration(tt.in)
+		if tt.err {
+			assert.Error(t, err, "case %d", i)
+			continue
+		}
+		require.NoError(t, err, "case %d", i)
+		assert.Equal(t, tt.res, res, "case %d", i)
+	}
+}
+
+func TestLoadRetention(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "retention.yml")
+	conf := `
+default:
+  tiers:
+    - {to: 5m, after: 1d}
+    - {to: 1h, after: 7d}
+    - {to: 1d, after: 90d}
+  max_age: 365d
+overrides:
+  - pattern: debug_*
+    max_age: 7d
+  - pattern: billing
+    tiers:
+      - {from: 5m, to: 1h, after: 30d}
+`
+	require.NoError(t, os.WriteFile(fileName, []byte(conf), 0o600))
+
+	res, err := LoadRetention(fileName)
+	require.NoError(t, err)
+	day := 24 * time.Hour
+	assert.Equal(t, RetentionConfig{
+		Default: RetentionPolicy{Buckets: []ReaggrBucket{
+			{Interval: 5 * time.Minute, Age: day, SrcType: time.Minute},
+			{Interval: time.Hour, Age: 7 * day, SrcType: 5 * time.Minute},
+			{Interval: day, Age: 90 * day, SrcType: time.Hour},
+		}, MaxAge: 365 * day},
+		Overrides: []RetentionOverride{
+			{Pattern: "debug_*", RetentionPolicy: RetentionPolicy{MaxAge: 7 * day}},
+			{Pattern: "billing", RetentionPolicy: RetentionPolicy{Buckets: []ReaggrBucket{
+				{Interval: time.Hour, Age: 30 * day, SrcType: 5 * time.Minute},
+			}}},
+		},
+	}, res)
+
+	require.NoError(t, os.WriteFile(fileName, []byte("default:\n  max_age: 1x\n"), 0o600))
+	_, err = LoadRetention(fileName)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `invalid duration "1x" at line 2`)
+
+	require.NoError(t, os.WriteFile(fileName, []byte("default:\n  maxage: 1d\n"), 0o600))
+	_, err = LoadRetention(fileName)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "field maxage not found")
+
+	_, err = LoadRetention(filepath.Join(t.TempDir(), "nope.yml"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to read retention config")
+}
@@ -0,0 +1,294 @@
+// Code generated by moq; DO NOT EDIT.
+// github.com/matryer/moq
+
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Ensure, that RollupStoreMock does implement RollupStore.
+// If this is not the case, regenerate this file with moq.
+var _ RollupStore = &RollupStoreMock{}
+
+// RollupStoreMock is a mock implementation of RollupStore.
+//
+// 	func TestSomethingThatUsesRollupStore(t *testing.T) {
+//
+// 		// make and configure a mocked RollupStore
+// 		mockedRollupStore := &RollupStoreMock{
+// 			DeleteOlderFunc: func(ctx context.Context, to time.Time, names []string) error {
+// 				panic("mock out the DeleteOlder method")
+// 			},
+// 			GetMetricsListFunc: func(ctx context.Context) ([]string, error) {
+// 				panic("mock out the GetMetricsList method")
+// 			},
+// 			OldestByTypeFunc: func(ctx context.Context, tp time.Duration, from time.Time, to time.Time, names []string) (time.Time, error) {
+// 				panic("mock out the OldestByType method")
+// 			},
+// 			ResumeRollupFunc: func(ctx context.Context) (int, int, error) {
+// 				panic("mock out the ResumeRollup method")
+// 			},
+// 			RollupFunc: func(ctx context.Context, w RollupWindow) (int, int, error) {
+// 				panic("mock out the Rollup method")
+// 			},
+// 		}
+//
+// 		// use mockedRollupStore in code that requires RollupStore
+// 		// and then make assertions.
+//
+// 	}
+type RollupStoreMock struct {
+	// DeleteOlderFunc mocks the DeleteOlder method.
+	DeleteOlderFunc func(ctx context.Context, to time.Time, names []string) error
+
+	// GetMetricsListFunc mocks the GetMetricsList method.
+	GetMetricsListFunc func(ctx context.Context) ([]string, error)
+
+	// OldestByTypeFunc mocks the OldestByType method.
+	OldestByTypeFunc func(ctx context.Context, tp time.Duration, from time.Time, to time.Time, names []string) (time.Time, error)
+
+	// ResumeRollupFunc mocks the ResumeRollup method.
+	ResumeRollupFunc func(ctx context.Context) (int, int, error)
+
+	// RollupFunc mocks the Rollup method.
+	RollupFunc func(ctx context.Context, w RollupWindow) (int, int, error)
+
+	// calls tracks calls to the methods.
+	calls struct {
+		// DeleteOlder holds details about calls to the DeleteOlder method.
+		DeleteOlder []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// To is the to argument value.
+			To time.Time
+			// Names is the names argument value.
+			Names []string
+		}
+		// GetMetricsList holds details about calls to the GetMetricsList method.
+		GetMetricsList []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+		// OldestByType holds details about calls to the OldestByType method.
+		OldestByType []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// Tp is the tp argument value.
+			Tp time.Duration
+			// From is the from argument value.
+			From time.Time
+			// To is the to argument value.
+			To time.Time
+			// Names is the names argument value.
+			Names []string
+		}
+		// ResumeRollup holds details about calls to the ResumeRollup method.
+		ResumeRollup []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+		}
+		// Rollup holds details about calls to the Rollup method.
+		Rollup []struct {
+			// Ctx is the ctx argument value.
+			Ctx context.Context
+			// W is the w argument value.
+			W RollupWindow
+		}
+	}
+	lockDeleteOlder    sync.RWMutex
+	lockGetMetricsList sync.RWMutex
+	lockOldestByType   sync.RWMutex
+	lockResumeRollup   sync.RWMutex
+	lockRollup         sync.RWMutex
+}
+
+// DeleteOlder calls DeleteOlderFunc.
+func (mock *RollupStoreMock) DeleteOlder(ctx context.Context, to time.Time, names []string) error {
+	if mock.DeleteOlderFunc == nil {
+		panic("RollupStoreMock.DeleteOlderFunc: method is nil but RollupStore.DeleteOlder was just called")
+	}
+	callInfo := struct {
+		Ctx   context.Context
+		To    time.Time
+		Names []string
+	}{
+		Ctx:   ctx,
+		To:    to,
+		Names: names,
+	}
+	mock.lockDeleteOlder.Lock()
+	mock.calls.DeleteOlder = append(mock.calls.DeleteOlder, callInfo)
+	mock.lockDeleteOlder.Unlock()
+	return mock.DeleteOlderFunc(ctx, to, names)
+}
+
+// DeleteOlderCalls gets all the calls that were made to DeleteOlder.
+// Check the length with:
+//
+// 	len(mockedRollupStore.DeleteOlderCalls())
+func (mock *RollupStoreMock) DeleteOlderCalls() []struct {
+	Ctx   context.Context
+	To    time.Time
+	Names []string
+} {
+	var calls []struct {
+		Ctx   context.Context
+		To    time.Time
+		Names []string
+	}
+	mock.lockDeleteOlder.RLock()
+	calls = mock.calls.DeleteOlder
+	mock.lockDeleteOlder.RUnlock()
+	return calls
+}
+
+// GetMetricsList calls GetMetricsListFunc.
+func (mock *RollupStoreMock) GetMetricsList(ctx context.Context) ([]string, error) {
+	if mock.GetMetricsListFunc == nil {
+		panic("RollupStoreMock.GetMetricsListFunc: method is nil but RollupStore.GetMetricsList was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockGetMetricsList.Lock()
+	mock.calls.GetMetricsList = append(mock.calls.GetMetricsList, callInfo)
+	mock.lockGetMetricsList.Unlock()
+	return mock.GetMetricsListFunc(ctx)
+}
+
+// GetMetricsListCalls gets all the calls that were made to GetMetricsList.
+// Check the length with:
+//
+// 	len(mockedRollupStore.GetMetricsListCalls())
+func (mock *RollupStoreMock) GetMetricsListCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockGetMetricsList.RLock()
+	calls = mock.calls.GetMetricsList
+	mock.lockGetMetricsList.RUnlock()
+	return calls
+}
+
+// OldestByType calls OldestByTypeFunc.
+func (mock *RollupStoreMock) OldestByType(ctx context.Context, tp time.Duration, from time.Time, to time.Time, names []string) (time.Time, error) {
+	if mock.OldestByTypeFunc == nil {
+		panic("RollupStoreMock.OldestByTypeFunc: method is nil but RollupStore.OldestByType was just called")
+	}
+	callInfo := struct {
+		Ctx   context.Context
+		Tp    time.Duration
+		From  time.Time
+		To    time.Time
+		Names []string
+	}{
+		Ctx:   ctx,
+		Tp:    tp,
+		From:  from,
+		To:    to,
+		Names: names,
+	}
+	mock.lockOldestByType.Lock()
+	mock.calls.OldestByType = append(mock.calls.OldestByType, callInfo)
+	mock.lockOldestByType.Unlock()
+	return mock.OldestByTypeFunc(ctx, tp, from, to, names)
+}
+
+// OldestByTypeCalls gets all the calls that were made to OldestByType.
+// Check the length with:
+//
+// 	len(mockedRollupStore.OldestByTypeCalls())
+func (mock *RollupStoreMock) OldestByTypeCalls() []struct {
+	Ctx   context.Context
+	Tp    time.Duration
+	From  time.Time
+	To    time.Time
+	Names []string
+} {
+	var calls []struct {
+		Ctx   context.Context
+		Tp    time.Duration
+		From  time.Time
+		To    time.Time
+		Names []string
+	}
+	mock.lockOldestByType.RLock()
+	calls = mock.calls.OldestByType
+	mock.lockOldestByType.RUnlock()
+	return calls
+}
+
+// ResumeRollup calls ResumeRollupFunc.
+func (mock *RollupStoreMock) ResumeRollup(ctx context.Context) (int, int, error) {
+	if mock.ResumeRollupFunc == nil {
+		panic("RollupStoreMock.ResumeRollupFunc: method is nil but RollupStore.ResumeRollup was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+	}{
+		Ctx: ctx,
+	}
+	mock.lockResumeRollup.Lock()
+	mock.calls.ResumeRollup = append(mock.calls.ResumeRollup, callInfo)
+	mock.lockResumeRollup.Unlock()
+	return mock.ResumeRollupFunc(ctx)
+}
+
+// ResumeRollupCalls gets all the calls that were made to ResumeRollup.
+// Check the length with:
+//
+// 	len(mockedRollupStore.ResumeRollupCalls())
+func (mock *RollupStoreMock) ResumeRollupCalls() []struct {
+	Ctx context.Context
+} {
+	var calls []struct {
+		Ctx context.Context
+	}
+	mock.lockResumeRollup.RLock()
+	calls = mock.calls.ResumeRollup
+	mock.lockResumeRollup.RUnlock()
+	return calls
+}
+
+// Rollup calls RollupFunc.
+func (mock *RollupStoreMock) Rollup(ctx context.Context, w RollupWindow) (int, int, error) {
+	if mock.RollupFunc == nil {
+		panic("RollupStoreMock.RollupFunc: method is nil but RollupStore.Rollup was just called")
+	}
+	callInfo := struct {
+		Ctx context.Context
+		W   RollupWindow
+	}{
+		Ctx: ctx,
+		W:   w,
+	}
+	mock.lockRollup.Lock()
+	mock.calls.Rollup = append(mock.calls.Rollup, callInfo)
+	mock.lockRollup.Unlock()
+	return mock.RollupFunc(ctx, w)
+}
+
+// RollupCalls gets all the calls that were made to Rollup.
+// Check the length with:
+//
+// 	len(mockedRollupStore.RollupCalls())
+func (mock *RollupStoreMock) RollupCalls() []struct {
+	Ctx context.Context
+	W   RollupWindow
+} {
+	var calls []struct {
+		Ctx context.Context
+		W   RollupWindow
+	}
+	mock.lockRollup.RLock()
+	calls = mock.calls.Rollup
+	mock.lockRollup.RUnlock()
+	return calls
+}
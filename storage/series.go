@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+	"github.com/umputun/metrics/metric"
+	"sort"
+)
+
+// aggrSeries merges the entries of different series into one series per group, i.e. per unique combination
+// of groupBy label values. Entries of the group with the same timestamp are aggregated across series with the
+// given aggregation, each resulting entry keeps only groupBy labels, the stats and the sketch merged from all of them,
+// histogram bucket counts are summed. The last value of the stats is the one of the last entry in order.
+// It is the cross-series step running after the time-axis roll-up made by aggrProcess.
+func aggrSeries(ctx context.Context, entries []metric.Entry, groupBy []string, aggregate string) ([]metric.Entry, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	type bucket struct {
+		entry metric.Entry
+		count int
+	}
+
+	dict := make(map[string]*bucket)
+	for _, e := range entries {
+		labels := make(map[string]string)
+		for _, k := range groupBy {
+			if v, ok := e.Labels[k]; ok && v != "" {
+				labels[k] = v
+			}
+		}
+		st := e.GetStats()
+		grouped := metric.Entry{Name: e.Name, Labels: labels, TimeStamp: e.TimeStamp, Value: e.Value,
+			Kind: e.Kind, Stats: &st, Sketch: e.GetSketch(), Buckets: e.Buckets, BucketCounts: e.GetBucketCounts(),
+			Type: e.Type, TypeStr: e.TypeStr}
+		if len(labels) == 0 {
+			grouped.Labels = nil
+		}
+
+		dictKey := grouped.SeriesKey() + "+" + grouped.TimeStamp.String()
+		b, ok := dict[dictKey]
+		if !ok {
+			dict[dictKey] = &bucket{entry: grouped, count: 1}
+			continue
+		}
+
+		b.count++
+		b.entry.Stats.Merge(e.GetStats(), true)
+		b.entry.Sketch.Merge(e.GetSketch()) // quantiles of the group are quantiles of all its samples
+		if b.entry.Kind == metric.KindHistogram {
+			b.entry.MergeBuckets(e) // bucket counts of histograms are always summed
+		}
+		switch aggregate {
+		case metric.AggrMin:
+			if e.Value < b.entry.Value {
+				b.entry.Value = e.Value
+			}
+		case metric.AggrMax:
+			if e.Value > b.entry.Value {
+				b.entry.Value = e.Value
+			}
+		default: // sum, avg and count are made from the total
+			b.entry.Value += e.Value
+		}
+	}
+
+	results := make([]metric.Entry, 0, len(dict))
+	for _, b := range dict {
+		switch aggregate {
+		case metric.AggrAvg:
+			b.entry.Value /= float64(b.count)
+		case metric.AggrCount:
+			b.entry.Value = float64(b.count)
+		}
+		results = append(results, b.entry)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if ki, kj := results[i].SeriesKey(), results[j].SeriesKey(); ki != kj {
+			return ki < kj
+		}
+		return results[i].TimeStamp.Before(results[j].TimeStamp)
+	})
+	return results, nil
+}
+
+// latestBySeries returns the latest entry of every series, the one of the smaller type if there are a few
+// with the same timestamp. Entries are sorted by series key
+func latestBySeries(entries []metric.Entry) []metric.Entry {
+	latest := make(map[string]metric.Entry)
+	for _, e := range entries {
+		key := e.SeriesKey()
+		prev, ok := latest[key]
+		if !ok || e.TimeStamp.After(prev.TimeStamp) || (e.TimeStamp.Equal(prev.TimeStamp) && e.Type < prev.Type) {
+			latest[key] = e
+		}
+	}
+
+	keys := make([]string, 0, len(latest))
+	for k := range latest {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := make([]metric.Entry, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, latest[k])
+	}
+	return res
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"testing"
+	"time"
+)
+
+func Test_aggrSeries(t *testing.T) {
+	tm1, tm2 := time.Date(2022, 10, 11, 2, 5, 0, 0, time.UTC), time.Date(2022, 10, 11, 2, 10, 0, 0, time.UTC)
+	entries := []metric.Entry{
+		{Name: "api_errors", Labels: map[string]string{"host": "h1", "region": "eu"}, TimeStamp: tm1, Value: 1, Type: 5 * time.Minute},
+		{Name: "api_errors", Labels: map[string]string{"host": "h2", "region": "eu"}, TimeStamp: tm1, Value: 6, Type: 5 * time.Minute},
+		{Name: "api_errors", Labels: map[string]string{"host": "h3", "region": "us"}, TimeStamp: tm1, Value: 4, Type: 5 * time.Minute},
+		{Name: "api_errors", Labels: map[string]string{"host": "h1", "region": "eu"}, TimeStamp: tm2, Value: 3, Type: 5 * time.Minute},
+		{Name: "api_errors", TimeStamp: tm2, Value: 8, Type: 5 * time.Minute},
+	}
+
+	type point struct {
+		labels map[string]string
+		tm     time.Time
+		value  float64
+	}
+
+	tbl := []struct {
+		groupBy   []string
+		aggregate string
+		res       []point
+	}{
+		{nil, metric.AggrSum, []point{{nil, tm1, 11}, {nil, tm2, 11}}},
+		{nil, metric.AggrAvg, []point{{nil, tm1, 11.0 / 3}, {nil, tm2, 5.5}}},
+		{nil, metric.AggrMin, []point{{nil, tm1, 1}, {nil, tm2, 3}}},
+		{nil, metric.AggrMax, []point{{nil, tm1, 6}, {nil, tm2, 8}}},
+		{nil, metric.AggrCount, []point{{nil, tm1, 3}, {nil, tm2, 2}}},
+		{[]string{"region"}, metric.AggrSum, []point{
+			{nil, tm2, 8},
+			{map[string]string{"region": "eu"}, tm1, 7},
+			{map[string]string{"region": "eu"}, tm2, 3},
+			{map[string]string{"region": "us"}, tm1, 4},
+		}},
+		{[]string{"region", "host"}, metric.AggrMax, []point{
+			{nil, tm2, 8},
+			{map[string]string{"host": "h1", "region": "eu"}, tm1, 1},
+			{map[string]string{"host": "h1", "region": "eu"}, tm2, 3},
+			{map[string]string{"host": "h2", "region": "eu"}, tm1, 6},
+			{map[string]string{"host": "h3", "region": "us"}, tm1, 4},
+		}},
+		{[]string{"dc"}, metric.AggrCount, []point{{nil, tm1, 3}, {nil, tm2, 2}}},
+	}
+
+	for i, tt := range tbl {
+		res, err := aggrSeries(context.Background(), entries, tt.groupBy, tt.aggregate)
+		require.NoError(t, err)
+		require.Equal(t, len(tt.res), len(res), "case #%d", i)
+		for j, r := range res {
+			assert.Equal(t, "api_errors", r.Name, "case #%d", i)
+			assert.Equal(t, tt.res[j].labels, r.Labels, "case #%d, entry #%d", i, j)
+			assert.Equal(t, tt.res[j].tm, r.TimeStamp, "case #%d, entry #%d", i, j)
+			assert.Equal(t, tt.res[j].value, r.Value, "case #%d, entry #%d", i, j)
+			assert.Equal(t, 5*time.Minute, r.Type, "case #%d", i)
+		}
+	}
+
+	{ // stats merged across the group
+		withStats := append([]metric.Entry{}, entries...)
+		withStats[0].Stats = &metric.Stats{Count: 2, Sum: 1, Min: 0, Max: 1, Last: 1}
+		res, err := aggrSeries(context.Background(), withStats, []string{"region"}, metric.AggrSum)
+		require.NoError(t, err)
+		require.Equal(t, 4, len(res))
+		assert.Equal(t, metric.Stats{Count: 3, Sum: 7, Min: 0, Max: 6, Last: 6}, *res[1].Stats)
+		assert.Equal(t, metric.Stats{Count: 1, Sum: 4, Min: 4, Max: 4, Last: 4}, *res[3].Stats)
+		assert.Nil(t, entries[0].Stats, "source not changed")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := aggrSeries(ctx, entries, nil, metric.AggrSum)
+	assert.Error(t, err)
+}
@@ -2,32 +2,84 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/umputun/metrics/metric"
 	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 //go:generate moq -out accessor_mock.go . Accessor
 
-// Service allows access to db and memory
+// Service allows access to db and memory.
+// Samples are staged by series and minute. A series keeps the minutes within LateWindow of its newest minute,
+// older minutes are moved to pending writes as soon as a newer sample moves the window. Samples of minutes behind
+// the window are late, added to pending writes as is, to be merged into the stored minute, or rejected with
+// ErrLateSample if RejectLate is set. Staging is sharded by metric name and pending writes are persisted by
+// the background flusher, so updates never wait for db, unless the flush queue is full
 type Service struct {
-	db Accessor
+	LateWindow time.Duration // how far behind the newest minute of a series samples are still staged
+	RejectLate bool          // reject late samples instead of merging them into the stored minutes
+	QueueSize  int           // capacity of the flush queue, defaultQueueSize if not set. Set before the first update
+	LatestAge  time.Duration // how far back Latest looks for persisted entries, defaultLatestAge if not set
 
-	staging struct {
-		sync.Mutex
-		data map[string]metric.Entry
-	}
+	db          Accessor
+	wal         *WAL          // nil if not used
+	cleanupDone chan struct{} // closed when the cleanup loop and the flusher stop, nil if not activated
+
+	shards    [stagingShards]*shard
+	series    int64  // number of staged series, atomic
+	lastID    uint64 // id of the last pending write, atomic
+	queueOnce sync.Once
+	queue     chan flushItem
 }
 
+// ErrLateSample returned for samples behind the lateness window, if they are rejected
+var ErrLateSample = errors.New("sample is older than the lateness window")
+
+// defaultLatestAge is how far back Latest looks for persisted entries by default,
+// series without entries in this time are not reported
+const defaultLatestAge = 24 * time.Hour
+
+// newestTTL is how long the newest minute of a series with nothing staged is kept
+const newestTTL = 24 * time.Hour
+
 // Accessor provides access to the db functions
 type Accessor interface {
 	Write(ctx context.Context, m metric.Entry) error
+	WriteMany(ctx context.Context, entries []metric.Entry) error // returns *WriteError if failed in part
 	Delete(ctx context.Context, m metric.Entry) error
 	GetMetricsList(ctx context.Context) ([]string, error)
-	FindOneMetric(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error)
+	FindOneMetric(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error)
 	FindAll(ctx context.Context, from, to time.Time, interval time.Duration) ([]metric.Entry, error)
+	FindLatest(ctx context.Context, from time.Time) ([]metric.Entry, error) // entries with timestamp after from
+}
+
+// WriteError is returned by batch writes failed in part, with errors of the failed entries by index in the batch.
+// Entries not in Failed are written
+type WriteError struct {
+	Failed map[int]error
+	Total  int
+}
+
+// Error returns the number of failed entries and the error of the first one
+func (e *WriteError) Error() string {
+	first := -1
+	for i := range e.Failed {
+		if first < 0 || i < first {
+			first = i
+		}
+	}
+	if first < 0 {
+		return fmt.Sprintf("0 of %d entries failed", e.Total)
+	}
+	return fmt.Sprintf("%d of %d entries failed, entry %d: %v", len(e.Failed), e.Total, first, e.Failed[first])
 }
 
 // New initiates and returns db and in-memory data
@@ -35,56 +87,270 @@ func New(db Accessor) *Service {
 	result := &Service{
 		db: db,
 	}
-	result.staging.data = make(map[string]metric.Entry)
+	for i := range result.shards {
+		result.shards[i] = newShard()
+	}
 	return result
 }
 
-// Update adds or updates a metric to the in-memory storage and
-// calls Write to add the metric to the db
+// change made by updates of a shard, to be logged and queued for write once the shard is unlocked
+type change struct {
+	records []walRecord
+	flush   []uint64              // ids of pending writes
+	saved   map[string]seriesCopy // series before the change, to roll it back if not logged, nil without wal
+	samples int                   // ingested samples, counted once the change is logged
+	late    int                   // late samples added to pending writes
+}
+
+// seriesCopy is the staged minutes and the newest minute of a series before the change
+type seriesCopy struct {
+	minutes map[int64]metric.Entry // nil if the series is not staged
+	newest  int64
+	known   bool // the newest minute is set
+}
+
+// Update adds or updates a metric in the in-memory storage, minutes left behind are queued for write to db
 func (s *Service) Update(ctx context.Context, m metric.Entry) error {
-	s.staging.Lock()
-	defer s.staging.Unlock()
-
-	v, ok := s.staging.data[m.Name]
-	if !ok {
-		// metric not found
-		m.MinSinceMidnight = s.getMinSinceMidnight(m.TimeStamp)
-		m.Type = 1 * time.Minute
-		m.TypeStr = "1m"
-		s.staging.data[m.Name] = m
-		return nil
+	defer updateDuration.With("update").Since(time.Now())
+	sh := s.shard(m.Name)
+	var ch change
+
+	sh.Lock()
+	err := s.update(sh, m, &ch)
+	if err == nil {
+		if err = s.commit(sh, &ch); err != nil {
+			err = fmt.Errorf("failed to log metric %v: %w", m, err)
+		}
 	}
+	sh.Unlock()
 
-	mins := s.getMinSinceMidnight(m.TimeStamp)
-	if mins == v.MinSinceMidnight { // matched minute, update metric value
-		v.Value += m.Value
-		s.staging.data[m.Name] = v
+	s.enqueue(ctx, sh, ch.flush)
+	return err
+}
+
+// UpdateMany adds or updates metrics the same way as Update, under a single lock per shard.
+// Returns errors by the index of the failed entries, nil if all of them were updated
+func (s *Service) UpdateMany(ctx context.Context, ms []metric.Entry) map[int]error {
+	defer updateDuration.With("update_many").Since(time.Now())
+
+	var shards []*shard // in order of the first entry
+	byShard := make(map[*shard][]int)
+	for i, m := range ms {
+		sh := s.shard(m.Name)
+		if _, ok := byShard[sh]; !ok {
+			shards = append(shards, sh)
+		}
+		byShard[sh] = append(byShard[sh], i)
+	}
+
+	var errs map[int]error
+	setErr := func(i int, err error) {
+		if errs == nil {
+			errs = make(map[int]error)
+		}
+		errs[i] = err
+	}
+
+	for _, sh := range shards {
+		var ch change
+		sh.Lock()
+		updated := make([]int, 0, len(byShard[sh]))
+		for _, i := range byShard[sh] {
+			if err := s.update(sh, ms[i], &ch); err != nil {
+				setErr(i, err)
+				continue
+			}
+			updated = append(updated, i)
+		}
+		if err := s.commit(sh, &ch); err != nil {
+			for _, i := range updated {
+				setErr(i, fmt.Errorf("failed to log metric %v: %w", ms[i], err))
+			}
+		}
+		sh.Unlock()
+		s.enqueue(ctx, sh, ch.flush)
+	}
+	return errs
+}
+
+// update adds or updates a metric, shard lock should be held by the caller.
+// Records of the changes and pending writes to queue are added to ch
+func (s *Service) update(sh *shard, m metric.Entry, ch *change) error {
+	m.TimeStamp = m.TimeStamp.UTC()
+	if m.Kind == metric.KindHistogram {
+		m.BucketCounts = m.GetBucketCounts() // count the sample in its bucket
+	}
+
+	key, minute, window := m.SeriesKey(), bucketMinute(m.TimeStamp), int64(s.LateWindow/time.Minute)
+	if sh.isLate(key, minute, window) {
+		if s.RejectLate {
+			lateSamples.With("rejected").Inc()
+			return fmt.Errorf("%w: %s at %s, the newest minute is %s", ErrLateSample, key,
+				m.TimeStamp.Format(time.RFC3339), minuteTime(sh.newest[key]).Format(time.RFC3339))
+		}
+		id := s.addPending(sh, m, true)
+		ch.records = append(ch.records, walRecord{op: walPending, id: id, e: m})
+		ch.flush = append(ch.flush, id)
+		ch.late++
+		ch.samples++
 		return nil
 	}
 
-	// new minute
-	if err := s.db.Write(ctx, v); err != nil {
-		return fmt.Errorf("failed to write metric %v: %w", m, err)
+	if s.wal != nil {
+		ch.save(sh, key)
+	}
+
+	if newest, ok := sh.newest[key]; !ok || minute > newest {
+		// minutes left behind the window are complete
+		for _, k := range sh.minutesBefore(key, minute-window) {
+			rec := s.expire(sh, key, k, true)
+			ch.records = append(ch.records, rec)
+			ch.flush = append(ch.flush, rec.id)
+		}
+		sh.newest[key] = minute
+	}
+	// a staged minute is not older than the newest one, so nothing is changed above if it is of another kind
+	added, err := sh.stage(key, minute, m)
+	if err != nil {
+		return fmt.Errorf("failed to stage %s at %s: %w", key, m.TimeStamp.Format(time.RFC3339), err)
 	}
+	if added {
+		stagingSeries.Set(float64(atomic.AddInt64(&s.series, 1)))
+	}
+	ch.records = append(ch.records, walRecord{op: walUpdate, e: m})
+	ch.samples++
+	return nil
+}
 
-	m.MinSinceMidnight = s.getMinSinceMidnight(m.TimeStamp)
-	m.Type = 1 * time.Minute
-	m.TypeStr = "1m"
-	s.staging.data[m.Name] = m // set new metric to hash
+// commit logs the change, if wal is used, and counts its samples. The change is rolled back if it can't be logged,
+// so the samples retried by the client are not counted twice. Shard lock should be held by the caller
+func (s *Service) commit(sh *shard, ch *change) error {
+	if s.wal != nil && len(ch.records) > 0 {
+		if err := s.wal.appendRecords(ch.records...); err != nil {
+			s.rollback(sh, ch)
+			return err
+		}
+	}
+	ingestedSamples.Add(uint64(ch.samples))
+	lateSamples.With("merged").Add(uint64(ch.late))
 	return nil
 }
 
-// Delete removes the metric from in-memory storage and db
-func (s *Service) Delete(ctx context.Context, m metric.Entry) error {
-	s.staging.Lock()
+// rollback restores the series changed and drops the pending writes added by the change.
+// Shard lock should be held by the caller
+func (s *Service) rollback(sh *shard, ch *change) {
+	for key, v := range ch.saved {
+		_, staged := sh.data[key]
+		switch {
+		case v.minutes == nil && staged:
+			delete(sh.data, key)
+			stagingSeries.Set(float64(atomic.AddInt64(&s.series, -1)))
+		case v.minutes != nil:
+			sh.data[key] = v.minutes
+			if !staged {
+				stagingSeries.Set(float64(atomic.AddInt64(&s.series, 1)))
+			}
+		}
+		if v.known {
+			sh.newest[key] = v.newest
+		} else {
+			delete(sh.newest, key)
+		}
+	}
+	for _, id := range ch.flush {
+		delete(sh.pending, id)
+	}
+	ch.records, ch.flush = nil, nil
+}
+
+// save keeps a copy of the series, once per change, to roll it back. Shard lock should be held by the caller
+func (ch *change) save(sh *shard, key string) {
+	if _, ok := ch.saved[key]; ok {
+		return
+	}
+	if ch.saved == nil {
+		ch.saved = make(map[string]seriesCopy)
+	}
+	v := seriesCopy{}
+	v.newest, v.known = sh.newest[key]
+	if minutes, ok := sh.data[key]; ok {
+		v.minutes = make(map[int64]metric.Entry, len(minutes))
+		for k, e := range minutes {
+			v.minutes[k] = e // entries are not changed in place by merge
+		}
+	}
+	ch.saved[key] = v
+}
 
-	_, ok := s.staging.data[m.Name]
-	if ok {
-		// metric found in data
-		delete(s.staging.data, m.Name)
+// expire moves the staged minute of the series to pending writes, returns the record of the change.
+// Shard lock should be held by the caller
+func (s *Service) expire(sh *shard, key string, minute int64, queued bool) walRecord {
+	v := sh.data[key][minute]
+	if sh.unstage(key, minute) {
+		stagingSeries.Set(float64(atomic.AddInt64(&s.series, -1)))
 	}
+	return walRecord{op: walExpire, id: s.addPending(sh, v, queued), e: v}
+}
 
-	s.staging.Unlock()
+// addPending adds the entry to pending writes of the shard, returns id of the write.
+// Shard lock should be held by the caller
+func (s *Service) addPending(sh *shard, e metric.Entry, queued bool) uint64 {
+	id := atomic.AddUint64(&s.lastID, 1)
+	sh.pending[id] = &pendingWrite{e: e, queued: queued}
+	return id
+}
+
+// enqueue puts pending writes to the flush queue, waits if the queue is full. Writes not queued before the context
+// is canceled are left for the next cleanup
+func (s *Service) enqueue(ctx context.Context, sh *shard, ids []uint64) {
+	q := s.flushQueue()
+	for i, id := range ids {
+		select {
+		case q <- flushItem{sh: sh, id: id}:
+			flushQueueLength.Set(float64(len(q)))
+		case <-ctx.Done():
+			sh.Lock()
+			for _, id := range ids[i:] {
+				if p, ok := sh.pending[id]; ok {
+					p.queued = false
+				}
+			}
+			sh.Unlock()
+			return
+		}
+	}
+}
+
+// flushQueue returns the queue of pending writes, made on the first use
+func (s *Service) flushQueue() chan flushItem {
+	s.queueOnce.Do(func() {
+		size := s.QueueSize
+		if size <= 0 {
+			size = defaultQueueSize
+		}
+		s.queue = make(chan flushItem, size)
+	})
+	return s.queue
+}
+
+// shard returns the staging shard of the metric
+func (s *Service) shard(name string) *shard {
+	return s.shards[shardIndex(name)]
+}
+
+// Delete removes all series of the metric from in-memory storage and db
+func (s *Service) Delete(ctx context.Context, m metric.Entry) error {
+	sh := s.shard(m.Name)
+	sh.Lock()
+	if removed := sh.deleteMetric(m.Name); removed > 0 {
+		stagingSeries.Set(float64(atomic.AddInt64(&s.series, -int64(removed))))
+	}
+	if s.wal != nil {
+		if err := s.wal.appendDelete(m.Name); err != nil {
+			log.Printf("[WARN] can't log delete of %s, it may be restored from wal: %v", m.Name, err)
+		}
+	}
+	sh.Unlock()
 
 	if err := s.db.Delete(ctx, m); err != nil {
 		return fmt.Errorf("failed to delete metric %v: %w", m, err)
@@ -101,11 +367,40 @@ func (s *Service) GetList(ctx context.Context) ([]string, error) {
 	return metrics, nil
 }
 
-// GetOneMetric returns a list values for the requested metric during the requested interval
-func (s *Service) GetOneMetric(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
-	metrics, err := s.db.FindOneMetric(ctx, name, from, to, interval)
+// GetOneMetric returns a list values for the requested metric series during the requested interval,
+// with the requested stat as the value, series aggregated across and quantiles if requested
+func (s *Service) GetOneMetric(ctx context.Context, req metric.Lookup) ([]metric.Entry, error) {
+	metrics, err := s.db.FindOneMetric(ctx, req.Name, req.Matchers, req.From, req.To, time.Duration(req.Interval))
 	if err != nil {
-		return metrics, fmt.Errorf("failed to find %v metric: %w", name, err)
+		return metrics, fmt.Errorf("failed to find %v metric: %w", req.Name, err)
+	}
+
+	if req.Stat != "" && req.Stat != metric.StatValue {
+		for i := range metrics {
+			metrics[i].Value = metrics[i].StatValue(req.Stat)
+		}
+	}
+
+	if req.Aggregate != "" && len(metrics) > 0 {
+		metrics, err = aggrSeries(ctx, metrics, req.GroupBy, req.Aggregate)
+		if err != nil {
+			return nil, fmt.Errorf("failed to aggregate %v series: %w", req.Name, err)
+		}
+	}
+
+	for i := range metrics {
+		if len(req.Quantiles) > 0 {
+			metrics[i].Quantiles = make(map[string]float64, len(req.Quantiles))
+			sketch := metrics[i].GetSketch()
+			for _, q := range req.Quantiles {
+				v, err := sketch.Quantile(q)
+				if err != nil {
+					return nil, fmt.Errorf("failed to get %v quantile of %v: %w", q, req.Name, err)
+				}
+				metrics[i].Quantiles[strconv.FormatFloat(q, 'f', -1, 64)] = v
+			}
+		}
+		metrics[i].Sketch = nil // internal, not a part of the response
 	}
 	return metrics, nil
 }
@@ -116,51 +411,448 @@ func (s *Service) GetAll(ctx context.Context, from, to time.Time, interval time.
 	if err != nil {
 		return metrics, fmt.Errorf("failed to find metrics: %w", err)
 	}
+	for i := range metrics {
+		metrics[i].Sketch = nil // internal, not a part of the response
+	}
 	return metrics, nil
 }
 
-// getMinSinceMidnight calculates the number of minutes since midnight
-func (s *Service) getMinSinceMidnight(tm time.Time) int {
-	return tm.Hour()*60 + tm.Minute()
+// Latest returns the latest entry of every series, the newest staged or pending minute if it is not persisted yet,
+// otherwise the last persisted one. Staged and persisted entries are compared by minute only, whatever the type
+// of the persisted one is. Entries are sorted by series key
+func (s *Service) Latest(ctx context.Context) ([]metric.Entry, error) {
+	age := s.LatestAge
+	if age <= 0 {
+		age = defaultLatestAge
+	}
+	persisted, err := s.db.FindLatest(ctx, time.Now().Add(-age))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find latest entries: %w", err)
+	}
+
+	unsaved := make(map[string]metric.Entry)
+	for _, sh := range s.shards {
+		sh.Lock()
+		staged, pending := sh.entries()
+		sh.Unlock()
+		for _, e := range pending {
+			staged = append(staged, e)
+		}
+		for _, e := range staged {
+			if v, ok := unsaved[e.SeriesKey()]; !ok || bucketMinute(v.TimeStamp) < bucketMinute(e.TimeStamp) {
+				unsaved[e.SeriesKey()] = e
+			}
+		}
+	}
+
+	res := make([]metric.Entry, 0, len(persisted)+len(unsaved))
+	for _, e := range persisted {
+		if v, ok := unsaved[e.SeriesKey()]; !ok || bucketMinute(v.TimeStamp) < bucketMinute(e.TimeStamp) {
+			res = append(res, e)
+			delete(unsaved, e.SeriesKey())
+		}
+	}
+	for _, e := range unsaved {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].SeriesKey() < res[j].SeriesKey() })
+	for i := range res {
+		res[i].Sketch = nil // internal, not a part of the response
+	}
+	return res, nil
 }
 
-// ActivateCleanup activates cleanup for the specified duration
+// ActivateCleanup activates cleanup for the specified duration and the flusher of pending writes,
+// until the context is canceled
 func (s *Service) ActivateCleanup(ctx context.Context, duration time.Duration) {
-
+	s.cleanupDone = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
 	go func() {
+		defer wg.Done()
 		tick := time.NewTicker(duration)
 		defer tick.Stop()
 
-		for range tick.C {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+			}
 			if err := s.doCleanup(ctx); err != nil {
 				log.Printf("oh my, failed to clenaup, %v", err)
 			}
 		}
-
 	}()
+	go func() {
+		defer wg.Done()
+		s.runFlusher(ctx)
+	}()
+	go func() {
+		wg.Wait()
+		close(s.cleanupDone)
+	}()
+}
+
+// runFlusher writes queued pending writes to db in batches of up to flushBatchSize, until the context is canceled.
+// Failed writes are left for the next cleanup
+func (s *Service) runFlusher(ctx context.Context) {
+	q := s.flushQueue()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case it := <-q:
+			batch := drainQueue(q, append(make([]flushItem, 0, flushBatchSize), it), flushBatchSize)
+			flushQueueLength.Set(float64(len(q)))
+			if _, err := s.writeBatch(ctx, batch); err != nil {
+				log.Printf("[WARN] %v, retry on the next cleanup", err)
+			}
+		}
+	}
 }
 
-// doCleanup cleans up the in-memory data by moving entries to db
-func (s *Service) doCleanup(ctx context.Context) error {
-	s.staging.Lock()
-	defer s.staging.Unlock()
+// writeBatch persists the pending writes in a single batch and removes the written ones. Failed writes are kept
+// but not queued anymore. Returns the number of failed writes, writes of deleted metrics are skipped
+func (s *Service) writeBatch(ctx context.Context, items []flushItem) (failed int, err error) {
+	live := make([]flushItem, 0, len(items))
+	entries := make([]metric.Entry, 0, len(items))
+	for _, it := range items {
+		it.sh.Lock()
+		if p, ok := it.sh.pending[it.id]; ok {
+			live = append(live, it)
+			entries = append(entries, p.e)
+		}
+		it.sh.Unlock()
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
 
-	if len(s.staging.data) <= 0 {
-		return nil
+	writeErr := s.db.WriteMany(ctx, entries)
+	isFailed := func(int) bool { return writeErr != nil } // all of them failed, unless reported otherwise
+	var werr *WriteError
+	if errors.As(writeErr, &werr) {
+		isFailed = func(i int) bool { _, ok := werr.Failed[i]; return ok }
+	}
+
+	records := make([]walRecord, 0, len(live))
+	for i, it := range live {
+		it.sh.Lock()
+		if p, ok := it.sh.pending[it.id]; ok { // not deleted during the write
+			if isFailed(i) {
+				p.queued = false
+				failed++
+			} else {
+				delete(it.sh.pending, it.id)
+				records = append(records, walRecord{op: walFlushed, id: it.id})
+			}
+		}
+		it.sh.Unlock()
+	}
+
+	if s.wal != nil && len(records) > 0 {
+		if err = s.wal.appendRecords(records...); err != nil {
+			log.Printf("[WARN] can't log %d writes, they may be written again on restore: %v", len(records), err)
+		}
+	}
+	if writeErr != nil {
+		flushFailures.Add(uint64(failed))
+		return failed, fmt.Errorf("failed to write metrics: %w", writeErr)
+	}
+	return 0, nil
+}
+
+// flush writes pending writes not queued, failed or restored from the log, and the ones left in the queue,
+// in batches of up to flushBatchSize. Returns the first error, after trying all of them
+func (s *Service) flush(ctx context.Context) (written, failed int, err error) {
+	q := s.flushQueue()
+	items := drainQueue(q, nil, -1)
+	flushQueueLength.Set(float64(len(q)))
+
+	for _, sh := range s.shards {
+		sh.Lock()
+		ids := make([]uint64, 0, len(sh.pending))
+		for id, p := range sh.pending {
+			if !p.queued {
+				p.queued = true
+				ids = append(ids, id)
+			}
+		}
+		sh.Unlock()
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			items = append(items, flushItem{sh: sh, id: id})
+		}
+	}
+
+	for start := 0; start < len(items); start += flushBatchSize {
+		if ctx.Err() != nil {
+			s.release(items[start:])
+			return written, failed + len(items) - start, ctx.Err()
+		}
+		batch := items[start:]
+		if len(batch) > flushBatchSize {
+			batch = batch[:flushBatchSize]
+		}
+		n, werr := s.writeBatch(ctx, batch)
+		if werr != nil && err == nil {
+			err = werr
+		}
+		failed += n
+		written += len(batch) - n
+	}
+	return written, failed, err
+}
+
+// drainQueue appends queued items to the batch without waiting, up to limit items in the batch, or all if limit < 0
+func drainQueue(q chan flushItem, batch []flushItem, limit int) []flushItem {
+	for limit < 0 || len(batch) < limit {
+		select {
+		case it := <-q:
+			batch = append(batch, it)
+		default:
+			return batch
+		}
+	}
+	return batch
+}
+
+// release marks the items not queued, so the next cleanup picks them
+func (s *Service) release(items []flushItem) {
+	for _, it := range items {
+		it.sh.Lock()
+		if p, ok := it.sh.pending[it.id]; ok {
+			p.queued = false
+		}
+		it.sh.Unlock()
+	}
+}
+
+// Shutdown waits for the cleanup loop and the flusher to stop, the context passed to ActivateCleanup should be
+// canceled before, and writes all the staged entries, including the current minute, and pending writes to db.
+// Entries failed to write are kept in memory and in the write-ahead log, if used
+func (s *Service) Shutdown(ctx context.Context) error {
+	if s.cleanupDone != nil {
+		select {
+		case <-s.cleanupDone:
+		case <-ctx.Done():
+			return fmt.Errorf("failed to wait for cleanup: %w", ctx.Err())
+		}
+	}
+
+	s.expireAll(func(int64) bool { return true })
+
+	var errs []string
+	if _, _, err := s.flush(ctx); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if s.wal != nil {
+		if err := s.checkpoint(); err != nil {
+			errs = append(errs, fmt.Sprintf("wal checkpoint: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		left := 0
+		for _, sh := range s.shards {
+			sh.Lock()
+			left += len(sh.pending)
+			sh.Unlock()
+		}
+		return fmt.Errorf("failed to flush staging, %d entries left: %s", left, strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// doCleanup moves complete minutes, older than the lateness window, to pending writes and writes to db
+// everything not written by the flusher
+func (s *Service) doCleanup(ctx context.Context) (err error) {
+	defer func(start time.Time) {
+		cleanupDuration.Since(start)
+		if err != nil {
+			cleanupFailures.Inc()
+		}
+	}(time.Now())
+
+	if s.wal != nil {
+		defer func() {
+			// the log keeps everything not persisted, even if some of the writes failed
+			if !s.wal.changed() {
+				return
+			}
+			if cpErr := s.checkpoint(); cpErr != nil && err == nil {
+				err = fmt.Errorf("failed to checkpoint wal: %w", cpErr)
+			}
+		}()
 	}
 
-	nowMins := s.getMinSinceMidnight(time.Now())
+	now := time.Now()
+	s.expireAll(func(minute int64) bool {
+		return !minuteTime(minute).Add(s.LateWindow).After(now) // complete and behind the lateness window
+	})
 
-	for k, v := range s.staging.data {
-		if nowMins == v.MinSinceMidnight {
-			continue
+	written, failed, err := s.flush(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to add expired minutes, %d of %d failed: %w", failed, written+failed, err)
+	}
+	return nil
+}
+
+// expireAll moves staged minutes matching the filter to pending writes, not queued,
+// and forgets the newest minutes of idle series
+func (s *Service) expireAll(filter func(minute int64) bool) {
+	now := time.Now()
+	for _, sh := range s.shards {
+		sh.Lock()
+		for k, newest := range sh.newest {
+			if _, ok := sh.data[k]; !ok && now.Sub(minuteTime(newest)) > newestTTL {
+				delete(sh.newest, k) // idle series
+			}
 		}
 
-		if err := s.db.Write(ctx, v); err != nil {
-			return fmt.Errorf("failed to add expired minute %v: %w", v, err)
+		keys := make([]string, 0, len(sh.data))
+		for key := range sh.data {
+			keys = append(keys, key)
 		}
-		delete(s.staging.data, k)
+		sort.Strings(keys)
+
+		var records []walRecord
+		for _, key := range keys {
+			for _, minute := range sh.minutesBefore(key, math.MaxInt64) { // oldest first
+				if filter(minute) {
+					records = append(records, s.expire(sh, key, minute, false))
+				}
+			}
+		}
+		if s.wal != nil && len(records) > 0 {
+			if err := s.wal.appendRecords(records...); err != nil {
+				log.Printf("[WARN] can't log expired minutes, they may be written again on restore: %v", err)
+			}
+		}
+		sh.Unlock()
 	}
+}
+
+// UseWAL restores staging and pending writes from the log and records all the following updates to it.
+// It should be called before the service gets any updates. Restored pending writes are written by the next cleanup
+func (s *Service) UseWAL(wal *WAL) error {
+	s.lockAll()
+	defer s.unlockAll()
 
+	restored := 0
+	owners := make(map[uint64]*shard) // shards of pending writes, flushed records have no entry
+	err := wal.replay(func(r walRecord) {
+		if r.id > s.lastID {
+			s.lastID = r.id
+		}
+		sh := s.shard(r.e.Name)
+		switch r.op {
+		case walDelete:
+			s.series -= int64(sh.deleteMetric(r.e.Name))
+		case walUpdate:
+			key, minute := r.e.SeriesKey(), bucketMinute(r.e.TimeStamp)
+			if newest, ok := sh.newest[key]; !ok || minute > newest {
+				sh.newest[key] = minute
+			}
+			added, err := sh.stage(key, minute, r.e)
+			if err != nil {
+				log.Printf("[WARN] can't restore %s: %v", key, err)
+			}
+			if added {
+				s.series++
+			}
+			restored++
+		case walExpire:
+			if sh.unstage(r.e.SeriesKey(), bucketMinute(r.e.TimeStamp)) {
+				s.series--
+			}
+			sh.pending[r.id] = &pendingWrite{e: r.e}
+			owners[r.id] = sh
+		case walPending:
+			sh.pending[r.id] = &pendingWrite{e: r.e}
+			owners[r.id] = sh
+		case walFlushed:
+			if owner, ok := owners[r.id]; ok {
+				delete(owner.pending, r.id)
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to replay wal: %w", err)
+	}
+	stagingSeries.Set(float64(s.series))
+
+	// start a new segment, so records of the broken tail, if any, are not followed by the new ones
+	if err = wal.checkpoint(s.walRecords()); err != nil {
+		return fmt.Errorf("failed to checkpoint wal: %w", err)
+	}
+	s.wal = wal
+	pending := 0
+	for _, sh := range s.shards {
+		pending += len(sh.pending)
+	}
+	log.Printf("[INFO] restored %d records of %d series and %d pending writes from wal", restored, s.series, pending)
 	return nil
 }
+
+// checkpoint starts a new segment of the log with everything not persisted
+func (s *Service) checkpoint() error {
+	s.lockAll()
+	defer s.unlockAll()
+	return s.wal.checkpoint(s.walRecords())
+}
+
+// walRecords returns records of everything not persisted, staged entries sorted by series key and time and
+// pending writes by id. All shards should be locked by the caller
+func (s *Service) walRecords() []walRecord {
+	var staged []metric.Entry
+	pending := make(map[uint64]metric.Entry)
+	for _, sh := range s.shards {
+		shStaged, shPending := sh.entries()
+		staged = append(staged, shStaged...)
+		for id, e := range shPending {
+			pending[id] = e
+		}
+	}
+	sortEntries(staged)
+	ids := make([]uint64, 0, len(pending))
+	for id := range pending {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	res := make([]walRecord, 0, len(staged)+len(pending))
+	for _, e := range staged {
+		res = append(res, walRecord{op: walUpdate, e: e})
+	}
+	for _, id := range ids {
+		res = append(res, walRecord{op: walPending, id: id, e: pending[id]})
+	}
+	return res
+}
+
+// lockAll locks all shards in order
+func (s *Service) lockAll() {
+	for _, sh := range s.shards {
+		sh.Lock()
+	}
+}
+
+// unlockAll unlocks all shards
+func (s *Service) unlockAll() {
+	for _, sh := range s.shards {
+		sh.Unlock()
+	}
+}
+
+// bucketMinute returns the minute of the stored 1m bucket of the timestamp, as minutes since the epoch,
+// so minutes of different days and time zones never collide
+func bucketMinute(ts time.Time) int64 {
+	return minuteBucket(ts).Unix() / 60
+}
+
+// minuteTime returns the time of the minute made by bucketMinute
+func minuteTime(minute int64) time.Time {
+	return time.Unix(minute*60, 0).UTC()
+}
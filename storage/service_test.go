@@ -7,39 +7,60 @@ import (
 	"github.com/stretchr/testify/require"
 	"github.com/umputun/metrics/metric"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestService_getMinSinceMidnight(t *testing.T) {
+func Test_bucketMinute(t *testing.T) {
+	est := time.FixedZone("EST", -5*3600)
 	tbl := []struct {
 		tm  time.Time
-		res int
+		res time.Time
 	}{
-		{
-			time.Date(2022, time.July, 27, 0, 1, 23, 0, time.UTC),
-			1,
-		},
-		{
-			time.Date(2022, time.July, 27, 16, 23, 23, 0, time.UTC),
-			983,
-		},
+		{time.Date(2022, time.July, 27, 0, 1, 23, 0, time.UTC), time.Date(2022, time.July, 27, 0, 2, 0, 0, time.UTC)},
+		{time.Date(2022, time.July, 27, 16, 23, 0, 0, time.UTC), time.Date(2022, time.July, 27, 16, 24, 0, 0, time.UTC)},
+		{time.Date(2022, time.July, 27, 23, 59, 59, 999, time.UTC), time.Date(2022, time.July, 28, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2022, time.July, 27, 11, 23, 5, 0, est), time.Date(2022, time.July, 27, 16, 24, 0, 0, time.UTC)},
 	}
 
-	svc := &Service{}
-
 	for i, tt := range tbl {
 		t.Run(strconv.Itoa(i+1), func(t *testing.T) {
-			assert.Equal(t, tt.res, svc.getMinSinceMidnight(tt.tm))
+			assert.Equal(t, tt.res, minuteTime(bucketMinute(tt.tm)))
+			assert.Equal(t, tt.res, minuteBucket(tt.tm))
 		})
 	}
 }
 
+func TestService_UpdateDays(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	svc := New(db)
+	svc.LateWindow = 48 * time.Hour
+
+	tm := time.Date(2022, 7, 29, 10, 3, 23, 0, time.UTC)
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(-24 * time.Hour), Value: 1}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 2}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.In(time.FixedZone("EST", -5*3600)), Value: 4}))
+
+	entries := stagedEntries(svc)
+	require.Equal(t, 2, len(entries), "the same minute of different days staged apart")
+	assert.Equal(t, 1.0, entries[0].Value)
+	assert.Equal(t, 6.0, entries[1].Value, "the same minute in another time zone merged")
+	assert.Equal(t, time.UTC, entries[1].TimeStamp.Location())
+	assert.Empty(t, writtenEntries(db))
+}
+
 func TestService_doCleanup(t *testing.T) {
 	db := &AccessorMock{
-		WriteFunc: func(ctx context.Context, m metric.Entry) error {
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
 			return nil
-		},
+		}),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -69,21 +90,190 @@ func TestService_doCleanup(t *testing.T) {
 	require.NoError(t, err)
 
 	//svc.data check
-	assert.Equal(t, 18, svc.staging.data["file_1"].Value)
+	assert.Equal(t, 18.0, staged(svc, "file_1").Value)
 
 	err = svc.doCleanup(ctx)
 	require.NoError(t, err)
 
 	//svc.data check, some gone
-	assert.Equal(t, 0, len(svc.staging.data))
+	assert.Equal(t, 0, stagedSeries(svc))
+	assert.Equal(t, 0, pendingWrites(svc))
+
+	{ // expired by the age of the minute, not the minute of the day
+		now := time.Now().UTC()
+		svc.LateWindow = 48 * time.Hour
+		for _, tm := range []time.Time{now, now.Add(-24 * time.Hour), now.Add(-time.Minute), now.Add(-3 * time.Minute)} {
+			require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_2", TimeStamp: tm, Value: 1}))
+		}
+		require.Equal(t, 4, len(stagedEntries(svc)))
+		svc.LateWindow = 2 * time.Minute
+		require.NoError(t, svc.doCleanup(ctx))
+		entries := stagedEntries(svc)
+		require.Equal(t, 2, len(entries), "the current minute and the one within the window kept")
+		assert.True(t, now.Add(-time.Minute).Equal(entries[0].TimeStamp))
+		assert.True(t, now.Equal(entries[1].TimeStamp))
+	}
+}
 
+func TestService_Instrumentation(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return errors.New("blah")
+		}),
+		DeleteFunc: func(ctx context.Context, m metric.Entry) error {
+			return nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	svc := New(db)
+	ingested, updates, cleanups, failures := ingestedSamples.Value(), updateDuration.With("update").Count(),
+		cleanupDuration.Count(), cleanupFailures.Value()
+
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 3}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 4}))
+	assert.Empty(t, svc.UpdateMany(ctx, []metric.Entry{{Name: "file_2", TimeStamp: tm, Value: 1}}))
+	assert.Equal(t, uint64(3), ingestedSamples.Value()-ingested)
+	assert.Equal(t, uint64(2), updateDuration.With("update").Count()-updates)
+	assert.Equal(t, 2.0, stagingSeries.Value())
+
+	// the previous minute queued for write, sample staged
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 1}))
+	assert.Equal(t, uint64(4), ingestedSamples.Value()-ingested)
+	assert.Equal(t, 1.0, flushQueueLength.Value())
+
+	flushFails := flushFailures.Value()
+	assert.Error(t, svc.doCleanup(ctx))
+	assert.Equal(t, uint64(1), cleanupDuration.Count()-cleanups)
+	assert.Equal(t, uint64(1), cleanupFailures.Value()-failures)
+	assert.Equal(t, uint64(3), flushFailures.Value()-flushFails, "all the minutes failed to write")
+	assert.Equal(t, 0.0, flushQueueLength.Value())
+	assert.Equal(t, 0.0, stagingSeries.Value())
+	assert.Equal(t, 3, pendingWrites(svc))
+
+	require.NoError(t, svc.Delete(ctx, metric.Entry{Name: "file_1"}))
+	assert.Equal(t, 1, pendingWrites(svc))
+}
+
+func TestService_Shutdown(t *testing.T) {
+	var written []metric.Entry
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			if m.Name == "fail" {
+				return errors.New("blah")
+			}
+			written = append(written, m)
+			return nil
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	svc := New(db)
+	svc.ActivateCleanup(ctx, time.Hour)
+
+	now := time.Now()
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: now, Value: 1}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_2", TimeStamp: now, Value: 2}))
+
+	{ // cleanup loop is still running
+		stopCtx, stopCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer stopCancel()
+		assert.EqualError(t, svc.Shutdown(stopCtx), "failed to wait for cleanup: context deadline exceeded")
+		assert.Empty(t, written)
+	}
+
+	{ // the current minute written
+		cancel()
+		require.NoError(t, svc.Shutdown(context.Background()))
+		require.Equal(t, 2, len(written))
+		assert.ElementsMatch(t, []string{"file_1", "file_2"}, []string{written[0].Name, written[1].Name})
+		assert.Equal(t, 0, stagedSeries(svc))
+		assert.Equal(t, 0, pendingWrites(svc))
+	}
+
+	{ // failed write kept in memory and wal
+		wal, err := OpenWAL(t.TempDir(), false)
+		require.NoError(t, err)
+		require.NoError(t, svc.UseWAL(wal))
+		require.NoError(t, svc.Update(context.Background(), metric.Entry{Name: "fail", TimeStamp: now, Value: 1}))
+		require.NoError(t, svc.Update(context.Background(), metric.Entry{Name: "file_3", TimeStamp: now, Value: 3}))
+		assert.EqualError(t, svc.Shutdown(context.Background()),
+			"failed to flush staging, 1 entries left: failed to write metrics: 1 of 2 entries failed, entry 1: blah")
+		assert.Equal(t, 3, len(written))
+		assert.Equal(t, 0, stagedSeries(svc))
+		assert.Equal(t, 1, pendingWrites(svc))
+
+		var records []walRecord
+		require.NoError(t, wal.replay(func(r walRecord) { records = append(records, r) }))
+		require.Equal(t, 1, len(records))
+		assert.Equal(t, walPending, records[0].op)
+		assert.Equal(t, "fail", records[0].e.Name)
+	}
+}
+
+func TestService_Flusher(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
+	}
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+
+	{ // minutes left behind written in the background
+		ctx, cancel := context.WithCancel(context.Background())
+		svc := New(db)
+		svc.ActivateCleanup(ctx, time.Hour)
+		require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 1}))
+		require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 2}))
+		require.Eventually(t, func() bool { return pendingWrites(svc) == 0 }, time.Second, time.Millisecond)
+		require.Equal(t, 1, len(writtenEntries(db)))
+		assert.Equal(t, 1.0, writtenEntries(db)[0].Value)
+		assert.Equal(t, 2.0, staged(svc, "file_1").Value)
+		cancel()
+		require.NoError(t, svc.Shutdown(context.Background()))
+		assert.Equal(t, 2, len(writtenEntries(db)))
+	}
+
+	{ // update waits for the full queue until the context is done, the rest left for cleanup
+		svc := New(db)
+		svc.QueueSize = 1
+		require.Empty(t, svc.UpdateMany(context.Background(), []metric.Entry{
+			{Name: "file_2", TimeStamp: tm, Value: 1}, {Name: "file_3", TimeStamp: tm, Value: 1}}))
+		require.NoError(t, svc.Update(context.Background(), metric.Entry{Name: "file_2", TimeStamp: tm.Add(time.Minute)}))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_3", TimeStamp: tm.Add(time.Minute)}))
+		assert.Equal(t, 2, pendingWrites(svc))
+		assert.Equal(t, 1, len(svc.flushQueue()))
+
+		calls := len(writtenEntries(db))
+		require.NoError(t, svc.doCleanup(context.Background()))
+		assert.Equal(t, 4, len(writtenEntries(db))-calls, "queued, not queued and staged minutes written")
+		assert.Equal(t, 0, pendingWrites(svc))
+	}
+
+	{ // pending writes persisted in batches
+		svc := New(db)
+		entries := make([]metric.Entry, flushBatchSize+1)
+		for i := range entries {
+			entries[i] = metric.Entry{Name: "file_" + strconv.Itoa(i), TimeStamp: tm, Value: 1}
+		}
+		require.Empty(t, svc.UpdateMany(context.Background(), entries))
+		calls := len(db.WriteManyCalls())
+		require.NoError(t, svc.doCleanup(context.Background()))
+		require.Equal(t, 2, len(db.WriteManyCalls())-calls)
+		assert.Equal(t, flushBatchSize, len(db.WriteManyCalls()[calls].Entries))
+		assert.Equal(t, 1, len(db.WriteManyCalls()[calls+1].Entries))
+	}
 }
 
 func TestService_Update(t *testing.T) {
 	db := &AccessorMock{
-		WriteFunc: func(ctx context.Context, m metric.Entry) error {
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
 			return nil
-		},
+		}),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -112,8 +302,8 @@ func TestService_Update(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	assert.Equal(t, 1, svc.staging.data["file_1"].Value)
-	assert.Equal(t, 5, svc.staging.data["file_2"].Value)
+	assert.Equal(t, 1.0, staged(svc, "file_1").Value)
+	assert.Equal(t, 5.0, staged(svc, "file_2").Value)
 
 	err = svc.Update(ctx, metric.Entry{
 		Name:      "file_2",
@@ -121,29 +311,270 @@ func TestService_Update(t *testing.T) {
 		Value:     4,
 	})
 	require.NoError(t, err)
-	assert.Equal(t, 1, svc.staging.data["file_1"].Value)
-	assert.Equal(t, 4, svc.staging.data["file_2"].Value)
+	assert.Equal(t, 1.0, staged(svc, "file_1").Value)
+	assert.Equal(t, 4.0, staged(svc, "file_2").Value)
 }
 
-func TestNew(t *testing.T) {
+func TestService_UpdateMany(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			if m.Name == "file_2" {
+				return errors.New("blah")
+			}
+			return nil
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	svc := New(db)
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	errs := svc.UpdateMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: tm, Value: 1},
+		{Name: "file_2", TimeStamp: tm, Value: 2},
+		{Name: "file_1", TimeStamp: tm, Value: 3},
+	})
+	assert.Nil(t, errs)
+	assert.Equal(t, 4.0, staged(svc, "file_1").Value)
+	assert.Equal(t, 2.0, staged(svc, "file_2").Value)
+
+	errs = svc.UpdateMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 5},
+		{Name: "file_2", TimeStamp: tm.Add(time.Minute), Value: 6},
+	})
+	assert.Nil(t, errs, "previous minutes are written in the background")
+	assert.Equal(t, 5.0, staged(svc, "file_1").Value)
+	assert.Equal(t, 6.0, staged(svc, "file_2").Value)
+	assert.Empty(t, writtenEntries(db))
+
+	written, failed, err := svc.flush(ctx)
+	assert.EqualError(t, err, "failed to write metrics: 1 of 2 entries failed, entry 1: blah")
+	assert.Equal(t, 1, written)
+	assert.Equal(t, 1, failed)
+	assert.Equal(t, 2, len(writtenEntries(db)))
+	assert.Equal(t, 1, pendingWrites(svc), "failed write kept for the next cleanup")
+}
+
+func TestService_UpdateLate(t *testing.T) {
+	var written []metric.Entry
 	db := &AccessorMock{
-		WriteFunc: func(ctx context.Context, m metric.Entry) error {
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			written = append(written, m)
+			return nil
+		}),
+		DeleteFunc: func(ctx context.Context, m metric.Entry) error {
 			return nil
 		},
 	}
+	ctx := context.Background()
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	sample := func(minutes int, v float64) metric.Entry {
+		return metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Duration(minutes) * time.Minute), Value: v}
+	}
+
+	{ // no window, late sample merged into the stored minute instead of writing the newer one
+		svc := New(db)
+		require.NoError(t, svc.Update(ctx, sample(0, 1)))
+		require.NoError(t, svc.Update(ctx, sample(2, 2)))
+		flushQueued(t, svc)
+		require.Equal(t, 1, len(written))
+		assert.Equal(t, 1.0, written[0].Value)
+
+		merged := lateSamples.With("merged").Value()
+		require.NoError(t, svc.Update(ctx, sample(0, 3)))
+		flushQueued(t, svc)
+		require.Equal(t, 2, len(written))
+		assert.Equal(t, 3.0, written[1].Value)
+		assert.Equal(t, uint64(1), lateSamples.With("merged").Value()-merged)
+		assert.Equal(t, 2.0, staged(svc, "file_1").Value)
+		assert.Equal(t, 1, stagedMinutes(svc, "file_1"))
+	}
+
+	{ // minutes within the window are staged, the ones left behind are written oldest first
+		written = nil
+		svc := New(db)
+		svc.LateWindow = 2 * time.Minute
+		assert.Empty(t, svc.UpdateMany(ctx, []metric.Entry{sample(0, 1), sample(2, 2), sample(1, 3), sample(0, 4)}))
+		flushQueued(t, svc)
+		assert.Empty(t, written)
+		assert.Equal(t, 3, stagedMinutes(svc, "file_1"))
+
+		require.NoError(t, svc.Update(ctx, sample(4, 5)))
+		flushQueued(t, svc)
+		require.Equal(t, 2, len(written))
+		assert.Equal(t, []float64{5, 3}, []float64{written[0].Value, written[1].Value})
+		assert.Equal(t, 2, stagedMinutes(svc, "file_1"))
+
+		require.NoError(t, svc.Update(ctx, sample(1, 6)), "late, merged into db")
+		flushQueued(t, svc)
+		require.Equal(t, 3, len(written))
+		assert.Equal(t, 6.0, written[2].Value)
+		require.NoError(t, svc.Update(ctx, sample(2, 7)), "within the window")
+		flushQueued(t, svc)
+		assert.Equal(t, 3, len(written))
+		assert.Equal(t, 2, stagedMinutes(svc, "file_1"))
+
+		// entries of staged minutes sorted by time
+		entries := stagedEntries(svc)
+		require.Equal(t, 2, len(entries))
+		assert.Equal(t, []float64{9, 5}, []float64{entries[0].Value, entries[1].Value})
+	}
+
+	{ // late samples rejected
+		written = nil
+		svc := New(db)
+		svc.RejectLate = true
+		require.NoError(t, svc.Update(ctx, sample(1, 1)))
+		require.NoError(t, svc.Update(ctx, sample(2, 2)))
+		rejected := lateSamples.With("rejected").Value()
+		err := svc.Update(ctx, sample(0, 3))
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, ErrLateSample))
+		assert.EqualError(t, err, "sample is older than the lateness window: file_1 at 2022-07-29T12:10:23Z, "+
+			"the newest minute is 2022-07-29T12:13:00Z")
+		assert.Equal(t, uint64(1), lateSamples.With("rejected").Value()-rejected)
+
+		errs := svc.UpdateMany(ctx, []metric.Entry{sample(2, 4), sample(1, 5)})
+		require.Equal(t, 1, len(errs))
+		assert.True(t, errors.Is(errs[1], ErrLateSample))
+		flushQueued(t, svc)
+		assert.Equal(t, 1, len(written))
+		assert.Equal(t, 6.0, staged(svc, "file_1").Value)
+
+		// deleted metric starts over
+		require.NoError(t, svc.Delete(ctx, metric.Entry{Name: "file_1"}))
+		require.NoError(t, svc.Update(ctx, sample(0, 3)))
+		assert.Equal(t, 3.0, staged(svc, "file_1").Value)
+	}
+}
+
+func TestService_UpdateGauge(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
 	svc := New(db)
-	assert.Equal(t, 0, len(svc.staging.data))
+	for _, e := range []metric.Entry{
+		{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC), Value: 12.5},
+		{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 7, 29, 12, 10, 45, 0, time.UTC), Value: 40.1},
+		{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 7, 29, 12, 10, 30, 0, time.UTC), Value: 20}, // late
+		{Name: "bytes", TimeStamp: time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC), Value: 0.5},
+		{Name: "bytes", TimeStamp: time.Date(2022, 7, 29, 12, 10, 45, 0, time.UTC), Value: 0.25},
+	} {
+		require.NoError(t, svc.Update(ctx, e))
+	}
+
+	assert.Equal(t, 40.1, staged(svc, "cpu").Value)
+	assert.Equal(t, 0.75, staged(svc, "bytes").Value)
+	assert.Equal(t, metric.NewSketch(12.5, 40.1, 20), staged(svc, "cpu").Sketch)
+
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "cpu", Kind: metric.KindGauge,
+		TimeStamp: time.Date(2022, 7, 29, 12, 11, 5, 0, time.UTC), Value: 3}))
+	flushQueued(t, svc)
+	require.Equal(t, 1, len(writtenEntries(db)))
+	assert.Equal(t, 40.1, writtenEntries(db)[0].Value)
+	assert.Equal(t, 3.0, staged(svc, "cpu").Value)
+
+	// sample of another kind rejected
+	err := svc.Update(ctx, metric.Entry{Name: "cpu", TimeStamp: time.Date(2022, 7, 29, 12, 11, 7, 0, time.UTC), Value: 1})
+	assert.ErrorIs(t, err, metric.ErrKindMismatch)
+	errs := svc.UpdateMany(ctx, []metric.Entry{
+		{Name: "cpu", Kind: metric.KindGauge, GaugeMode: metric.GaugeMax, TimeStamp: time.Date(2022, 7, 29, 12, 11, 7, 0, time.UTC), Value: 1},
+		{Name: "cpu", Kind: metric.KindGauge, TimeStamp: time.Date(2022, 7, 29, 12, 11, 9, 0, time.UTC), Value: 4},
+	})
+	require.Equal(t, 1, len(errs))
+	assert.ErrorIs(t, errs[0], metric.ErrKindMismatch)
+	assert.Equal(t, 4.0, staged(svc, "cpu").Value)
+	assert.Equal(t, int64(2), staged(svc, "cpu").Stats.Count, "only samples of the same kind")
 }
 
-func TestService_Delete(t *testing.T) {
+func TestService_UpdateHistogram(t *testing.T) {
 	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	svc := New(db)
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	bounds := []float64{0.1, 0.5, 1}
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "latency", Kind: metric.KindHistogram, TimeStamp: tm,
+		Value: 0.7, Buckets: bounds}))
+	assert.Equal(t, []int64{0, 0, 1, 0}, staged(svc, "latency").BucketCounts, "single sample counted")
+
+	for _, v := range []float64{0.05, 0.2, 0.3, 12} {
+		require.NoError(t, svc.Update(ctx, metric.Entry{Name: "latency", Kind: metric.KindHistogram, TimeStamp: tm,
+			Value: v, Buckets: bounds}))
+	}
+	assert.Equal(t, []int64{1, 2, 1, 1}, staged(svc, "latency").BucketCounts)
+	assert.InDelta(t, 13.25, staged(svc, "latency").Value, 1e-9)
+}
+
+func TestService_UpdateWithLabels(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
 		DeleteFunc: func(ctx context.Context, m metric.Entry) error {
 			return nil
 		},
-		WriteFunc: func(ctx context.Context, m metric.Entry) error {
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	svc := New(db)
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+
+	for _, e := range []metric.Entry{
+		{Name: "api_errors", Labels: map[string]string{"host": "h1", "region": "eu"}, TimeStamp: tm, Value: 1},
+		{Name: "api_errors", Labels: map[string]string{"region": "eu", "host": "h1"}, TimeStamp: tm, Value: 2},
+		{Name: "api_errors", Labels: map[string]string{"host": "h2", "region": "eu"}, TimeStamp: tm, Value: 4},
+		{Name: "api_errors", TimeStamp: tm, Value: 8},
+		{Name: "file_1", TimeStamp: tm, Value: 16},
+	} {
+		require.NoError(t, svc.Update(ctx, e))
+	}
+
+	assert.Equal(t, 4, stagedSeries(svc))
+	assert.Equal(t, 3.0, staged(svc, `api_errors{host="h1",region="eu"}`).Value)
+	assert.Equal(t, 4.0, staged(svc, `api_errors{host="h2",region="eu"}`).Value)
+	assert.Equal(t, 8.0, staged(svc, "api_errors").Value)
+
+	require.NoError(t, svc.Delete(ctx, metric.Entry{Name: "api_errors"}))
+	assert.Equal(t, 1, stagedSeries(svc))
+	assert.Equal(t, 16.0, staged(svc, "file_1").Value)
+}
+
+func TestNew(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
+	}
+
+	svc := New(db)
+	assert.Equal(t, 0, stagedSeries(svc))
+	assert.Equal(t, stagingShards, len(svc.shards))
+}
+
+func TestService_Delete(t *testing.T) {
+	db := &AccessorMock{
+		DeleteFunc: func(ctx context.Context, m metric.Entry) error {
 			return nil
 		},
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -176,8 +607,9 @@ func TestService_Delete(t *testing.T) {
 		Name: "file_2",
 	})
 	require.NoError(t, err)
-	assert.Equal(t, 1, len(svc.staging.data))
-	assert.Equal(t, 1, svc.staging.data["file_1"].Value)
+	assert.Equal(t, 1, stagedSeries(svc))
+	assert.Equal(t, 0, pendingWrites(svc), "queued minute of the deleted metric dropped")
+	assert.Equal(t, 1.0, staged(svc, "file_1").Value)
 }
 
 func TestService_GetList(t *testing.T) {
@@ -206,9 +638,73 @@ func TestService_GetList(t *testing.T) {
 	}
 }
 
+func TestService_Latest(t *testing.T) {
+	persisted := []metric.Entry{
+		{Name: "file_1", Value: 1, TimeStamp: time.Date(2022, 7, 29, 12, 10, 0, 0, time.UTC), Type: time.Minute},
+		{Name: "file_2", Value: 2, TimeStamp: time.Date(2022, 7, 29, 12, 10, 0, 0, time.UTC), Type: time.Minute},
+		{Name: "file_3", Value: 4, TimeStamp: time.Date(2022, 7, 29, 12, 0, 0, 0, time.UTC), Type: 30 * time.Minute},
+		{Name: "file_4", Value: 6, TimeStamp: time.Date(2022, 7, 29, 12, 30, 0, 0, time.UTC), Type: 30 * time.Minute},
+	}
+	db := &AccessorMock{
+		FindLatestFunc: func(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+			return persisted, nil
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	svc := New(db)
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_2", Value: 5,
+		TimeStamp: time.Date(2022, 7, 29, 12, 11, 23, 0, time.UTC)}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_0", Labels: map[string]string{"host": "h1"}, Value: 3,
+		TimeStamp: time.Date(2022, 7, 29, 12, 11, 23, 0, time.UTC)}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_3", Value: 7,
+		TimeStamp: time.Date(2022, 7, 29, 12, 11, 23, 0, time.UTC)}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_4", Value: 8,
+		TimeStamp: time.Date(2022, 7, 29, 12, 11, 23, 0, time.UTC)}))
+
+	{ // newer staged entries override persisted, of any type
+		res, err := svc.Latest(ctx)
+		require.NoError(t, err)
+		require.Equal(t, 5, len(res))
+		assert.Equal(t, `file_0{host="h1"}`, res[0].SeriesKey())
+		assert.Equal(t, 3.0, res[0].Value)
+		assert.Equal(t, "file_1", res[1].Name)
+		assert.Equal(t, 1.0, res[1].Value)
+		assert.Equal(t, "file_2", res[2].Name)
+		assert.Equal(t, 5.0, res[2].Value)
+		assert.Equal(t, "file_3", res[3].Name)
+		assert.Equal(t, 7.0, res[3].Value, "staged minute newer than the persisted 30m aggregate")
+		assert.Equal(t, time.Minute, res[3].Type)
+		assert.Equal(t, "file_4", res[4].Name)
+		assert.Equal(t, 6.0, res[4].Value, "persisted 30m aggregate newer than the staged minute")
+		for _, r := range res {
+			assert.Nil(t, r.Sketch)
+		}
+	}
+
+	{ // persisted entries looked up within the latest age
+		svc.LatestAge = time.Hour
+		_, err := svc.Latest(ctx)
+		require.NoError(t, err)
+		calls := db.FindLatestCalls()
+		require.Equal(t, 2, len(calls))
+		assert.WithinDuration(t, time.Now().Add(-defaultLatestAge), calls[0].From, time.Minute)
+		assert.WithinDuration(t, time.Now().Add(-time.Hour), calls[1].From, time.Minute)
+	}
+
+	{ // failed attempt
+		db.FindLatestFunc = func(ctx context.Context, from time.Time) ([]metric.Entry, error) {
+			return nil, errors.New("blah")
+		}
+		_, err := svc.Latest(ctx)
+		assert.EqualError(t, err, "failed to find latest entries: blah")
+	}
+}
+
 func TestService_GetOneMetric(t *testing.T) {
 	db := &AccessorMock{
-		FindOneMetricFunc: func(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+		FindOneMetricFunc: func(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
 			return nil, nil
 		},
 	}
@@ -218,24 +714,116 @@ func TestService_GetOneMetric(t *testing.T) {
 	svc := New(db)
 
 	{ // successful attempt
-		metrics, err := svc.GetOneMetric(ctx, "file_1",
-			time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
-			time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
-			2*time.Minute)
+		metrics, err := svc.GetOneMetric(ctx, metric.Lookup{
+			Name:     "file_1",
+			Matchers: []metric.Matcher{{Label: "host", Type: metric.MatchEqual, Value: "h1"}},
+			From:     time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
+			To:       time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
+			Interval: metric.Duration(2 * time.Minute),
+		})
 		require.NoError(t, err)
 		assert.Equal(t, 0, len(metrics))
+		require.Equal(t, 1, len(db.FindOneMetricCalls()))
+		assert.Equal(t, "file_1", db.FindOneMetricCalls()[0].Name)
+		assert.Equal(t, []metric.Matcher{{Label: "host", Type: metric.MatchEqual, Value: "h1"}}, db.FindOneMetricCalls()[0].Matchers)
+		assert.Equal(t, 2*time.Minute, db.FindOneMetricCalls()[0].Interval)
 	}
 
 	{ // failed attempt
-		db.FindOneMetricFunc = func(ctx context.Context, name string, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+		db.FindOneMetricFunc = func(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
 			return nil, errors.New("blah")
 		}
-		_, err := svc.GetOneMetric(ctx, "file_1",
-			time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
-			time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
-			2*time.Minute)
+		_, err := svc.GetOneMetric(ctx, metric.Lookup{
+			Name:     "file_1",
+			From:     time.Date(2022, 10, 11, 2, 0, 0, 0, time.UTC),
+			To:       time.Date(2022, 10, 11, 3, 0, 0, 0, time.UTC),
+			Interval: metric.Duration(2 * time.Minute),
+		})
 		assert.EqualError(t, err, "failed to find file_1 metric: blah")
 	}
+
+	{ // stat selected
+		db.FindOneMetricFunc = func(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+			return []metric.Entry{
+				{Name: "latency", Labels: map[string]string{"host": "h1"}, Value: 30, Stats: &metric.Stats{Count: 3, Sum: 30, Min: 2, Max: 20, Last: 8}},
+				{Name: "latency", Labels: map[string]string{"host": "h2"}, Value: 7},
+			}, nil
+		}
+		metrics, err := svc.GetOneMetric(ctx, metric.Lookup{Name: "latency", Interval: metric.Duration(2 * time.Minute),
+			Stat: metric.StatMax})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(metrics))
+		assert.Equal(t, 20.0, metrics[0].Value)
+		assert.Equal(t, 7.0, metrics[1].Value)
+
+		metrics, err = svc.GetOneMetric(ctx, metric.Lookup{Name: "latency", Interval: metric.Duration(2 * time.Minute),
+			Stat: metric.StatMax, Aggregate: metric.AggrMax})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(metrics))
+		assert.Equal(t, 20.0, metrics[0].Value)
+		assert.Equal(t, metric.Stats{Count: 4, Sum: 37, Min: 2, Max: 20, Last: 7}, *metrics[0].Stats, "stats of the group")
+	}
+
+	{ // quantiles
+		db.FindOneMetricFunc = func(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+			return []metric.Entry{
+				{Name: "latency", Labels: map[string]string{"host": "h1"}, Value: 60, Sketch: metric.NewSketch(10, 20, 30)},
+				{Name: "latency", Labels: map[string]string{"host": "h2"}, Value: 100, Sketch: metric.NewSketch(40, 60)},
+			}, nil
+		}
+		metrics, err := svc.GetOneMetric(ctx, metric.Lookup{Name: "latency", Interval: metric.Duration(2 * time.Minute),
+			Quantiles: []float64{0.5, 1}})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(metrics))
+		assert.InEpsilon(t, 20, metrics[0].Quantiles["0.5"], 0.01)
+		assert.InEpsilon(t, 30, metrics[0].Quantiles["1"], 0.01)
+		assert.Nil(t, metrics[0].Sketch)
+
+		metrics, err = svc.GetOneMetric(ctx, metric.Lookup{Name: "latency", Interval: metric.Duration(2 * time.Minute),
+			Quantiles: []float64{0.5, 1}, Aggregate: metric.AggrSum})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(metrics))
+		assert.Equal(t, 160.0, metrics[0].Value)
+		assert.InEpsilon(t, 30, metrics[0].Quantiles["0.5"], 0.01, "quantiles of all series samples")
+		assert.InEpsilon(t, 60, metrics[0].Quantiles["1"], 0.01)
+	}
+
+	{ // histograms aggregated across series
+		bounds := []float64{0.1, 0.5, 1}
+		db.FindOneMetricFunc = func(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+			return []metric.Entry{
+				{Name: "latency", Kind: metric.KindHistogram, Labels: map[string]string{"host": "h1"}, Value: 2,
+					Buckets: bounds, BucketCounts: []int64{1, 2, 0, 1}},
+				{Name: "latency", Kind: metric.KindHistogram, Labels: map[string]string{"host": "h2"}, Value: 0.3,
+					Buckets: bounds},
+			}, nil
+		}
+		metrics, err := svc.GetOneMetric(ctx, metric.Lookup{Name: "latency", Interval: metric.Duration(2 * time.Minute),
+			Aggregate: metric.AggrSum})
+		require.NoError(t, err)
+		require.Equal(t, 1, len(metrics))
+		assert.Equal(t, bounds, metrics[0].Buckets)
+		assert.Equal(t, []int64{1, 3, 0, 1}, metrics[0].BucketCounts)
+	}
+
+	{ // aggregated across series
+		tm := time.Date(2022, 10, 11, 2, 2, 0, 0, time.UTC)
+		db.FindOneMetricFunc = func(ctx context.Context, name string, matchers []metric.Matcher, from, to time.Time, interval time.Duration) ([]metric.Entry, error) {
+			return []metric.Entry{
+				{Name: "api_errors", Labels: map[string]string{"host": "h1", "region": "eu"}, TimeStamp: tm, Value: 1},
+				{Name: "api_errors", Labels: map[string]string{"host": "h2", "region": "eu"}, TimeStamp: tm, Value: 2},
+				{Name: "api_errors", Labels: map[string]string{"host": "h3", "region": "us"}, TimeStamp: tm, Value: 4},
+			}, nil
+		}
+		metrics, err := svc.GetOneMetric(ctx, metric.Lookup{Name: "api_errors", Interval: metric.Duration(2 * time.Minute),
+			GroupBy: []string{"region"}, Aggregate: metric.AggrSum})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(metrics))
+		assert.Equal(t, map[string]string{"region": "eu"}, metrics[0].Labels)
+		assert.Equal(t, 3.0, metrics[0].Value)
+		assert.Equal(t, map[string]string{"region": "us"}, metrics[1].Labels)
+		assert.Equal(t, 4.0, metrics[1].Value)
+	}
 }
 
 func TestService_GetAll(t *testing.T) {
@@ -269,3 +857,132 @@ func TestService_GetAll(t *testing.T) {
 		assert.EqualError(t, err, "failed to find metrics: blah")
 	}
 }
+
+// staged returns the newest staged minute of the series
+func staged(svc *Service, key string) metric.Entry {
+	sh := seriesShard(svc, key)
+	sh.Lock()
+	defer sh.Unlock()
+	var res metric.Entry
+	for _, v := range sh.data[key] {
+		if v.TimeStamp.After(res.TimeStamp) {
+			res = v
+		}
+	}
+	return res
+}
+
+// stagedEntries returns staged entries sorted by series key and time, pending writes are not included
+func stagedEntries(svc *Service) []metric.Entry {
+	var res []metric.Entry
+	for _, sh := range svc.shards {
+		sh.Lock()
+		staged, _ := sh.entries()
+		sh.Unlock()
+		res = append(res, staged...)
+	}
+	sortEntries(res)
+	return res
+}
+
+// stagedMinutes returns the number of staged minutes of the series
+func stagedMinutes(svc *Service, key string) int {
+	sh := seriesShard(svc, key)
+	sh.Lock()
+	defer sh.Unlock()
+	return len(sh.data[key])
+}
+
+// stagedSeries returns the number of staged series
+func stagedSeries(svc *Service) int {
+	return int(atomic.LoadInt64(&svc.series))
+}
+
+// pendingWrites returns the number of entries waiting for write to db
+func pendingWrites(svc *Service) int {
+	res := 0
+	for _, sh := range svc.shards {
+		sh.Lock()
+		res += len(sh.pending)
+		sh.Unlock()
+	}
+	return res
+}
+
+// seriesShard returns the staging shard of the series
+func seriesShard(svc *Service, key string) *shard {
+	if i := strings.Index(key, "{"); i >= 0 {
+		key = key[:i]
+	}
+	return svc.shard(key)
+}
+
+// flushQueued writes pending writes synchronously, as the flusher and cleanup do
+func flushQueued(t *testing.T, svc *Service) {
+	_, _, err := svc.flush(context.Background())
+	require.NoError(t, err)
+}
+
+func BenchmarkService_Update(b *testing.B) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			time.Sleep(100 * time.Microsecond) // network round trip
+			return nil
+		}),
+	}
+	names := make([]string, 1000)
+	for i := range names {
+		names[i] = "metric_" + strconv.Itoa(i)
+	}
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+
+	for _, p := range []int{1, 8, 64} {
+		b.Run("goroutines per cpu "+strconv.Itoa(p), func(b *testing.B) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			svc := New(db)
+			svc.ActivateCleanup(ctx, time.Hour)
+
+			var seq int64
+			b.SetParallelism(p)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&seq, 1)
+					// every metric moves to the next minute after 100 samples, leaving the previous one for write
+					m := metric.Entry{Name: names[i%int64(len(names))], Value: 1,
+						TimeStamp: tm.Add(time.Duration(i/int64(100*len(names))) * time.Minute)}
+					if err := svc.Update(ctx, m); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// writeEach makes WriteMany of the mock calling fn for every entry, failed entries are reported by WriteError
+func writeEach(fn func(ctx context.Context, m metric.Entry) error) func(ctx context.Context, entries []metric.Entry) error {
+	return func(ctx context.Context, entries []metric.Entry) error {
+		werr := &WriteError{Failed: make(map[int]error), Total: len(entries)}
+		for i, e := range entries {
+			if err := fn(ctx, e); err != nil {
+				werr.Failed[i] = err
+			}
+		}
+		if len(werr.Failed) == 0 {
+			return nil
+		}
+		return werr
+	}
+}
+
+// writtenEntries returns entries passed to WriteMany of the mock, in order
+func writtenEntries(db *AccessorMock) []metric.Entry {
+	var res []metric.Entry
+	for _, c := range db.WriteManyCalls() {
+		res = append(res, c.Entries...)
+	}
+	return res
+}
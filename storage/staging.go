@@ -0,0 +1,155 @@
+package storage
+
+import (
+	"github.com/umputun/metrics/metric"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stagingShards is the number of staging shards, metrics are spread over them by name
+const stagingShards = 64
+
+// defaultQueueSize is the capacity of the flush queue, used if Service.QueueSize is not set
+const defaultQueueSize = 10000
+
+// flushBatchSize is the maximum number of pending writes persisted in a single batch
+const flushBatchSize = 500
+
+// shard keeps not persisted minutes of the metrics hashed to it. Minutes left behind the lateness window
+// and late samples are moved to pending writes, kept until the flusher writes them to db
+type shard struct {
+	sync.Mutex
+	data    map[string]map[int64]metric.Entry // by series key and minute, see bucketMinute
+	newest  map[string]int64                  // the newest minute of every series, lateness is measured from it
+	pending map[uint64]*pendingWrite          // by id of the write
+}
+
+// pendingWrite is an entry waiting for write to db
+type pendingWrite struct {
+	e      metric.Entry // not changed once pending, safe to read without the lock
+	queued bool         // in the flush queue or being written, otherwise picked by the next cleanup
+}
+
+// flushItem is a pending write in the flush queue
+type flushItem struct {
+	sh *shard
+	id uint64
+}
+
+func newShard() *shard {
+	return &shard{
+		data:    make(map[string]map[int64]metric.Entry),
+		newest:  make(map[string]int64),
+		pending: make(map[uint64]*pendingWrite),
+	}
+}
+
+// shardIndex returns the index of the shard of the metric
+func shardIndex(name string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	return int(h.Sum32() % stagingShards)
+}
+
+// isLate checks if the minute is behind the lateness window of the series, the window is in minutes
+func (sh *shard) isLate(key string, minute, window int64) bool {
+	newest, ok := sh.newest[key]
+	return ok && minute < newest-window
+}
+
+// minutesBefore returns staged minutes of the series older than the given one, oldest first
+func (sh *shard) minutesBefore(key string, minute int64) []int64 {
+	var res []int64
+	for k := range sh.data[key] {
+		if k < minute {
+			res = append(res, k)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res
+}
+
+// stage merges the sample into the staged minute of the series, returns true if the series is new.
+// Returns metric.ErrKindMismatch if the staged minute is of another kind, nothing is staged then
+func (sh *shard) stage(key string, minute int64, m metric.Entry) (added bool, err error) {
+	if v, ok := sh.data[key][minute]; ok {
+		if err = v.Merge(m); err != nil {
+			return false, err
+		}
+		sh.data[key][minute] = v
+		return false, nil
+	}
+
+	buckets, ok := sh.data[key]
+	if !ok {
+		buckets = make(map[int64]metric.Entry)
+		sh.data[key] = buckets
+		added = true
+	}
+	m.Type = 1 * time.Minute
+	m.TypeStr = "1m"
+	buckets[minute] = m
+	return added, nil
+}
+
+// unstage removes the staged minute of the series, and the series itself if nothing left.
+// Returns true if the series is removed
+func (sh *shard) unstage(key string, minute int64) (removed bool) {
+	delete(sh.data[key], minute)
+	if len(sh.data[key]) == 0 {
+		delete(sh.data, key)
+		return true
+	}
+	return false
+}
+
+// deleteMetric removes all staged series and pending writes of the metric, returns the number of removed series
+func (sh *shard) deleteMetric(name string) (removed int) {
+	for k := range sh.newest {
+		if k == name || strings.HasPrefix(k, name+"{") {
+			delete(sh.newest, k)
+		}
+	}
+	for k, buckets := range sh.data {
+		for _, v := range buckets {
+			if v.Name == name {
+				delete(sh.data, k)
+				removed++
+			}
+			break // all minutes are of the same series
+		}
+	}
+	for id, p := range sh.pending {
+		if p.e.Name == name {
+			delete(sh.pending, id)
+		}
+	}
+	return removed
+}
+
+// entries returns staged entries and pending writes of the shard
+func (sh *shard) entries() (staged []metric.Entry, pending map[uint64]metric.Entry) {
+	pending = make(map[uint64]metric.Entry, len(sh.pending))
+	for _, buckets := range sh.data {
+		for _, v := range buckets {
+			staged = append(staged, v)
+		}
+	}
+	for id, p := range sh.pending {
+		pending[id] = p.e
+	}
+	return staged, pending
+}
+
+// sortEntries sorts entries by series key and time
+func sortEntries(entries []metric.Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if ki, kj := entries[i].SeriesKey(), entries[j].SeriesKey(); ki != kj {
+			return ki < kj
+		}
+		return entries[i].TimeStamp.Before(entries[j].TimeStamp)
+	})
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_shardIndex(t *testing.T) {
+	assert.Equal(t, shardIndex("file_1"), shardIndex("file_1"))
+
+	used := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		idx := shardIndex("metric_" + strconv.Itoa(i))
+		assert.True(t, idx >= 0 && idx < stagingShards)
+		used[idx] = true
+	}
+	assert.Equal(t, stagingShards, len(used), "metrics spread over all shards")
+}
+
+func TestShard_StageUnstage(t *testing.T) {
+	sh := newShard()
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	key, minute := "file_1", bucketMinute(tm)
+
+	stage := func(minute int64, e metric.Entry) bool {
+		added, err := sh.stage(key, minute, e)
+		require.NoError(t, err)
+		return added
+	}
+	assert.True(t, stage(minute, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 1}), "new series")
+	assert.False(t, stage(minute, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 2}))
+	assert.False(t, stage(minute+2, metric.Entry{Name: "file_1", TimeStamp: tm.Add(2 * time.Minute), Value: 4}))
+	assert.False(t, stage(minute+1, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 8}))
+	_, err := sh.stage(key, minute, metric.Entry{Name: "file_1", Kind: metric.KindGauge, TimeStamp: tm, Value: 16})
+	assert.ErrorIs(t, err, metric.ErrKindMismatch, "minute of another kind")
+	assert.Equal(t, 3.0, sh.data[key][minute].Value)
+	assert.Equal(t, "1m", sh.data[key][minute].TypeStr)
+	assert.Equal(t, []int64{minute, minute + 1}, sh.minutesBefore(key, minute+2), "oldest first")
+
+	assert.False(t, sh.unstage(key, minute))
+	assert.False(t, sh.unstage(key, minute+1))
+	assert.True(t, sh.unstage(key, minute+2), "nothing left of the series")
+	assert.Empty(t, sh.data)
+}
+
+func TestShard_deleteMetric(t *testing.T) {
+	sh := newShard()
+	tm := time.Date(2022, 7, 29, 12, 10, 23, 0, time.UTC)
+	for _, e := range []metric.Entry{
+		{Name: "api_errors", Labels: map[string]string{"host": "h1"}, TimeStamp: tm, Value: 1},
+		{Name: "api_errors", TimeStamp: tm, Value: 2},
+		{Name: "api_errors_total", TimeStamp: tm, Value: 4},
+	} {
+		sh.newest[e.SeriesKey()] = bucketMinute(tm)
+		sh.stage(e.SeriesKey(), bucketMinute(tm), e)
+	}
+	sh.pending[1] = &pendingWrite{e: metric.Entry{Name: "api_errors", Value: 8}}
+	sh.pending[2] = &pendingWrite{e: metric.Entry{Name: "api_errors_total", Value: 16}}
+
+	assert.Equal(t, 2, sh.deleteMetric("api_errors"))
+	staged, pending := sh.entries()
+	assert.Equal(t, []metric.Entry{{Name: "api_errors_total", TimeStamp: tm, Value: 4, Type: time.Minute, TypeStr: "1m"}}, staged)
+	assert.Equal(t, map[uint64]metric.Entry{2: {Name: "api_errors_total", Value: 16}}, pending)
+	assert.Equal(t, map[string]int64{"api_errors_total": bucketMinute(tm)}, sh.newest)
+}
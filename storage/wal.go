@@ -0,0 +1,312 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/umputun/metrics/metric"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WAL is an append-only log of staging updates, making the current minute survive a crash or restart.
+// Minutes moved out of staging for write stay in the log until the write is recorded as flushed.
+// Each checkpoint starts a new segment with the snapshot of not yet persisted staging entries and pending
+// writes and removes the older segments, so only the latest segment is replayed on start
+type WAL struct {
+	dir  string
+	sync bool // fsync every append, otherwise records survive a crash of the process but not of the OS
+
+	mu      sync.Mutex
+	f       *os.File
+	seq     uint64 // sequence number of the latest segment
+	pending int    // records appended since the last checkpoint
+}
+
+// walOp is the kind of record
+type walOp byte
+
+const (
+	walUpdate  walOp = 1 // entry merged into staging
+	walDelete  walOp = 2 // all series of the entry name removed from staging and pending writes
+	walExpire  walOp = 3 // staged minute of the entry series and timestamp moved to pending writes under the id
+	walPending walOp = 4 // entry added to pending writes under the id as is
+	walFlushed walOp = 5 // pending write of the id persisted
+)
+
+// walRecord is a single change of staging
+type walRecord struct {
+	op walOp
+	id uint64 // id of the pending write, expire, pending and flushed records only
+	e  metric.Entry
+}
+
+// hasID checks if records of the op carry the id of a pending write
+func (op walOp) hasID() bool {
+	return op == walExpire || op == walPending || op == walFlushed
+}
+
+const walSuffix = ".wal"
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// OpenWAL opens the log in the directory, making the directory if missing. Set sync to fsync every append
+func OpenWAL(dir string, sync bool) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to make wal directory %s: %w", dir, err)
+	}
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{dir: dir, sync: sync}
+	if len(segments) > 0 {
+		w.seq = segments[len(segments)-1]
+	}
+	return w, nil
+}
+
+// Close closes the current segment
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return nil
+	}
+	err := w.f.Close()
+	w.f = nil
+	if err != nil {
+		return fmt.Errorf("failed to close wal segment: %w", err)
+	}
+	return nil
+}
+
+// replay reads records of the latest segment. Reading stops at the first broken record, left by a crash
+// in the middle of append, as nothing after it was acknowledged
+func (w *WAL) replay(fn func(r walRecord)) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.seq == 0 {
+		return nil
+	}
+
+	f, err := os.Open(w.segmentPath(w.seq))
+	if err != nil {
+		return fmt.Errorf("failed to open wal segment: %w", err)
+	}
+	defer f.Close() //nolint
+
+	r := bufio.NewReader(f)
+	for n := 0; ; n++ {
+		rec, err := readWALRecord(r)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			log.Printf("[WARN] wal segment %s is broken at record %d, the rest is skipped: %v", f.Name(), n, err)
+			return nil
+		}
+		fn(rec)
+	}
+}
+
+// appendDelete adds delete record of the metric
+func (w *WAL) appendDelete(name string) error {
+	return w.appendRecords(walRecord{op: walDelete, e: metric.Entry{Name: name}})
+}
+
+// appendRecords adds records, written at once
+func (w *WAL) appendRecords(records ...walRecord) error {
+	buf := make([]byte, 0, 256*len(records))
+	for _, r := range records {
+		var err error
+		if buf, err = appendWALRecord(buf, r); err != nil {
+			return err
+		}
+	}
+	return w.write(buf, len(records))
+}
+
+func (w *WAL) write(buf []byte, records int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.f == nil {
+		return fmt.Errorf("wal is closed")
+	}
+	if _, err := w.f.Write(buf); err != nil {
+		return fmt.Errorf("failed to write wal: %w", err)
+	}
+	if w.sync {
+		if err := w.f.Sync(); err != nil {
+			return fmt.Errorf("failed to sync wal: %w", err)
+		}
+	}
+	w.pending += records
+	return nil
+}
+
+// changed reports if anything was appended since the last checkpoint
+func (w *WAL) changed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.pending > 0
+}
+
+// checkpoint starts a new segment with the records of everything not persisted yet, and removes the older
+// segments. The segment is written to a temporary file and renamed, so a crash leaves either the old or the new one
+func (w *WAL) checkpoint(records []walRecord) error {
+	var buf []byte
+	for _, r := range records {
+		var err error
+		if buf, err = appendWALRecord(buf, r); err != nil {
+			return err
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	tmp := filepath.Join(w.dir, "segment.tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to create wal segment: %w", err)
+	}
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, w.segmentPath(w.seq+1))
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return fmt.Errorf("failed to write wal segment: %w", err)
+	}
+	syncDir(w.dir)
+
+	if w.f != nil {
+		if err = w.f.Close(); err != nil {
+			log.Printf("[WARN] can't close wal segment: %v", err)
+		}
+	}
+	w.f, w.seq, w.pending = f, w.seq+1, 0
+
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, seq := range segments {
+		if seq < w.seq {
+			if err = os.Remove(w.segmentPath(seq)); err != nil {
+				return fmt.Errorf("failed to remove wal segment: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (w *WAL) segmentPath(seq uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", seq, walSuffix))
+}
+
+// walSegments returns sequence numbers of the segments in the directory, sorted
+func walSegments(dir string) ([]uint64, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wal directory %s: %w", dir, err)
+	}
+	var res []uint64
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), walSuffix), 10, 64)
+		if err != nil {
+			continue // not a segment
+		}
+		res = append(res, seq)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i] < res[j] })
+	return res, nil
+}
+
+// appendWALRecord encodes record as the length and crc32 of the rest, the op, the id if the op has it,
+// and json of the entry
+func appendWALRecord(buf []byte, r walRecord) ([]byte, error) {
+	data, err := json.Marshal(r.e)
+	if err != nil {
+		return buf, fmt.Errorf("failed to encode wal record of %s: %w", r.e.SeriesKey(), err)
+	}
+	payload := []byte{byte(r.op)}
+	if r.op.hasID() {
+		var id [8]byte
+		binary.LittleEndian.PutUint64(id[:], r.id)
+		payload = append(payload, id[:]...)
+	}
+	payload = append(payload, data...)
+	var header [8]byte
+	binary.LittleEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[4:], crc32.Checksum(payload, walTable))
+	return append(append(buf, header[:]...), payload...), nil
+}
+
+// readWALRecord decodes the next record, returns io.EOF at the end of the segment
+func readWALRecord(r io.Reader) (walRecord, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return walRecord{}, fmt.Errorf("truncated header")
+		}
+		return walRecord{}, err
+	}
+	size := binary.LittleEndian.Uint32(header[:4])
+	if size < 1 || size > maxWALRecord {
+		return walRecord{}, fmt.Errorf("invalid record size %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, fmt.Errorf("truncated record: %w", err)
+	}
+	if crc32.Checksum(payload, walTable) != binary.LittleEndian.Uint32(header[4:]) {
+		return walRecord{}, fmt.Errorf("checksum mismatch")
+	}
+
+	rec := walRecord{op: walOp(payload[0])}
+	if rec.op < walUpdate || rec.op > walFlushed {
+		return walRecord{}, fmt.Errorf("unknown op %d", rec.op)
+	}
+	payload = payload[1:]
+	if rec.op.hasID() {
+		if len(payload) < 8 {
+			return walRecord{}, fmt.Errorf("truncated id")
+		}
+		rec.id = binary.LittleEndian.Uint64(payload[:8])
+		payload = payload[8:]
+	}
+	if err := json.Unmarshal(payload, &rec.e); err != nil {
+		return walRecord{}, fmt.Errorf("failed to decode entry: %w", err)
+	}
+	return rec, nil
+}
+
+// maxWALRecord limits the size of a record, protecting from allocations by a broken length
+const maxWALRecord = 16 * 1024 * 1024
+
+// syncDir makes the rename in the directory durable, errors are ignored as not every OS supports it
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	_ = d.Sync()
+	_ = d.Close()
+}
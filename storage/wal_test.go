@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/umputun/metrics/metric"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWAL_AppendReplay(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, true)
+	require.NoError(t, err)
+
+	{ // nothing to replay in a new log
+		calls := 0
+		require.NoError(t, wal.replay(func(r walRecord) { calls++ }))
+		assert.Equal(t, 0, calls)
+	}
+
+	assert.EqualError(t, wal.appendRecords(walRecord{op: walUpdate, e: metric.Entry{Name: "file_1"}}), "wal is closed")
+	require.NoError(t, wal.checkpoint([]walRecord{{op: walUpdate, e: metric.Entry{Name: "file_0", Value: 1}}}))
+	assert.False(t, wal.changed())
+
+	tm := time.Date(2022, 10, 11, 2, 10, 23, 0, time.UTC)
+	require.NoError(t, wal.appendRecords(
+		walRecord{op: walUpdate, e: metric.Entry{Name: "file_1", Labels: map[string]string{"host": "h1"}, Value: 3, TimeStamp: tm}},
+		walRecord{op: walUpdate, e: metric.Entry{Name: "latency", Kind: metric.KindHistogram, Buckets: []float64{1, 2},
+			Value: 1.5, TimeStamp: tm}}))
+	require.NoError(t, wal.appendDelete("file_0"))
+	require.NoError(t, wal.appendRecords(walRecord{op: walExpire, id: 1, e: metric.Entry{Name: "file_1", Value: 3}},
+		walRecord{op: walPending, id: 1 << 40, e: metric.Entry{Name: "file_2", Value: 4}}, walRecord{op: walFlushed, id: 1}))
+	assert.True(t, wal.changed())
+	require.NoError(t, wal.Close())
+
+	wal, err = OpenWAL(dir, false)
+	require.NoError(t, err)
+	var records []walRecord
+	require.NoError(t, wal.replay(func(r walRecord) { records = append(records, r) }))
+	require.Equal(t, 7, len(records))
+	assert.Equal(t, walRecord{op: walUpdate, e: metric.Entry{Name: "file_0", Value: 1}}, records[0])
+	assert.Equal(t, walUpdate, records[1].op)
+	assert.Equal(t, `file_1{host="h1"}`, records[1].e.SeriesKey())
+	assert.Equal(t, 3.0, records[1].e.Value)
+	assert.True(t, tm.Equal(records[1].e.TimeStamp))
+	assert.Equal(t, []float64{1, 2}, records[2].e.Buckets)
+	assert.Equal(t, walRecord{op: walDelete, e: metric.Entry{Name: "file_0"}}, records[3])
+	assert.Equal(t, walRecord{op: walExpire, id: 1, e: metric.Entry{Name: "file_1", Value: 3}}, records[4])
+	assert.Equal(t, walRecord{op: walPending, id: 1 << 40, e: metric.Entry{Name: "file_2", Value: 4}}, records[5])
+	assert.Equal(t, walRecord{op: walFlushed, id: 1}, records[6])
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, false)
+	require.NoError(t, err)
+	defer wal.Close()
+
+	require.NoError(t, wal.checkpoint(nil))
+	require.NoError(t, wal.appendRecords(walRecord{op: walUpdate, e: metric.Entry{Name: "file_1", Value: 1}},
+		walRecord{op: walUpdate, e: metric.Entry{Name: "file_2", Value: 2}}))
+	require.NoError(t, wal.checkpoint([]walRecord{{op: walUpdate, e: metric.Entry{Name: "file_2", Value: 2}}}))
+	require.NoError(t, wal.appendRecords(walRecord{op: walUpdate, e: metric.Entry{Name: "file_3", Value: 3}}))
+
+	segments, err := walSegments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, segments, "older segments removed")
+
+	var names []string
+	require.NoError(t, wal.replay(func(r walRecord) { names = append(names, r.e.Name) }))
+	assert.Equal(t, []string{"file_2", "file_3"}, names)
+
+	// leftovers of a crash in the middle of checkpoint are ignored and removed by the next one
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "segment.tmp"), []byte("garbage"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000001.wal"), []byte("garbage"), 0o600))
+	wal2, err := OpenWAL(dir, false)
+	require.NoError(t, err)
+	names = nil
+	require.NoError(t, wal2.replay(func(r walRecord) { names = append(names, r.e.Name) }))
+	assert.Equal(t, []string{"file_2", "file_3"}, names)
+	require.NoError(t, wal2.checkpoint(nil))
+	require.NoError(t, wal2.Close())
+	segments, err = walSegments(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{3}, segments)
+}
+
+func TestWAL_BrokenTail(t *testing.T) {
+	dir := t.TempDir()
+	wal, err := OpenWAL(dir, false)
+	require.NoError(t, err)
+	require.NoError(t, wal.checkpoint(nil))
+	require.NoError(t, wal.appendRecords(walRecord{op: walUpdate, e: metric.Entry{Name: "file_1", Value: 1}},
+		walRecord{op: walUpdate, e: metric.Entry{Name: "file_2", Value: 2}}))
+	require.NoError(t, wal.Close())
+
+	path := wal.segmentPath(1)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	tbl := []struct {
+		name string
+		data []byte
+		res  []string
+	}{
+		{"complete", data, []string{"file_1", "file_2"}},
+		{"truncated record", data[:len(data)-3], []string{"file_1"}},
+		{"truncated header", append(append([]byte{}, data...), 1, 2, 3), []string{"file_1", "file_2"}},
+		{"checksum mismatch", append(append([]byte{}, data[:len(data)-1]...), data[len(data)-1]^0xff), []string{"file_1"}},
+		{"invalid size", append(append([]byte{}, data...), 0, 0, 0, 0, 0, 0, 0, 0), []string{"file_1", "file_2"}},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, tt.data, 0o600))
+			w, err := OpenWAL(dir, false)
+			require.NoError(t, err)
+			var names []string
+			require.NoError(t, w.replay(func(r walRecord) { names = append(names, r.e.Name) }))
+			assert.Equal(t, tt.res, names)
+		})
+	}
+}
+
+func TestService_UseWAL(t *testing.T) {
+	var written []metric.Entry
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			written = append(written, m)
+			return nil
+		}),
+		DeleteFunc: func(ctx context.Context, m metric.Entry) error {
+			return nil
+		},
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	open := func() *Service {
+		wal, err := OpenWAL(dir, false)
+		require.NoError(t, err)
+		svc := New(db)
+		require.NoError(t, svc.UseWAL(wal))
+		return svc
+	}
+
+	tm := time.Now().Add(-time.Hour).Truncate(time.Minute) // an old minute, persisted by the first cleanup
+	svc := open()
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 1}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 2}))
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 5}))
+	assert.Empty(t, svc.UpdateMany(ctx, []metric.Entry{
+		{Name: "file_2", Labels: map[string]string{"host": "h1"}, TimeStamp: tm, Value: 7},
+		{Name: "file_3", TimeStamp: tm, Value: 1},
+	}))
+	require.NoError(t, svc.Delete(ctx, metric.Entry{Name: "file_3"}))
+	assert.Empty(t, written, "the first minute of file_1 queued for write")
+
+	// crash, nothing flushed
+	require.NoError(t, svc.wal.Close())
+	svc = open()
+	require.Equal(t, 2, stagedSeries(svc))
+	assert.Equal(t, 5.0, staged(svc, "file_1").Value)
+	assert.Equal(t, 7.0, staged(svc, `file_2{host="h1"}`).Value)
+	require.Equal(t, 1, pendingWrites(svc), "the queued minute restored")
+	flushQueued(t, svc)
+	require.Equal(t, 1, len(written))
+	assert.Equal(t, 3.0, written[0].Value)
+
+	// updates after restore are merged and logged
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 1}))
+	require.NoError(t, svc.wal.Close())
+	svc = open()
+	assert.Equal(t, 6.0, staged(svc, "file_1").Value)
+	assert.Equal(t, &metric.Stats{Count: 2, Sum: 6, Min: 1, Max: 5, Last: 1}, staged(svc, "file_1").Stats)
+	assert.Equal(t, 0, pendingWrites(svc), "the written minute is not restored")
+
+	// late sample logged until merged into db
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm, Value: 10}))
+	require.NoError(t, svc.wal.Close())
+	svc = open()
+	require.Equal(t, 1, pendingWrites(svc))
+	flushQueued(t, svc)
+	require.Equal(t, 2, len(written))
+	assert.Equal(t, 10.0, written[1].Value)
+	require.NoError(t, svc.wal.Close())
+	svc = open()
+	assert.Equal(t, 0, pendingWrites(svc))
+	assert.Equal(t, 1, stagedMinutes(svc, "file_1"))
+	assert.Equal(t, 6.0, staged(svc, "file_1").Value)
+
+	// cleanup persists the minutes and truncates the log
+	require.NoError(t, svc.doCleanup(ctx))
+	assert.Equal(t, 4, len(written))
+	segments, err := walSegments(dir)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(segments))
+	require.NoError(t, svc.wal.Close())
+	svc = open()
+	assert.Equal(t, 0, stagedSeries(svc))
+	assert.Equal(t, 0, pendingWrites(svc))
+
+	// failed write keeps the not persisted entries in the log
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_4", TimeStamp: tm, Value: 4}))
+	db.WriteManyFunc = writeEach(func(ctx context.Context, m metric.Entry) error { return errors.New("blah") })
+	err = svc.doCleanup(ctx)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to add expired minutes, 1 of 1 failed")
+	require.NoError(t, svc.wal.Close())
+	svc = open()
+	assert.Equal(t, 0, stagedSeries(svc))
+	require.Equal(t, 1, pendingWrites(svc))
+
+	// restored write persisted by the next cleanup
+	db.WriteManyFunc = writeEach(func(ctx context.Context, m metric.Entry) error {
+		written = append(written, m)
+		return nil
+	})
+	require.NoError(t, svc.doCleanup(ctx))
+	require.Equal(t, 5, len(written))
+	assert.Equal(t, 4.0, written[4].Value)
+}
+
+func TestService_UpdateNotLogged(t *testing.T) {
+	db := &AccessorMock{}
+	ctx := context.Background()
+	wal, err := OpenWAL(t.TempDir(), false)
+	require.NoError(t, err)
+	svc := New(db)
+	svc.LateWindow = time.Minute
+	require.NoError(t, svc.UseWAL(wal))
+
+	tm := time.Now().Add(-time.Hour).Truncate(time.Minute).Add(time.Second)
+	require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 1}))
+	require.NoError(t, wal.Close())
+	samples := ingestedSamples.Value()
+
+	// failed updates are rolled back, to be retried by the client
+	err = svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Minute), Value: 2})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wal is closed")
+	errs := svc.UpdateMany(ctx, []metric.Entry{
+		{Name: "file_1", TimeStamp: tm.Add(3 * time.Minute), Value: 3}, // moves the window
+		{Name: "file_1", TimeStamp: tm, Value: 4},                      // late
+		{Name: "file_2", TimeStamp: tm, Value: 5},                      // new series
+	})
+	assert.Equal(t, 3, len(errs))
+
+	assert.Equal(t, 1, stagedSeries(svc))
+	assert.Equal(t, 1, stagedMinutes(svc, "file_1"))
+	assert.Equal(t, 1.0, staged(svc, "file_1").Value)
+	assert.Equal(t, 0, pendingWrites(svc))
+	assert.False(t, svc.shard("file_1").isLate("file_1", bucketMinute(tm.Add(time.Minute)), 1), "newest minute restored")
+	assert.Equal(t, uint64(0), ingestedSamples.Value()-samples)
+}
+
+func TestService_UseWALLateWindow(t *testing.T) {
+	db := &AccessorMock{
+		WriteManyFunc: writeEach(func(ctx context.Context, m metric.Entry) error {
+			return nil
+		}),
+	}
+	ctx := context.Background()
+	dir := t.TempDir()
+	open := func() *Service {
+		wal, err := OpenWAL(dir, false)
+		require.NoError(t, err)
+		svc := New(db)
+		svc.LateWindow = time.Minute
+		require.NoError(t, svc.UseWAL(wal))
+		return svc
+	}
+
+	tm := time.Now().Add(-time.Hour).Truncate(time.Minute).Add(time.Second)
+	svc := open()
+	for _, m := range []int{0, 2, 1, 3} {
+		require.NoError(t, svc.Update(ctx, metric.Entry{Name: "file_1", TimeStamp: tm.Add(time.Duration(m) * time.Minute), Value: 1}))
+	}
+	flushQueued(t, svc)
+	require.Equal(t, 2, len(writtenEntries(db)), "minutes 0 and 1 written")
+	require.NoError(t, svc.wal.Close())
+
+	svc = open()
+	entries := stagedEntries(svc)
+	require.Equal(t, 2, len(entries))
+	assert.True(t, tm.Add(2*time.Minute).Equal(entries[0].TimeStamp))
+	assert.True(t, tm.Add(3*time.Minute).Equal(entries[1].TimeStamp))
+	assert.True(t, svc.shard("file_1").isLate("file_1", bucketMinute(tm.Add(time.Minute)), 1), "the newest minute restored")
+}